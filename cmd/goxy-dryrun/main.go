@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"goxy/internal/common"
+	"goxy/internal/dryrun"
+	"goxy/internal/replay"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	configFile = pflag.StringP("config", "c", "config.yml", "Path to the config file in YAML format")
+	service    = pflag.StringP("service", "s", "", "Evaluate all sessions with this service's filters")
+	input      = pflag.StringP("input", "i", "", "Recorded sessions: pcap, pcapng or goxy capture file")
+	samples    = pflag.IntP("samples", "n", dryrun.DefaultMaxSamples, "Number of sample payloads per filter")
+	asJSON     = pflag.Bool("json", false, "Print the report in JSON")
+)
+
+func main() {
+	pflag.Parse()
+
+	if *input == "" {
+		logrus.Fatal("Input file is required")
+	}
+
+	viper.SetConfigFile(*configFile)
+	viper.SetConfigType("yaml")
+	cfg, err := common.LoadProxyConfig()
+	if err != nil {
+		logrus.Fatalf("Error loading config: %v", err)
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		logrus.Fatalf("Error opening input: %v", err)
+	}
+	records, err := replay.ReadRecords(f)
+	_ = f.Close()
+	if err != nil {
+		logrus.Fatalf("Error reading input: %v", err)
+	}
+
+	report, err := dryrun.Run(cfg, records, dryrun.Options{Service: *service, MaxSamples: *samples})
+	if err != nil {
+		logrus.Fatalf("Error evaluating filters: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logrus.Fatalf("Error writing report: %v", err)
+		}
+		return
+	}
+	printReport(report)
+}
+
+func printReport(report *dryrun.Report) {
+	fmt.Printf("%d sessions, %d not matching any service\n", report.Sessions, report.Unmatched)
+	for _, s := range report.Services {
+		fmt.Printf(
+			"\n%s (%s): %d sessions, %d dropped, %d errors\n",
+			s.Name, s.Type, s.Sessions, s.Dropped, s.Errors,
+		)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "RULE\tVERDICT\tMATCHES\tSESSIONS")
+		for _, f := range s.Filters {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", f.Rule, f.Verdict, f.Matches, f.Sessions)
+		}
+		_ = w.Flush()
+
+		verdicts := make([]string, 0, len(s.Verdicts))
+		for v, n := range s.Verdicts {
+			verdicts = append(verdicts, fmt.Sprintf("%s=%d", v, n))
+		}
+		sort.Strings(verdicts)
+		fmt.Printf("Verdicts: %s\n", strings.Join(verdicts, ", "))
+
+		for _, f := range s.Filters {
+			for _, sample := range f.Samples {
+				direction := "egress"
+				if sample.Ingress {
+					direction = "ingress"
+				}
+				fmt.Printf("  %s, session %s, %s: %s\n", f.Rule, sample.Session, direction, strconv.Quote(sample.Payload))
+			}
+		}
+	}
+}
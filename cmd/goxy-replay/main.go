@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"goxy/internal/common"
+	"goxy/internal/replay"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	configFile = pflag.StringP("config", "c", "config.yml", "Path to the config file in YAML format")
+	service    = pflag.StringP("service", "s", "", "Name of the service to replay the traffic through")
+	input      = pflag.StringP("input", "i", "", "Recorded sessions: pcap, pcapng or goxy capture file")
+	port       = pflag.IntP("port", "p", 0, "Replay only the sessions to this target port")
+	timeout    = pflag.DurationP("timeout", "t", time.Millisecond*500, "Time to wait for the data passing the proxy")
+	asJSON     = pflag.Bool("json", false, "Print the report in JSON")
+	verbose    = pflag.BoolP("verbose", "v", false, "Verbose logging")
+)
+
+func main() {
+	pflag.Parse()
+
+	if *verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	if *input == "" {
+		logrus.Fatal("Input file is required")
+	}
+
+	viper.SetConfigFile(*configFile)
+	viper.SetConfigType("yaml")
+	cfg, err := common.LoadProxyConfig()
+	if err != nil {
+		logrus.Fatalf("Error loading config: %v", err)
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		logrus.Fatalf("Error opening input: %v", err)
+	}
+	records, err := replay.ReadRecords(f)
+	_ = f.Close()
+	if err != nil {
+		logrus.Fatalf("Error reading input: %v", err)
+	}
+	records = replay.FilterByPort(records, *port)
+
+	r, err := replay.NewReplayer(cfg, *service, *timeout)
+	if err != nil {
+		logrus.Fatalf("Error creating replayer: %v", err)
+	}
+
+	results := make([]replay.Result, 0, len(records))
+	for _, rec := range records {
+		results = append(results, r.Replay(rec))
+	}
+	if err := r.Close(); err != nil {
+		logrus.Errorf("Error shutting down replayer: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			logrus.Fatalf("Error writing report: %v", err)
+		}
+		return
+	}
+	printReport(results)
+}
+
+func printReport(results []replay.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SESSION\tCLIENT\tDROPPED\tFILTERS\tERROR")
+	dropped := 0
+	for _, res := range results {
+		fired := make([]string, 0, len(res.Matches))
+		for _, m := range res.Matches {
+			fired = append(fired, fmt.Sprintf("%s(%s)", m.Rule, m.Verdict))
+		}
+		if res.Dropped {
+			dropped += 1
+		}
+		_, _ = fmt.Fprintf(
+			w,
+			"%s\t%s\t%v\t%s\t%s\n",
+			res.Session,
+			res.ClientAddr,
+			res.Dropped,
+			strings.Join(fired, ","),
+			res.Error,
+		)
+	}
+	_ = w.Flush()
+	fmt.Printf("\n%d sessions replayed, %d dropped\n", len(results), dropped)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"github.com/fsnotify/fsnotify"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 )
@@ -19,6 +21,7 @@ import (
 var (
 	configFile = pflag.StringP("config", "c", "config.yml", "Path to the config file in YAML format")
 	verbose    = pflag.BoolP("verbose", "v", false, "Verbose logging & web server debug")
+	watch      = pflag.BoolP("watch", "w", false, "Reload the config automatically when the file changes")
 )
 
 func main() {
@@ -36,9 +39,23 @@ func main() {
 	s := web.NewServer(m)
 	httpServer := startHttpServer(s)
 
+	if *watch {
+		watchConfig(m)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logrus.Info("SIGHUP received, reloading config")
+			reloadConfig(m)
+		}
+	}()
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	<-c
+	signal.Stop(hup)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -77,6 +94,13 @@ func setConfigDefaults() {
 	viper.SetDefault("web.static_dir", "front/dist")
 	viper.SetDefault("web.username", "admin")
 	viper.SetDefault("web.listen", "0.0.0.0:8000")
+	viper.SetDefault("capture.dir", "capture")
+	viper.SetDefault("capture.max_segment_size", 64*1024*1024)
+	viper.SetDefault("capture.max_segments", 16)
+	viper.SetDefault("capture.max_record_size", 1024*1024)
+	viper.SetDefault("capture.pcap.dir", "pcap")
+	viper.SetDefault("capture.pcap.max_file_size", 64*1024*1024)
+	viper.SetDefault("capture.pcap.max_files", 16)
 }
 
 func parseConfig() {
@@ -95,6 +119,55 @@ func parseProxyConfig() *common.ProxyConfig {
 	return cfg
 }
 
+// reloadConfig reads the config file and applies it, the reloads are serialized by the manager.
+func reloadConfig(m *proxy.Manager) {
+	if err := m.ReloadWith(common.LoadProxyConfig); err != nil {
+		logrus.Errorf("Error reloading config, keeping the old one: %v", err)
+	}
+}
+
+// watchConfig reloads the config when the file changes. The file is read only by reloadConfig,
+// as viper.WatchConfig would read it in its own goroutine along with the other reloads.
+// The directory is watched, as editors and SaveConfig replace the file by renaming.
+func watchConfig(m *proxy.Manager) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Errorf("Error watching config: %v", err)
+		return
+	}
+	file := filepath.Clean(viper.ConfigFileUsed())
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		logrus.Errorf("Error watching config: %v", err)
+		_ = watcher.Close()
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != file || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if m.SavedConfig(file) {
+					logrus.Debugf("Config file %s saved from the web, not reloading", e.Name)
+					continue
+				}
+				logrus.Infof("Config file %s changed, reloading", e.Name)
+				reloadConfig(m)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logrus.Errorf("Error watching config: %v", err)
+			}
+		}
+	}()
+}
+
 func runProxyManager(cfg *common.ProxyConfig) *proxy.Manager {
 	m, err := proxy.NewManager(cfg)
 	if err != nil {
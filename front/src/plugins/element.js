@@ -9,6 +9,7 @@ import {
     Header,
     Row,
     Tag,
+    MessageBox,
 } from 'element-ui';
 import lang from 'element-ui/lib/locale/lang/en';
 import locale from 'element-ui/lib/locale';
@@ -24,3 +25,5 @@ Vue.use(Switch);
 Vue.use(Header);
 Vue.use(Row);
 Vue.use(Tag);
+
+Vue.prototype.$confirm = MessageBox.confirm;
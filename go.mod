@@ -3,11 +3,17 @@ module goxy
 go 1.15
 
 require (
+	github.com/andybalholm/brotli v1.0.5
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-contrib/gzip v0.0.3
+	github.com/gin-contrib/sse v0.1.0
 	github.com/gin-gonic/gin v1.6.3
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.7.1
 	go.uber.org/atomic v1.4.0
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v2 v2.3.0
 )
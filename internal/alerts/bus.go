@@ -0,0 +1,137 @@
+package alerts
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistorySize = 1000
+	MaxPayloadSize     = 512
+
+	subscriberBuffer = 64
+
+	// ReasonRuleTriggered is the reason of the alerts raised by the filters with alert enabled.
+	ReasonRuleTriggered = "rule triggered"
+	// ReasonBodyOversized is the reason of the alerts raised for the HTTP bodies larger than the inspected size.
+	ReasonBodyOversized = "body too large"
+	// ReasonBodyPartial is the reason of the alerts raised for the HTTP bodies streamed on after the idle timeout.
+	ReasonBodyPartial = "body partly inspected"
+	// ReasonBodyUndecoded is the reason of the alerts raised for the HTTP bodies in the unsupported content encoding.
+	ReasonBodyUndecoded = "body encoding not supported"
+)
+
+type Alert struct {
+	ID         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Rule       string    `json:"rule"`
+	Reason     string    `json:"reason"`
+	ConnID     string    `json:"conn_id"`
+	RecordID   string    `json:"record_id,omitempty"`
+	ClientAddr string    `json:"client_addr"`
+	Ingress    bool      `json:"ingress"`
+	Payload    string    `json:"payload"`
+}
+
+// Bus delivers the alerts to the subscribers and keeps the bounded history of them.
+type Bus struct {
+	history []Alert
+	size    int
+	lastID  int64
+	subs    map[chan Alert]struct{}
+	mu      sync.Mutex
+}
+
+func NewBus(historySize int) *Bus {
+	return &Bus{
+		history: make([]Alert, 0, historySize),
+		size:    historySize,
+		subs:    make(map[chan Alert]struct{}),
+	}
+}
+
+// Publish assigns the ID to the alert and sends it to the subscribers.
+// Slow subscribers miss the alerts instead of blocking the proxies.
+func (b *Bus) Publish(a Alert) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID += 1
+	a.ID = b.lastID
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+
+	if b.size > 0 {
+		if len(b.history) >= b.size {
+			n := copy(b.history, b.history[len(b.history)-b.size+1:])
+			b.history = b.history[:n]
+		}
+		b.history = append(b.history, a)
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+// History returns the alerts with IDs greater than after, newest first.
+func (b *Bus) History(after int64, limit int) []Alert {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([]Alert, 0)
+	for i := len(b.history) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		if b.history[i].ID <= after {
+			break
+		}
+		result = append(result, b.history[i])
+	}
+	return result
+}
+
+// Subscribe returns the channel receiving the new alerts and the function cancelling the subscription.
+func (b *Bus) Subscribe() (<-chan Alert, func()) {
+	ch := make(chan Alert, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	once := sync.Once{}
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Excerpt returns the beginning of the payload to put in the alert.
+func Excerpt(data []byte) string {
+	if len(data) > MaxPayloadSize {
+		data = data[:MaxPayloadSize]
+	}
+	return string(data)
+}
+
+var defaultBus = NewBus(DefaultHistorySize)
+
+func Publish(a Alert) {
+	defaultBus.Publish(a)
+}
+
+func History(after int64, limit int) []Alert {
+	return defaultBus.History(after, limit)
+}
+
+func Subscribe() (<-chan Alert, func()) {
+	return defaultBus.Subscribe()
+}
@@ -0,0 +1,67 @@
+package alerts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBus_History(t *testing.T) {
+	b := NewBus(3)
+	for _, rule := range []string{"a", "b", "c", "d"} {
+		b.Publish(Alert{Rule: rule})
+	}
+
+	tests := []struct {
+		name  string
+		after int64
+		limit int
+		want  []string
+	}{
+		{"all", 0, 0, []string{"d", "c", "b"}},
+		{"limit", 0, 2, []string{"d", "c"}},
+		{"after", 3, 0, []string{"d"}},
+		{"nothing new", 4, 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := b.History(tt.after, tt.limit)
+			if len(got) != len(tt.want) {
+				t.Fatalf("History() = %v, want rules %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Rule != tt.want[i] {
+					t.Errorf("History() = %v, want rules %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBus_Subscribe(t *testing.T) {
+	b := NewBus(0)
+	ch, cancel := b.Subscribe()
+
+	b.Publish(Alert{Rule: "a"})
+	select {
+	case a := <-ch:
+		if a.Rule != "a" || a.ID != 1 || a.Time.IsZero() {
+			t.Errorf("Subscribe() received %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribe() alert not received")
+	}
+
+	cancel()
+	b.Publish(Alert{Rule: "b"})
+	if _, ok := <-ch; ok {
+		t.Errorf("Subscribe() received alert after cancel")
+	}
+	cancel()
+}
+
+func TestExcerpt(t *testing.T) {
+	data := make([]byte, MaxPayloadSize*2)
+	if got := Excerpt(data); len(got) != MaxPayloadSize {
+		t.Errorf("Excerpt() length = %d, want %d", len(got), MaxPayloadSize)
+	}
+}
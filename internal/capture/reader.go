@@ -0,0 +1,42 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ReadRecords reads records in the capture file format: one JSON-encoded record per line.
+// Pieces of the long records are merged, the records not finished in the file are skipped.
+// Partially written last line is ignored.
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	records := make([]*Record, 0)
+	pending := make(map[string][]*Record)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		rec := new(Record)
+		if err := json.Unmarshal(line, rec); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				continue
+			}
+			return nil, fmt.Errorf("decoding record: %w", err)
+		}
+		pieces := append(pending[rec.ID], rec)
+		if rec.Partial {
+			pending[rec.ID] = pieces
+			continue
+		}
+		delete(pending, rec.ID)
+		records = append(records, mergePieces(pieces))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading records: %w", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,117 @@
+package capture
+
+import (
+	"goxy/internal/common"
+	"time"
+)
+
+const (
+	VerdictPass   = "pass"
+	VerdictAccept = "accept"
+	VerdictDrop   = "drop"
+)
+
+type Chunk struct {
+	Time    time.Time `json:"time"`
+	Ingress bool      `json:"ingress"`
+	Data    []byte    `json:"data"`
+}
+
+type Match struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Verdict string    `json:"verdict"`
+	Ingress bool      `json:"ingress"`
+	Shadow  bool      `json:"shadow,omitempty"`
+}
+
+type HTTPInfo struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+}
+
+// Record is a single captured TCP connection or HTTP request/response pair.
+// For HTTP records the raw request is stored as an ingress chunk
+// and the raw response as an egress one.
+type Record struct {
+	ID           string    `json:"id"`
+	Service      string    `json:"service"`
+	Type         string    `json:"type"`
+	ClientAddr   string    `json:"client_addr"`
+	TargetAddr   string    `json:"target_addr"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	HTTP         *HTTPInfo `json:"http,omitempty"`
+	IngressBytes int       `json:"ingress_bytes"`
+	EgressBytes  int       `json:"egress_bytes"`
+	Truncated    bool      `json:"truncated"`
+	Matches      []Match   `json:"matches"`
+	Verdict      string    `json:"verdict"`
+	Chunks       []Chunk   `json:"chunks,omitempty"`
+	// Long records are written out in pieces as they go, Partial is set on all the pieces but the last one.
+	// Piece is the number of the piece, the pieces are merged back when the record is read.
+	Partial bool `json:"partial,omitempty"`
+	Piece   int  `json:"piece,omitempty"`
+}
+
+// Summary returns the copy of the record without the payload.
+func (r Record) Summary() Record {
+	r.Chunks = nil
+	return r
+}
+
+// mergePieces joins the pieces of the record, written in order, into the whole record.
+// The record is marked truncated if some of its pieces are missing.
+func mergePieces(pieces []*Record) *Record {
+	last := pieces[len(pieces)-1]
+	if len(pieces) == 1 && last.Piece == 0 {
+		return last
+	}
+	rec := *last
+	rec.Chunks = make([]Chunk, 0)
+	for _, p := range pieces {
+		rec.Chunks = append(rec.Chunks, p.Chunks...)
+	}
+	if pieces[0].Piece != 0 || len(pieces) != last.Piece+1 {
+		rec.Truncated = true
+	}
+	rec.Partial = false
+	rec.Piece = 0
+	return &rec
+}
+
+// Query selects the records by time and matched rule. Zero values match everything.
+type Query struct {
+	From time.Time
+	To   time.Time
+	Rule string
+}
+
+func (q Query) Match(rec *Record) bool {
+	if !q.From.IsZero() && rec.Start.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && rec.Start.After(q.To) {
+		return false
+	}
+	if q.Rule == "" {
+		return true
+	}
+	for _, m := range rec.Matches {
+		if m.Rule == q.Rule {
+			return true
+		}
+	}
+	return false
+}
+
+func VerdictFromContext(ctx *common.ProxyContext) string {
+	if ctx.GetFlag(common.DropFlag) {
+		return VerdictDrop
+	}
+	if ctx.GetFlag(common.AcceptFlag) {
+		return VerdictAccept
+	}
+	return VerdictPass
+}
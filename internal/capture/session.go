@@ -0,0 +1,181 @@
+package capture
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxPieceSize is the payload size after which the session writes the collected chunks out
+// to the persistent store, so the long connections aren't kept in memory until they end.
+const MaxPieceSize = 1024 * 1024
+
+// Session collects a single record while the traffic is being proxied.
+// All methods are safe to call on nil session, so callers don't need to check
+// whether the capture is enabled.
+type Session struct {
+	rec      Record
+	maxSize  int
+	buffered int
+	piece    int
+	store    *Store
+	mu       *sync.Mutex
+}
+
+// NewSession creates the session that's not saved anywhere, it can be used to inspect the record later.
+func NewSession(service, typ, clientAddr, targetAddr string) *Session {
+	return &Session{
+		rec: Record{
+			ID:         newRecordID(),
+			Service:    service,
+			Type:       typ,
+			ClientAddr: clientAddr,
+			TargetAddr: targetAddr,
+			Start:      time.Now(),
+			Matches:    make([]Match, 0),
+		},
+		mu: new(sync.Mutex),
+	}
+}
+
+func (s *Session) ID() string {
+	if s == nil {
+		return ""
+	}
+	return s.rec.ID
+}
+
+func (s *Session) AddChunk(ingress bool, data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ingress {
+		s.rec.IngressBytes += len(data)
+	} else {
+		s.rec.EgressBytes += len(data)
+	}
+
+	if s.maxSize > 0 {
+		left := s.maxSize - s.rec.IngressBytes - s.rec.EgressBytes + len(data)
+		if left <= 0 {
+			s.rec.Truncated = true
+			return
+		}
+		if len(data) > left {
+			data = data[:left]
+			s.rec.Truncated = true
+		}
+	}
+
+	chunk := Chunk{
+		Time:    time.Now(),
+		Ingress: ingress,
+		Data:    append([]byte(nil), data...),
+	}
+	s.rec.Chunks = append(s.rec.Chunks, chunk)
+	s.buffered += len(chunk.Data)
+	if s.buffered >= MaxPieceSize && s.store != nil && s.store.cfg.Dir != "" {
+		s.flush()
+	}
+}
+
+// flush hands the collected chunks to the store writer as the partial piece of the record.
+// Must be called with mu held. It doesn't wait for the writer: if its queue is full,
+// the chunks are dropped and the record is marked truncated.
+func (s *Session) flush() {
+	piece := s.rec
+	piece.Partial = true
+	piece.Piece = s.piece
+	piece.Matches = nil
+	if !s.store.enqueue(saveRequest{rec: &piece}, false) {
+		logrus.Errorf("Error saving capture record %s piece: store busy or closed", piece.ID)
+		s.rec.Truncated = true
+	}
+	s.rec.Chunks = nil
+	s.buffered = 0
+	s.piece += 1
+}
+
+func (s *Session) AddMatch(rule, verdict string, ingress, shadow bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := Match{
+		Time:    time.Now(),
+		Rule:    rule,
+		Verdict: verdict,
+		Ingress: ingress,
+		Shadow:  shadow,
+	}
+	s.rec.Matches = append(s.rec.Matches, m)
+}
+
+func (s *Session) SetHTTPInfo(info HTTPInfo) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.HTTP = &info
+}
+
+func (s *Session) SetStatus(status int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rec.HTTP == nil {
+		s.rec.HTTP = new(HTTPInfo)
+	}
+	s.rec.HTTP.Status = status
+}
+
+// Finish sets the final verdict of the session and queues it to be saved to the store, if any.
+// It waits only for the room in the queue, use Store.Sync to wait for the record to be saved.
+func (s *Session) Finish(verdict string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.rec.End = time.Now()
+	s.rec.Verdict = verdict
+	rec := s.rec
+	rec.Piece = s.piece
+	s.mu.Unlock()
+
+	if s.store == nil {
+		return
+	}
+	if !s.store.enqueue(saveRequest{rec: &rec}, true) {
+		logrus.Errorf("Error saving capture record %s: store closed", rec.ID)
+	}
+}
+
+// Record returns the snapshot of the collected record.
+// Chunks already written out to the store are not included.
+func (s *Session) Record() Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.rec
+	rec.Chunks = append([]Chunk(nil), s.rec.Chunks...)
+	rec.Matches = append(make([]Match, 0, len(s.rec.Matches)), s.rec.Matches...)
+	return rec
+}
+
+func newRecordID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		logrus.Errorf("Error generating record id: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
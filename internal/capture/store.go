@@ -0,0 +1,640 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+const (
+	segmentExt      = ".jsonl"
+	cleanupInterval = time.Minute
+	maxLineSize     = 64 * 1024 * 1024
+	// saveQueueSize is how many records wait for the writer, the pieces over it are dropped.
+	saveQueueSize = 64
+)
+
+var (
+	ErrNoSuchRecord = errors.New("no such record")
+
+	serviceDirReplacer = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// Store keeps captured records in append-only segment files, one directory per service.
+// Segments are rotated by size, old ones are removed according to the retention limits.
+// Records are located in the segments by the in-memory index, built when the store is opened.
+// Store with empty dir doesn't persist anything and only passes the records to the sinks.
+// Sessions hand their records to the writer goroutine, so the proxies don't wait for the disk.
+type Store struct {
+	cfg         common.CaptureConfig
+	segments    map[string]*segment
+	index       map[string]*serviceIndex
+	lastCleanup time.Time
+	cleaning    atomic.Bool
+	// mu guards the segments and the index, the file reads and the sinks are outside of it.
+	mu *sync.Mutex
+
+	sinks  []Sink
+	sinkMu *sync.Mutex
+
+	queue   chan saveRequest
+	stopped chan struct{}
+	// closed is set under the write lock of queueMu, once the queue is closed.
+	closed  bool
+	queueMu *sync.RWMutex
+}
+
+// saveRequest is the record for the writer to save, or the done channel closed
+// once the records queued before are saved.
+type saveRequest struct {
+	rec  *Record
+	done chan struct{}
+}
+
+// Sink receives every record saved to the store, the pieces of the long records are merged for it.
+type Sink interface {
+	Write(rec *Record) error
+}
+
+type segment struct {
+	file *os.File
+	size int64
+}
+
+// recordRef is the location of the record piece in the segment.
+type recordRef struct {
+	path    string
+	offset  int64
+	size    int64
+	partial bool
+}
+
+// serviceIndex locates the records of the service directory.
+type serviceIndex struct {
+	// ids are the finished records, oldest first.
+	ids    []string
+	pieces map[string][]recordRef
+}
+
+func newServiceIndex() *serviceIndex {
+	return &serviceIndex{pieces: make(map[string][]recordRef)}
+}
+
+func (idx *serviceIndex) add(id string, ref recordRef) {
+	idx.pieces[id] = append(idx.pieces[id], ref)
+	if !ref.partial {
+		idx.ids = append(idx.ids, id)
+	}
+}
+
+// remove forgets the pieces in the removed segments, and the records whose last piece is removed.
+func (idx *serviceIndex) remove(removed map[string]bool) {
+	for id, refs := range idx.pieces {
+		kept := refs[:0]
+		for _, ref := range refs {
+			if !removed[ref.path] {
+				kept = append(kept, ref)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.pieces, id)
+		} else {
+			idx.pieces[id] = kept
+		}
+	}
+	ids := idx.ids[:0]
+	for _, id := range idx.ids {
+		if refs, ok := idx.pieces[id]; ok && !removed[refs[len(refs)-1].path] {
+			ids = append(ids, id)
+		}
+	}
+	idx.ids = ids
+}
+
+func NewStore(cfg common.CaptureConfig) (*Store, error) {
+	s := &Store{
+		cfg:      cfg,
+		segments: make(map[string]*segment),
+		index:    make(map[string]*serviceIndex),
+		mu:       new(sync.Mutex),
+		sinkMu:   new(sync.Mutex),
+		queue:    make(chan saveRequest, saveQueueSize),
+		stopped:  make(chan struct{}),
+		queueMu:  new(sync.RWMutex),
+	}
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("creating capture dir: %w", err)
+		}
+		if err := s.loadIndex(); err != nil {
+			return nil, fmt.Errorf("indexing capture: %w", err)
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// AddSink registers the sink for the records. Sinks implementing io.Closer are closed with the store.
+func (s *Store) AddSink(sink Sink) {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	s.sinks = append(s.sinks, sink)
+}
+
+// NewSession creates the session that's saved to the store when finished.
+// Returns nil if the store is nil.
+func (s *Store) NewSession(service, typ, clientAddr, targetAddr string) *Session {
+	if s == nil {
+		return nil
+	}
+	sess := NewSession(service, typ, clientAddr, targetAddr)
+	sess.store = s
+	sess.maxSize = s.cfg.MaxRecordSize
+	return sess
+}
+
+// run saves the queued records until the store is closed.
+func (s *Store) run() {
+	defer close(s.stopped)
+	for req := range s.queue {
+		if req.done != nil {
+			close(req.done)
+			continue
+		}
+		if err := s.Save(req.rec); err != nil {
+			logrus.Errorf("Error saving capture record %s: %v", req.rec.ID, err)
+		}
+	}
+}
+
+// enqueue hands the request to the writer. If wait is unset and the queue is full, it's not queued.
+// Returns false if the request is not queued or the store is closed.
+func (s *Store) enqueue(req saveRequest, wait bool) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.closed {
+		return false
+	}
+	if wait {
+		s.queue <- req
+		return true
+	}
+	select {
+	case s.queue <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sync waits until the records the sessions queued so far are saved.
+func (s *Store) Sync() {
+	done := make(chan struct{})
+	if s.enqueue(saveRequest{done: done}, true) {
+		<-done
+	}
+}
+
+// Save writes the record to the segment and passes it to the sinks.
+// Only the segment write is done under the store lock, the sinks and the cleanup are run after it.
+func (s *Store) Save(rec *Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshaling record: %w", err)
+	}
+	data = append(data, '\n')
+
+	if s.cfg.Dir == "" {
+		s.writeSinks(rec)
+		return nil
+	}
+
+	s.mu.Lock()
+	seg, err := s.getSegment(rec.Service)
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("opening segment: %w", err)
+	}
+	ref := recordRef{path: seg.file.Name(), offset: seg.size, partial: rec.Partial}
+	n, err := seg.file.Write(data)
+	seg.size += int64(n)
+	if err != nil {
+		s.mu.Unlock()
+		if !rec.Partial {
+			s.writeSinks(rec)
+		}
+		return fmt.Errorf("writing record: %w", err)
+	}
+	ref.size = int64(n)
+	idx := s.serviceIndex(s.serviceDir(rec.Service))
+	idx.add(rec.ID, ref)
+	refs := append([]recordRef(nil), idx.pieces[rec.ID]...)
+
+	clean := time.Since(s.lastCleanup) > cleanupInterval
+	if s.cfg.MaxSegmentSize > 0 && seg.size >= s.cfg.MaxSegmentSize {
+		if err := seg.file.Close(); err != nil {
+			logrus.Errorf("Error closing capture segment: %v", err)
+		}
+		delete(s.segments, rec.Service)
+		clean = true
+	}
+	if clean {
+		s.lastCleanup = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !rec.Partial {
+		whole := rec
+		if rec.Piece > 0 && s.hasSinks() {
+			if whole, err = readPieces(refs); err != nil {
+				logrus.Errorf("Error reading capture record %s for sinks: %v", rec.ID, err)
+				whole = rec
+			}
+		}
+		s.writeSinks(whole)
+	}
+	if clean {
+		s.cleanup()
+	}
+	return nil
+}
+
+func (s *Store) hasSinks() bool {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	return len(s.sinks) != 0
+}
+
+// writeSinks passes the record to the sinks, one record at a time.
+func (s *Store) writeSinks(rec *Record) {
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	for _, sink := range s.sinks {
+		if err := sink.Write(rec); err != nil {
+			logrus.Errorf("Error writing record to sink %T: %v", sink, err)
+		}
+	}
+}
+
+// List returns the summaries of the service records, newest first.
+func (s *Store) List(service string, offset, limit int) ([]Record, error) {
+	s.mu.Lock()
+	refs := make([]recordRef, 0)
+	if idx, ok := s.index[s.serviceDir(service)]; ok {
+		for i := len(idx.ids) - 1 - offset; i >= 0; i -= 1 {
+			if limit > 0 && len(refs) == limit {
+				break
+			}
+			pieces := idx.pieces[idx.ids[i]]
+			// The last piece has the whole record but the payload.
+			refs = append(refs, pieces[len(pieces)-1])
+		}
+	}
+	s.mu.Unlock()
+
+	r := newPieceReader()
+	defer r.close()
+	result := make([]Record, 0, len(refs))
+	for _, ref := range refs {
+		rec, err := r.read(ref)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by the cleanup.
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, rec.Summary())
+	}
+	return result, nil
+}
+
+func (s *Store) Get(service, id string) (*Record, error) {
+	s.mu.Lock()
+	var refs []recordRef
+	if idx, ok := s.index[s.serviceDir(service)]; ok {
+		refs = append(refs, idx.pieces[id]...)
+	}
+	s.mu.Unlock()
+
+	// The record not finished yet has only the partial pieces.
+	if len(refs) == 0 || refs[len(refs)-1].partial {
+		return nil, ErrNoSuchRecord
+	}
+	rec, err := readPieces(refs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSuchRecord
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Walk calls f for every service record, newest first, until f returns false.
+// Records are read one at a time.
+func (s *Store) Walk(service string, f func(rec *Record) bool) error {
+	s.mu.Lock()
+	var records [][]recordRef
+	if idx, ok := s.index[s.serviceDir(service)]; ok {
+		records = make([][]recordRef, 0, len(idx.ids))
+		for i := len(idx.ids) - 1; i >= 0; i -= 1 {
+			records = append(records, append([]recordRef(nil), idx.pieces[idx.ids[i]]...))
+		}
+	}
+	s.mu.Unlock()
+
+	for _, refs := range records {
+		rec, err := readPieces(refs)
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, ErrNoSuchRecord) {
+				// Removed by the cleanup.
+				continue
+			}
+			return err
+		}
+		if !f(rec) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Close saves the queued records and closes the segments and the sinks.
+func (s *Store) Close() error {
+	s.queueMu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.queueMu.Unlock()
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for service, seg := range s.segments {
+		if err := seg.file.Close(); err != nil {
+			return fmt.Errorf("closing segment for %s: %w", service, err)
+		}
+		delete(s.segments, service)
+	}
+	s.sinkMu.Lock()
+	defer s.sinkMu.Unlock()
+	for _, sink := range s.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return fmt.Errorf("closing sink %T: %w", sink, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) serviceDir(service string) string {
+	return filepath.Join(s.cfg.Dir, SafeName(service))
+}
+
+// SafeName converts the service name to the string usable as a file name.
+func SafeName(service string) string {
+	return serviceDirReplacer.ReplaceAllString(service, "_")
+}
+
+// segmentPaths returns the segments in the service directory, oldest first.
+func segmentPaths(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing segments: %w", err)
+	}
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), segmentExt) {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	// Segment names are zero-padded timestamps.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// serviceIndex returns the index of the service directory, creating it if missing. Must be called with mu held.
+func (s *Store) serviceIndex(dir string) *serviceIndex {
+	idx, ok := s.index[dir]
+	if !ok {
+		idx = newServiceIndex()
+		s.index[dir] = idx
+	}
+	return idx
+}
+
+// loadIndex indexes the segments left by the previous runs.
+func (s *Store) loadIndex() error {
+	infos, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("listing capture dir: %w", err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.cfg.Dir, info.Name())
+		paths, err := segmentPaths(dir)
+		if err != nil {
+			return err
+		}
+		idx := s.serviceIndex(dir)
+		for _, path := range paths {
+			if err := indexSegment(path, idx); err != nil {
+				return fmt.Errorf("indexing segment %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) getSegment(service string) (*segment, error) {
+	if seg, ok := s.segments[service]; ok {
+		return seg, nil
+	}
+	dir := s.serviceDir(service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating service dir: %w", err)
+	}
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentExt)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("creating segment file: %w", err)
+	}
+	seg := &segment{file: f}
+	s.segments[service] = seg
+	return seg, nil
+}
+
+// cleanup removes segments exceeding the retention limits.
+// The files are removed without the store lock, only one cleanup runs at a time.
+func (s *Store) cleanup() {
+	if !s.cleaning.CAS(false, true) {
+		return
+	}
+	defer s.cleaning.Store(false)
+
+	infos, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		logrus.Errorf("Error listing capture dir: %v", err)
+		return
+	}
+
+	removed := make(map[string]bool)
+	s.mu.Lock()
+	active := make(map[string]bool, len(s.segments))
+	for _, seg := range s.segments {
+		active[seg.file.Name()] = true
+	}
+	s.mu.Unlock()
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.cfg.Dir, info.Name())
+		segments, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logrus.Errorf("Error listing capture dir %s: %v", dir, err)
+			continue
+		}
+		// ReadDir returns segments sorted by name, i.e. oldest first.
+		for i, seg := range segments {
+			path := filepath.Join(dir, seg.Name())
+			if active[path] || !strings.HasSuffix(seg.Name(), segmentExt) {
+				continue
+			}
+			tooMany := s.cfg.MaxSegments > 0 && len(segments)-i > s.cfg.MaxSegments
+			tooOld := s.cfg.MaxAge != nil && time.Since(seg.ModTime()) > *s.cfg.MaxAge
+			if tooMany || tooOld {
+				if err := os.Remove(path); err != nil {
+					logrus.Errorf("Error removing capture segment %s: %v", path, err)
+					continue
+				}
+				removed[path] = true
+			}
+		}
+	}
+	if len(removed) != 0 {
+		s.mu.Lock()
+		for _, idx := range s.index {
+			idx.remove(removed)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// indexSegment adds the records of the segment to the index.
+func indexSegment(path string, idx *serviceIndex) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("Error closing segment %s: %v", path, err)
+		}
+	}()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	offset := int64(0)
+	for sc.Scan() {
+		line := sc.Bytes()
+		ref := recordRef{path: path, offset: offset, size: int64(len(line)) + 1}
+		offset += ref.size
+		if len(line) == 0 {
+			continue
+		}
+		var head struct {
+			ID      string `json:"id"`
+			Partial bool   `json:"partial"`
+		}
+		if err := json.Unmarshal(line, &head); err != nil {
+			// Partially written line.
+			continue
+		}
+		ref.partial = head.Partial
+		idx.add(head.ID, ref)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading records: %w", err)
+	}
+	return nil
+}
+
+// readPieces reads the record pieces and merges them.
+func readPieces(refs []recordRef) (*Record, error) {
+	r := newPieceReader()
+	defer r.close()
+	pieces := make([]*Record, 0, len(refs))
+	for _, ref := range refs {
+		rec, err := r.read(ref)
+		if err != nil {
+			if os.IsNotExist(err) && len(refs) > 1 {
+				// Earlier pieces removed by the cleanup.
+				continue
+			}
+			return nil, err
+		}
+		pieces = append(pieces, rec)
+	}
+	if len(pieces) == 0 {
+		return nil, ErrNoSuchRecord
+	}
+	return mergePieces(pieces), nil
+}
+
+// pieceReader reads the record pieces, keeping the segments open until closed.
+type pieceReader struct {
+	files map[string]*os.File
+}
+
+func newPieceReader() *pieceReader {
+	return &pieceReader{files: make(map[string]*os.File)}
+}
+
+func (r *pieceReader) read(ref recordRef) (*Record, error) {
+	f, ok := r.files[ref.path]
+	if !ok {
+		var err error
+		if f, err = os.Open(ref.path); err != nil {
+			return nil, err
+		}
+		r.files[ref.path] = f
+	}
+	buf := make([]byte, ref.size)
+	if _, err := f.ReadAt(buf, ref.offset); err != nil {
+		return nil, fmt.Errorf("reading segment %s: %w", ref.path, err)
+	}
+	rec := new(Record)
+	if err := json.Unmarshal(buf, rec); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	return rec, nil
+}
+
+func (r *pieceReader) close() {
+	for path, f := range r.files {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("Error closing segment %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"goxy/internal/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, cfg common.CaptureConfig) *Store {
+	t.Helper()
+	cfg.Dir = t.TempDir()
+	s, err := NewStore(cfg)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	})
+	return s
+}
+
+func TestStore_ListGet(t *testing.T) {
+	s := newTestStore(t, common.CaptureConfig{})
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		sess := s.NewSession("test service", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+		sess.AddChunk(true, []byte("request"))
+		sess.AddChunk(false, []byte("response"))
+		sess.AddMatch("contains 'req'", "drop", true, false)
+		sess.Finish(VerdictDrop)
+		ids = append(ids, sess.ID())
+	}
+	other := s.NewSession("other service", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+	other.Finish(VerdictPass)
+	s.Sync()
+
+	records, err := s.List("test service", 1, 2)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("List() got %d records, want 2", len(records))
+	}
+	if records[0].ID != ids[3] || records[1].ID != ids[2] {
+		t.Errorf("List() got records %s, %s, want %s, %s", records[0].ID, records[1].ID, ids[3], ids[2])
+	}
+	if records[0].Chunks != nil {
+		t.Errorf("List() returned payload")
+	}
+
+	rec, err := s.Get("test service", ids[0])
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(rec.Chunks) != 2 || string(rec.Chunks[0].Data) != "request" || !rec.Chunks[0].Ingress {
+		t.Errorf("Get() got invalid chunks: %+v", rec.Chunks)
+	}
+	if len(rec.Matches) != 1 || rec.Verdict != VerdictDrop {
+		t.Errorf("Get() got invalid matches or verdict: %+v %s", rec.Matches, rec.Verdict)
+	}
+
+	if _, err := s.Get("test service", other.ID()); !errors.Is(err, ErrNoSuchRecord) {
+		t.Errorf("Get() got record from other service, error = %v", err)
+	}
+}
+
+func TestStore_Retention(t *testing.T) {
+	s := newTestStore(t, common.CaptureConfig{
+		MaxSegmentSize: 1,
+		MaxSegments:    3,
+	})
+
+	for i := 0; i < 10; i++ {
+		sess := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+		sess.AddChunk(true, []byte("data"))
+		sess.Finish(VerdictPass)
+	}
+	s.Sync()
+
+	files, err := ioutil.ReadDir(filepath.Join(s.cfg.Dir, "test"))
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("got %d segments, want 3", len(files))
+	}
+
+	records, err := s.List("test", 0, 0)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 3 {
+		t.Errorf("List() got %d records, want 3", len(records))
+	}
+}
+
+func TestSession_MaxSize(t *testing.T) {
+	s := newTestStore(t, common.CaptureConfig{MaxRecordSize: 10})
+
+	sess := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+	sess.AddChunk(true, []byte("123456"))
+	sess.AddChunk(false, []byte("789012"))
+	sess.AddChunk(true, []byte("345"))
+
+	rec := sess.Record()
+	if !rec.Truncated {
+		t.Errorf("record not truncated")
+	}
+	if len(rec.Chunks) != 2 || string(rec.Chunks[1].Data) != "7890" {
+		t.Errorf("invalid chunks: %+v", rec.Chunks)
+	}
+	if rec.IngressBytes != 9 || rec.EgressBytes != 6 {
+		t.Errorf("invalid byte counters: %d %d", rec.IngressBytes, rec.EgressBytes)
+	}
+}
+
+type testSink struct {
+	records []*Record
+}
+
+func (s *testSink) Write(rec *Record) error {
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func TestStore_Pieces(t *testing.T) {
+	s := newTestStore(t, common.CaptureConfig{})
+	sink := new(testSink)
+	s.AddSink(sink)
+
+	sess := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+	chunk := bytes.Repeat([]byte("a"), MaxPieceSize/2+1)
+	for i := 0; i < 5; i++ {
+		sess.AddChunk(i%2 == 0, chunk)
+	}
+	// Chunks written out are not kept in the session.
+	if got := len(sess.Record().Chunks); got != 1 {
+		t.Errorf("session keeps %d chunks, want 1", got)
+	}
+	s.Sync()
+	if _, err := s.Get("test", sess.ID()); !errors.Is(err, ErrNoSuchRecord) {
+		t.Errorf("Get() unfinished record error = %v, want %v", err, ErrNoSuchRecord)
+	}
+	sess.AddMatch("contains 'a'", "alert", true, false)
+	sess.Finish(VerdictPass)
+	s.Sync()
+
+	check := func(name string, rec *Record) {
+		t.Helper()
+		if len(rec.Chunks) != 5 || rec.Partial || rec.Truncated {
+			t.Errorf("%s got %d chunks, partial %v, truncated %v, want 5 whole", name, len(rec.Chunks), rec.Partial, rec.Truncated)
+			return
+		}
+		if !rec.Chunks[0].Ingress || rec.Chunks[1].Ingress || len(rec.Matches) != 1 {
+			t.Errorf("%s got invalid chunks or matches: %+v", name, rec.Matches)
+		}
+	}
+	rec, err := s.Get("test", sess.ID())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	check("Get()", rec)
+	if len(sink.records) != 1 {
+		t.Fatalf("sink got %d records, want 1", len(sink.records))
+	}
+	check("sink", sink.records[0])
+	if records, err := s.List("test", 0, 0); err != nil || len(records) != 1 {
+		t.Errorf("List() = %d records, %v, want 1", len(records), err)
+	}
+
+	paths, err := segmentPaths(s.serviceDir("test"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("segmentPaths() = %v, %v", paths, err)
+	}
+	f, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer f.Close()
+	records, err := ReadRecords(f)
+	if err != nil {
+		t.Fatalf("ReadRecords() error = %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("ReadRecords() got %d records, want 1", len(records))
+	}
+	check("ReadRecords()", records[0])
+}
+
+func TestStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(common.CaptureConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		sess := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+		sess.AddChunk(true, []byte("data"))
+		sess.Finish(VerdictPass)
+		ids = append(ids, sess.ID())
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The records of the previous run are indexed when the store is opened.
+	s, err = NewStore(common.CaptureConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	defer s.Close()
+	records, err := s.List("test", 0, 0)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(records) != 3 || records[0].ID != ids[2] {
+		t.Fatalf("List() got %d records, want 3 newest first", len(records))
+	}
+	rec, err := s.Get("test", ids[1])
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(rec.Chunks) != 1 || string(rec.Chunks[0].Data) != "data" {
+		t.Errorf("Get() got invalid chunks: %+v", rec.Chunks)
+	}
+}
+
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(_ *Record) error {
+	<-s.release
+	return nil
+}
+
+func TestSession_FlushWriterBusy(t *testing.T) {
+	s := newTestStore(t, common.CaptureConfig{})
+	sink := &blockingSink{release: make(chan struct{})}
+	s.AddSink(sink)
+
+	// The writer is stuck passing the first record to the sink.
+	first := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+	first.Finish(VerdictPass)
+
+	sess := s.NewSession("test", "tcp", "1.2.3.4:5", "127.0.0.1:1338")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := bytes.Repeat([]byte("a"), MaxPieceSize/2+1)
+		for i := 0; i < 4; i++ {
+			sess.AddChunk(true, chunk)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatalf("AddChunk() waits for the writer")
+	}
+	if sess.Record().Truncated {
+		t.Errorf("record truncated with the room in the queue")
+	}
+
+	close(sink.release)
+	sess.Finish(VerdictPass)
+	s.Sync()
+	rec, err := s.Get("test", sess.ID())
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if rec.IngressBytes != 4*(MaxPieceSize/2+1) || len(rec.Chunks) != 4 {
+		t.Errorf("Get() got %d bytes in %d chunks, want 4 chunks", rec.IngressBytes, len(rec.Chunks))
+	}
+}
@@ -1,30 +1,403 @@
 package common
 
-import "time"
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
 
 type RuleConfig struct {
-	Name  string   `json:"name" mapstructure:"name"`
-	Type  string   `json:"type" mapstructure:"type"`
-	Field string   `json:"field" mapstructure:"field"`
-	Args  []string `json:"args" mapstructure:"args"`
+	Name  string   `json:"name" mapstructure:"name" yaml:"name"`
+	Type  string   `json:"type" mapstructure:"type" yaml:"type"`
+	Field string   `json:"field" mapstructure:"field" yaml:"field,omitempty"`
+	Args  []string `json:"args" mapstructure:"args" yaml:"args,omitempty"`
 }
 
 type FilterConfig struct {
-	Rule    string `json:"rule" mapstructure:"rule"`
-	Alert   bool   `json:"alert" mapstructure:"alert"`
-	Verdict string `json:"verdict" mapstructure:"verdict"`
+	Rule    string `json:"rule" mapstructure:"rule" yaml:"rule"`
+	Alert   bool   `json:"alert" mapstructure:"alert" yaml:"alert,omitempty"`
+	Verdict string `json:"verdict" mapstructure:"verdict" yaml:"verdict"`
+	// Shadow filter records its matches, but its verdict is never applied.
+	Shadow   bool `json:"shadow" mapstructure:"shadow" yaml:"shadow,omitempty"`
+	Disabled bool `json:"disabled" mapstructure:"disabled" yaml:"disabled,omitempty"`
+}
+
+// TLSConfig sets up TLS on the client and the target sides of the proxy.
+type TLSConfig struct {
+	// Terminate enables TLS on the listening side.
+	// Certificate is loaded from Cert and Key, or generated for Hosts if they're not set.
+	Terminate bool     `json:"terminate" mapstructure:"terminate" yaml:"terminate,omitempty"`
+	Cert      string   `json:"cert" mapstructure:"cert" yaml:"cert,omitempty"`
+	Key       string   `json:"key" mapstructure:"key" yaml:"key,omitempty"`
+	Hosts     []string `json:"hosts" mapstructure:"hosts" yaml:"hosts,omitempty"`
+
+	// Upstream enables TLS to the target. The target certificate is checked
+	// against CA if it's set, ServerName overrides the name from the target address.
+	Upstream   bool   `json:"upstream" mapstructure:"upstream" yaml:"upstream,omitempty"`
+	SkipVerify bool   `json:"skip_verify" mapstructure:"skip_verify" yaml:"skip_verify,omitempty"`
+	CA         string `json:"ca" mapstructure:"ca" yaml:"ca,omitempty"`
+	ServerName string `json:"server_name" mapstructure:"server_name" yaml:"server_name,omitempty"`
+}
+
+// Policies for the HTTP bodies larger than the inspected size.
+const (
+	BodyPolicyAllow = "allow"
+	BodyPolicyDrop  = "drop"
+	BodyPolicyAlert = "alert"
+)
+
+// Drop modes, how the dropped connection or request is answered.
+const (
+	// DropModeClose closes the TCP connection, HTTP requests get the empty 204 response.
+	DropModeClose = "close"
+	// DropModeResponse answers the HTTP request with the configured status, headers and body.
+	DropModeResponse = "response"
+	// DropModeTemplate answers the HTTP request with the raw response from the template file.
+	DropModeTemplate = "template"
+	// DropModeMimic answers the HTTP request with the response of the target for a missing page.
+	DropModeMimic = "mimic"
+	// DropModeRST resets the connection instead of closing it gracefully.
+	DropModeRST = "rst"
+	// DropModeBlackhole keeps the connection open, discarding the client data until the timeout.
+	DropModeBlackhole = "blackhole"
+)
+
+// DefaultSessionCookies are the usual session cookies of the web frameworks.
+var DefaultSessionCookies = []string{"session", "sessionid", "PHPSESSID", "JSESSIONID", "connect.sid"}
+
+// DefaultBlackholeTimeout is used if the blackhole drop has no timeout set.
+const DefaultBlackholeTimeout = time.Minute
+
+// DefaultBodyIdleTimeout is used if the service has no body idle timeout set.
+const DefaultBodyIdleTimeout = time.Millisecond * 200
+
+var (
+	streamDropModes = []string{DropModeClose, DropModeRST, DropModeBlackhole}
+	httpDropModes   = []string{DropModeClose, DropModeResponse, DropModeTemplate, DropModeMimic, DropModeRST, DropModeBlackhole}
+)
+
+// DropConfig sets how the service answers the dropped connections and requests.
+type DropConfig struct {
+	Mode string `json:"mode" mapstructure:"mode" yaml:"mode,omitempty"`
+	// Status, Headers and Body make the response of the response mode, the status is 404 if it's not set.
+	Status  int               `json:"status" mapstructure:"status" yaml:"status,omitempty"`
+	Headers map[string]string `json:"headers" mapstructure:"headers" yaml:"headers,omitempty"`
+	Body    string            `json:"body" mapstructure:"body" yaml:"body,omitempty"`
+	// Template is the file with the raw HTTP response for the template mode.
+	Template string `json:"template" mapstructure:"template" yaml:"template,omitempty"`
+	// Timeout is how long the blackholed connection is kept.
+	Timeout *time.Duration `json:"timeout" mapstructure:"timeout" yaml:"timeout,omitempty"`
+}
+
+// IsDropMode reports whether the mode is known, modes supported by the service type are checked with DropModes.
+func IsDropMode(mode string) bool {
+	for _, m := range httpDropModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// DropModes returns the drop modes supported by the service type.
+func DropModes(serviceType string) []string {
+	switch serviceType {
+	case "http":
+		return httpDropModes
+	case "tcp":
+		return streamDropModes
+	default:
+		return []string{DropModeClose}
+	}
 }
 
 type ServiceConfig struct {
-	Name           string         `json:"name" mapstructure:"name"`
-	Type           string         `json:"type" mapstructure:"type"`
-	Listen         string         `json:"listen" mapstructure:"listen"`
-	Target         string         `json:"target" mapstructure:"target"`
-	RequestTimeout *time.Duration `json:"request_timeout" mapstructure:"request_timeout"`
-	Filters        []FilterConfig `json:"filters" mapstructure:"filters"`
+	Name           string         `json:"name" mapstructure:"name" yaml:"name"`
+	Type           string         `json:"type" mapstructure:"type" yaml:"type"`
+	Listen         string         `json:"listen" mapstructure:"listen" yaml:"listen"`
+	Target         string         `json:"target" mapstructure:"target" yaml:"target"`
+	RequestTimeout *time.Duration `json:"request_timeout" mapstructure:"request_timeout" yaml:"request_timeout,omitempty"`
+	StreamWindow   int            `json:"stream_window" mapstructure:"stream_window" yaml:"stream_window,omitempty"`
+	Shadow         bool           `json:"shadow" mapstructure:"shadow" yaml:"shadow,omitempty"`
+	// DrainTimeout is how long the connections of the removed service are allowed to finish.
+	DrainTimeout *time.Duration `json:"drain_timeout" mapstructure:"drain_timeout" yaml:"drain_timeout,omitempty"`
+	TLS          *TLSConfig     `json:"tls" mapstructure:"tls" yaml:"tls,omitempty"`
+	// H2C makes the HTTP proxy talk HTTP/2 to the target without TLS, with prior knowledge.
+	// It can't be set along with the upstream TLS, HTTP/2 is negotiated over TLS anyway.
+	H2C bool `json:"h2c" mapstructure:"h2c" yaml:"h2c,omitempty"`
+	// MaxInspectBody is how many bytes of the HTTP body the filters see, the rest is passed through.
+	// Zero means no limit. OversizedBody is the policy for the larger bodies, allow by default.
+	// Its alert policy also alerts on the bodies in the content encodings the filters can't decode.
+	MaxInspectBody int64  `json:"max_inspect_body" mapstructure:"max_inspect_body" yaml:"max_inspect_body,omitempty"`
+	OversizedBody  string `json:"oversized_body" mapstructure:"oversized_body" yaml:"oversized_body,omitempty"`
+	// BodyIdleTimeout is how long the HTTP response body of unknown length is waited for before the rest of it
+	// is streamed uninspected, under the OversizedBody policy. Zero waits for the whole inspected size.
+	BodyIdleTimeout *time.Duration `json:"body_idle_timeout" mapstructure:"body_idle_timeout" yaml:"body_idle_timeout,omitempty"`
+	// SessionTimeout is how long the UDP session is kept without datagrams in either direction.
+	SessionTimeout *time.Duration `json:"session_timeout" mapstructure:"session_timeout" yaml:"session_timeout,omitempty"`
+	// DropSession makes the UDP drop discard the rest of the session instead of the single datagram.
+	DropSession bool `json:"drop_session" mapstructure:"drop_session" yaml:"drop_session,omitempty"`
+	// Drop sets how the dropped connections are answered, the drop verdict can override the mode.
+	Drop *DropConfig `json:"drop" mapstructure:"drop" yaml:"drop,omitempty"`
+	// StateTTL is how long the counters and flags wider than the connection live after the last update.
+	StateTTL *time.Duration `json:"state_ttl" mapstructure:"state_ttl" yaml:"state_ttl,omitempty"`
+	// SessionCookies are the cookies identifying the HTTP session scope, DefaultSessionCookies if not set.
+	SessionCookies []string       `json:"session_cookies" mapstructure:"session_cookies" yaml:"session_cookies,omitempty"`
+	Filters        []FilterConfig `json:"filters" mapstructure:"filters" yaml:"filters"`
+}
+
+// DropMode returns the mode for the connection dropped by the verdict.
+// Mode set by the verdict overrides the service one, modes not supported by the service close the connection.
+func (c ServiceConfig) DropMode(ctx *ProxyContext) string {
+	mode := DropModeClose
+	if c.Drop != nil && c.Drop.Mode != "" {
+		mode = c.Drop.Mode
+	}
+	if m, ok := ctx.GetValue(DropModeKey); ok {
+		mode = m
+	}
+	for _, m := range DropModes(c.Type) {
+		if m == mode {
+			return mode
+		}
+	}
+	return DropModeClose
+}
+
+// BlackholeTimeout returns how long the blackholed connection is kept.
+func (c ServiceConfig) BlackholeTimeout() time.Duration {
+	if c.Drop != nil && c.Drop.Timeout != nil {
+		return *c.Drop.Timeout
+	}
+	return DefaultBlackholeTimeout
+}
+
+// GetStateTTL returns how long the scoped counters and flags live.
+func (c ServiceConfig) GetStateTTL() time.Duration {
+	if c.StateTTL != nil {
+		return *c.StateTTL
+	}
+	return DefaultStateTTL
+}
+
+// GetBodyIdleTimeout returns how long the streamed response body is waited for.
+func (c ServiceConfig) GetBodyIdleTimeout() time.Duration {
+	if c.BodyIdleTimeout != nil {
+		return *c.BodyIdleTimeout
+	}
+	return DefaultBodyIdleTimeout
+}
+
+// GetSessionCookies returns the cookies identifying the HTTP session.
+func (c ServiceConfig) GetSessionCookies() []string {
+	if len(c.SessionCookies) != 0 {
+		return c.SessionCookies
+	}
+	return DefaultSessionCookies
+}
+
+// Copy returns the deep copy of the service config.
+func (c ServiceConfig) Copy() ServiceConfig {
+	if c.RequestTimeout != nil {
+		timeout := *c.RequestTimeout
+		c.RequestTimeout = &timeout
+	}
+	if c.DrainTimeout != nil {
+		timeout := *c.DrainTimeout
+		c.DrainTimeout = &timeout
+	}
+	if c.SessionTimeout != nil {
+		timeout := *c.SessionTimeout
+		c.SessionTimeout = &timeout
+	}
+	if c.StateTTL != nil {
+		ttl := *c.StateTTL
+		c.StateTTL = &ttl
+	}
+	if c.BodyIdleTimeout != nil {
+		timeout := *c.BodyIdleTimeout
+		c.BodyIdleTimeout = &timeout
+	}
+	c.SessionCookies = append([]string(nil), c.SessionCookies...)
+	if c.TLS != nil {
+		tlsCfg := *c.TLS
+		tlsCfg.Hosts = append([]string(nil), tlsCfg.Hosts...)
+		c.TLS = &tlsCfg
+	}
+	if c.Drop != nil {
+		drop := *c.Drop
+		if drop.Timeout != nil {
+			timeout := *drop.Timeout
+			drop.Timeout = &timeout
+		}
+		if drop.Headers != nil {
+			drop.Headers = make(map[string]string, len(c.Drop.Headers))
+			for k, v := range c.Drop.Headers {
+				drop.Headers[k] = v
+			}
+		}
+		c.Drop = &drop
+	}
+	c.Filters = append([]FilterConfig(nil), c.Filters...)
+	return c
+}
+
+type PCAPConfig struct {
+	Enabled     bool   `json:"enabled" mapstructure:"enabled"`
+	Dir         string `json:"dir" mapstructure:"dir"`
+	MaxFileSize int64  `json:"max_file_size" mapstructure:"max_file_size"`
+	MaxFiles    int    `json:"max_files" mapstructure:"max_files"`
+}
+
+type CaptureConfig struct {
+	Enabled        bool           `json:"enabled" mapstructure:"enabled"`
+	Dir            string         `json:"dir" mapstructure:"dir"`
+	MaxAge         *time.Duration `json:"max_age" mapstructure:"max_age"`
+	MaxSegmentSize int64          `json:"max_segment_size" mapstructure:"max_segment_size"`
+	MaxSegments    int            `json:"max_segments" mapstructure:"max_segments"`
+	MaxRecordSize  int            `json:"max_record_size" mapstructure:"max_record_size"`
+	PCAP           PCAPConfig     `json:"pcap" mapstructure:"pcap"`
 }
 
 type ProxyConfig struct {
 	Rules    []RuleConfig    `json:"rules" mapstructure:"rules"`
 	Services []ServiceConfig `json:"services" mapstructure:"services"`
+	Capture  CaptureConfig   `json:"capture" mapstructure:"capture"`
+}
+
+// Copy returns the deep copy of the rules and services, capture config is shared.
+func (c *ProxyConfig) Copy() *ProxyConfig {
+	result := *c
+	result.Rules = make([]RuleConfig, 0, len(c.Rules))
+	for _, r := range c.Rules {
+		r.Args = append([]string(nil), r.Args...)
+		result.Rules = append(result.Rules, r)
+	}
+	result.Services = make([]ServiceConfig, 0, len(c.Services))
+	for _, sc := range c.Services {
+		result.Services = append(result.Services, sc.Copy())
+	}
+	return &result
+}
+
+// LoadProxyConfig reads the config file viper is set up with and parses the proxy config from it.
+// If the file is invalid, viper keeps the previously read config.
+// Viper isn't safe for the concurrent reads, the goxy reloads go through Manager.ReloadWith.
+func LoadProxyConfig() (*ProxyConfig, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	cfg := new(ProxyConfig)
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	return cfg, nil
+}
+
+// SaveProxyConfig replaces the rules and services in the config file with the ones from cfg.
+// Other sections are kept, but comments and formatting are not.
+func SaveProxyConfig(path string, cfg *ProxyConfig) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	set := func(key string, value interface{}) {
+		for i := range doc {
+			if doc[i].Key == key {
+				doc[i].Value = value
+				return
+			}
+		}
+		doc = append(doc, yaml.MapItem{Key: key, Value: value})
+	}
+	set("rules", yamlValue(reflect.ValueOf(cfg.Rules)))
+	set("services", yamlValue(reflect.ValueOf(cfg.Services)))
+
+	if data, err = yaml.Marshal(doc); err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+
+	// Write to the temporary file first, so the config is never left half-written.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replacing config: %w", err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// yamlValue converts the config to the YAML tree following the yaml tags, with the durations written
+// like "30s" instead of the nanoseconds, so the saved config reads like the hand-written one.
+func yamlValue(v reflect.Value) interface{} {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return yamlValue(v.Elem())
+	case reflect.Struct:
+		doc := yaml.MapSlice{}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(f.Tag.Get("yaml"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fv := v.Field(i)
+			if len(tag) > 1 && tag[1] == "omitempty" && isEmpty(fv) {
+				continue
+			}
+			doc = append(doc, yaml.MapItem{Key: name, Value: yamlValue(fv)})
+		}
+		return doc
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, yamlValue(v.Index(i)))
+		}
+		return items
+	case reflect.Map:
+		items := make(map[interface{}]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			items[iter.Key().Interface()] = yamlValue(iter.Value())
+		}
+		return items
+	default:
+		return v.Interface()
+	}
+}
+
+// isEmpty reports whether the field is omitted with omitempty, as yaml.v2 does.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return v.IsZero()
+	}
 }
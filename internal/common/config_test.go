@@ -0,0 +1,99 @@
+package common
+
+import (
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveProxyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxy-config")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	initial := "web:\n  listen: 0.0.0.0:8000\nrules: []\nservices: []\n"
+	if err := ioutil.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	timeout := 5 * time.Second
+	cfg := &ProxyConfig{
+		Rules: []RuleConfig{{Name: "flag", Type: "tcp::contains", Args: []string{"flag"}}},
+		Services: []ServiceConfig{{
+			Name:           "svc",
+			Type:           "http",
+			Listen:         "0.0.0.0:1337",
+			Target:         "127.0.0.1:1338",
+			RequestTimeout: &timeout,
+			Drop:           &DropConfig{Mode: DropModeBlackhole, Timeout: &timeout},
+			Filters:        []FilterConfig{{Rule: "flag", Verdict: "drop", Shadow: true}},
+		}},
+	}
+	if err := SaveProxyConfig(path, cfg); err != nil {
+		t.Fatalf("SaveProxyConfig() error = %v", err)
+	}
+
+	// Durations are written the way they're set by hand.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !strings.Contains(string(data), "request_timeout: 5s") || !strings.Contains(string(data), "timeout: 5s") {
+		t.Errorf("SaveProxyConfig() durations not written as strings:\n%s", data)
+	}
+
+	viper.Reset()
+	defer viper.Reset()
+	viper.SetConfigFile(path)
+	got, err := LoadProxyConfig()
+	if err != nil {
+		t.Fatalf("LoadProxyConfig() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Rules, cfg.Rules) {
+		t.Errorf("LoadProxyConfig() rules = %+v, want %+v", got.Rules, cfg.Rules)
+	}
+	if !reflect.DeepEqual(got.Services, cfg.Services) {
+		t.Errorf("LoadProxyConfig() services = %+v, want %+v", got.Services, cfg.Services)
+	}
+	if listen := viper.GetString("web.listen"); listen != "0.0.0.0:8000" {
+		t.Errorf("SaveProxyConfig() lost other sections, web.listen = %q", listen)
+	}
+}
+
+func TestServiceConfig_DropMode(t *testing.T) {
+	verdict := func(mode string) *ProxyContext {
+		ctx := NewProxyContext()
+		if err := (VerdictDrop{Mode: mode}).Mutate(ctx); err != nil {
+			t.Fatalf("Mutate() error = %v", err)
+		}
+		return ctx
+	}
+	tests := []struct {
+		name string
+		cfg  ServiceConfig
+		ctx  *ProxyContext
+		want string
+	}{
+		{"default", ServiceConfig{Type: "http"}, NewProxyContext(), DropModeClose},
+		{"service mode", ServiceConfig{Type: "http", Drop: &DropConfig{Mode: DropModeMimic}}, NewProxyContext(), DropModeMimic},
+		{"verdict mode", ServiceConfig{Type: "http", Drop: &DropConfig{Mode: DropModeMimic}}, verdict(DropModeRST), DropModeRST},
+		{"tcp rst", ServiceConfig{Type: "tcp"}, verdict(DropModeRST), DropModeRST},
+		{"unsupported by tcp", ServiceConfig{Type: "tcp"}, verdict(DropModeResponse), DropModeClose},
+		{"unsupported by udp", ServiceConfig{Type: "udp", Drop: &DropConfig{Mode: DropModeBlackhole}}, NewProxyContext(), DropModeClose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.DropMode(tt.ctx); got != tt.want {
+				t.Errorf("DropMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
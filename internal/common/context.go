@@ -1,17 +1,35 @@
 package common
 
 import (
+	"bytes"
 	"github.com/sirupsen/logrus"
 	"sync"
+	"time"
+)
+
+// Connection details the proxies store in the context values.
+const (
+	TLSServerNameKey = "tls.sni"
+	TLSProtocolKey   = "tls.alpn"
+	// DropModeKey is the drop mode set by the verdict.
+	DropModeKey = "drop.mode"
 )
 
 type ProxyContext struct {
 	flags    map[string]bool
 	counters map[string]int
+	values   map[string]string
+	alerts   []string
+	rewrites []Rewriter
+	delay    time.Duration
+	tarpit   int
+	state    *State
+	stateTTL time.Duration
+	scopes   map[string]string
 	mu       *sync.RWMutex
 }
 
-func (c ProxyContext) DumpFields() logrus.Fields {
+func (c *ProxyContext) DumpFields() logrus.Fields {
 	fields := make(logrus.Fields)
 	for k, v := range c.counters {
 		fields[k] = v
@@ -21,39 +39,248 @@ func (c ProxyContext) DumpFields() logrus.Fields {
 			fields[k] = v
 		}
 	}
+	for k, v := range c.values {
+		fields[k] = v
+	}
 	return fields
 }
 
-func (c ProxyContext) AddToCounter(key string, value int) {
+func (c *ProxyContext) AddToCounter(key string, value int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.counters[key] += value
 }
 
-func (c ProxyContext) GetCounter(key string) int {
+func (c *ProxyContext) GetCounter(key string) int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	val := c.counters[key]
 	return val
 }
 
-func (c ProxyContext) SetFlag(flag string) {
+func (c *ProxyContext) SetFlag(flag string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.flags[flag] = true
 }
 
-func (c ProxyContext) GetFlag(flag string) bool {
+func (c *ProxyContext) ClearFlag(flag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.flags, flag)
+}
+
+func (c *ProxyContext) GetFlag(flag string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	val := c.flags[flag]
 	return val
 }
 
+// SetValue stores the connection detail, like the TLS server name, for the rules to match.
+func (c *ProxyContext) SetValue(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+}
+
+func (c *ProxyContext) GetValue(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	val, ok := c.values[key]
+	return val, ok
+}
+
+// AddAlert queues the alert raised by the verdict, the proxy publishes it with the connection details.
+func (c *ProxyContext) AddAlert(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.alerts = append(c.alerts, reason)
+}
+
+// TakeAlerts returns the queued alerts and clears the queue.
+func (c *ProxyContext) TakeAlerts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := c.alerts
+	c.alerts = nil
+	return result
+}
+
+// AddRewrite queues the payload rewrite requested by the verdict.
+func (c *ProxyContext) AddRewrite(r Rewriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rewrites = append(c.rewrites, r)
+}
+
+// TakeRewrites returns the queued rewrites and clears the queue.
+func (c *ProxyContext) TakeRewrites() []Rewriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := c.rewrites
+	c.rewrites = nil
+	return result
+}
+
+// Rewrite applies the queued rewrites to the payload in order, setting the modified flag if it has changed.
+func (c *ProxyContext) Rewrite(data []byte) []byte {
+	return c.ApplyRewrites(c.TakeRewrites(), data)
+}
+
+// ApplyRewrites applies the rewrites taken from the queue to the payload, like Rewrite.
+func (c *ProxyContext) ApplyRewrites(rewrites []Rewriter, data []byte) []byte {
+	if len(rewrites) == 0 {
+		return data
+	}
+	result := data
+	for _, r := range rewrites {
+		result = r.Rewrite(result)
+	}
+	if !bytes.Equal(result, data) {
+		c.SetFlag(ModifiedFlag)
+	}
+	return result
+}
+
+// AddDelay queues the pause before the data is forwarded, the delays add up.
+func (c *ProxyContext) AddDelay(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay += d
+}
+
+// TakeDelay returns the queued delay and clears it.
+func (c *ProxyContext) TakeDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := c.delay
+	c.delay = 0
+	return result
+}
+
+// SetTarpit limits the rate of the rest of the connection in bytes per second, the lowest rate is kept.
+func (c *ProxyContext) SetTarpit(rate int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tarpit == 0 || rate < c.tarpit {
+		c.tarpit = rate
+	}
+}
+
+// TakeTarpit returns the rate limit set since the last call and clears it,
+// for the proxies not throttling the data, like the datagram ones.
+func (c *ProxyContext) TakeTarpit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := c.tarpit
+	c.tarpit = 0
+	return result
+}
+
+// GetTarpit returns the rate limit of the connection, zero if it's not limited.
+func (c *ProxyContext) GetTarpit() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tarpit
+}
+
+// BindState keeps the scoped counters and flags of the context in the state.
+// Keys identify the connection in the scopes, see ScopeKeys. Scopes without the key are ignored.
+// Unbound context keeps all of them in the connection scope.
+func (c *ProxyContext) BindState(state *State, ttl time.Duration, keys map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	c.stateTTL = ttl
+	c.scopes = make(map[string]string, len(keys))
+	for scope, key := range keys {
+		c.scopes[scope] = key
+	}
+}
+
+// SetScopeKey identifies the connection in the scope, like the HTTP session found in the request.
+func (c *ProxyContext) SetScopeKey(scope, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scopes != nil {
+		c.scopes[scope] = key
+	}
+}
+
+// ScopeKey returns the key identifying the connection in the scope.
+func (c *ProxyContext) ScopeKey(scope string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok := c.scopes[scope]
+	return key, ok
+}
+
+// stateKey returns the key of the name in the shared state, local is set for the connection scope.
+func (c *ProxyContext) stateKey(scope, name string) (key string, local, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if scope == ScopeConn || scope == "" || c.state == nil {
+		return name, true, true
+	}
+	prefix, ok := c.scopes[scope]
+	if !ok {
+		return "", false, false
+	}
+	return scope + "\x00" + prefix + "\x00" + name, false, true
+}
+
+func (c *ProxyContext) AddToScopedCounter(scope, name string, value int) {
+	key, local, ok := c.stateKey(scope, name)
+	switch {
+	case !ok:
+	case local:
+		c.AddToCounter(key, value)
+	default:
+		c.state.Add(key, value, c.stateTTL)
+	}
+}
+
+func (c *ProxyContext) GetScopedCounter(scope, name string) int {
+	key, local, ok := c.stateKey(scope, name)
+	switch {
+	case !ok:
+		return 0
+	case local:
+		return c.GetCounter(key)
+	default:
+		return c.state.Get(key)
+	}
+}
+
+func (c *ProxyContext) SetScopedFlag(scope, name string) {
+	key, local, ok := c.stateKey(scope, name)
+	switch {
+	case !ok:
+	case local:
+		c.SetFlag(key)
+	default:
+		c.state.SetFlag(key, c.stateTTL)
+	}
+}
+
+func (c *ProxyContext) GetScopedFlag(scope, name string) bool {
+	key, local, ok := c.stateKey(scope, name)
+	switch {
+	case !ok:
+		return false
+	case local:
+		return c.GetFlag(key)
+	default:
+		return c.state.GetFlag(key)
+	}
+}
+
 func NewProxyContext() *ProxyContext {
 	return &ProxyContext{
 		counters: make(map[string]int),
 		flags:    make(map[string]bool),
+		values:   make(map[string]string),
 		mu:       new(sync.RWMutex),
 	}
 }
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// TarpitInterval is how often the tarpitted data is written.
+const TarpitInterval = time.Millisecond * 100
+
+// Sleep pauses for the duration, returning the context error if it's done earlier.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ThrottledWriter writes at about rate bytes per second, in small chunks every TarpitInterval.
+// Write stops with the context error once ctx is done.
+type ThrottledWriter struct {
+	ctx  context.Context
+	w    io.Writer
+	rate int
+}
+
+func NewThrottledWriter(ctx context.Context, w io.Writer, rate int) *ThrottledWriter {
+	return &ThrottledWriter{ctx: ctx, w: w, rate: rate}
+}
+
+func (t *ThrottledWriter) Write(data []byte) (int, error) {
+	if t.rate <= 0 {
+		return t.w.Write(data)
+	}
+	chunk := int(int64(t.rate) * int64(TarpitInterval) / int64(time.Second))
+	if chunk < 1 {
+		chunk = 1
+	}
+	interval := time.Duration(chunk) * time.Second / time.Duration(t.rate)
+
+	written := 0
+	for written < len(data) {
+		end := written + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := t.w.Write(data[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := Sleep(t.ctx, interval); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
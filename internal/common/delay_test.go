@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSleep_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*10, cancel)
+
+	start := time.Now()
+	if err := Sleep(ctx, time.Minute); err != context.Canceled {
+		t.Errorf("Sleep() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Sleep() took %v after the context is done", elapsed)
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int
+		size    int
+		minTime time.Duration
+	}{
+		{"chunks", 100, 30, time.Millisecond * 300},
+		{"single bytes", 5, 2, time.Millisecond * 400},
+		{"not limited", 0, 1000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			data := bytes.Repeat([]byte("a"), tt.size)
+
+			start := time.Now()
+			n, err := NewThrottledWriter(context.Background(), buf, tt.rate).Write(data)
+			if err != nil || n != len(data) {
+				t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(data))
+			}
+			if elapsed := time.Since(start); elapsed < tt.minTime {
+				t.Errorf("Write() took %v, want at least %v", elapsed, tt.minTime)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("Write() wrote %q, want %q", buf.Bytes(), data)
+			}
+		})
+	}
+}
@@ -7,10 +7,14 @@ type Rule interface {
 }
 
 type Filter interface {
+	GetName() string
 	GetRule() Rule
 	GetVerdict() Verdict
 	GetAlert() bool
+	GetShadow() bool
+	GetStats() *FilterStats
 	IsEnabled() bool
 	SetEnabled(enabled bool)
 	SetAlert(alert bool)
+	SetShadow(shadow bool)
 }
@@ -0,0 +1,266 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// Keys the rates are counted by. Header and cookie keys are followed by the name, like "header:X-Api-Key".
+const (
+	RateKeyIP     = "ip"
+	RateKeyGlobal = "global"
+	RateKeyHeader = "header"
+	RateKeyCookie = "cookie"
+)
+
+var ErrInvalidRateKey = errors.New("invalid rate key")
+
+// Clock returns the current time, tests replace it to move the rate windows.
+type Clock func() time.Time
+
+// RateKey is what the rate is counted by: the client IP, all clients, or the HTTP header or cookie value.
+type RateKey struct {
+	Source string
+	Name   string
+}
+
+func ParseRateKey(s string) (RateKey, error) {
+	parts := strings.SplitN(s, ":", 2)
+	source := strings.ToLower(parts[0])
+	switch source {
+	case RateKeyIP, RateKeyGlobal:
+		if len(parts) != 1 {
+			return RateKey{}, fmt.Errorf("%w: %s", ErrInvalidRateKey, s)
+		}
+		return RateKey{Source: source}, nil
+	case RateKeyHeader, RateKeyCookie:
+		if len(parts) != 2 || parts[1] == "" {
+			return RateKey{}, fmt.Errorf("%w: %s name missing", ErrInvalidRateKey, source)
+		}
+		return RateKey{Source: source, Name: parts[1]}, nil
+	default:
+		return RateKey{}, fmt.Errorf("%w: %s", ErrInvalidRateKey, s)
+	}
+}
+
+// Resolve returns the key of the connection, header and cookie values are looked up by the HTTP rules.
+// Keys are counted per service, as the client IP scope is, the global one is shared by all services.
+func (k RateKey) Resolve(ctx *ProxyContext, value string) (string, bool) {
+	switch k.Source {
+	case RateKeyIP:
+		return ctx.ScopeKey(ScopeIP)
+	case RateKeyGlobal:
+		return "", true
+	default:
+		if value == "" {
+			return "", false
+		}
+		service, _ := ctx.ScopeKey(ScopeService)
+		return service + "/" + value, true
+	}
+}
+
+func (k RateKey) String() string {
+	if k.Name == "" {
+		return k.Source
+	}
+	return k.Source + ":" + k.Name
+}
+
+// ParseRate parses the limit and the window, like "10" and "10s".
+func ParseRate(limit, window string) (int, time.Duration, error) {
+	l, err := strconv.Atoi(limit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing limit: %w", err)
+	}
+	if l < 0 {
+		return 0, 0, fmt.Errorf("invalid limit: %d", l)
+	}
+	w, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing window: %w", err)
+	}
+	if w <= 0 {
+		return 0, 0, fmt.Errorf("invalid window: %v", w)
+	}
+	return l, w, nil
+}
+
+var rateLimiterSeq atomic.Int64
+
+// RateLimiter counts the events per key in the sliding window.
+// The window is approximated by the current and the previous fixed windows,
+// with the previous one weighted by its part still in the sliding window.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	id        string
+	clock     Clock
+	mu        sync.Mutex
+	counters  map[string]*rateCounter
+	lastSweep time.Time
+}
+
+type rateCounter struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:     limit,
+		Window:    window,
+		id:        "rate." + strconv.FormatInt(rateLimiterSeq.Inc(), 10),
+		clock:     time.Now,
+		counters:  make(map[string]*rateCounter),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetClock replaces the time source, for the tests.
+func (l *RateLimiter) SetClock(clock Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clock
+	l.lastSweep = clock()
+}
+
+// Hit records the event for the key and reports whether the rate is over the limit.
+// Keys above MaxStateKeys are not counted.
+func (l *RateLimiter) Hit(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	l.sweep(now)
+	c, ok := l.counters[key]
+	if !ok {
+		if len(l.counters) >= MaxStateKeys {
+			return false
+		}
+		c = &rateCounter{start: now.Truncate(l.Window)}
+		l.counters[key] = c
+	}
+	l.advance(c, now)
+	c.current++
+	return l.rate(c, now) > float64(l.Limit)
+}
+
+// HitOnce is Hit counting the connection once, later calls with the same context return the first result.
+func (l *RateLimiter) HitOnce(ctx *ProxyContext, key string) bool {
+	if v, ok := ctx.GetValue(l.id); ok {
+		return v == "over"
+	}
+	over := l.Hit(key)
+	result := "under"
+	if over {
+		result = "over"
+	}
+	ctx.SetValue(l.id, result)
+	return over
+}
+
+// Rate returns the number of events for the key in the sliding window.
+func (l *RateLimiter) Rate(key string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counters[key]
+	if !ok {
+		return 0
+	}
+	now := l.clock()
+	l.advance(c, now)
+	return l.rate(c, now)
+}
+
+// advance moves the counter to the fixed window of now.
+func (l *RateLimiter) advance(c *rateCounter, now time.Time) {
+	start := now.Truncate(l.Window)
+	switch {
+	case !start.After(c.start):
+		return
+	case start.Sub(c.start) == l.Window:
+		c.previous = c.current
+	default:
+		c.previous = 0
+	}
+	c.current = 0
+	c.start = start
+}
+
+func (l *RateLimiter) rate(c *rateCounter, now time.Time) float64 {
+	weight := 1 - float64(now.Sub(c.start))/float64(l.Window)
+	return float64(c.previous)*weight + float64(c.current)
+}
+
+// sweep removes the counters without events in the last two windows, at most once a window.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Window {
+		return
+	}
+	l.lastSweep = now
+	for k, c := range l.counters {
+		if now.Sub(c.start) >= 2*l.Window {
+			delete(l.counters, k)
+		}
+	}
+}
+
+// RateLimiters keeps the limiters of the rules across the config reloads, so the windows aren't reset.
+// The limiters are keyed by the definition, a changed limit or window gets the new limiter.
+type RateLimiters struct {
+	prev     *RateLimiters
+	mu       sync.Mutex
+	limiters map[string]*RateLimiter
+}
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{limiters: make(map[string]*RateLimiter)}
+}
+
+// Next returns the registry for the reloaded config, reusing the limiters of this one.
+func (r *RateLimiters) Next() *RateLimiters {
+	next := NewRateLimiters()
+	next.prev = r
+	return next
+}
+
+// Commit drops the limiters not used since Next, once the reloaded config is applied.
+func (r *RateLimiters) Commit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prev = nil
+}
+
+// Get returns the limiter of the definition, like the rule name and the key,
+// nil registry always returns the new one.
+func (r *RateLimiters) Get(def string, limit int, window time.Duration) *RateLimiter {
+	if r == nil {
+		return NewRateLimiter(limit, window)
+	}
+	key := fmt.Sprintf("%s/%d/%v", def, limit, window)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.limiters[key]; ok {
+		return l
+	}
+	var l *RateLimiter
+	if r.prev != nil {
+		r.prev.mu.Lock()
+		l = r.prev.limiters[key]
+		r.prev.mu.Unlock()
+	}
+	if l == nil {
+		l = NewRateLimiter(limit, window)
+	}
+	r.limiters[key] = l
+	return l
+}
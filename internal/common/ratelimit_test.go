@@ -0,0 +1,129 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is the time source moved by the tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestRateLimiter_Hit(t *testing.T) {
+	clock := newFakeClock()
+	l := NewRateLimiter(2, time.Second*10)
+	l.SetClock(clock.Now)
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		key     string
+		want    bool
+	}{
+		{"first", 0, "a", false},
+		{"second", time.Second, "a", false},
+		{"third over the limit", time.Second, "a", true},
+		{"other key", 0, "b", false},
+		// 12s: the previous window of 3 hits weighs 0.8, 2.4 + 1 > 2.
+		{"previous window counts", time.Second * 10, "a", true},
+		// 18s: 3 * 0.2 + 2 = 2.6 > 2.
+		{"previous window fades", time.Second * 6, "a", true},
+		// 21s: the previous window of 2 hits weighs 0.9, 1.8 + 1 > 2.
+		{"new window", time.Second * 3, "a", true},
+		// 45s: the windows without hits are forgotten.
+		{"after quiet windows", time.Second * 24, "a", false},
+	}
+	for _, s := range steps {
+		clock.Advance(s.advance)
+		if got := l.Hit(s.key); got != s.want {
+			t.Errorf("%s: Hit() = %v, want %v (rate %.2f)", s.name, got, s.want, l.Rate(s.key))
+		}
+	}
+
+	if _, ok := l.counters["b"]; ok {
+		t.Errorf("counter of the quiet key is not swept")
+	}
+}
+
+func TestRateLimiter_HitOnce(t *testing.T) {
+	clock := newFakeClock()
+	l := NewRateLimiter(1, time.Minute)
+	l.SetClock(clock.Now)
+
+	first, second := NewProxyContext(), NewProxyContext()
+	for i := 0; i < 3; i++ {
+		if l.HitOnce(first, "ip") {
+			t.Fatalf("HitOnce() of the first connection is over the limit")
+		}
+	}
+	if !l.HitOnce(second, "ip") {
+		t.Errorf("HitOnce() of the second connection is under the limit")
+	}
+	if got := l.Rate("ip"); got != 2 {
+		t.Errorf("Rate() = %v, want 2", got)
+	}
+}
+
+func TestParseRateKey(t *testing.T) {
+	tests := []struct {
+		desc    string
+		want    RateKey
+		wantErr bool
+	}{
+		{"ip", RateKey{Source: RateKeyIP}, false},
+		{"GLOBAL", RateKey{Source: RateKeyGlobal}, false},
+		{"header:X-Api-Key", RateKey{Source: RateKeyHeader, Name: "X-Api-Key"}, false},
+		{"cookie:session", RateKey{Source: RateKeyCookie, Name: "session"}, false},
+		{"header", RateKey{}, true},
+		{"ip:1", RateKey{}, true},
+		{"user", RateKey{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateKey(tt.desc)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRateKey(%q) = %+v, %v, want %+v, error %v", tt.desc, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestVerdictRateLimit_Mutate(t *testing.T) {
+	v, err := ParseVerdict("ratelimit::ip::1::1m")
+	if err != nil {
+		t.Fatalf("ParseVerdict() error = %v", err)
+	}
+	if _, err := ParseVerdict("ratelimit::header:X-Api-Key::1::1m"); err == nil {
+		t.Errorf("ParseVerdict() accepted the header key")
+	}
+	clock := newFakeClock()
+	v.(VerdictRateLimit).Limiter.SetClock(clock.Now)
+
+	state := NewState()
+	for i, want := range []bool{false, false, true} {
+		ctx := NewProxyContext()
+		addr := "10.0.0.1:1000"
+		if i == 1 {
+			addr = "10.0.0.2:1000"
+		}
+		ctx.BindState(state, time.Minute, ScopeKeys("svc", addr))
+		if err := v.Mutate(ctx); err != nil {
+			t.Fatalf("Mutate() error = %v", err)
+		}
+		if got := ctx.GetFlag(DropFlag); got != want {
+			t.Errorf("connection %d dropped = %v, want %v", i, got, want)
+		}
+		clock.Advance(time.Second)
+	}
+}
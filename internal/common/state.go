@@ -0,0 +1,198 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of the counters and the flags. Connection scope is the proxy context itself,
+// the wider ones are kept in the shared state and expire after the TTL without updates.
+const (
+	ScopeConn    = "conn"
+	ScopeIP      = "ip"
+	ScopeSession = "session"
+	ScopeService = "service"
+	ScopeGlobal  = "global"
+)
+
+const (
+	// DefaultStateTTL is how long the scoped counter or flag lives after its last update.
+	DefaultStateTTL = time.Minute * 10
+	// MaxStateKeys limits the number of the scoped counters and flags, new ones are ignored above it.
+	MaxStateKeys = 1 << 20
+)
+
+var ErrInvalidScope = errors.New("invalid scope")
+
+var scopes = []string{ScopeConn, ScopeIP, ScopeSession, ScopeService, ScopeGlobal}
+
+// IsScope reports whether the name is the known scope.
+func IsScope(name string) bool {
+	for _, s := range scopes {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScoped splits the optional scope from the name, like "ip::hits".
+// The first token is the scope only if it's a known one, otherwise it's a part of the name,
+// so the names containing the separator are kept as they were.
+// Connection scope, the default one, is returned empty.
+func ParseScoped(tokens []string) (scope, name string, err error) {
+	if len(tokens) == 0 {
+		return "", "", fmt.Errorf("%w: name missing", ErrInvalidScope)
+	}
+	if len(tokens) > 1 && IsScope(strings.ToLower(tokens[0])) {
+		scope = strings.ToLower(tokens[0])
+		tokens = tokens[1:]
+	}
+	if scope == ScopeConn {
+		scope = ""
+	}
+	return scope, strings.Join(tokens, "::"), nil
+}
+
+// ScopedName describes the name in the scope, the connection scope is omitted.
+func ScopedName(scope, name string) string {
+	if scope == ScopeConn || scope == "" {
+		return name
+	}
+	return scope + "::" + name
+}
+
+// ScopeKeys identifies the client of the service in the shared scopes.
+// Client IP scope is kept per service, session scope is added once the session is known.
+func ScopeKeys(service, clientAddr string) map[string]string {
+	ip := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		ip = host
+	}
+	return map[string]string{
+		ScopeIP:      service + "/" + ip,
+		ScopeService: service,
+		ScopeGlobal:  "",
+	}
+}
+
+// NewServiceContext creates the context of the service client, bound to the shared state.
+func NewServiceContext(cfg *ServiceConfig, clientAddr string) *ProxyContext {
+	ctx := NewProxyContext()
+	ctx.BindState(SharedState, cfg.GetStateTTL(), ScopeKeys(cfg.Name, clientAddr))
+	return ctx
+}
+
+// SharedState keeps the scoped counters and flags of all proxies.
+var SharedState = NewState()
+
+// State keeps the counters and the flags living longer than a connection.
+// Entries expire after their TTL without updates, expired ones are swept on writes.
+type State struct {
+	mu        sync.Mutex
+	counters  map[string]*stateEntry
+	flags     map[string]*stateEntry
+	lastSweep time.Time
+}
+
+type stateEntry struct {
+	value   int
+	expires time.Time
+}
+
+func NewState() *State {
+	return &State{
+		counters:  make(map[string]*stateEntry),
+		flags:     make(map[string]*stateEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add adds the value to the counter, extending its life by ttl, and returns the new value.
+func (s *State) Add(key string, value int, ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	e := s.get(s.counters, key, now)
+	if e == nil {
+		if s.full() {
+			return 0
+		}
+		e = new(stateEntry)
+		s.counters[key] = e
+	}
+	e.value += value
+	e.expires = now.Add(ttl)
+	return e.value
+}
+
+func (s *State) Get(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.get(s.counters, key, time.Now()); e != nil {
+		return e.value
+	}
+	return 0
+}
+
+// SetFlag sets the flag for ttl.
+func (s *State) SetFlag(key string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+	e := s.get(s.flags, key, now)
+	if e == nil {
+		if s.full() {
+			return
+		}
+		e = &stateEntry{value: 1}
+		s.flags[key] = e
+	}
+	e.expires = now.Add(ttl)
+}
+
+func (s *State) GetFlag(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(s.flags, key, time.Now()) != nil
+}
+
+// Len returns the number of the stored counters and flags, including the expired ones not swept yet.
+func (s *State) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.counters) + len(s.flags)
+}
+
+func (s *State) get(entries map[string]*stateEntry, key string, now time.Time) *stateEntry {
+	e, ok := entries[key]
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	return e
+}
+
+func (s *State) full() bool {
+	return len(s.counters)+len(s.flags) >= MaxStateKeys
+}
+
+// sweep removes the expired entries, at most once a second.
+func (s *State) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Second {
+		return
+	}
+	s.lastSweep = now
+	for _, entries := range []map[string]*stateEntry{s.counters, s.flags} {
+		for k, e := range entries {
+			if now.After(e.expires) {
+				delete(entries, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestState_Expiry(t *testing.T) {
+	s := NewState()
+	ttl := time.Millisecond * 50
+
+	if got := s.Add("hits", 2, ttl); got != 2 {
+		t.Errorf("Add() = %d, want 2", got)
+	}
+	s.SetFlag("banned", ttl)
+	if got := s.Get("hits"); got != 2 {
+		t.Errorf("Get() = %d, want 2", got)
+	}
+	if !s.GetFlag("banned") {
+		t.Errorf("GetFlag() = false, want true")
+	}
+	// Counters and flags don't share the names.
+	if s.GetFlag("hits") || s.Get("banned") != 0 {
+		t.Errorf("counter and flag with the same name are mixed up")
+	}
+
+	time.Sleep(ttl * 2)
+	if got := s.Get("hits"); got != 0 {
+		t.Errorf("Get() after ttl = %d, want 0", got)
+	}
+	if s.GetFlag("banned") {
+		t.Errorf("GetFlag() after ttl = true, want false")
+	}
+	if got := s.Add("hits", 1, ttl); got != 1 {
+		t.Errorf("Add() after ttl = %d, want 1", got)
+	}
+
+	s.lastSweep = time.Now().Add(-time.Minute)
+	time.Sleep(ttl * 2)
+	s.SetFlag("other", ttl)
+	if got := s.Len(); got != 1 {
+		t.Errorf("Len() after sweep = %d, want 1", got)
+	}
+}
+
+func TestProxyContext_Scoped(t *testing.T) {
+	state := NewState()
+	newCtx := func(addr string) *ProxyContext {
+		ctx := NewProxyContext()
+		ctx.BindState(state, time.Minute, ScopeKeys("svc", addr))
+		return ctx
+	}
+	first := newCtx("10.0.0.1:1000")
+	second := newCtx("10.0.0.1:1001")
+	other := newCtx("10.0.0.2:1000")
+
+	for _, ctx := range []*ProxyContext{first, second, other} {
+		ctx.AddToScopedCounter("", "hits", 1)
+		ctx.AddToScopedCounter(ScopeIP, "hits", 1)
+		ctx.AddToScopedCounter(ScopeService, "hits", 1)
+		ctx.AddToScopedCounter(ScopeGlobal, "hits", 1)
+		// The session is not known, the counter is ignored.
+		ctx.AddToScopedCounter(ScopeSession, "hits", 1)
+	}
+	tests := []struct {
+		scope string
+		ctx   *ProxyContext
+		want  int
+	}{
+		{ScopeConn, second, 1},
+		{ScopeIP, second, 2},
+		{ScopeIP, other, 1},
+		{ScopeService, other, 3},
+		{ScopeGlobal, first, 3},
+		{ScopeSession, first, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.ctx.GetScopedCounter(tt.scope, "hits"); got != tt.want {
+			t.Errorf("GetScopedCounter(%s) = %d, want %d", tt.scope, got, tt.want)
+		}
+	}
+
+	first.SetScopeKey(ScopeSession, "svc/abc")
+	first.SetScopedFlag(ScopeSession, "admin")
+	second.SetScopeKey(ScopeSession, "svc/abc")
+	if !second.GetScopedFlag(ScopeSession, "admin") {
+		t.Errorf("GetScopedFlag() = false for the same session")
+	}
+	if other.GetScopedFlag(ScopeSession, "admin") {
+		t.Errorf("GetScopedFlag() = true without the session")
+	}
+
+	// Unbound context keeps everything in the connection.
+	local := NewProxyContext()
+	local.AddToScopedCounter(ScopeIP, "hits", 1)
+	if got := local.GetCounter("hits"); got != 1 {
+		t.Errorf("unbound GetCounter() = %d, want 1", got)
+	}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// FilterStats holds the filter counters, safe for concurrent use.
+type FilterStats struct {
+	evaluations atomic.Int64
+	matches     atomic.Int64
+	drops       atomic.Int64
+	errors      atomic.Int64
+	lastMatch   atomic.Int64
+}
+
+type FilterCounters struct {
+	Evaluations int64      `json:"evaluations"`
+	Matches     int64      `json:"matches"`
+	Drops       int64      `json:"drops"`
+	Errors      int64      `json:"errors"`
+	LastMatch   *time.Time `json:"last_match"`
+}
+
+func (s *FilterStats) AddEvaluation() {
+	s.evaluations.Inc()
+}
+
+func (s *FilterStats) AddMatch() {
+	s.matches.Inc()
+	s.lastMatch.Store(time.Now().UnixNano())
+}
+
+func (s *FilterStats) AddDrop() {
+	s.drops.Inc()
+}
+
+func (s *FilterStats) AddError() {
+	s.errors.Inc()
+}
+
+func (s *FilterStats) Dump() FilterCounters {
+	c := FilterCounters{
+		Evaluations: s.evaluations.Load(),
+		Matches:     s.matches.Load(),
+		Drops:       s.drops.Load(),
+		Errors:      s.errors.Load(),
+	}
+	if ts := s.lastMatch.Load(); ts != 0 {
+		t := time.Unix(0, ts)
+		c.LastMatch = &t
+	}
+	return c
+}
+
+func (s *FilterStats) Reset() {
+	s.evaluations.Store(0)
+	s.matches.Store(0)
+	s.drops.Store(0)
+	s.errors.Store(0)
+	s.lastMatch.Store(0)
+}
+
+// ProxyStats holds the proxy counters, safe for concurrent use.
+type ProxyStats struct {
+	connections atomic.Int64
+	requests    atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	dropped     atomic.Int64
+	undecoded   atomic.Int64
+}
+
+type ProxyCounters struct {
+	Connections int64 `json:"connections"`
+	Requests    int64 `json:"requests"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Dropped     int64 `json:"dropped"`
+	// Undecoded are the HTTP bodies the filters saw raw, as their content encoding isn't supported.
+	Undecoded int64 `json:"undecoded"`
+}
+
+func (s *ProxyStats) AddConnection() {
+	s.connections.Inc()
+}
+
+func (s *ProxyStats) AddRequest() {
+	s.requests.Inc()
+}
+
+// AddBytes counts the data received from the client if ingress is set, or sent to the client otherwise.
+func (s *ProxyStats) AddBytes(ingress bool, n int) {
+	if ingress {
+		s.bytesIn.Add(int64(n))
+	} else {
+		s.bytesOut.Add(int64(n))
+	}
+}
+
+func (s *ProxyStats) AddDropped() {
+	s.dropped.Inc()
+}
+
+func (s *ProxyStats) AddUndecoded() {
+	s.undecoded.Inc()
+}
+
+func (s *ProxyStats) Dump() ProxyCounters {
+	return ProxyCounters{
+		Connections: s.connections.Load(),
+		Requests:    s.requests.Load(),
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		Dropped:     s.dropped.Load(),
+		Undecoded:   s.undecoded.Load(),
+	}
+}
+
+func (s *ProxyStats) Reset() {
+	s.connections.Store(0)
+	s.requests.Store(0)
+	s.bytesIn.Store(0)
+	s.bytesOut.Store(0)
+	s.dropped.Store(0)
+	s.undecoded.Store(0)
+}
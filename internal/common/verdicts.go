@@ -1,15 +1,22 @@
 package common
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	DropFlag   = "drop"
 	AcceptFlag = "accept"
+	// ModifiedFlag is set once the payload is rewritten by the verdict.
+	ModifiedFlag = "modified"
 )
 
 type Verdict interface {
@@ -17,12 +24,28 @@ type Verdict interface {
 	fmt.Stringer
 }
 
+// Rewriter is the verdict changing the payload.
+// Its Mutate queues it in the context, the proxy applies it to the payload before forwarding.
+type Rewriter interface {
+	Rewrite(data []byte) []byte
+	// Pending returns the length of the data tail that could be the start of the payload to rewrite,
+	// so the stream proxies hold back only it until the rest arrives.
+	Pending(data []byte) int
+}
+
 func ParseVerdict(desc string) (Verdict, error) {
 	tokens := strings.Split(desc, "::")
 	switch strings.ToLower(tokens[0]) {
 	case "drop":
-		v := VerdictSetFlag{DropFlag}
-		return v, nil
+		if len(tokens) < 2 {
+			v := VerdictSetFlag{DropFlag}
+			return v, nil
+		}
+		mode := strings.ToLower(tokens[1])
+		if !IsDropMode(mode) {
+			return nil, fmt.Errorf("unknown drop mode: %s", tokens[1])
+		}
+		return VerdictDrop{Mode: mode}, nil
 	case "accept":
 		v := VerdictSetFlag{AcceptFlag}
 		return v, nil
@@ -30,20 +53,98 @@ func ParseVerdict(desc string) (Verdict, error) {
 		if len(tokens) < 2 {
 			return nil, errors.New("counter missing for inc verdict")
 		}
-		return VerdictIncrement{Key: tokens[1]}, nil
+		scope, key, err := ParseScoped(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		return VerdictIncrement{Scope: scope, Key: key}, nil
 	case "dec":
 		if len(tokens) < 2 {
 			return nil, errors.New("counter missing for dec verdict")
 		}
-		return VerdictDecrement{Key: tokens[1]}, nil
+		scope, key, err := ParseScoped(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		return VerdictDecrement{Scope: scope, Key: key}, nil
+	case "flag":
+		if len(tokens) < 2 {
+			return nil, errors.New("flag missing for flag verdict")
+		}
+		scope, key, err := ParseScoped(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		return VerdictScopedFlag{Scope: scope, Key: key}, nil
 	case "alert":
 		if len(tokens) < 2 {
 			return nil, errors.New("reason missing for alert verdict")
 		}
 		v := VerdictAlert{
+			Reason: tokens[1],
 			Logger: logrus.WithField("reason", tokens[1]),
 		}
 		return v, nil
+	case "replace":
+		// The replacement may contain the separator itself.
+		parts := strings.SplitN(desc, "::", 3)
+		if len(parts) < 3 {
+			return nil, errors.New("pattern and replacement missing for replace verdict")
+		}
+		pattern, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace pattern: %w", err)
+		}
+		return VerdictReplace{Pattern: pattern, Replacement: []byte(parts[2])}, nil
+	case "replace_bytes":
+		if len(tokens) != 3 {
+			return nil, errors.New("old and new bytes missing for replace_bytes verdict")
+		}
+		old, err := decodeHex(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid old bytes: %w", err)
+		}
+		if len(old) == 0 {
+			return nil, errors.New("empty old bytes for replace_bytes verdict")
+		}
+		replacement, err := decodeHex(tokens[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid new bytes: %w", err)
+		}
+		return VerdictReplaceBytes{Old: old, New: replacement}, nil
+	case "delay":
+		if len(tokens) != 2 {
+			return nil, errors.New("duration missing for delay verdict")
+		}
+		d, err := time.ParseDuration(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing delay: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid delay: %v", d)
+		}
+		return VerdictDelay{Duration: d}, nil
+	case "ratelimit":
+		v, err := ParseRateLimit(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		if v.Key.Name != "" {
+			return nil, fmt.Errorf("%w: %s is supported only for http", ErrInvalidRateKey, v.Key.Source)
+		}
+		return v, nil
+	case "tarpit":
+		if len(tokens) != 2 {
+			return nil, errors.New("rate missing for tarpit verdict")
+		}
+		rate, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing tarpit rate: %w", err)
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("invalid tarpit rate: %d", rate)
+		}
+		return VerdictTarpit{Rate: rate}, nil
 	default:
 		return nil, fmt.Errorf("unknown verdict: %s", tokens[0])
 	}
@@ -62,41 +163,218 @@ func (v VerdictSetFlag) String() string {
 	return fmt.Sprintf("set '%s'", v.Key)
 }
 
+// VerdictDrop drops the connection in the given mode instead of the service one.
+type VerdictDrop struct {
+	Mode string
+}
+
+func (v VerdictDrop) Mutate(ctx *ProxyContext) error {
+	ctx.SetValue(DropModeKey, v.Mode)
+	ctx.SetFlag(DropFlag)
+	return nil
+}
+
+func (v VerdictDrop) String() string {
+	return fmt.Sprintf("set 'drop' (%s)", v.Mode)
+}
+
+// VerdictScopedFlag sets the flag in the scope, for the flag rules to match.
+type VerdictScopedFlag struct {
+	Scope string
+	Key   string
+}
+
+func (v VerdictScopedFlag) Mutate(ctx *ProxyContext) error {
+	ctx.SetScopedFlag(v.Scope, v.Key)
+	return nil
+}
+
+func (v VerdictScopedFlag) String() string {
+	return fmt.Sprintf("flag '%s'", ScopedName(v.Scope, v.Key))
+}
+
 type VerdictIncrement struct {
-	Key string
+	Scope string
+	Key   string
 }
 
 func (v VerdictIncrement) Mutate(ctx *ProxyContext) error {
-	ctx.AddToCounter(v.Key, 1)
+	ctx.AddToScopedCounter(v.Scope, v.Key, 1)
 	return nil
 }
 
 func (v VerdictIncrement) String() string {
-	return fmt.Sprintf("inc '%s'", v.Key)
+	return fmt.Sprintf("inc '%s'", ScopedName(v.Scope, v.Key))
 }
 
 type VerdictDecrement struct {
-	Key string
+	Scope string
+	Key   string
 }
 
 func (v VerdictDecrement) Mutate(ctx *ProxyContext) error {
-	ctx.AddToCounter(v.Key, -1)
+	ctx.AddToScopedCounter(v.Scope, v.Key, -1)
 	return nil
 }
 
 func (v VerdictDecrement) String() string {
-	return fmt.Sprintf("dec '%s'", v.Key)
+	return fmt.Sprintf("dec '%s'", ScopedName(v.Scope, v.Key))
 }
 
 type VerdictAlert struct {
+	Reason string
 	Logger *logrus.Entry
 }
 
 func (v VerdictAlert) Mutate(ctx *ProxyContext) error {
 	v.Logger.WithFields(ctx.DumpFields()).Warningf("Alert triggered")
+	ctx.AddAlert(v.Reason)
 	return nil
 }
 
 func (v VerdictAlert) String() string {
 	return "alert"
 }
+
+// VerdictReplace replaces the pattern matches in the payload, the replacement can refer to the groups as $1.
+type VerdictReplace struct {
+	Pattern     *regexp.Regexp
+	Replacement []byte
+}
+
+func (v VerdictReplace) Mutate(ctx *ProxyContext) error {
+	ctx.AddRewrite(v)
+	return nil
+}
+
+func (v VerdictReplace) Rewrite(data []byte) []byte {
+	return v.Pattern.ReplaceAll(data, v.Replacement)
+}
+
+// Pending holds back from the literal prefix of the pattern, all the data if the pattern has none.
+func (v VerdictReplace) Pending(data []byte) int {
+	prefix, complete := v.Pattern.LiteralPrefix()
+	if prefix == "" {
+		return len(data)
+	}
+	n := partialPrefix(data, []byte(prefix))
+	if !complete {
+		// The match started by the whole prefix may still go on.
+		if i := bytes.Index(data, []byte(prefix)); i >= 0 && len(data)-i > n {
+			n = len(data) - i
+		}
+	}
+	return n
+}
+
+func (v VerdictReplace) String() string {
+	return fmt.Sprintf("replace '%s' with '%s'", v.Pattern, v.Replacement)
+}
+
+type VerdictReplaceBytes struct {
+	Old []byte
+	New []byte
+}
+
+func (v VerdictReplaceBytes) Mutate(ctx *ProxyContext) error {
+	ctx.AddRewrite(v)
+	return nil
+}
+
+func (v VerdictReplaceBytes) Rewrite(data []byte) []byte {
+	return bytes.ReplaceAll(data, v.Old, v.New)
+}
+
+func (v VerdictReplaceBytes) Pending(data []byte) int {
+	return partialPrefix(data, v.Old)
+}
+
+// partialPrefix returns the length of the longest data suffix which is the proper prefix of the payload.
+func partialPrefix(data, payload []byte) int {
+	n := len(payload) - 1
+	if n > len(data) {
+		n = len(data)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasSuffix(data, payload[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+func (v VerdictReplaceBytes) String() string {
+	return fmt.Sprintf("replace bytes %x with %x", v.Old, v.New)
+}
+
+// VerdictDelay pauses the data before it's forwarded.
+type VerdictDelay struct {
+	Duration time.Duration
+}
+
+func (v VerdictDelay) Mutate(ctx *ProxyContext) error {
+	ctx.AddDelay(v.Duration)
+	return nil
+}
+
+func (v VerdictDelay) String() string {
+	return fmt.Sprintf("delay %v", v.Duration)
+}
+
+// VerdictTarpit limits the rate of the rest of the connection, in bytes per second.
+type VerdictTarpit struct {
+	Rate int
+}
+
+func (v VerdictTarpit) Mutate(ctx *ProxyContext) error {
+	ctx.SetTarpit(v.Rate)
+	return nil
+}
+
+func (v VerdictTarpit) String() string {
+	return fmt.Sprintf("tarpit %d B/s", v.Rate)
+}
+
+// VerdictRateLimit drops the connections over the rate limit, each connection is counted once.
+type VerdictRateLimit struct {
+	Key     RateKey
+	Limiter *RateLimiter
+}
+
+// ParseRateLimit parses the key, the limit and the window of the ratelimit verdict, like "ip::10::1m".
+func ParseRateLimit(tokens []string) (VerdictRateLimit, error) {
+	if len(tokens) != 3 {
+		return VerdictRateLimit{}, errors.New("key, limit and window missing for ratelimit verdict")
+	}
+	key, err := ParseRateKey(tokens[0])
+	if err != nil {
+		return VerdictRateLimit{}, err
+	}
+	limit, window, err := ParseRate(tokens[1], tokens[2])
+	if err != nil {
+		return VerdictRateLimit{}, err
+	}
+	return VerdictRateLimit{Key: key, Limiter: NewRateLimiter(limit, window)}, nil
+}
+
+func (v VerdictRateLimit) Mutate(ctx *ProxyContext) error {
+	return v.Apply(ctx, "")
+}
+
+// Apply counts the connection by the key value, see RateKey.Resolve.
+func (v VerdictRateLimit) Apply(ctx *ProxyContext, value string) error {
+	key, ok := v.Key.Resolve(ctx, value)
+	if ok && v.Limiter.HitOnce(ctx, key) {
+		ctx.SetFlag(DropFlag)
+	}
+	return nil
+}
+
+func (v VerdictRateLimit) String() string {
+	return fmt.Sprintf("ratelimit %d per %v by %s", v.Limiter.Limit, v.Limiter.Window, v.Key)
+}
+
+// decodeHex decodes the hex string, spaces between the bytes are allowed.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+}
@@ -3,7 +3,9 @@ package common
 import (
 	"github.com/sirupsen/logrus"
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 )
 
 func TestParseVerdict(t *testing.T) {
@@ -20,7 +22,8 @@ func TestParseVerdict(t *testing.T) {
 			"alert",
 			args{"alert::some message"},
 			VerdictAlert{
-				logrus.WithField("reason", "some message"),
+				Reason: "some message",
+				Logger: logrus.WithField("reason", "some message"),
 			},
 			false,
 		},
@@ -36,6 +39,36 @@ func TestParseVerdict(t *testing.T) {
 			VerdictIncrement{Key: "test something"},
 			false,
 		},
+		{
+			"scoped increment",
+			args{"inc::ip::hits"},
+			VerdictIncrement{Scope: ScopeIP, Key: "hits"},
+			false,
+		},
+		{
+			"increment with separator",
+			args{"inc::user::hits"},
+			VerdictIncrement{Key: "user::hits"},
+			false,
+		},
+		{
+			"scoped increment with separator",
+			args{"inc::ip::user::hits"},
+			VerdictIncrement{Scope: ScopeIP, Key: "user::hits"},
+			false,
+		},
+		{
+			"scoped flag",
+			args{"flag::session::admin"},
+			VerdictScopedFlag{Scope: ScopeSession, Key: "admin"},
+			false,
+		},
+		{
+			"connection flag",
+			args{"flag::conn::seen"},
+			VerdictScopedFlag{Key: "seen"},
+			false,
+		},
 		{
 			"decrement",
 			args{"dec::test"},
@@ -60,6 +93,84 @@ func TestParseVerdict(t *testing.T) {
 			VerdictSetFlag{Key: DropFlag},
 			false,
 		},
+		{
+			"delay",
+			args{"delay::1500ms"},
+			VerdictDelay{Duration: 1500 * time.Millisecond},
+			false,
+		},
+		{
+			"invalid delay",
+			args{"delay::-1s"},
+			nil,
+			true,
+		},
+		{
+			"tarpit",
+			args{"tarpit::100"},
+			VerdictTarpit{Rate: 100},
+			false,
+		},
+		{
+			"tarpit without rate",
+			args{"tarpit"},
+			nil,
+			true,
+		},
+		{
+			"drop with mode",
+			args{"drop::rst"},
+			VerdictDrop{Mode: DropModeRST},
+			false,
+		},
+		{
+			"drop with unknown mode",
+			args{"drop::nothing"},
+			nil,
+			true,
+		},
+		{
+			"replace",
+			args{`replace::flag\{\w+\}::a::b`},
+			VerdictReplace{Pattern: regexp.MustCompile(`flag\{\w+\}`), Replacement: []byte("a::b")},
+			false,
+		},
+		{
+			"replace with empty replacement",
+			args{"replace::flag::"},
+			VerdictReplace{Pattern: regexp.MustCompile("flag"), Replacement: []byte{}},
+			false,
+		},
+		{
+			"replace without replacement",
+			args{"replace::flag"},
+			nil,
+			true,
+		},
+		{
+			"replace with invalid pattern",
+			args{"replace::(::x"},
+			nil,
+			true,
+		},
+		{
+			"replace bytes",
+			args{"replace_bytes::de ad::00"},
+			VerdictReplaceBytes{Old: []byte{0xde, 0xad}, New: []byte{0}},
+			false,
+		},
+		{
+			"replace bytes with invalid hex",
+			args{"replace_bytes::dx::00"},
+			nil,
+			true,
+		},
+		{
+			"replace empty bytes",
+			args{"replace_bytes::::00"},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -98,11 +209,15 @@ func TestVerdictAlert_Mutate(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			v := &VerdictAlert{
+				Reason: "reason",
 				Logger: tt.fields.Logger,
 			}
 			if err := v.Mutate(tt.args.ctx); (err != nil) != tt.wantErr {
 				t.Errorf("Mutate() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if got := tt.args.ctx.TakeAlerts(); !reflect.DeepEqual(got, []string{"reason"}) {
+				t.Errorf("Mutate() alerts = %v", got)
+			}
 		})
 	}
 }
@@ -214,3 +329,89 @@ func TestVerdictSetFlag_Mutate(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyContext_Rewrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		verdicts     []Verdict
+		data         string
+		want         string
+		wantModified bool
+	}{
+		{
+			"no rewrites",
+			nil,
+			"flag{abc}",
+			"flag{abc}",
+			false,
+		},
+		{
+			"longer replacement",
+			[]Verdict{VerdictReplace{Pattern: regexp.MustCompile(`flag\{(\w+)\}`), Replacement: []byte("[$1 redacted]")}},
+			"x flag{abc} y flag{de}",
+			"x [abc redacted] y [de redacted]",
+			true,
+		},
+		{
+			"in order",
+			[]Verdict{
+				VerdictReplaceBytes{Old: []byte("ab"), New: []byte("c")},
+				VerdictReplaceBytes{Old: []byte("cc"), New: nil},
+			},
+			"abcd",
+			"d",
+			true,
+		},
+		{
+			"nothing replaced",
+			[]Verdict{VerdictReplaceBytes{Old: []byte("z"), New: []byte("y")}},
+			"abcd",
+			"abcd",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewProxyContext()
+			for _, v := range tt.verdicts {
+				if err := v.Mutate(ctx); err != nil {
+					t.Fatalf("Mutate() error = %v", err)
+				}
+			}
+			if got := ctx.Rewrite([]byte(tt.data)); string(got) != tt.want {
+				t.Errorf("Rewrite() = %q, want %q", got, tt.want)
+			}
+			if got := ctx.GetFlag(ModifiedFlag); got != tt.wantModified {
+				t.Errorf("Rewrite() modified = %v, want %v", got, tt.wantModified)
+			}
+			if got := ctx.Rewrite([]byte(tt.data)); string(got) != tt.data {
+				t.Errorf("Rewrite() applied twice: %q", got)
+			}
+		})
+	}
+}
+
+func TestRewriter_Pending(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewriter Rewriter
+		data     string
+		want     int
+	}{
+		{"bytes prefix", VerdictReplaceBytes{Old: []byte("kek")}, "hello ke", 2},
+		{"bytes no prefix", VerdictReplaceBytes{Old: []byte("kek")}, "hello world", 0},
+		{"bytes whole payload", VerdictReplaceBytes{Old: []byte("kek")}, "hello kek", 1},
+		{"regex prefix", VerdictReplace{Pattern: regexp.MustCompile(`flag\{\w+\}`)}, "a fl", 2},
+		{"regex started", VerdictReplace{Pattern: regexp.MustCompile(`flag\{\w+\}`)}, "a flag{ab", 7},
+		{"regex no prefix", VerdictReplace{Pattern: regexp.MustCompile(`flag\{\w+\}`)}, "a tail", 0},
+		{"regex literal", VerdictReplace{Pattern: regexp.MustCompile(`kek`)}, "a kek", 1},
+		{"regex without literal prefix", VerdictReplace{Pattern: regexp.MustCompile(`\d+`)}, "a tail", 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rewriter.Pending([]byte(tt.data)); got != tt.want {
+				t.Errorf("Pending() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package dryrun
+
+import (
+	"fmt"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http"
+	"goxy/internal/proxy/tcp"
+	"goxy/internal/proxy/udp"
+	"net"
+
+	httpfilters "goxy/internal/proxy/http/filters"
+	tcpfilters "goxy/internal/proxy/tcp/filters"
+)
+
+const (
+	DefaultMaxSamples    = 3
+	DefaultMaxSampleSize = 512
+)
+
+type Options struct {
+	// Service runs all records through the single service instead of matching them.
+	Service       string
+	MaxSamples    int
+	MaxSampleSize int
+}
+
+type Sample struct {
+	Session string `json:"session"`
+	Ingress bool   `json:"ingress"`
+	Payload string `json:"payload"`
+}
+
+type FilterReport struct {
+	Rule     string   `json:"rule"`
+	Verdict  string   `json:"verdict"`
+	Shadow   bool     `json:"shadow"`
+	Matches  int      `json:"matches"`
+	Sessions int      `json:"sessions"`
+	Samples  []Sample `json:"samples"`
+}
+
+type ServiceReport struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Sessions int    `json:"sessions"`
+	Dropped  int    `json:"dropped"`
+	Errors   int    `json:"errors"`
+	// Verdicts counts the applied verdicts, shadow matches are not included.
+	Verdicts map[string]int `json:"verdicts"`
+	Filters  []FilterReport `json:"filters"`
+}
+
+type Report struct {
+	Sessions  int `json:"sessions"`
+	Unmatched int `json:"unmatched"`
+	// Rules aggregates the matches of all services by rule name.
+	Rules    map[string]int  `json:"rules"`
+	Services []ServiceReport `json:"services"`
+}
+
+type service struct {
+	cfg    common.ServiceConfig
+	tcp    []tcpfilters.Filter
+	http   []httpfilters.Filter
+	report *ServiceReport
+	ports  []string
+	opts   Options
+
+	// index maps the filter pointer to its position in the chain and in the report.
+	index map[interface{}]int
+}
+
+// Run evaluates the filter chains of the services over the recorded sessions without any network I/O.
+// Sessions are assigned to the service with the same name, then to the one with the same
+// listen or target port. Sessions not assigned to any service are only counted.
+func Run(cfg *common.ProxyConfig, records []*capture.Record, opts Options) (*Report, error) {
+	if opts.MaxSamples == 0 {
+		opts.MaxSamples = DefaultMaxSamples
+	}
+	if opts.MaxSampleSize == 0 {
+		opts.MaxSampleSize = DefaultMaxSampleSize
+	}
+
+	services, err := newServices(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Rules:    make(map[string]int),
+		Services: make([]ServiceReport, 0, len(services)),
+	}
+	for _, rec := range records {
+		report.Sessions += 1
+		s := findService(services, rec)
+		if s == nil {
+			report.Unmatched += 1
+			continue
+		}
+		s.evaluate(rec)
+	}
+
+	for _, s := range services {
+		for _, f := range s.report.Filters {
+			report.Rules[f.Rule] += f.Matches
+		}
+		report.Services = append(report.Services, *s.report)
+	}
+	return report, nil
+}
+
+func newServices(cfg *common.ProxyConfig, opts Options) ([]*service, error) {
+	tcpRuleSet, err := tcpfilters.NewRuleSet(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("creating tcp ruleset: %w", err)
+	}
+	httpRuleSet, err := httpfilters.NewRuleSet(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("creating http ruleset: %w", err)
+	}
+	udpRuleSet, err := tcpfilters.NewRuleSetFor("udp", cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("creating udp ruleset: %w", err)
+	}
+
+	services := make([]*service, 0, len(cfg.Services))
+	for _, sc := range cfg.Services {
+		if opts.Service != "" && sc.Name != opts.Service {
+			continue
+		}
+		s := &service{
+			cfg:  sc,
+			opts: opts,
+			report: &ServiceReport{
+				Name:     sc.Name,
+				Type:     sc.Type,
+				Verdicts: make(map[string]int),
+				Filters:  make([]FilterReport, 0, len(sc.Filters)),
+			},
+			ports: []string{port(sc.Listen), port(sc.Target)},
+			index: make(map[interface{}]int),
+		}
+		switch sc.Type {
+		case "tcp", "udp":
+			rs := tcpRuleSet
+			if sc.Type == "udp" {
+				rs = udpRuleSet
+			}
+			if s.tcp, err = tcpfilters.NewFilters(sc.Filters, rs); err != nil {
+				return nil, fmt.Errorf("creating filters for %s: %w", sc.Name, err)
+			}
+			for i := range s.tcp {
+				s.index[&s.tcp[i]] = i
+				s.report.Filters = append(s.report.Filters, newFilterReport(s.tcp[i].Name, s.tcp[i].Verdict, sc.Shadow || s.tcp[i].GetShadow()))
+			}
+		case "http":
+			if s.http, err = httpfilters.NewFilters(sc.Filters, httpRuleSet); err != nil {
+				return nil, fmt.Errorf("creating filters for %s: %w", sc.Name, err)
+			}
+			for i := range s.http {
+				s.index[&s.http[i]] = i
+				s.report.Filters = append(s.report.Filters, newFilterReport(s.http[i].Name, s.http[i].Verdict, sc.Shadow || s.http[i].GetShadow()))
+			}
+		default:
+			return nil, fmt.Errorf("invalid proxy type: %s", sc.Type)
+		}
+		services = append(services, s)
+	}
+	if opts.Service != "" && len(services) == 0 {
+		return nil, fmt.Errorf("no such service: %s", opts.Service)
+	}
+	return services, nil
+}
+
+func newFilterReport(rule string, v common.Verdict, shadow bool) FilterReport {
+	return FilterReport{
+		Rule:    rule,
+		Verdict: v.String(),
+		Shadow:  shadow,
+		Samples: make([]Sample, 0),
+	}
+}
+
+func findService(services []*service, rec *capture.Record) *service {
+	if len(services) == 1 && services[0].opts.Service != "" {
+		return services[0]
+	}
+	for _, s := range services {
+		if s.cfg.Name == rec.Service {
+			return s
+		}
+	}
+	p := port(rec.TargetAddr)
+	if p == "" {
+		return nil
+	}
+	for _, s := range services {
+		for _, sp := range s.ports {
+			if sp == p {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func port(addr string) string {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+func (s *service) evaluate(rec *capture.Record) {
+	s.report.Sessions += 1
+
+	fired := make(map[int]bool)
+	match := func(f interface{}, ingress, shadow bool, payload []byte) {
+		idx := s.index[f]
+		fr := &s.report.Filters[idx]
+		fr.Matches += 1
+		if !shadow {
+			s.report.Verdicts[fr.Verdict] += 1
+		}
+		if !fired[idx] {
+			fired[idx] = true
+			fr.Sessions += 1
+			if len(fr.Samples) < s.opts.MaxSamples {
+				if len(payload) > s.opts.MaxSampleSize {
+					payload = payload[:s.opts.MaxSampleSize]
+				}
+				fr.Samples = append(fr.Samples, Sample{
+					Session: rec.ID,
+					Ingress: ingress,
+					Payload: string(payload),
+				})
+			}
+		}
+	}
+
+	var (
+		dropped bool
+		err     error
+	)
+	switch s.cfg.Type {
+	case "tcp":
+		var pctx *common.ProxyContext
+		pctx, err = tcp.Evaluate(s.cfg, s.tcp, rec.Chunks, func(f *tcpfilters.Filter, ingress, shadow bool, buf []byte) {
+			match(f, ingress, shadow, buf)
+		})
+		dropped = pctx.GetFlag(common.DropFlag)
+	case "udp":
+		var pctx *common.ProxyContext
+		pctx, err = udp.Evaluate(s.cfg, s.tcp, rec.Chunks, func(f *tcpfilters.Filter, ingress, shadow bool, buf []byte) {
+			match(f, ingress, shadow, buf)
+		})
+		dropped = pctx.GetFlag(common.DropFlag)
+	case "http":
+		var contexts []*common.ProxyContext
+		contexts, err = http.Evaluate(s.cfg, s.http, rec.Chunks, func(f *httpfilters.Filter, ingress, shadow bool, raw []byte) {
+			match(f, ingress, shadow, raw)
+		})
+		for _, pctx := range contexts {
+			dropped = dropped || pctx.GetFlag(common.DropFlag)
+		}
+	}
+	if err != nil {
+		s.report.Errors += 1
+	}
+	if dropped {
+		s.report.Dropped += 1
+	}
+}
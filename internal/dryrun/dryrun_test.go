@@ -0,0 +1,105 @@
+package dryrun
+
+import (
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"testing"
+)
+
+func testConfig() *common.ProxyConfig {
+	return &common.ProxyConfig{
+		Rules: []common.RuleConfig{
+			{Name: "tcp_attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+			{Name: "http_attack", Type: "http::ingress::body::contains", Args: []string{"attack"}},
+		},
+		Services: []common.ServiceConfig{
+			{
+				Name:         "tcp service",
+				Type:         "tcp",
+				Listen:       "0.0.0.0:1337",
+				Target:       "127.0.0.1:1338",
+				StreamWindow: 16,
+				Filters: []common.FilterConfig{
+					{Rule: "tcp_attack", Verdict: "drop"},
+				},
+			},
+			{
+				Name:   "http service",
+				Type:   "http",
+				Listen: "0.0.0.0:8080",
+				Target: "127.0.0.1:8081",
+				Filters: []common.FilterConfig{
+					{Rule: "http_attack", Verdict: "alert::attack"},
+				},
+			},
+		},
+	}
+}
+
+func session(id, service, target string, chunks ...capture.Chunk) *capture.Record {
+	return &capture.Record{ID: id, Service: service, TargetAddr: target, Chunks: chunks}
+}
+
+func chunk(ingress bool, data string) capture.Chunk {
+	return capture.Chunk{Ingress: ingress, Data: []byte(data)}
+}
+
+func TestRun(t *testing.T) {
+	records := []*capture.Record{
+		session("1", "tcp service", "", chunk(true, "hello"), chunk(false, "attack")),
+		// Payload split between chunks, matched by the stream window.
+		session("2", "", "10.0.0.1:1337", chunk(true, "att"), chunk(true, "ack"), chunk(true, "attack")),
+		session(
+			"3", "http service", "",
+			chunk(true, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\nattack"),
+			chunk(false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+			chunk(true, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\nattack"),
+			chunk(false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+		),
+		session("4", "", "10.0.0.1:22", chunk(true, "attack")),
+	}
+
+	report, err := Run(testConfig(), records, Options{})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Sessions != 4 || report.Unmatched != 1 {
+		t.Errorf("Run() sessions = %d, unmatched = %d, want 4, 1", report.Sessions, report.Unmatched)
+	}
+
+	tcpReport := report.Services[0]
+	if tcpReport.Sessions != 2 || tcpReport.Dropped != 1 {
+		t.Errorf("Run() tcp sessions = %d, dropped = %d, want 2, 1", tcpReport.Sessions, tcpReport.Dropped)
+	}
+	if f := tcpReport.Filters[0]; f.Matches != 1 || len(f.Samples) != 1 || f.Samples[0].Payload != "attack" {
+		t.Errorf("Run() tcp filter report = %+v", f)
+	}
+
+	httpReport := report.Services[1]
+	if f := httpReport.Filters[0]; f.Matches != 2 || f.Sessions != 1 || f.Verdict != "alert" {
+		t.Errorf("Run() http filter report = %+v", f)
+	}
+	if httpReport.Dropped != 0 || httpReport.Verdicts["alert"] != 2 {
+		t.Errorf("Run() http report = %+v", httpReport)
+	}
+	if report.Rules["tcp_attack"] != 1 || report.Rules["http_attack"] != 2 {
+		t.Errorf("Run() rules = %v", report.Rules)
+	}
+}
+
+func TestRun_Service(t *testing.T) {
+	records := []*capture.Record{
+		session("1", "http service", "", chunk(true, "attack")),
+	}
+	report, err := Run(testConfig(), records, Options{Service: "tcp service"})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(report.Services) != 1 || report.Services[0].Filters[0].Matches != 1 {
+		t.Errorf("Run() report = %+v", report)
+	}
+
+	if _, err := Run(testConfig(), records, Options{Service: "nope"}); err == nil {
+		t.Errorf("Run() unknown service accepted")
+	}
+}
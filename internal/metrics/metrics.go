@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "goxy"
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled by the http proxies, by response status code.",
+		},
+		[]string{"service", "code"},
+	)
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to handle the request by the http proxy, including the upstream request.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"service"},
+	)
+
+	UpstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_errors_total",
+			Help:      "Failed connections and requests to the proxy targets.",
+		},
+		[]string{"service"},
+	)
+)
+
+// Collectors returns the metrics updated by the proxies directly.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		HTTPRequests,
+		HTTPRequestDuration,
+		UpstreamErrors,
+	}
+}
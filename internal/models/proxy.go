@@ -5,15 +5,33 @@ import "goxy/internal/common"
 type FilterDescription struct {
 	ID      int    `json:"id"`
 	ProxyID int    `json:"proxy_id"`
+	Name    string `json:"name"`
 	Rule    string `json:"rule"`
 	Verdict string `json:"verdict"`
 	Enabled bool   `json:"enabled"`
 	Alert   bool   `json:"alert"`
+	Shadow  bool   `json:"shadow"`
+
+	Stats common.FilterCounters `json:"stats"`
 }
 
 type ProxyDescription struct {
 	ID                 int                   `json:"id"`
 	Service            *common.ServiceConfig `json:"service"`
 	Listening          bool                  `json:"listening"`
+	Stats              common.ProxyCounters  `json:"stats"`
 	FilterDescriptions []FilterDescription   `json:"filter_descriptions"`
 }
+
+type FilterStats struct {
+	ID    int                   `json:"id"`
+	Rule  string                `json:"rule"`
+	Stats common.FilterCounters `json:"stats"`
+}
+
+type ProxyStats struct {
+	ID      int                  `json:"id"`
+	Name    string               `json:"name"`
+	Stats   common.ProxyCounters `json:"stats"`
+	Filters []FilterStats        `json:"filters"`
+}
@@ -0,0 +1,180 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	protoTCP      = 6
+	protoUDP      = 17
+
+	ethernetHeaderLen = 14
+	ipv4HeaderLen     = 20
+	ipv6HeaderLen     = 40
+	tcpHeaderLen      = 20
+	udpHeaderLen      = 8
+
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagPSH = 0x08
+	flagACK = 0x10
+)
+
+var (
+	clientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	serverMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+type endpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+// parseEndpoint parses host:port address. Hostnames are not resolved,
+// unspecified address is used instead.
+func parseEndpoint(addr string) endpoint {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return endpoint{ip: net.IPv4zero}
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return endpoint{ip: ip, port: uint16(port)}
+}
+
+// normalizeIPs returns both addresses in the same family.
+func normalizeIPs(a, b net.IP) (net.IP, net.IP, bool) {
+	a4, b4 := a.To4(), b.To4()
+	if a4 != nil && b4 != nil {
+		return a4, b4, false
+	}
+	return a.To16(), b.To16(), true
+}
+
+type tcpSegment struct {
+	src, dst   endpoint
+	fromClient bool
+	seq, ack   uint32
+	flags      byte
+	payload    []byte
+}
+
+func (s tcpSegment) serialize() []byte {
+	srcIP, dstIP, v6 := normalizeIPs(s.src.ip, s.dst.ip)
+
+	tcpLen := tcpHeaderLen + len(s.payload)
+	pkt, tcp := ipPacket(srcIP, dstIP, v6, s.fromClient, protoTCP, tcpLen)
+	binary.BigEndian.PutUint16(tcp[0:2], s.src.port)
+	binary.BigEndian.PutUint16(tcp[2:4], s.dst.port)
+	binary.BigEndian.PutUint32(tcp[4:8], s.seq)
+	binary.BigEndian.PutUint32(tcp[8:12], s.ack)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = s.flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[tcpHeaderLen:], s.payload)
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(tcp, pseudoHeaderSum(srcIP, dstIP, protoTCP, tcpLen)))
+
+	return pkt
+}
+
+type udpDatagram struct {
+	src, dst   endpoint
+	fromClient bool
+	payload    []byte
+}
+
+func (d udpDatagram) serialize() []byte {
+	srcIP, dstIP, v6 := normalizeIPs(d.src.ip, d.dst.ip)
+
+	udpLen := udpHeaderLen + len(d.payload)
+	pkt, udp := ipPacket(srcIP, dstIP, v6, d.fromClient, protoUDP, udpLen)
+	binary.BigEndian.PutUint16(udp[0:2], d.src.port)
+	binary.BigEndian.PutUint16(udp[2:4], d.dst.port)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[udpHeaderLen:], d.payload)
+	sum := checksum(udp, pseudoHeaderSum(srcIP, dstIP, protoUDP, udpLen))
+	if sum == 0 {
+		// Zero means no checksum in UDP.
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+
+	return pkt
+}
+
+// ipPacket builds the ethernet frame with the IP header for the transport payload of the given length.
+// Addresses must be normalized, the returned transport slice is to be filled by the caller.
+func ipPacket(srcIP, dstIP net.IP, v6, fromClient bool, proto byte, transportLen int) (pkt, transport []byte) {
+	ipHeaderLen := ipv4HeaderLen
+	etherType := etherTypeIPv4
+	if v6 {
+		ipHeaderLen = ipv6HeaderLen
+		etherType = etherTypeIPv6
+	}
+
+	pkt = make([]byte, ethernetHeaderLen+ipHeaderLen+transportLen)
+
+	srcMAC, dstMAC := clientMAC, serverMAC
+	if !fromClient {
+		srcMAC, dstMAC = serverMAC, clientMAC
+	}
+	copy(pkt[0:6], dstMAC)
+	copy(pkt[6:12], srcMAC)
+	binary.BigEndian.PutUint16(pkt[12:14], uint16(etherType))
+
+	ip := pkt[ethernetHeaderLen : ethernetHeaderLen+ipHeaderLen]
+	if v6 {
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(transportLen))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:24], srcIP)
+		copy(ip[24:40], dstIP)
+	} else {
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipHeaderLen+transportLen))
+		// Don't fragment.
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000)
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:16], srcIP)
+		copy(ip[16:20], dstIP)
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+	}
+
+	return pkt, pkt[ethernetHeaderLen+ipHeaderLen:]
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint32 {
+	var sum uint32
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i+1 < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// checksum calculates the internet checksum of data, initial is the precalculated sum to add.
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,269 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	magicNanoseconds = 0xa1b23c4d
+	magicPcapNG      = 0x0a0d0d0a
+	byteOrderMagic   = 0x1a2b3c4d
+
+	blockInterfaceDescription = 0x00000001
+	blockSimplePacket         = 0x00000003
+	blockEnhancedPacket       = 0x00000006
+
+	optionEnd        = 0
+	optionTSResol    = 9
+	maxBlockSize     = 64 * 1024 * 1024
+	defaultTSResolNs = 1000
+)
+
+var (
+	ErrInvalidFormat = errors.New("invalid pcap file")
+)
+
+// Packet is the single captured frame.
+type Packet struct {
+	Time     time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+// IsPcap reports whether the header starts the pcap or pcapng file.
+func IsPcap(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+	le := binary.LittleEndian.Uint32(header)
+	be := binary.BigEndian.Uint32(header)
+	for _, m := range []uint32{magicMicroseconds, magicNanoseconds} {
+		if le == m || be == m {
+			return true
+		}
+	}
+	return le == magicPcapNG
+}
+
+// ReadPackets reads all packets from the pcap or pcapng file.
+func ReadPackets(r io.Reader) ([]Packet, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading magic: %w", err)
+	}
+	if binary.LittleEndian.Uint32(header) == magicPcapNG {
+		return readPcapNG(br)
+	}
+	return readPcap(br)
+}
+
+func readPcap(r io.Reader) ([]Packet, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading file header: %w", err)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(hdr[0:4])
+	if magic != magicMicroseconds && magic != magicNanoseconds {
+		order = binary.BigEndian
+		magic = order.Uint32(hdr[0:4])
+	}
+	var tsMul int64
+	switch magic {
+	case magicMicroseconds:
+		tsMul = 1000
+	case magicNanoseconds:
+		tsMul = 1
+	default:
+		return nil, ErrInvalidFormat
+	}
+	linkType := order.Uint32(hdr[20:24])
+
+	packets := make([]Packet, 0)
+	pktHdr := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, pktHdr); err != nil {
+			if err == io.EOF {
+				return packets, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				// Capture was interrupted while writing.
+				return packets, nil
+			}
+			return nil, fmt.Errorf("reading packet header: %w", err)
+		}
+		capLen := order.Uint32(pktHdr[8:12])
+		if capLen > maxBlockSize {
+			return nil, ErrInvalidFormat
+		}
+		data := make([]byte, capLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return packets, nil
+			}
+			return nil, fmt.Errorf("reading packet: %w", err)
+		}
+		sec := int64(order.Uint32(pktHdr[0:4]))
+		frac := int64(order.Uint32(pktHdr[4:8]))
+		p := Packet{
+			Time:     time.Unix(sec, frac*tsMul),
+			LinkType: linkType,
+			Data:     data,
+		}
+		packets = append(packets, p)
+	}
+}
+
+type ngInterface struct {
+	linkType uint32
+	tsResol  time.Duration
+}
+
+func readPcapNG(r io.Reader) ([]Packet, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	interfaces := make([]ngInterface, 0)
+	packets := make([]Packet, 0)
+
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return packets, nil
+			}
+			return nil, fmt.Errorf("reading block header: %w", err)
+		}
+
+		blockType := binary.LittleEndian.Uint32(hdr[0:4])
+		if blockType == magicPcapNG {
+			// Section header block, byte order is defined by it.
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return nil, fmt.Errorf("reading byte order magic: %w", err)
+			}
+			if binary.LittleEndian.Uint32(bom) == byteOrderMagic {
+				order = binary.LittleEndian
+			} else if binary.BigEndian.Uint32(bom) == byteOrderMagic {
+				order = binary.BigEndian
+			} else {
+				return nil, ErrInvalidFormat
+			}
+			interfaces = interfaces[:0]
+			length := order.Uint32(hdr[4:8])
+			if length < 16 || length > maxBlockSize {
+				return nil, ErrInvalidFormat
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(length-12)); err != nil {
+				return nil, fmt.Errorf("skipping section header: %w", err)
+			}
+			continue
+		}
+
+		blockType = order.Uint32(hdr[0:4])
+		length := order.Uint32(hdr[4:8])
+		if length < 12 || length > maxBlockSize {
+			return nil, ErrInvalidFormat
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return packets, nil
+			}
+			return nil, fmt.Errorf("reading block: %w", err)
+		}
+		// Trailing block length.
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case blockInterfaceDescription:
+			if len(body) < 8 {
+				return nil, ErrInvalidFormat
+			}
+			iface := ngInterface{
+				linkType: uint32(order.Uint16(body[0:2])),
+				tsResol:  defaultTSResolNs,
+			}
+			parseNGOptions(body[8:], order, func(code uint16, value []byte) {
+				if code == optionTSResol && len(value) > 0 {
+					iface.tsResol = tsResolution(value[0])
+				}
+			})
+			interfaces = append(interfaces, iface)
+
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, ErrInvalidFormat
+			}
+			ifaceID := order.Uint32(body[0:4])
+			if int(ifaceID) >= len(interfaces) {
+				return nil, ErrInvalidFormat
+			}
+			iface := interfaces[ifaceID]
+			ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+			capLen := order.Uint32(body[12:16])
+			if int(capLen) > len(body)-20 {
+				return nil, ErrInvalidFormat
+			}
+			p := Packet{
+				Time:     time.Unix(0, 0).Add(time.Duration(ts) * iface.tsResol),
+				LinkType: iface.linkType,
+				Data:     append([]byte(nil), body[20:20+capLen]...),
+			}
+			packets = append(packets, p)
+
+		case blockSimplePacket:
+			if len(interfaces) == 0 || len(body) < 4 {
+				return nil, ErrInvalidFormat
+			}
+			origLen := order.Uint32(body[0:4])
+			data := body[4:]
+			if int(origLen) < len(data) {
+				data = data[:origLen]
+			}
+			p := Packet{
+				LinkType: interfaces[0].linkType,
+				Data:     append([]byte(nil), data...),
+			}
+			packets = append(packets, p)
+		}
+	}
+}
+
+func parseNGOptions(data []byte, order binary.ByteOrder, f func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code := order.Uint16(data[0:2])
+		length := int(order.Uint16(data[2:4]))
+		if code == optionEnd || 4+length > len(data) {
+			return
+		}
+		f(code, data[4:4+length])
+		padded := (length + 3) &^ 3
+		if 4+padded > len(data) {
+			return
+		}
+		data = data[4+padded:]
+	}
+}
+
+func tsResolution(v byte) time.Duration {
+	exp := int(v & 0x7f)
+	if v&0x80 != 0 {
+		// Negative power of two.
+		if exp >= 30 {
+			return 1
+		}
+		return time.Second / time.Duration(1<<uint(exp))
+	}
+	res := time.Second
+	for i := 0; i < exp && res > 1; i++ {
+		res /= 10
+	}
+	return res
+}
@@ -0,0 +1,164 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goxy/internal/capture"
+	"testing"
+	"time"
+)
+
+func TestReadRecords_RoundTrip(t *testing.T) {
+	now := time.Unix(1600000000, 123000)
+	records := []*capture.Record{
+		{
+			ID:         "first",
+			ClientAddr: "10.0.0.1:40000",
+			TargetAddr: "10.0.0.2:1337",
+			Start:      now,
+			End:        now.Add(time.Second),
+			Chunks: []capture.Chunk{
+				{Time: now, Ingress: true, Data: []byte("ke")},
+				{Time: now, Ingress: true, Data: []byte("k")},
+				{Time: now.Add(time.Millisecond), Ingress: false, Data: bytes.Repeat([]byte("B"), mss+1)},
+			},
+		},
+		{
+			ID:         "second",
+			ClientAddr: "[::1]:40001",
+			TargetAddr: "[::1]:1337",
+			Start:      now.Add(time.Second),
+			End:        now.Add(time.Second * 2),
+			Chunks: []capture.Chunk{
+				{Time: now.Add(time.Second), Ingress: true, Data: []byte("attack")},
+			},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Export(buf, records); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if !IsPcap(buf.Bytes()) {
+		t.Errorf("IsPcap() = false")
+	}
+
+	got, err := ReadRecords(buf)
+	if err != nil {
+		t.Fatalf("ReadRecords() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("ReadRecords() got %d records, want 2", len(got))
+	}
+	if got[0].ClientAddr != "10.0.0.1:40000" || got[0].TargetAddr != "10.0.0.2:1337" {
+		t.Errorf("invalid addresses: %s -> %s", got[0].ClientAddr, got[0].TargetAddr)
+	}
+	if got[1].ClientAddr != "[::1]:40001" {
+		t.Errorf("invalid ipv6 address: %s", got[1].ClientAddr)
+	}
+	if !got[0].Start.Equal(now) {
+		t.Errorf("invalid start time: %v", got[0].Start)
+	}
+
+	// Large egress chunk is split into two segments.
+	if len(got[0].Chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(got[0].Chunks))
+	}
+	if string(got[0].Chunks[0].Data) != "ke" || string(got[0].Chunks[1].Data) != "k" || !got[0].Chunks[1].Ingress {
+		t.Errorf("invalid ingress chunks: %+v", got[0].Chunks[:2])
+	}
+	if got[0].EgressBytes != mss+1 || got[0].Chunks[2].Ingress {
+		t.Errorf("invalid egress chunks")
+	}
+}
+
+func TestReassemble_Retransmission(t *testing.T) {
+	client := endpoint{ip: []byte{10, 0, 0, 1}, port: 40000}
+	server := endpoint{ip: []byte{10, 0, 0, 2}, port: 80}
+	now := time.Now()
+	segments := []tcpSegment{
+		{src: client, dst: server, seq: 100, flags: flagSYN},
+		{src: server, dst: client, seq: 500, ack: 101, flags: flagSYN | flagACK},
+		// Out of order.
+		{src: client, dst: server, seq: 105, flags: flagACK, payload: []byte("efg")},
+		{src: client, dst: server, seq: 101, flags: flagACK, payload: []byte("abc")},
+		// Retransmitted with overlap.
+		{src: client, dst: server, seq: 102, flags: flagACK, payload: []byte("bcdefgh")},
+		{src: client, dst: server, seq: 101, flags: flagACK, payload: []byte("ab")},
+	}
+	packets := make([]Packet, 0, len(segments))
+	for _, s := range segments {
+		packets = append(packets, Packet{Time: now, LinkType: linkTypeEthernet, Data: s.serialize()})
+	}
+
+	records := Reassemble(packets)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	data := make([]byte, 0)
+	for _, c := range records[0].Chunks {
+		data = append(data, c.Data...)
+	}
+	// "d" at seq 104 is missing until the retransmission.
+	if string(data) != "abcdefgh" {
+		t.Errorf("reassembled %q, want %q", data, "abcdefgh")
+	}
+}
+
+func TestReadPackets_PcapNG(t *testing.T) {
+	frame := tcpSegment{
+		src:     endpoint{ip: []byte{10, 0, 0, 1}, port: 40000},
+		dst:     endpoint{ip: []byte{10, 0, 0, 2}, port: 80},
+		seq:     1,
+		flags:   flagPSH | flagACK,
+		payload: []byte("hello"),
+	}.serialize()
+
+	le := binary.LittleEndian
+	block := func(typ uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		b := make([]byte, 8, 12+len(body))
+		le.PutUint32(b[0:4], typ)
+		le.PutUint32(b[4:8], uint32(12+len(body)))
+		b = append(b, body...)
+		b = append(b, b[4:8]...)
+		return b
+	}
+
+	shb := make([]byte, 16)
+	le.PutUint32(shb[0:4], byteOrderMagic)
+	le.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+
+	// Interface with nanosecond resolution.
+	idb := make([]byte, 8)
+	le.PutUint16(idb[0:2], linkTypeEthernet)
+	idb = append(idb, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0)
+
+	ts := uint64(1600000000123456789)
+	epb := make([]byte, 20)
+	le.PutUint32(epb[4:8], uint32(ts>>32))
+	le.PutUint32(epb[8:12], uint32(ts))
+	le.PutUint32(epb[12:16], uint32(len(frame)))
+	le.PutUint32(epb[16:20], uint32(len(frame)))
+	epb = append(epb, frame...)
+
+	file := append(block(magicPcapNG, shb), block(blockInterfaceDescription, idb)...)
+	file = append(file, block(blockEnhancedPacket, epb)...)
+
+	packets, err := ReadPackets(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("ReadPackets() error = %v", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("got %d packets, want 1", len(packets))
+	}
+	if !bytes.Equal(packets[0].Data, frame) {
+		t.Errorf("invalid packet data")
+	}
+	if packets[0].Time.UnixNano() != int64(ts) {
+		t.Errorf("invalid timestamp: %d", packets[0].Time.UnixNano())
+	}
+}
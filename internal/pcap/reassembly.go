@@ -0,0 +1,279 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"goxy/internal/capture"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	linkTypeNull     = 0
+	linkTypeRaw      = 101
+	linkTypeRawAlt   = 12
+	linkTypeLinuxSLL = 113
+	linkTypeSLL2     = 276
+
+	etherTypeVLAN = 0x8100
+	flagRST       = 0x04
+)
+
+type decodedSegment struct {
+	time     time.Time
+	src, dst string
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+// ReadRecords reads the pcap or pcapng file and reassembles TCP connections in it into records.
+// Client of the connection is the side sending SYN, or the first sender if the handshake is not captured.
+func ReadRecords(r io.Reader) ([]*capture.Record, error) {
+	packets, err := ReadPackets(r)
+	if err != nil {
+		return nil, err
+	}
+	return Reassemble(packets), nil
+}
+
+type direction struct {
+	started bool
+	nextSeq uint32
+	pending map[uint32]decodedSegment
+}
+
+type connection struct {
+	rec     *capture.Record
+	client  string
+	closed  bool
+	ingress *direction
+	egress  *direction
+}
+
+func (c *connection) deliver(seg decodedSegment, ingress bool) {
+	d := c.egress
+	if ingress {
+		d = c.ingress
+	}
+
+	if seg.flags&flagSYN != 0 {
+		d.started = true
+		d.nextSeq = seg.seq + 1
+		return
+	}
+	if len(seg.payload) == 0 {
+		return
+	}
+	if !d.started {
+		d.started = true
+		d.nextSeq = seg.seq
+	}
+
+	d.pending[seg.seq] = seg
+	for {
+		progressed := false
+		for seq, s := range d.pending {
+			end := seq + uint32(len(s.payload))
+			if seqLE(end, d.nextSeq) {
+				// Retransmission of the data already delivered.
+				delete(d.pending, seq)
+				continue
+			}
+			if seqLE(seq, d.nextSeq) {
+				data := s.payload[d.nextSeq-seq:]
+				c.rec.Chunks = append(c.rec.Chunks, capture.Chunk{
+					Time:    s.time,
+					Ingress: ingress,
+					Data:    data,
+				})
+				if ingress {
+					c.rec.IngressBytes += len(data)
+				} else {
+					c.rec.EgressBytes += len(data)
+				}
+				d.nextSeq = end
+				delete(d.pending, seq)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+// seqLE compares sequence numbers with wraparound.
+func seqLE(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// Reassemble groups TCP segments of the packets into records, ordered by connection start.
+func Reassemble(packets []Packet) []*capture.Record {
+	active := make(map[string]*connection)
+	conns := make([]*connection, 0)
+
+	for _, p := range packets {
+		seg, ok := decodePacket(p)
+		if !ok {
+			continue
+		}
+		key := connKey(seg.src, seg.dst)
+		c, ok := active[key]
+		isSyn := seg.flags&flagSYN != 0 && seg.flags&flagACK == 0
+		if !ok || (c.closed && isSyn) {
+			client, target := seg.src, seg.dst
+			if seg.flags&flagSYN != 0 && seg.flags&flagACK != 0 {
+				// SYN-ACK is sent by the server.
+				client, target = seg.dst, seg.src
+			}
+			c = &connection{
+				rec: &capture.Record{
+					ID:         fmt.Sprintf("pcap-%d", len(conns)+1),
+					Type:       "tcp",
+					ClientAddr: client,
+					TargetAddr: target,
+					Start:      seg.time,
+					Matches:    make([]capture.Match, 0),
+				},
+				client:  client,
+				ingress: &direction{pending: make(map[uint32]decodedSegment)},
+				egress:  &direction{pending: make(map[uint32]decodedSegment)},
+			}
+			active[key] = c
+			conns = append(conns, c)
+		}
+
+		c.deliver(seg, seg.src == c.client)
+		c.rec.End = seg.time
+		if seg.flags&(flagFIN|flagRST) != 0 {
+			c.closed = true
+		}
+	}
+
+	records := make([]*capture.Record, 0, len(conns))
+	for _, c := range conns {
+		if len(c.rec.Chunks) > 0 {
+			records = append(records, c.rec)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start.Before(records[j].Start)
+	})
+	return records
+}
+
+func connKey(a, b string) string {
+	if a < b {
+		return a + "-" + b
+	}
+	return b + "-" + a
+}
+
+func decodePacket(p Packet) (decodedSegment, bool) {
+	data := p.Data
+	var etherType uint16
+	switch p.LinkType {
+	case linkTypeEthernet:
+		if len(data) < ethernetHeaderLen {
+			return decodedSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[ethernetHeaderLen:]
+		if etherType == etherTypeVLAN {
+			if len(data) < 4 {
+				return decodedSegment{}, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeNull:
+		if len(data) < 4 {
+			return decodedSegment{}, false
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		etherType = etherTypeIPv6
+		if family == 2 {
+			etherType = etherTypeIPv4
+		}
+		data = data[4:]
+	case linkTypeRaw, linkTypeRawAlt:
+		if len(data) < 1 {
+			return decodedSegment{}, false
+		}
+		etherType = etherTypeIPv4
+		if data[0]>>4 == 6 {
+			etherType = etherTypeIPv6
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return decodedSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return decodedSegment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	default:
+		return decodedSegment{}, false
+	}
+
+	var srcIP, dstIP net.IP
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < ipv4HeaderLen || data[9] != protoTCP {
+			return decodedSegment{}, false
+		}
+		// Fragments are not supported.
+		if binary.BigEndian.Uint16(data[6:8])&0x3fff != 0 {
+			return decodedSegment{}, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(data) {
+			return decodedSegment{}, false
+		}
+		srcIP, dstIP = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[ihl:total]
+	case etherTypeIPv6:
+		if len(data) < ipv6HeaderLen || data[6] != protoTCP {
+			return decodedSegment{}, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		if ipv6HeaderLen+payloadLen > len(data) {
+			return decodedSegment{}, false
+		}
+		srcIP, dstIP = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[ipv6HeaderLen : ipv6HeaderLen+payloadLen]
+	default:
+		return decodedSegment{}, false
+	}
+
+	if len(data) < tcpHeaderLen {
+		return decodedSegment{}, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < tcpHeaderLen || offset > len(data) {
+		return decodedSegment{}, false
+	}
+	srcPort := binary.BigEndian.Uint16(data[0:2])
+	dstPort := binary.BigEndian.Uint16(data[2:4])
+	seg := decodedSegment{
+		time:    p.Time,
+		src:     net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort))),
+		dst:     net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort))),
+		seq:     binary.BigEndian.Uint32(data[4:8]),
+		flags:   data[13],
+		payload: append([]byte(nil), data[offset:]...),
+	}
+	return seg, true
+}
@@ -0,0 +1,136 @@
+package pcap
+
+import (
+	"fmt"
+	"goxy/internal/capture"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const fileExt = ".pcap"
+
+// RollingWriter is the capture sink writing records into per-service pcap files,
+// rotated by size. Only the last maxFiles files are kept for each service.
+type RollingWriter struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	files    map[string]*rollingFile
+	mu       *sync.Mutex
+}
+
+type rollingFile struct {
+	file   *os.File
+	writer *Writer
+	size   int64
+}
+
+func (f *rollingFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func NewRollingWriter(dir string, maxSize int64, maxFiles int) (*RollingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating pcap dir: %w", err)
+	}
+	w := &RollingWriter{
+		dir:      dir,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		files:    make(map[string]*rollingFile),
+		mu:       new(sync.Mutex),
+	}
+	return w, nil
+}
+
+func (w *RollingWriter) Write(rec *capture.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := w.getFile(rec.Service)
+	if err != nil {
+		return fmt.Errorf("opening pcap file: %w", err)
+	}
+	if err := f.writer.WriteRecord(rec); err != nil {
+		return fmt.Errorf("writing record: %w", err)
+	}
+
+	if w.maxSize > 0 && f.size >= w.maxSize {
+		if err := f.file.Close(); err != nil {
+			logrus.Errorf("Error closing pcap file: %v", err)
+		}
+		delete(w.files, rec.Service)
+		w.cleanup(rec.Service)
+	}
+	return nil
+}
+
+func (w *RollingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for service, f := range w.files {
+		if err := f.file.Close(); err != nil {
+			return fmt.Errorf("closing pcap file for %s: %w", service, err)
+		}
+		delete(w.files, service)
+	}
+	return nil
+}
+
+func (w *RollingWriter) serviceDir(service string) string {
+	return filepath.Join(w.dir, capture.SafeName(service))
+}
+
+func (w *RollingWriter) getFile(service string) (*rollingFile, error) {
+	if f, ok := w.files[service]; ok {
+		return f, nil
+	}
+	dir := w.serviceDir(service)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating service dir: %w", err)
+	}
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), fileExt)
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("creating file: %w", err)
+	}
+	f := &rollingFile{file: file}
+	if f.writer, err = NewWriter(f); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	w.files[service] = f
+	return f, nil
+}
+
+func (w *RollingWriter) cleanup(service string) {
+	if w.maxFiles <= 0 {
+		return
+	}
+	dir := w.serviceDir(service)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("Error listing pcap dir %s: %v", dir, err)
+		return
+	}
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), fileExt) {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+	// ReadDir returns files sorted by name, i.e. oldest first.
+	for i := 0; i < len(files)-w.maxFiles; i++ {
+		if err := os.Remove(files[i]); err != nil {
+			logrus.Errorf("Error removing pcap file %s: %v", files[i], err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"fmt"
+	"goxy/internal/capture"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+const mss = 1460
+
+type flow struct {
+	w              *Writer
+	client, server endpoint
+	clientSeq      uint32
+	serverSeq      uint32
+}
+
+func (f *flow) send(ts time.Time, fromClient bool, flags byte, payload []byte) error {
+	seg := tcpSegment{
+		src:        f.client,
+		dst:        f.server,
+		fromClient: fromClient,
+		seq:        f.clientSeq,
+		ack:        f.serverSeq,
+		flags:      flags,
+		payload:    payload,
+	}
+	if !fromClient {
+		seg.src, seg.dst = f.server, f.client
+		seg.seq, seg.ack = f.serverSeq, f.clientSeq
+	}
+	if flags&flagACK == 0 {
+		seg.ack = 0
+	}
+
+	if err := f.w.WritePacket(ts, seg.serialize()); err != nil {
+		return err
+	}
+
+	advance := uint32(len(payload))
+	if flags&(flagSYN|flagFIN) != 0 {
+		advance += 1
+	}
+	if fromClient {
+		f.clientSeq += advance
+	} else {
+		f.serverSeq += advance
+	}
+	return nil
+}
+
+// WriteRecord writes the captured record as a synthesized TCP session:
+// three-way handshake, data segments in both directions and connection teardown.
+// UDP records are written as plain datagrams.
+func (w *Writer) WriteRecord(rec *capture.Record) error {
+	if rec.Type == "udp" {
+		return w.writeDatagrams(rec)
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(rec.ID))
+	isn := h.Sum32()
+
+	f := &flow{
+		w:         w,
+		client:    parseEndpoint(rec.ClientAddr),
+		server:    parseEndpoint(rec.TargetAddr),
+		clientSeq: isn,
+		serverSeq: isn ^ 0x5a5a5a5a,
+	}
+
+	handshake := []struct {
+		fromClient bool
+		flags      byte
+	}{
+		{true, flagSYN},
+		{false, flagSYN | flagACK},
+		{true, flagACK},
+	}
+	for _, s := range handshake {
+		if err := f.send(rec.Start, s.fromClient, s.flags, nil); err != nil {
+			return fmt.Errorf("writing handshake: %w", err)
+		}
+	}
+
+	end := rec.End
+	for _, c := range rec.Chunks {
+		for start := 0; start < len(c.Data); start += mss {
+			stop := start + mss
+			if stop > len(c.Data) {
+				stop = len(c.Data)
+			}
+			if err := f.send(c.Time, c.Ingress, flagPSH|flagACK, c.Data[start:stop]); err != nil {
+				return fmt.Errorf("writing data: %w", err)
+			}
+		}
+		if end.Before(c.Time) {
+			end = c.Time
+		}
+	}
+
+	teardown := []struct {
+		fromClient bool
+		flags      byte
+	}{
+		{true, flagFIN | flagACK},
+		{false, flagFIN | flagACK},
+		{true, flagACK},
+	}
+	for _, s := range teardown {
+		if err := f.send(end, s.fromClient, s.flags, nil); err != nil {
+			return fmt.Errorf("writing teardown: %w", err)
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeDatagrams(rec *capture.Record) error {
+	client, server := parseEndpoint(rec.ClientAddr), parseEndpoint(rec.TargetAddr)
+	for _, c := range rec.Chunks {
+		d := udpDatagram{src: client, dst: server, fromClient: c.Ingress, payload: c.Data}
+		if !c.Ingress {
+			d.src, d.dst = server, client
+		}
+		if err := w.WritePacket(c.Time, d.serialize()); err != nil {
+			return fmt.Errorf("writing datagram: %w", err)
+		}
+	}
+	return nil
+}
+
+// Export writes all records into the new pcap file, in the given order.
+func Export(w io.Writer, records []*capture.Record) error {
+	pw, err := NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := pw.WriteRecord(rec); err != nil {
+			return fmt.Errorf("writing record %s: %w", rec.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"goxy/internal/capture"
+	"testing"
+	"time"
+)
+
+type parsedPacket struct {
+	ipv6    bool
+	flags   byte
+	seq     uint32
+	ack     uint32
+	payload []byte
+}
+
+func parsePackets(t *testing.T, data []byte) []parsedPacket {
+	t.Helper()
+
+	if len(data) < 24 || binary.LittleEndian.Uint32(data[0:4]) != magicMicroseconds {
+		t.Fatalf("invalid file header")
+	}
+	if binary.LittleEndian.Uint32(data[20:24]) != linkTypeEthernet {
+		t.Fatalf("invalid link type")
+	}
+	data = data[24:]
+
+	packets := make([]parsedPacket, 0)
+	for len(data) > 0 {
+		if len(data) < 16 {
+			t.Fatalf("truncated packet header")
+		}
+		capLen := binary.LittleEndian.Uint32(data[8:12])
+		pkt := data[16 : 16+capLen]
+		data = data[16+capLen:]
+
+		var p parsedPacket
+		var ip, tcp []byte
+		var pseudo uint32
+		switch binary.BigEndian.Uint16(pkt[12:14]) {
+		case etherTypeIPv4:
+			ip = pkt[ethernetHeaderLen : ethernetHeaderLen+ipv4HeaderLen]
+			if checksum(ip, 0) != 0 {
+				t.Errorf("invalid ipv4 checksum")
+			}
+			tcp = pkt[ethernetHeaderLen+ipv4HeaderLen:]
+			pseudo = pseudoHeaderSum(ip[12:16], ip[16:20], protoTCP, len(tcp))
+		case etherTypeIPv6:
+			p.ipv6 = true
+			ip = pkt[ethernetHeaderLen : ethernetHeaderLen+ipv6HeaderLen]
+			tcp = pkt[ethernetHeaderLen+ipv6HeaderLen:]
+			pseudo = pseudoHeaderSum(ip[8:24], ip[24:40], protoTCP, len(tcp))
+		default:
+			t.Fatalf("invalid ether type")
+		}
+		if checksum(tcp, pseudo) != 0 {
+			t.Errorf("invalid tcp checksum")
+		}
+		p.seq = binary.BigEndian.Uint32(tcp[4:8])
+		p.ack = binary.BigEndian.Uint32(tcp[8:12])
+		p.flags = tcp[13]
+		p.payload = tcp[tcpHeaderLen:]
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func TestWriter_WriteRecord(t *testing.T) {
+	now := time.Now()
+	bigChunk := bytes.Repeat([]byte("A"), mss*2+10)
+	tests := []struct {
+		name   string
+		client string
+		target string
+		ipv6   bool
+	}{
+		{"ipv4", "10.0.0.1:40000", "10.0.0.2:1337", false},
+		{"ipv6", "[fe80::1]:40000", "[fe80::2]:1337", true},
+		{"mixed", "[::1]:40000", "127.0.0.1:1337", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &capture.Record{
+				ID:         "test",
+				ClientAddr: tt.client,
+				TargetAddr: tt.target,
+				Start:      now,
+				End:        now.Add(time.Second),
+				Chunks: []capture.Chunk{
+					{Time: now, Ingress: true, Data: []byte("hello")},
+					{Time: now, Ingress: false, Data: bigChunk},
+				},
+			}
+
+			buf := new(bytes.Buffer)
+			if err := Export(buf, []*capture.Record{rec}); err != nil {
+				t.Fatalf("Export() error = %v", err)
+			}
+			packets := parsePackets(t, buf.Bytes())
+
+			// 3 handshake, 1 request, 3 response segments, 3 teardown.
+			if len(packets) != 10 {
+				t.Fatalf("got %d packets, want 10", len(packets))
+			}
+			if packets[0].flags != flagSYN || packets[1].flags != flagSYN|flagACK || packets[2].flags != flagACK {
+				t.Errorf("invalid handshake flags")
+			}
+			if packets[1].ack != packets[0].seq+1 {
+				t.Errorf("invalid handshake ack")
+			}
+			if string(packets[3].payload) != "hello" || packets[3].seq != packets[0].seq+1 {
+				t.Errorf("invalid request segment")
+			}
+
+			response := make([]byte, 0)
+			for _, p := range packets[4:7] {
+				response = append(response, p.payload...)
+			}
+			if !bytes.Equal(response, bigChunk) {
+				t.Errorf("response not reassembled")
+			}
+			if packets[6].ack != packets[3].seq+5 {
+				t.Errorf("invalid response ack")
+			}
+			if packets[7].flags != flagFIN|flagACK || packets[7].seq != packets[3].seq+5 {
+				t.Errorf("invalid client fin")
+			}
+			for _, p := range packets {
+				if p.ipv6 != tt.ipv6 {
+					t.Errorf("invalid ip version")
+				}
+			}
+		})
+	}
+}
+
+func TestWriter_WriteRecord_UDP(t *testing.T) {
+	now := time.Now()
+	rec := &capture.Record{
+		ID:         "test",
+		Type:       "udp",
+		ClientAddr: "10.0.0.1:40000",
+		TargetAddr: "10.0.0.2:53",
+		Start:      now,
+		End:        now,
+		Chunks: []capture.Chunk{
+			{Time: now, Ingress: true, Data: []byte("query")},
+			{Time: now, Ingress: false, Data: []byte("answer")},
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Export(buf, []*capture.Record{rec}); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	data := buf.Bytes()[24:]
+	for i, want := range []struct {
+		srcPort uint16
+		payload string
+	}{{40000, "query"}, {53, "answer"}} {
+		capLen := binary.LittleEndian.Uint32(data[8:12])
+		pkt := data[16 : 16+capLen]
+		data = data[16+capLen:]
+
+		ip := pkt[ethernetHeaderLen : ethernetHeaderLen+ipv4HeaderLen]
+		if ip[9] != protoUDP {
+			t.Fatalf("packet %d protocol = %d, want udp", i, ip[9])
+		}
+		udp := pkt[ethernetHeaderLen+ipv4HeaderLen:]
+		if checksum(udp, pseudoHeaderSum(ip[12:16], ip[16:20], protoUDP, len(udp))) != 0 {
+			t.Errorf("packet %d has invalid udp checksum", i)
+		}
+		if got := binary.BigEndian.Uint16(udp[0:2]); got != want.srcPort {
+			t.Errorf("packet %d source port = %d, want %d", i, got, want.srcPort)
+		}
+		if got := string(udp[udpHeaderLen:]); got != want.payload {
+			t.Errorf("packet %d payload = %q, want %q", i, got, want.payload)
+		}
+	}
+	if len(data) != 0 {
+		t.Errorf("unexpected packets after the datagrams")
+	}
+}
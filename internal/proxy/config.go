@@ -0,0 +1,417 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	httpfilters "goxy/internal/proxy/http/filters"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoSuchRule    = errors.New("no such rule")
+	ErrRuleExists    = errors.New("rule already exists")
+	ErrNoSuchFilter  = errors.New("no such filter")
+	ErrInvalidRule   = errors.New("invalid rule")
+	ErrInvalidFilter = errors.New("invalid filter")
+	ErrInvalidOrder  = errors.New("invalid order")
+
+	ErrServiceExists  = errors.New("service already exists")
+	ErrInvalidService = errors.New("invalid service")
+)
+
+var ruleTypePrefixes = []string{"tcp::", "http::", "udp::", "ws::"}
+
+// GetConfig returns the copy of the running config.
+func (m *Manager) GetConfig() *common.ProxyConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config.Copy()
+}
+
+// snapshot returns the copy of the running config and the IDs of its services.
+func (m *Manager) snapshot() (*common.ProxyConfig, []int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config.Copy(), append([]int(nil), m.ids...)
+}
+
+// SaveConfig writes the rules and services of the running config to the file.
+func (m *Manager) SaveConfig(path string) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	if err := common.SaveProxyConfig(path, m.GetConfig()); err != nil {
+		return fmt.Errorf("saving config: %w", err)
+	}
+	// The stat failing only makes the watcher reload the saved config once more.
+	m.saved, _ = os.Stat(path)
+	return nil
+}
+
+// SavedConfig reports whether the file is the one SaveConfig wrote last and wasn't changed since,
+// so the config watcher can skip the writes of the manager itself.
+func (m *Manager) SavedConfig(path string) bool {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	if m.saved == nil {
+		return false
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fi.Size() == m.saved.Size() && fi.ModTime().Equal(m.saved.ModTime())
+}
+
+// editConfig applies the change to the copy of the running config and reloads it.
+// Proxies are not touched if the resulting config is invalid.
+func (m *Manager) editConfig(edit func(cfg *common.ProxyConfig, ids []int) error) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+
+	cfg, ids := m.snapshot()
+	if err := edit(cfg, ids); err != nil {
+		return err
+	}
+	return m.reload(cfg, ids)
+}
+
+func validateRule(r common.RuleConfig) error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidRule)
+	}
+	for _, prefix := range ruleTypePrefixes {
+		if strings.HasPrefix(r.Type, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown type %s", ErrInvalidRule, r.Type)
+}
+
+func findRule(cfg *common.ProxyConfig, name string) int {
+	for i, r := range cfg.Rules {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Manager) AddRule(r common.RuleConfig) error {
+	if err := validateRule(r); err != nil {
+		return err
+	}
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		if findRule(cfg, r.Name) != -1 {
+			return fmt.Errorf("%w: %s", ErrRuleExists, r.Name)
+		}
+		cfg.Rules = append(cfg.Rules, r)
+		return nil
+	})
+}
+
+// UpdateRule replaces the rule, filters using it are updated too. Rules can't be renamed.
+func (m *Manager) UpdateRule(name string, r common.RuleConfig) error {
+	r.Name = name
+	if err := validateRule(r); err != nil {
+		return err
+	}
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		i := findRule(cfg, name)
+		if i == -1 {
+			return fmt.Errorf("%w: %s", ErrNoSuchRule, name)
+		}
+		cfg.Rules[i] = r
+		return nil
+	})
+}
+
+// DeleteRule removes the rule, which must not be used by any filter.
+func (m *Manager) DeleteRule(name string) error {
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		i := findRule(cfg, name)
+		if i == -1 {
+			return fmt.Errorf("%w: %s", ErrNoSuchRule, name)
+		}
+		cfg.Rules = append(cfg.Rules[:i], cfg.Rules[i+1:]...)
+		return nil
+	})
+}
+
+// ReorderRules sets the order of the rules, names must list all rules.
+func (m *Manager) ReorderRules(names []string) error {
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		if len(names) != len(cfg.Rules) {
+			return fmt.Errorf("%w: %d rules expected", ErrInvalidOrder, len(cfg.Rules))
+		}
+		rules := make([]common.RuleConfig, 0, len(names))
+		for _, name := range names {
+			i := findRule(cfg, name)
+			if i == -1 {
+				return fmt.Errorf("%w: %s", ErrNoSuchRule, name)
+			}
+			rules = append(rules, cfg.Rules[i])
+		}
+		if err := checkUnique(len(names), func(i int) interface{} { return names[i] }); err != nil {
+			return err
+		}
+		cfg.Rules = rules
+		return nil
+	})
+}
+
+// serviceFilters returns the filters of the service by the proxy ID.
+func serviceFilters(cfg *common.ProxyConfig, ids []int, proxyID int) (*[]common.FilterConfig, error) {
+	i, err := serviceIndex(ids, proxyID)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg.Services[i].Filters, nil
+}
+
+func validateFilter(f common.FilterConfig) error {
+	if f.Rule == "" {
+		return fmt.Errorf("%w: empty rule", ErrInvalidFilter)
+	}
+	// The HTTP verdicts include the common ones, the proxy checks they suit the service type.
+	if _, err := httpfilters.ParseVerdict(f.Verdict); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return nil
+}
+
+// AddFilter inserts the filter into the proxy chain before the filter with the given ID,
+// or appends it if the ID is zero.
+func (m *Manager) AddFilter(proxyID, beforeID int, f common.FilterConfig) error {
+	if err := validateFilter(f); err != nil {
+		return err
+	}
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		fts, err := serviceFilters(cfg, ids, proxyID)
+		if err != nil {
+			return err
+		}
+		if beforeID == 0 {
+			*fts = append(*fts, f)
+			return nil
+		}
+		if beforeID < 1 || beforeID > len(*fts) {
+			return ErrNoSuchFilter
+		}
+		i := beforeID - 1
+		*fts = append((*fts)[:i], append([]common.FilterConfig{f}, (*fts)[i:]...)...)
+		return nil
+	})
+}
+
+func (m *Manager) UpdateFilter(proxyID, filterID int, f common.FilterConfig) error {
+	if err := validateFilter(f); err != nil {
+		return err
+	}
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		fts, err := serviceFilters(cfg, ids, proxyID)
+		if err != nil {
+			return err
+		}
+		if filterID < 1 || filterID > len(*fts) {
+			return ErrNoSuchFilter
+		}
+		(*fts)[filterID-1] = f
+		return nil
+	})
+}
+
+func (m *Manager) DeleteFilter(proxyID, filterID int) error {
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		fts, err := serviceFilters(cfg, ids, proxyID)
+		if err != nil {
+			return err
+		}
+		if filterID < 1 || filterID > len(*fts) {
+			return ErrNoSuchFilter
+		}
+		*fts = append((*fts)[:filterID-1], (*fts)[filterID:]...)
+		return nil
+	})
+}
+
+// ReorderFilters sets the order of the proxy filters, order must list all filter IDs.
+func (m *Manager) ReorderFilters(proxyID int, order []int) error {
+	return m.editConfig(func(cfg *common.ProxyConfig, ids []int) error {
+		fts, err := serviceFilters(cfg, ids, proxyID)
+		if err != nil {
+			return err
+		}
+		if len(order) != len(*fts) {
+			return fmt.Errorf("%w: %d filters expected", ErrInvalidOrder, len(*fts))
+		}
+		if err := checkUnique(len(order), func(i int) interface{} { return order[i] }); err != nil {
+			return err
+		}
+		result := make([]common.FilterConfig, 0, len(order))
+		for _, id := range order {
+			if id < 1 || id > len(*fts) {
+				return ErrNoSuchFilter
+			}
+			result = append(result, (*fts)[id-1])
+		}
+		*fts = result
+		return nil
+	})
+}
+
+func validateService(s common.ServiceConfig) error {
+	if s.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidService)
+	}
+	if s.Listen == "" || s.Target == "" {
+		return fmt.Errorf("%w: listen and target addresses required", ErrInvalidService)
+	}
+	switch s.OversizedBody {
+	case "", common.BodyPolicyAllow, common.BodyPolicyDrop, common.BodyPolicyAlert:
+	default:
+		return fmt.Errorf("%w: invalid oversized body policy %s", ErrInvalidService, s.OversizedBody)
+	}
+	if err := validateDrop(s); err != nil {
+		return err
+	}
+	if s.H2C && s.TLS != nil && s.TLS.Upstream {
+		return fmt.Errorf("%w: h2c can't be used with upstream tls", ErrInvalidService)
+	}
+	if s.StateTTL != nil && *s.StateTTL <= 0 {
+		return fmt.Errorf("%w: state ttl must be positive", ErrInvalidService)
+	}
+	if s.BodyIdleTimeout != nil && *s.BodyIdleTimeout < 0 {
+		return fmt.Errorf("%w: body idle timeout must not be negative", ErrInvalidService)
+	}
+	for _, f := range s.Filters {
+		if err := validateFilter(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDrop checks the drop mode is supported by the service type.
+// Modes set by the verdicts are not checked, the unsupported ones close the connection.
+func validateDrop(s common.ServiceConfig) error {
+	if s.Drop == nil || s.Drop.Mode == "" {
+		return nil
+	}
+	supported := false
+	for _, m := range common.DropModes(s.Type) {
+		supported = supported || m == s.Drop.Mode
+	}
+	if !supported {
+		return fmt.Errorf("%w: drop mode %s is not supported for %s", ErrInvalidService, s.Drop.Mode, s.Type)
+	}
+	if s.Drop.Mode == common.DropModeTemplate && s.Drop.Template == "" {
+		return fmt.Errorf("%w: template file required for template drop mode", ErrInvalidService)
+	}
+	if s.Drop.Status != 0 && (s.Drop.Status < 100 || s.Drop.Status > 999) {
+		return fmt.Errorf("%w: invalid drop status %d", ErrInvalidService, s.Drop.Status)
+	}
+	return nil
+}
+
+// checkServiceName ensures the service names stay unique, as the capture and metrics are keyed by them.
+func checkServiceName(cfg *common.ProxyConfig, name string, skip int) error {
+	for i, s := range cfg.Services {
+		if i != skip && s.Name == name {
+			return fmt.Errorf("%w: %s", ErrServiceExists, name)
+		}
+	}
+	return nil
+}
+
+// GetService returns the config of the proxied service.
+func (m *Manager) GetService(proxyID int) (common.ServiceConfig, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i, err := serviceIndex(m.ids, proxyID)
+	if err != nil {
+		return common.ServiceConfig{}, err
+	}
+	return m.config.Services[i].Copy(), nil
+}
+
+// editServices applies the change of the services.
+// If the changed proxy fails to start, the previous config is restored.
+func (m *Manager) editServices(edit func(cfg *common.ProxyConfig, ids *[]int) error) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+
+	cfg, ids := m.snapshot()
+	if err := edit(cfg, &ids); err != nil {
+		return err
+	}
+	return m.reloadOrRestore(cfg, ids)
+}
+
+// AddService starts the proxy for the new service and returns its ID.
+func (m *Manager) AddService(s common.ServiceConfig) (int, error) {
+	if err := validateService(s); err != nil {
+		return 0, err
+	}
+	id := 0
+	err := m.editServices(func(cfg *common.ProxyConfig, ids *[]int) error {
+		if err := checkServiceName(cfg, s.Name, -1); err != nil {
+			return err
+		}
+		cfg.Services = append(cfg.Services, s.Copy())
+		// Reload gives the unknown ID to the new proxy as is.
+		id = m.nextID
+		*ids = append(*ids, id)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// RemoveService stops the proxy, its active connections are drained in background.
+// IDs of other proxies are not changed.
+func (m *Manager) RemoveService(proxyID int) error {
+	return m.editServices(func(cfg *common.ProxyConfig, ids *[]int) error {
+		i, err := serviceIndex(*ids, proxyID)
+		if err != nil {
+			return err
+		}
+		cfg.Services = append(cfg.Services[:i], cfg.Services[i+1:]...)
+		*ids = append((*ids)[:i], (*ids)[i+1:]...)
+		return nil
+	})
+}
+
+// UpdateService replaces the service config, keeping its ID.
+// The proxy is restarted only if its type or listen address is changed.
+func (m *Manager) UpdateService(proxyID int, s common.ServiceConfig) error {
+	if err := validateService(s); err != nil {
+		return err
+	}
+	return m.editServices(func(cfg *common.ProxyConfig, ids *[]int) error {
+		i, err := serviceIndex(*ids, proxyID)
+		if err != nil {
+			return err
+		}
+		if err := checkServiceName(cfg, s.Name, i); err != nil {
+			return err
+		}
+		cfg.Services[i] = s.Copy()
+		return nil
+	})
+}
+
+func checkUnique(n int, key func(i int) interface{}) error {
+	seen := make(map[interface{}]bool, n)
+	for i := 0; i < n; i++ {
+		k := key(i)
+		if seen[k] {
+			return fmt.Errorf("%w: %v repeated", ErrInvalidOrder, k)
+		}
+		seen[k] = true
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"errors"
+	"goxy/internal/common"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestManager_EditConfig(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	before := m.proxies[0]
+
+	if err := m.AddRule(common.RuleConfig{Name: "other", Type: "tcp::regex", Args: []string{"lol"}}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if err := m.AddFilter(1, 1, common.FilterConfig{Rule: "other", Verdict: "alert::lol"}); err != nil {
+		t.Fatalf("AddFilter() error = %v", err)
+	}
+	if m.proxies[0] != before {
+		t.Errorf("AddFilter() restarted the proxy, but mustn't")
+	}
+	ruleNames := func() []string {
+		var result []string
+		for _, f := range m.proxies[0].GetFilters() {
+			result = append(result, f.GetRule().String())
+		}
+		return result
+	}
+	if got := ruleNames(); len(got) != 2 || got[0] != "regex 'lol'" || got[1] != "contains 'kek'" {
+		t.Errorf("AddFilter() got filters %v", got)
+	}
+
+	if err := m.ReorderFilters(1, []int{2, 1}); err != nil {
+		t.Fatalf("ReorderFilters() error = %v", err)
+	}
+	if got := ruleNames(); got[0] != "contains 'kek'" || got[1] != "regex 'lol'" {
+		t.Errorf("ReorderFilters() got filters %v", got)
+	}
+	if err := m.ReorderFilters(1, []int{1, 1}); !errors.Is(err, ErrInvalidOrder) {
+		t.Errorf("ReorderFilters() repeated ID error = %v, want %v", err, ErrInvalidOrder)
+	}
+
+	if err := m.UpdateRule("other", common.RuleConfig{Type: "tcp::contains", Args: []string{"lol"}}); err != nil {
+		t.Fatalf("UpdateRule() error = %v", err)
+	}
+	if got := ruleNames(); got[1] != "contains 'lol'" {
+		t.Errorf("UpdateRule() filter not updated, got %v", got)
+	}
+
+	if err := m.DeleteRule("other"); err == nil {
+		t.Errorf("DeleteRule() removed the rule used by the filter")
+	}
+	if err := m.DeleteFilter(1, 2); err != nil {
+		t.Fatalf("DeleteFilter() error = %v", err)
+	}
+	if err := m.DeleteRule("other"); err != nil {
+		t.Fatalf("DeleteRule() error = %v", err)
+	}
+	if got := m.GetConfig(); len(got.Rules) != 1 || len(got.Services[0].Filters) != 1 {
+		t.Errorf("GetConfig() got %d rules and %d filters, want 1 and 1", len(got.Rules), len(got.Services[0].Filters))
+	}
+}
+
+func TestManager_EditConfig_Invalid(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func() error
+	}{
+		{"unknown rule type", func() error {
+			return m.AddRule(common.RuleConfig{Name: "bad", Type: "ftp::contains"})
+		}},
+		{"invalid rule", func() error {
+			return m.UpdateRule("tcp_rule", common.RuleConfig{Type: "tcp::invalid"})
+		}},
+		{"duplicate rule", func() error {
+			return m.AddRule(common.RuleConfig{Name: "tcp_rule", Type: "tcp::contains", Args: []string{"a"}})
+		}},
+		{"invalid verdict", func() error {
+			return m.AddFilter(1, 0, common.FilterConfig{Rule: "tcp_rule", Verdict: "explode"})
+		}},
+		{"unknown filter rule", func() error {
+			return m.AddFilter(1, 0, common.FilterConfig{Rule: "missing", Verdict: "drop"})
+		}},
+		{"unknown proxy", func() error {
+			return m.DeleteFilter(2, 1)
+		}},
+		{"unknown filter", func() error {
+			return m.DeleteFilter(1, 2)
+		}},
+		{"incomplete order", func() error {
+			return m.ReorderRules(nil)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.edit(); err == nil {
+				t.Errorf("edit accepted, but mustn't")
+			}
+			cfg := m.GetConfig()
+			if len(cfg.Rules) != 1 || cfg.Rules[0].Type != "tcp::contains" || len(cfg.Services[0].Filters) != 1 {
+				t.Errorf("config changed: %+v", cfg)
+			}
+			if got := m.proxies[0].GetFilters()[0].GetRule().String(); got != "contains 'kek'" {
+				t.Errorf("filters changed, got rule %s", got)
+			}
+		})
+	}
+}
+
+func TestManager_SavedConfig(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte("web:\n  listen: 127.0.0.1:8000\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if m.SavedConfig(path) {
+		t.Errorf("SavedConfig() = true before the save")
+	}
+
+	if err := m.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+	if !m.SavedConfig(path) {
+		t.Errorf("SavedConfig() = false after the save")
+	}
+
+	// The edit of the file is the change to reload.
+	if err := ioutil.WriteFile(path, []byte("rules: []\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if m.SavedConfig(path) {
+		t.Errorf("SavedConfig() = true after the file changed")
+	}
+}
+
+func TestManager_ReloadWith(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	errLoad := errors.New("load failed")
+	if err := m.ReloadWith(func() (*common.ProxyConfig, error) { return nil, errLoad }); !errors.Is(err, errLoad) {
+		t.Errorf("ReloadWith() error = %v, want %v", err, errLoad)
+	}
+	if got := m.proxies[0].GetFilters()[0].GetRule().String(); got != "contains 'kek'" {
+		t.Errorf("ReloadWith() failed load applied, got rule %s", got)
+	}
+
+	// The load runs under the edit lock, so the concurrent reloads don't overlap.
+	var running atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := m.ReloadWith(func() (*common.ProxyConfig, error) {
+				if running.Inc() != 1 {
+					t.Errorf("ReloadWith() loads overlap")
+				}
+				defer running.Dec()
+				time.Sleep(time.Millisecond * 10)
+				return testConfig("tcp::regex"), nil
+			})
+			if err != nil {
+				t.Errorf("ReloadWith() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := m.proxies[0].GetFilters()[0].GetRule().String(); got != "regex 'kek'" {
+		t.Errorf("ReloadWith() config not applied, got rule %s", got)
+	}
+}
@@ -0,0 +1,193 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"goxy/internal/alerts"
+	"goxy/internal/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_MaxInspectBody(t *testing.T) {
+	received := make(chan int, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- len(body)
+		_, _ = fmt.Fprint(w, strings.Repeat("b", 100))
+	}))
+	defer target.Close()
+
+	// The attack is past the inspected prefix.
+	body := strings.Repeat("a", 50) + "attack"
+	tests := []struct {
+		name       string
+		limit      int64
+		policy     string
+		wantStatus int
+		wantAlert  bool
+	}{
+		{name: "within limit", limit: 100, wantStatus: http.StatusNoContent},
+		{name: "allow", limit: 16, policy: common.BodyPolicyAllow, wantStatus: http.StatusOK},
+		{name: "default policy", limit: 16, wantStatus: http.StatusOK},
+		{name: "drop", limit: 16, policy: common.BodyPolicyDrop, wantStatus: http.StatusNoContent},
+		{name: "alert", limit: 16, policy: common.BodyPolicyAlert, wantStatus: http.StatusOK, wantAlert: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:           "body " + tt.name,
+				Type:           "http",
+				Listen:         "127.0.0.1:0",
+				Target:         strings.TrimPrefix(target.URL, "http://"),
+				MaxInspectBody: tt.limit,
+				OversizedBody:  tt.policy,
+				Filters:        []common.FilterConfig{{Rule: "attack", Verdict: "drop"}},
+			}, []common.RuleConfig{
+				{Name: "attack", Type: "http::ingress::body::contains", Args: []string{"attack"}},
+			})
+			sub, cancel := alerts.Subscribe()
+			defer cancel()
+
+			resp, err := http.Post("http://"+p.Addr().String()+"/", "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("Post() error = %v", err)
+			}
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if resp.StatusCode == http.StatusOK {
+				if got := <-received; got != len(body) {
+					t.Errorf("target received %d bytes, want %d", got, len(body))
+				}
+				if len(respBody) != 100 {
+					t.Errorf("client received %d bytes, want 100", len(respBody))
+				}
+			}
+
+			alerted := false
+			select {
+			case a := <-sub:
+				alerted = a.Reason == alerts.ReasonBodyOversized && a.Ingress
+			case <-time.After(time.Millisecond * 100):
+			}
+			if alerted != tt.wantAlert {
+				t.Errorf("alerted = %v, want %v", alerted, tt.wantAlert)
+			}
+		})
+	}
+}
+
+func TestProxy_StreamingResponse(t *testing.T) {
+	finish := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "data: "+r.URL.Query().Get("first")+"\n\n")
+		w.(http.Flusher).Flush()
+		<-finish
+		_, _ = fmt.Fprint(w, "data: last\n\n")
+	}))
+	defer target.Close()
+	defer close(finish)
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:    "sse",
+		Type:    "http",
+		Listen:  "127.0.0.1:0",
+		Target:  strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{{Rule: "flag", Verdict: "drop"}},
+	}, []common.RuleConfig{
+		{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+	})
+	client := &http.Client{Timeout: time.Second * 2}
+
+	resp, err := client.Get("http://" + p.Addr().String() + "/?first=hello")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading first event: %v", err)
+	}
+	if line != "data: hello\n" {
+		t.Errorf("first event = %q, want data: hello", line)
+	}
+
+	// Filters still see the part received before the stream is passed through.
+	dropped, err := client.Get("http://" + p.Addr().String() + "/?first=flag{test}")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	_ = dropped.Body.Close()
+	if dropped.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", dropped.StatusCode)
+	}
+}
+
+func TestProxy_BodyIdleTimeout(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond * 300)
+		_, _ = fmt.Fprint(w, "data: flag{test}\n\n")
+	}))
+	defer target.Close()
+
+	second := time.Second
+	tests := []struct {
+		name       string
+		timeout    *time.Duration
+		policy     string
+		wantStatus int
+		wantAlert  bool
+	}{
+		{name: "allow", wantStatus: http.StatusOK},
+		{name: "drop", policy: common.BodyPolicyDrop, wantStatus: http.StatusNoContent},
+		{name: "alert", policy: common.BodyPolicyAlert, wantStatus: http.StatusOK, wantAlert: true},
+		{name: "waited for", timeout: &second, wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:            "idle " + tt.name,
+				Type:            "http",
+				Listen:          "127.0.0.1:0",
+				Target:          strings.TrimPrefix(target.URL, "http://"),
+				OversizedBody:   tt.policy,
+				BodyIdleTimeout: tt.timeout,
+				Filters:         []common.FilterConfig{{Rule: "flag", Verdict: "drop"}},
+			}, []common.RuleConfig{
+				{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+			})
+			sub, cancel := alerts.Subscribe()
+			defer cancel()
+
+			resp, err := http.Get("http://" + p.Addr().String() + "/")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			alerted := false
+			select {
+			case a := <-sub:
+				alerted = a.Reason == alerts.ReasonBodyPartial && !a.Ingress
+			case <-time.After(time.Millisecond * 100):
+			}
+			if alerted != tt.wantAlert {
+				t.Errorf("alerted = %v, want %v", alerted, tt.wantAlert)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"context"
+	"goxy/internal/common"
+	"io"
+	"net/http"
+)
+
+// requestContext is done once the client goes away or the proxy is shut down.
+func (p *Proxy) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// delay pauses the request for the delay queued by the filters.
+func (p *Proxy) delay(r *http.Request, pctx *common.ProxyContext) error {
+	d := pctx.TakeDelay()
+	if d <= 0 {
+		return nil
+	}
+	ctx, cancel := p.requestContext(r)
+	defer cancel()
+	return common.Sleep(ctx, d)
+}
+
+// tarpitWriter trickles the body to the client at the tarpit rate.
+type tarpitWriter struct {
+	http.ResponseWriter
+	throttled io.Writer
+}
+
+func newTarpitWriter(ctx context.Context, w http.ResponseWriter, rate int) *tarpitWriter {
+	return &tarpitWriter{
+		ResponseWriter: w,
+		throttled:      common.NewThrottledWriter(ctx, flushWriter{w}, rate),
+	}
+}
+
+func (w *tarpitWriter) Write(data []byte) (int, error) {
+	return w.throttled.Write(data)
+}
+
+func (w *tarpitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushWriter sends every write to the client right away.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
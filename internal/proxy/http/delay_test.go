@@ -0,0 +1,100 @@
+package http
+
+import (
+	"context"
+	"goxy/internal/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy_DelayAndTarpit(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 15)))
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "delay",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "slow", Verdict: "delay::200ms"},
+			{Rule: "trickle", Verdict: "tarpit::50"},
+		},
+	}, []common.RuleConfig{
+		{Name: "slow", Type: "http::ingress::path::contains", Args: []string{"slow"}},
+		{Name: "trickle", Type: "http::ingress::path::contains", Args: []string{"trickle"}},
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		minTime time.Duration
+	}{
+		{"not matched", "/fast", 0},
+		{"delay", "/slow", time.Millisecond * 200},
+		// 15 bytes at 50 B/s are written in three chunks 100ms apart.
+		{"tarpit", "/trickle", time.Millisecond * 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			resp, err := http.Get("http://" + p.Addr().String() + tt.path)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if resp.StatusCode != http.StatusOK || len(body) != 15 {
+				t.Errorf("response = %d %q, want 200 with 15 bytes", resp.StatusCode, body)
+			}
+			if elapsed < tt.minTime {
+				t.Errorf("response received in %v, want at least %v", elapsed, tt.minTime)
+			}
+			if tt.minTime == 0 && elapsed > time.Millisecond*100 {
+				t.Errorf("response received in %v, want no delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxy_Shutdown_Delayed(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:    "delay",
+		Type:    "http",
+		Listen:  "127.0.0.1:0",
+		Target:  strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{{Rule: "ingress", Verdict: "delay::1m"}},
+	}, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + p.Addr().String() + "/")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Errorf("delayed request is not finished after shutdown")
+	}
+}
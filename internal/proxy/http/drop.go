@@ -0,0 +1,296 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goxy/internal/common"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MimicCacheTTL is how long the target response for the missing page is reused.
+	MimicCacheTTL = time.Minute
+	// MaxDropBody limits the body of the template and the mimicked responses.
+	MaxDropBody = 1024 * 1024
+)
+
+// Headers not copied from the template and the mimicked responses, the server sets them itself.
+var skipDropHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Date":              true,
+}
+
+// dropResponse is the response the dropped request gets.
+type dropResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *dropResponse) write(w http.ResponseWriter) {
+	for k, vals := range r.header {
+		if skipDropHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(r.body)))
+	w.WriteHeader(r.status)
+	_, _ = w.Write(r.body)
+}
+
+// handleDrop answers the dropped request in the drop mode.
+// RST and blackhole modes leave the client without any response.
+func (p *Proxy) handleDrop(w http.ResponseWriter, r *http.Request, cfg *common.ServiceConfig, pctx *common.ProxyContext) {
+	drop := cfg.Drop
+	if drop == nil {
+		drop = new(common.DropConfig)
+	}
+
+	var (
+		resp *dropResponse
+		err  error
+	)
+	switch cfg.DropMode(pctx) {
+	case common.DropModeResponse:
+		resp = &dropResponse{status: drop.Status, header: make(http.Header), body: []byte(drop.Body)}
+		if resp.status == 0 {
+			resp.status = http.StatusNotFound
+		}
+		for k, v := range drop.Headers {
+			resp.header.Set(k, v)
+		}
+	case common.DropModeTemplate:
+		resp, err = loadTemplate(drop.Template)
+	case common.DropModeMimic:
+		resp, err = p.mimic.get(func() (*dropResponse, error) {
+			return p.fetchMissingPage(r, cfg)
+		})
+	case common.DropModeRST:
+		p.conns.reset(r.RemoteAddr)
+		panic(http.ErrAbortHandler)
+	case common.DropModeBlackhole:
+		p.blackhole(w, r, cfg.BlackholeTimeout())
+		return
+	}
+	if err != nil {
+		p.logger.Errorf("Error making drop response: %v", err)
+	}
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp.write(w)
+}
+
+// blackhole keeps the connection open without answering until the timeout.
+// HTTP/1 connection is taken over to discard the client data, HTTP/2 stream is just left hanging.
+// The taken over connections are tracked, as the server doesn't close them on shutdown.
+func (p *Proxy) blackhole(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	if sw, ok := w.(*statusWriter); ok {
+		w = sw.ResponseWriter
+	}
+	if hj, ok := w.(http.Hijacker); ok && r.ProtoMajor == 1 {
+		if conn, _, err := hj.Hijack(); err == nil {
+			p.blackholes.add(conn)
+			defer p.blackholes.remove(conn)
+			defer conn.Close()
+			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}
+			return
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// loadTemplate reads the raw HTTP response from the file.
+func loadTemplate(path string) (*dropResponse, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDropBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading template body: %w", err)
+	}
+	return &dropResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// fetchMissingPage requests the random path from the target, so the drop looks like its usual 404 page.
+func (p *Proxy) fetchMissingPage(r *http.Request, cfg *common.ServiceConfig) (*dropResponse, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("generating path: %w", err)
+	}
+	scheme := "http"
+	if cfg.TLS != nil && cfg.TLS.Upstream {
+		scheme = "https"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout(cfg))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+cfg.Target+"/"+hex.EncodeToString(buf), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	req.Host = r.Host
+	req.Header.Set("User-Agent", r.UserAgent())
+	resp, err := p.getClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting target: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDropBody))
+	if err != nil {
+		return nil, fmt.Errorf("reading target response: %w", err)
+	}
+	return &dropResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// mimicCache keeps the target response for the missing page for MimicCacheTTL.
+type mimicCache struct {
+	mu      sync.Mutex
+	resp    *dropResponse
+	fetched time.Time
+	pending *mimicFetch
+}
+
+// mimicFetch is the fetch in progress, the concurrent drops wait for its result.
+type mimicFetch struct {
+	done chan struct{}
+	resp *dropResponse
+	err  error
+}
+
+// get returns the cached response, or fetches it once for all the concurrent callers.
+// The lock is not held during the fetch, so the other drops aren't stuck behind it.
+func (c *mimicCache) get(fetch func() (*dropResponse, error)) (*dropResponse, error) {
+	c.mu.Lock()
+	if c.resp != nil && time.Since(c.fetched) < MimicCacheTTL {
+		resp := c.resp
+		c.mu.Unlock()
+		return resp, nil
+	}
+	if f := c.pending; f != nil {
+		c.mu.Unlock()
+		<-f.done
+		return f.resp, f.err
+	}
+	f := &mimicFetch{done: make(chan struct{})}
+	c.pending = f
+	c.mu.Unlock()
+
+	f.resp, f.err = fetch()
+	c.mu.Lock()
+	c.pending = nil
+	if f.err == nil {
+		c.resp = f.resp
+		c.fetched = time.Now()
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.resp, f.err
+}
+
+// connSet tracks the connections taken over from the server.
+// Connections added after closeAll are closed at once.
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[net.Conn]struct{})}
+}
+
+func (s *connSet) add(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = c.Close()
+		return
+	}
+	s.conns[c] = struct{}{}
+}
+
+func (s *connSet) remove(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+}
+
+func (s *connSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// rawConns keeps the accepted TCP connections by the client address, so they can be reset under TLS.
+type rawConns struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}
+
+func newRawConns() *rawConns {
+	return &rawConns{conns: make(map[string]net.Conn)}
+}
+
+func (s *rawConns) add(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c.RemoteAddr().String()] = c
+}
+
+func (s *rawConns) remove(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.RemoteAddr().String()] == c {
+		delete(s.conns, c.RemoteAddr().String())
+	}
+}
+
+// reset closes the client connection with RST.
+func (s *rawConns) reset(addr string) {
+	s.mu.Lock()
+	c := s.conns[addr]
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	_ = c.Close()
+}
@@ -0,0 +1,230 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestProxy_DropModes(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.Header().Set("X-Page", "missing")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("no such page"))
+			return
+		}
+		_, _ = w.Write([]byte("index"))
+	}))
+	defer target.Close()
+
+	dir, err := ioutil.TempDir("", "goxy-drop")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	template := filepath.Join(dir, "template.http")
+	raw := "HTTP/1.1 502 Bad Gateway\r\nX-Page: template\r\nContent-Length: 8\r\n\r\nupstream"
+	if err := ioutil.WriteFile(template, []byte(raw), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	timeout := time.Millisecond * 300
+
+	tests := []struct {
+		name       string
+		drop       *common.DropConfig
+		verdict    string
+		wantStatus int
+		wantHeader string
+		wantBody   string
+		wantErr    bool
+	}{
+		{
+			name:       "default",
+			verdict:    "drop",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name: "response",
+			drop: &common.DropConfig{
+				Mode:    common.DropModeResponse,
+				Status:  http.StatusForbidden,
+				Headers: map[string]string{"X-Page": "custom"},
+				Body:    "go away",
+			},
+			verdict:    "drop",
+			wantStatus: http.StatusForbidden,
+			wantHeader: "custom",
+			wantBody:   "go away",
+		},
+		{
+			name:       "template",
+			drop:       &common.DropConfig{Mode: common.DropModeTemplate, Template: template},
+			verdict:    "drop",
+			wantStatus: http.StatusBadGateway,
+			wantHeader: "template",
+			wantBody:   "upstream",
+		},
+		{
+			name:       "mimic",
+			drop:       &common.DropConfig{Mode: common.DropModeMimic},
+			verdict:    "drop",
+			wantStatus: http.StatusNotFound,
+			wantHeader: "missing",
+			wantBody:   "no such page",
+		},
+		{
+			name:       "verdict overrides service mode",
+			drop:       &common.DropConfig{Mode: common.DropModeMimic},
+			verdict:    "drop::close",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:    "rst",
+			verdict: "drop::rst",
+			wantErr: true,
+		},
+		{
+			name:    "blackhole",
+			drop:    &common.DropConfig{Mode: common.DropModeBlackhole, Timeout: &timeout},
+			verdict: "drop",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:    "drop",
+				Type:    "http",
+				Listen:  "127.0.0.1:0",
+				Target:  strings.TrimPrefix(target.URL, "http://"),
+				Drop:    tt.drop,
+				Filters: []common.FilterConfig{{Rule: "ingress", Verdict: tt.verdict}},
+			}, nil)
+
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			start := time.Now()
+			resp, err := client.Get("http://" + p.Addr().String() + "/")
+			if tt.wantErr {
+				if err == nil {
+					_ = resp.Body.Close()
+					t.Fatalf("Get() got response %d, want error", resp.StatusCode)
+				}
+				if tt.drop != nil && tt.drop.Mode == common.DropModeBlackhole && time.Since(start) < timeout {
+					t.Errorf("Get() failed after %v, want blackhole for %v", time.Since(start), timeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			if got := resp.Header.Get("X-Page"); got != tt.wantHeader {
+				t.Errorf("X-Page = %q, want %q", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestMimicCache_Get(t *testing.T) {
+	c := new(mimicCache)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func() (*dropResponse, error) {
+		fetches.Inc()
+		<-release
+		return &dropResponse{status: http.StatusNotFound}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := c.get(fetch); err != nil || resp.status != http.StatusNotFound {
+				t.Errorf("get() = %v, %v", resp, err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetched %d times, want once", got)
+	}
+
+	// Failed fetches are not cached.
+	c = new(mimicCache)
+	if _, err := c.get(func() (*dropResponse, error) { return nil, errors.New("unreachable") }); err == nil {
+		t.Errorf("get() error = nil, want fetch error")
+	}
+	if resp, err := c.get(fetch); err != nil || resp.status != http.StatusNotFound {
+		t.Errorf("get() after failure = %v, %v", resp, err)
+	}
+}
+
+func TestProxy_ShutdownBlackhole(t *testing.T) {
+	timeout := time.Minute
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:    "blackhole shutdown",
+		Type:    "http",
+		Listen:  "127.0.0.1:0",
+		Target:  "127.0.0.1:1",
+		Drop:    &common.DropConfig{Mode: common.DropModeBlackhole, Timeout: &timeout},
+		Filters: []common.FilterConfig{{Rule: "ingress", Verdict: "drop"}},
+	}, nil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	blackholed := func() int {
+		p.blackholes.mu.Lock()
+		defer p.blackholes.mu.Unlock()
+		return len(p.blackholes.conns)
+	}
+	for i := 0; blackholed() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("connection is not blackholed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bufio.NewReader(conn).ReadByte(); err == nil || isTimeout(err) {
+		t.Errorf("read after Shutdown() error = %v, want connection closed", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"fmt"
+	"goxy/internal/proxy/http/wrapper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+)
+
+// dumpRequest returns the raw request. Body must be wrapped with BodyReader,
+// it's rewound after reading.
+func dumpRequest(r *http.Request) ([]byte, error) {
+	head, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		return nil, fmt.Errorf("dumping headers: %w", err)
+	}
+	return appendBody(head, r.Body)
+}
+
+// dumpResponse returns the raw response. Body must be wrapped with BodyReader,
+// it's rewound after reading.
+func dumpResponse(r *http.Response) ([]byte, error) {
+	head, err := httputil.DumpResponse(r, false)
+	if err != nil {
+		return nil, fmt.Errorf("dumping headers: %w", err)
+	}
+	return appendBody(head, r.Body)
+}
+
+// dumpEntity returns the raw request or response of the entity, or the payload of the message.
+func dumpEntity(e wrapper.Entity) ([]byte, error) {
+	switch v := e.(type) {
+	case *wrapper.Request:
+		return dumpRequest(v.Request)
+	case *wrapper.Response:
+		return dumpResponse(v.Response)
+	case *wrapper.Message:
+		return v.Data, nil
+	default:
+		return nil, fmt.Errorf("unsupported entity %T", e)
+	}
+}
+
+func appendBody(head []byte, body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return head, nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if err := body.Close(); err != nil {
+		return nil, fmt.Errorf("resetting body: %w", err)
+	}
+	return append(head, data...), nil
+}
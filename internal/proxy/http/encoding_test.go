@@ -0,0 +1,232 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"goxy/internal/alerts"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/wrapper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func compress(t *testing.T, encoding string, data string) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "deflate":
+		w = zlib.NewWriter(buf)
+	case "raw deflate":
+		fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("flate.NewWriter() error = %v", err)
+		}
+		w = fw
+	case "br":
+		w = brotli.NewWriter(buf)
+	default:
+		return []byte(data)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("compressing: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("compressing: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestProxy_CompressedBody(t *testing.T) {
+	received := make(chan []byte, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+		encoding := r.URL.Query().Get("respond")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(compress(t, encoding, `{"flag": "`+r.URL.Query().Get("flag")+`"}`))
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "compressed",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "admin", Verdict: "drop"},
+			{Rule: "admin_form", Verdict: "drop"},
+			{Rule: "flag", Verdict: "drop"},
+		},
+	}, []common.RuleConfig{
+		{Name: "admin", Type: "http::ingress::json::contains", Field: "user", Args: []string{"admin"}},
+		{Name: "admin_form", Type: "http::ingress::form::contains", Field: "user", Args: []string{"admin"}},
+		{Name: "flag", Type: "http::egress::json::contains", Field: "flag", Args: []string{"flag{"}},
+	})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	tests := []struct {
+		name        string
+		encoding    string
+		contentType string
+		body        string
+		query       string
+		wantStatus  int
+	}{
+		{name: "gzip json", encoding: "gzip", body: `{"user": "admin"}`, wantStatus: http.StatusNoContent},
+		{name: "deflate json", encoding: "deflate", body: `{"user": "admin"}`, wantStatus: http.StatusNoContent},
+		{name: "raw deflate json", encoding: "raw deflate", body: `{"user": "admin"}`, wantStatus: http.StatusNoContent},
+		{name: "br json", encoding: "br", body: `{"user": "admin"}`, wantStatus: http.StatusNoContent},
+		{name: "gzip json allowed", encoding: "gzip", body: `{"user": "guest"}`, wantStatus: http.StatusOK},
+		// Unsupported encodings are inspected raw.
+		{name: "zstd json", encoding: "zstd", body: `{"user": "admin"}`, wantStatus: http.StatusNoContent},
+		{
+			name:        "gzip form",
+			encoding:    "gzip",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "user=admin",
+			wantStatus:  http.StatusNoContent,
+		},
+		{name: "gzip response", encoding: "gzip", body: `{}`, query: "?respond=gzip&flag=flag{test}", wantStatus: http.StatusNoContent},
+		{name: "br response", encoding: "br", body: `{}`, query: "?respond=br&flag=flag{test}", wantStatus: http.StatusNoContent},
+		{name: "br response allowed", encoding: "br", body: `{}`, query: "?respond=br&flag=none", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := compress(t, tt.encoding, tt.body)
+			req, err := http.NewRequest(http.MethodPost, "http://"+p.Addr().String()+"/"+tt.query, bytes.NewReader(sent))
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			req.Header.Set("Content-Encoding", strings.TrimPrefix(tt.encoding, "raw "))
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			req.Header.Set("Content-Type", contentType)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			// The bodies are forwarded as they are, dropped requests don't reach the target.
+			select {
+			case got := <-received:
+				if !bytes.Equal(got, sent) {
+					t.Errorf("target received %q, want %q", got, sent)
+				}
+			default:
+				if tt.query != "" || resp.StatusCode == http.StatusOK {
+					t.Errorf("request is not forwarded")
+				}
+			}
+			if resp.StatusCode == http.StatusOK && tt.query != "" {
+				if resp.Header.Get("Content-Encoding") != tt.encoding {
+					t.Errorf("response encoding = %q, want %q", resp.Header.Get("Content-Encoding"), tt.encoding)
+				}
+				if want := compress(t, tt.encoding, `{"flag": "none"}`); !bytes.Equal(respBody, want) {
+					t.Errorf("client received %q, want %q", respBody, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequest_DecodedOnce(t *testing.T) {
+	body, err := wrapper.NewBodyReader(bytes.NewReader(compress(t, "gzip", "hello attack")))
+	if err != nil {
+		t.Fatalf("NewBodyReader() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Encoding", "gzip")
+	e := &wrapper.Request{Request: req}
+
+	first, err := e.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody() error = %v", err)
+	}
+	second, err := e.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody() error = %v", err)
+	}
+	if string(first) != "hello attack" || &first[0] != &second[0] {
+		t.Errorf("GetBody() = %q, %q, want the same decoded body", first, second)
+	}
+
+	if _, err := e.ReplaceBody(func(data []byte) []byte {
+		return bytes.Replace(data, []byte("attack"), []byte("world"), -1)
+	}); err != nil {
+		t.Fatalf("ReplaceBody() error = %v", err)
+	}
+	replaced, err := e.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody() error = %v", err)
+	}
+	if string(replaced) != "hello world" {
+		t.Errorf("GetBody() after ReplaceBody() = %q, want hello world", replaced)
+	}
+}
+
+func TestProxy_UndecodedBody(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:          "undecoded",
+		Type:          "http",
+		Listen:        "127.0.0.1:0",
+		Target:        strings.TrimPrefix(target.URL, "http://"),
+		OversizedBody: common.BodyPolicyAlert,
+	}, nil)
+	sub, cancel := alerts.Subscribe()
+	defer cancel()
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		req, err := http.NewRequest(http.MethodPost, "http://"+p.Addr().String()+"/",
+			bytes.NewReader(compress(t, encoding, "data")))
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	if got := p.GetStats().Dump().Undecoded; got != 1 {
+		t.Errorf("undecoded = %d, want 1", got)
+	}
+	select {
+	case a := <-sub:
+		if a.Reason != alerts.ReasonBodyUndecoded || !a.Ingress || a.Payload != "Content-Encoding: zstd" {
+			t.Errorf("got alert %+v, want the undecoded zstd request body", a)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Errorf("undecoded body not alerted")
+	}
+}
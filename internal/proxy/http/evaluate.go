@@ -0,0 +1,160 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/filters"
+	"goxy/internal/proxy/http/wrapper"
+	"io"
+	"net/http"
+)
+
+// Evaluate runs the filter chain over the HTTP exchanges of the recorded connection without any network I/O.
+// Requests and responses are parsed from the ingress and egress streams and paired in order,
+// every exchange gets its own context like the live request does, which is returned.
+// Response filters are skipped for the dropped requests.
+// After the switch to WebSocket the rest of the streams are read as messages,
+// ingress ones are evaluated before egress ones, as the capture doesn't keep their order.
+// matched is called for every triggered filter with the raw message that triggered it.
+// Filter errors don't stop the evaluation, the first one is returned.
+func Evaluate(
+	cfg common.ServiceConfig,
+	fts []filters.Filter,
+	chunks []capture.Chunk,
+	matched func(f *filters.Filter, ingress, shadow bool, raw []byte),
+) ([]*common.ProxyContext, error) {
+	ingress := new(bytes.Buffer)
+	egress := new(bytes.Buffer)
+	for _, c := range chunks {
+		if c.Ingress {
+			ingress.Write(c.Data)
+		} else {
+			egress.Write(c.Data)
+		}
+	}
+
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	result := make([]*common.ProxyContext, 0)
+	reqReader := bufio.NewReader(ingress)
+	respReader := bufio.NewReader(egress)
+	for {
+		req, err := http.ReadRequest(reqReader)
+		if err != nil {
+			if err != io.EOF {
+				setErr(fmt.Errorf("parsing request: %w", err))
+			}
+			break
+		}
+		if req.Body, err = wrapper.NewBodyReader(req.Body); err != nil {
+			setErr(fmt.Errorf("reading request body: %w", err))
+			break
+		}
+
+		pctx := common.NewProxyContext()
+		result = append(result, pctx)
+		if err := evaluateEntity(pctx, fts, cfg.Shadow, &wrapper.Request{Request: req}, func() ([]byte, error) {
+			return dumpRequest(req)
+		}, matched); err != nil {
+			setErr(err)
+		}
+
+		// Response is parsed anyway to keep the streams in sync.
+		resp, err := http.ReadResponse(respReader, req)
+		if err != nil {
+			if err != io.EOF {
+				setErr(fmt.Errorf("parsing response: %w", err))
+			}
+			continue
+		}
+		if resp.Body, err = wrapper.NewBodyReader(resp.Body); err != nil {
+			setErr(fmt.Errorf("reading response body: %w", err))
+			continue
+		}
+		upgraded := resp.StatusCode == http.StatusSwitchingProtocols
+		if pctx.GetFlag(common.DropFlag) {
+			if upgraded {
+				break
+			}
+			continue
+		}
+		if err := evaluateEntity(pctx, fts, cfg.Shadow, &wrapper.Response{Response: resp}, func() ([]byte, error) {
+			return dumpResponse(resp)
+		}, matched); err != nil {
+			setErr(err)
+		}
+		if upgraded {
+			for _, ingress := range []bool{true, false} {
+				r := reqReader
+				if !ingress {
+					r = respReader
+				}
+				if err := evaluateMessages(pctx, fts, cfg.Shadow, req, r, ingress, matched); err != nil {
+					setErr(err)
+				}
+			}
+			break
+		}
+	}
+	return result, firstErr
+}
+
+// evaluateMessages runs the filters over the WebSocket messages in one direction until the socket is dropped.
+func evaluateMessages(
+	pctx *common.ProxyContext,
+	fts []filters.Filter,
+	shadow bool,
+	req *http.Request,
+	r *bufio.Reader,
+	ingress bool,
+	matched func(f *filters.Filter, ingress, shadow bool, raw []byte),
+) error {
+	mr := newMessageReader(r, MaxMessageSize)
+	for !pctx.GetFlag(common.DropFlag) {
+		msg, err := mr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading websocket message: %w", err)
+		}
+		if !msg.isData() {
+			continue
+		}
+		e := &wrapper.Message{Request: req, Ingress: ingress, Text: msg.opcode == opText, Data: msg.payload}
+		if err := evaluateEntity(pctx, fts, shadow, e, func() ([]byte, error) {
+			return msg.payload, nil
+		}, matched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func evaluateEntity(
+	pctx *common.ProxyContext,
+	fts []filters.Filter,
+	shadow bool,
+	e wrapper.Entity,
+	dump func() ([]byte, error),
+	matched func(f *filters.Filter, ingress, shadow bool, raw []byte),
+) error {
+	var raw []byte
+	return applyFilters(pctx, fts, e, shadow, func(f *filters.Filter, shadow bool) {
+		if raw == nil {
+			var err error
+			if raw, err = dump(); err != nil {
+				raw = []byte{}
+			}
+		}
+		matched(f, e.GetIngress(), shadow, raw)
+	})
+}
@@ -12,6 +12,10 @@ var DefaultRuleWrappers = map[string]RuleWrapperCreator{
 }
 
 var DefaultRuleCreators = map[string]RuleCreator{
+	"counter_gt": NewCounterGTRule,
+	"rate_gt":    NewRateGTRule,
+	"flag":       NewFlagRule,
+
 	"and": NewCompositeAndRule,
 	"not": NewCompositeNotRule,
 }
@@ -29,11 +29,14 @@ type RuleWrapperCreator func(rule Rule, cfg common.RuleConfig) Rule
 type RawRuleWrapperCreator func(rule RawRule, cfg common.RuleConfig) RawRule
 
 type Filter struct {
+	Name    string
 	Rule    Rule
 	Verdict common.Verdict
 
 	alert    atomic.Bool
 	disabled atomic.Bool
+	shadow   atomic.Bool
+	stats    *common.FilterStats
 }
 
 func (f Filter) IsEnabled() bool {
@@ -44,6 +47,14 @@ func (f Filter) GetAlert() bool {
 	return f.alert.Load()
 }
 
+func (f Filter) GetShadow() bool {
+	return f.shadow.Load()
+}
+
+func (f Filter) GetStats() *common.FilterStats {
+	return f.stats
+}
+
 func (f *Filter) SetEnabled(enabled bool) {
 	f.disabled.Store(!enabled)
 }
@@ -52,6 +63,14 @@ func (f *Filter) SetAlert(alert bool) {
 	f.alert.Store(alert)
 }
 
+func (f *Filter) SetShadow(shadow bool) {
+	f.shadow.Store(shadow)
+}
+
+func (f Filter) GetName() string {
+	return f.Name
+}
+
 func (f Filter) GetRule() common.Rule {
 	return f.Rule
 }
@@ -63,3 +82,54 @@ func (f Filter) GetVerdict() common.Verdict {
 func (f Filter) String() string {
 	return fmt.Sprintf("if %s: %s", f.Rule, f.Verdict)
 }
+
+func NewFilters(cfg []common.FilterConfig, rs *RuleSet) ([]Filter, error) {
+	fts := make([]Filter, 0, len(cfg))
+	for _, f := range cfg {
+		rule, ok := rs.GetRule(f.Rule)
+		if !ok {
+			return nil, fmt.Errorf("invalid rule name: %s", f.Rule)
+		}
+		verdict, err := ParseVerdict(f.Verdict)
+		if err != nil {
+			return nil, fmt.Errorf("parse verdict: %w", err)
+		}
+		if _, ok := verdict.(common.Rewriter); ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedVerdict, verdict)
+		}
+		// Messages are forwarded in the frames they came in, so there's nothing to modify.
+		if _, ok := verdict.(Modifier); ok && IsMessageRule(rule) {
+			return nil, fmt.Errorf("%w: %s for websocket messages", ErrUnsupportedVerdict, verdict)
+		}
+		filter := Filter{
+			Name:    f.Rule,
+			Rule:    rule,
+			Verdict: verdict,
+			stats:   new(common.FilterStats),
+		}
+		filter.SetAlert(f.Alert)
+		filter.SetShadow(f.Shadow)
+		filter.SetEnabled(!f.Disabled)
+		fts = append(fts, filter)
+	}
+	return fts, nil
+}
+
+// KeepStats makes the new filters continue the counters of the old ones with the same rule and verdict.
+// The rate limit verdicts are kept too, so the reload doesn't reset their windows.
+func KeepStats(fts, old []Filter) {
+	used := make(map[int]bool, len(old))
+	for i := range fts {
+		for j := range old {
+			if used[j] || fts[i].Name != old[j].Name || fts[i].Verdict.String() != old[j].Verdict.String() {
+				continue
+			}
+			fts[i].stats = old[j].stats
+			if _, ok := old[j].Verdict.(VerdictRateLimit); ok {
+				fts[i].Verdict = old[j].Verdict
+			}
+			used[j] = true
+			break
+		}
+	}
+}
@@ -18,6 +18,10 @@ func NewNotWrapper(rule Rule, _ common.RuleConfig) Rule {
 	return NotWrapper{rule}
 }
 
+func NewMessageWrapper(rule Rule) Rule {
+	return MessageWrapper{rule}
+}
+
 type IngressWrapper struct {
 	rule Rule
 }
@@ -71,3 +75,29 @@ func (w NotWrapper) Apply(ctx *common.ProxyContext, e wrapper.Entity) (bool, err
 func (w NotWrapper) String() string {
 	return fmt.Sprintf("not (%s)", w.rule)
 }
+
+// MessageWrapper marks the rule of the ws:: family, it applies only to WebSocket messages.
+type MessageWrapper struct {
+	rule Rule
+}
+
+func (w MessageWrapper) Apply(ctx *common.ProxyContext, e wrapper.Entity) (bool, error) {
+	if _, ok := e.(*wrapper.Message); !ok {
+		return false, nil
+	}
+	res, err := w.rule.Apply(ctx, e)
+	if err != nil {
+		return false, fmt.Errorf("error in rule %T: %w", w.rule, err)
+	}
+	return res, nil
+}
+
+func (w MessageWrapper) String() string {
+	return fmt.Sprintf("websocket message and %s", w.rule)
+}
+
+// IsMessageRule reports whether the rule is of the ws:: family.
+func IsMessageRule(rule Rule) bool {
+	_, ok := rule.(MessageWrapper)
+	return ok
+}
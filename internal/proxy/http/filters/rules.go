@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"goxy/internal/common"
 	"goxy/internal/proxy/http/wrapper"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 var (
-	ErrInvalidRuleArgs  = errors.New("invalid rule arguments")
-	ErrInvalidInputType = errors.New("invalid input data")
+	ErrInvalidRuleArgs    = errors.New("invalid rule arguments")
+	ErrInvalidInputType   = errors.New("invalid input data")
+	ErrUnsupportedVerdict = errors.New("verdict not supported for http")
 )
 
 func NewContainsRawRule(cfg common.RuleConfig) (RawRule, error) {
@@ -40,6 +43,51 @@ func NewRegexRawRule(cfg common.RuleConfig) (RawRule, error) {
 	return RegexRawRule{re}, nil
 }
 
+// NewCounterGTRule takes the counter and the value, the counter may be preceded by the scope.
+func NewCounterGTRule(_ RuleSet, cfg common.RuleConfig) (Rule, error) {
+	if len(cfg.Args) != 2 && len(cfg.Args) != 3 {
+		return nil, ErrInvalidRuleArgs
+	}
+	scope, key, err := common.ParseScoped(cfg.Args[:len(cfg.Args)-1])
+	if err != nil {
+		return nil, err
+	}
+	val, err := strconv.Atoi(cfg.Args[len(cfg.Args)-1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing value: %w", err)
+	}
+	return CounterGTRule{scope: scope, key: key, value: val}, nil
+}
+
+// NewFlagRule takes the flag, optionally preceded by the scope.
+func NewFlagRule(_ RuleSet, cfg common.RuleConfig) (Rule, error) {
+	if len(cfg.Args) != 1 && len(cfg.Args) != 2 {
+		return nil, ErrInvalidRuleArgs
+	}
+	scope, flag, err := common.ParseScoped(cfg.Args)
+	if err != nil {
+		return nil, err
+	}
+	return FlagRule{scope: scope, flag: flag}, nil
+}
+
+// NewRateGTRule takes the key, the limit and the window, like "header:X-Api-Key", "10" and "10s".
+func NewRateGTRule(rs RuleSet, cfg common.RuleConfig) (Rule, error) {
+	if len(cfg.Args) != 3 {
+		return nil, ErrInvalidRuleArgs
+	}
+	key, err := common.ParseRateKey(cfg.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	limit, window, err := common.ParseRate(cfg.Args[1], cfg.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	limiter := rs.Limiters.Get(cfg.Type+"/"+cfg.Name+"/"+key.String(), limit, window)
+	return RateGTRule{key: key, limiter: limiter}, nil
+}
+
 type IngressRule struct{}
 
 func (r IngressRule) Apply(_ *common.ProxyContext, e wrapper.Entity) (bool, error) {
@@ -50,6 +98,69 @@ func (r IngressRule) String() string {
 	return "ingress"
 }
 
+type CounterGTRule struct {
+	scope string
+	key   string
+	value int
+}
+
+func (r CounterGTRule) Apply(ctx *common.ProxyContext, _ wrapper.Entity) (bool, error) {
+	return ctx.GetScopedCounter(r.scope, r.key) > r.value, nil
+}
+
+func (r CounterGTRule) String() string {
+	return fmt.Sprintf("counter '%s' > %d", common.ScopedName(r.scope, r.key), r.value)
+}
+
+// FlagRule matches if the flag is set in the scope, like the flag set for the client IP.
+type FlagRule struct {
+	scope string
+	flag  string
+}
+
+func (r FlagRule) Apply(ctx *common.ProxyContext, _ wrapper.Entity) (bool, error) {
+	return ctx.GetScopedFlag(r.scope, r.flag), nil
+}
+
+func (r FlagRule) String() string {
+	return fmt.Sprintf("flag '%s'", common.ScopedName(r.scope, r.flag))
+}
+
+// RateGTRule matches the requests over the rate limit, each request is counted once.
+type RateGTRule struct {
+	key     common.RateKey
+	limiter *common.RateLimiter
+}
+
+func (r RateGTRule) Apply(ctx *common.ProxyContext, e wrapper.Entity) (bool, error) {
+	key, ok := r.key.Resolve(ctx, rateKeyValue(r.key, e))
+	if !ok {
+		return false, nil
+	}
+	return r.limiter.HitOnce(ctx, key), nil
+}
+
+func (r RateGTRule) String() string {
+	return fmt.Sprintf("rate by %s > %d per %v", r.key, r.limiter.Limit, r.limiter.Window)
+}
+
+// rateKeyValue returns the header or the cookie value the rate is counted by.
+func rateKeyValue(key common.RateKey, e wrapper.Entity) string {
+	switch key.Source {
+	case common.RateKeyHeader:
+		if values := e.GetHeaders()[http.CanonicalHeaderKey(key.Name)]; len(values) != 0 {
+			return values[0]
+		}
+	case common.RateKeyCookie:
+		for _, c := range e.GetCookies() {
+			if c.Name == key.Name {
+				return c.Value
+			}
+		}
+	}
+	return ""
+}
+
 type ContainsRawRule struct {
 	value string
 }
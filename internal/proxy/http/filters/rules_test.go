@@ -0,0 +1,77 @@
+package filters
+
+import (
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/wrapper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateGTRule_Apply(t *testing.T) {
+	rule, err := NewRateGTRule(RuleSet{}, common.RuleConfig{Args: []string{"header:X-Api-Key", "1", "10s"}})
+	if err != nil {
+		t.Fatalf("NewRateGTRule() error = %v", err)
+	}
+	r := rule.(RateGTRule)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.limiter.SetClock(func() time.Time { return now })
+
+	tests := []struct {
+		name    string
+		apiKey  string
+		advance time.Duration
+		want    bool
+	}{
+		{"first request", "a", 0, false},
+		{"other key", "b", time.Second, false},
+		{"second request", "a", time.Second, true},
+		{"no key", "", 0, false},
+		{"no key again", "", 0, false},
+		// 25s: the windows of the first requests are over.
+		{"after the window", "a", time.Second * 23, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.apiKey != "" {
+				req.Header.Set("X-Api-Key", tt.apiKey)
+			}
+			got, err := r.Apply(common.NewProxyContext(), &wrapper.Request{Request: req})
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Apply() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerdictRateLimit_MutateEntity(t *testing.T) {
+	v, err := ParseVerdict("ratelimit::cookie:session::1::1m")
+	if err != nil {
+		t.Fatalf("ParseVerdict() error = %v", err)
+	}
+	verdict, ok := v.(VerdictRateLimit)
+	if !ok {
+		t.Fatalf("ParseVerdict() got = %T, want VerdictRateLimit", v)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	verdict.Limiter.SetClock(func() time.Time { return now })
+
+	for i, want := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		ctx := common.NewProxyContext()
+		if err := verdict.MutateEntity(ctx, &wrapper.Request{Request: req}); err != nil {
+			t.Fatalf("MutateEntity() error = %v", err)
+		}
+		if got := ctx.GetFlag(common.DropFlag); got != want {
+			t.Errorf("request %d dropped = %v, want %v", i, got, want)
+		}
+		now = now.Add(time.Second)
+	}
+}
@@ -8,6 +8,8 @@ import (
 
 type RuleSet struct {
 	Rules map[string]Rule
+	// Limiters keeps the windows of the rate rules across the reloads, nil creates the new limiters.
+	Limiters *common.RateLimiters
 }
 
 func (rs *RuleSet) GetRule(name string) (Rule, bool) {
@@ -20,13 +22,20 @@ func (rs *RuleSet) GetRule(name string) (Rule, bool) {
 	return nil, false
 }
 
+// NewRuleSet parses the http:: rules, which apply to requests and responses,
+// and the ws:: rules, which apply to WebSocket messages. Both families share the syntax.
 func NewRuleSet(cfg []common.RuleConfig) (*RuleSet, error) {
-	rs := RuleSet{Rules: make(map[string]Rule)}
+	return NewRuleSetWith(cfg, nil)
+}
+
+// NewRuleSetWith is NewRuleSet taking the rate limiters of the rules from the registry.
+func NewRuleSetWith(cfg []common.RuleConfig, limiters *common.RateLimiters) (*RuleSet, error) {
+	rs := RuleSet{Rules: make(map[string]Rule), Limiters: limiters}
 
 	for _, rc := range cfg {
-		if strings.HasPrefix(rc.Type, "http::") {
+		if strings.HasPrefix(rc.Type, "http::") || strings.HasPrefix(rc.Type, "ws::") {
 			tokens := strings.Split(rc.Type, "::")
-			if len(tokens) < 3 {
+			if len(tokens) < 2 {
 				return nil, fmt.Errorf("invalid rule: %s", rc.Type)
 			}
 
@@ -90,6 +99,9 @@ func NewRuleSet(cfg []common.RuleConfig) (*RuleSet, error) {
 				return nil, fmt.Errorf("entity converter for %s not specified", rc.Type)
 			}
 
+			if tokens[0] == "ws" {
+				rule = NewMessageWrapper(rule)
+			}
 			rs.Rules[rc.Name] = rule
 		}
 	}
@@ -0,0 +1,273 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/wrapper"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Modifier is the verdict changing the request or the response.
+// It's applied to the entity as soon as the filter matches, so the next filters see the change.
+// Modifications not applicable to the entity, like the status of the request, are skipped.
+type Modifier interface {
+	common.Verdict
+	Modify(e wrapper.Entity) (bool, error)
+}
+
+// EntityVerdict is the verdict depending on the request or the response, it's applied instead of Mutate.
+type EntityVerdict interface {
+	common.Verdict
+	MutateEntity(ctx *common.ProxyContext, e wrapper.Entity) error
+}
+
+// ParseVerdict parses the HTTP modification verdicts along with the common ones.
+func ParseVerdict(desc string) (common.Verdict, error) {
+	tokens := strings.Split(desc, "::")
+	switch strings.ToLower(tokens[0]) {
+	case "set_header":
+		// The value may contain the separator itself.
+		parts := strings.SplitN(desc, "::", 3)
+		if len(parts) < 3 || parts[1] == "" {
+			return nil, errors.New("header and value missing for set_header verdict")
+		}
+		return VerdictSetHeader{Name: parts[1], Value: parts[2]}, nil
+	case "remove_header":
+		if len(tokens) != 2 || tokens[1] == "" {
+			return nil, errors.New("header missing for remove_header verdict")
+		}
+		return VerdictRemoveHeader{Name: tokens[1]}, nil
+	case "replace_header":
+		parts := strings.SplitN(desc, "::", 4)
+		if len(parts) < 4 || parts[1] == "" {
+			return nil, errors.New("header, pattern and replacement missing for replace_header verdict")
+		}
+		pattern, err := regexp.Compile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace_header pattern: %w", err)
+		}
+		return VerdictReplaceHeader{Name: parts[1], Pattern: pattern, Replacement: parts[3]}, nil
+	case "replace_body":
+		parts := strings.SplitN(desc, "::", 3)
+		if len(parts) < 3 {
+			return nil, errors.New("pattern and replacement missing for replace_body verdict")
+		}
+		pattern, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace_body pattern: %w", err)
+		}
+		return VerdictReplaceBody{Pattern: pattern, Replacement: []byte(parts[2])}, nil
+	case "set_query":
+		parts := strings.SplitN(desc, "::", 3)
+		if len(parts) < 3 || parts[1] == "" {
+			return nil, errors.New("parameter and value missing for set_query verdict")
+		}
+		return VerdictSetQuery{Name: parts[1], Value: parts[2]}, nil
+	case "remove_query":
+		if len(tokens) != 2 || tokens[1] == "" {
+			return nil, errors.New("parameter missing for remove_query verdict")
+		}
+		return VerdictRemoveQuery{Name: tokens[1]}, nil
+	case "set_status":
+		if len(tokens) != 2 {
+			return nil, errors.New("status missing for set_status verdict")
+		}
+		code, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing status: %w", err)
+		}
+		if code < 100 || code > 999 {
+			return nil, fmt.Errorf("invalid status: %d", code)
+		}
+		return VerdictSetStatus{Code: code}, nil
+	case "ratelimit":
+		v, err := common.ParseRateLimit(tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		return VerdictRateLimit{v}, nil
+	default:
+		return common.ParseVerdict(desc)
+	}
+}
+
+// modification is embedded into the modification verdicts, they only change the entity.
+type modification struct{}
+
+func (modification) Mutate(_ *common.ProxyContext) error {
+	return nil
+}
+
+func headers(e wrapper.Entity) http.Header {
+	switch e.(type) {
+	case *wrapper.Request, *wrapper.Response:
+		return http.Header(e.GetHeaders())
+	default:
+		return nil
+	}
+}
+
+type VerdictSetHeader struct {
+	modification
+	Name  string
+	Value string
+}
+
+func (v VerdictSetHeader) Modify(e wrapper.Entity) (bool, error) {
+	if req, ok := e.(*wrapper.Request); ok {
+		req.SetHeader(v.Name, v.Value)
+		return true, nil
+	}
+	h := headers(e)
+	if h == nil {
+		return false, nil
+	}
+	h.Set(v.Name, v.Value)
+	return true, nil
+}
+
+func (v VerdictSetHeader) String() string {
+	return fmt.Sprintf("set header '%s' to '%s'", v.Name, v.Value)
+}
+
+type VerdictRemoveHeader struct {
+	modification
+	Name string
+}
+
+func (v VerdictRemoveHeader) Modify(e wrapper.Entity) (bool, error) {
+	h := headers(e)
+	if h == nil || h.Get(v.Name) == "" {
+		return false, nil
+	}
+	h.Del(v.Name)
+	return true, nil
+}
+
+func (v VerdictRemoveHeader) String() string {
+	return fmt.Sprintf("remove header '%s'", v.Name)
+}
+
+// VerdictReplaceHeader replaces the pattern matches in the header values.
+type VerdictReplaceHeader struct {
+	modification
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func (v VerdictReplaceHeader) Modify(e wrapper.Entity) (bool, error) {
+	h := headers(e)
+	if h == nil {
+		return false, nil
+	}
+	values := h[http.CanonicalHeaderKey(v.Name)]
+	changed := false
+	for i, val := range values {
+		if result := v.Pattern.ReplaceAllString(val, v.Replacement); result != val {
+			values[i] = result
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func (v VerdictReplaceHeader) String() string {
+	return fmt.Sprintf("replace '%s' in header '%s' with '%s'", v.Pattern, v.Name, v.Replacement)
+}
+
+// VerdictReplaceBody replaces the pattern matches in the body, Content-Length is updated to match.
+type VerdictReplaceBody struct {
+	modification
+	Pattern     *regexp.Regexp
+	Replacement []byte
+}
+
+func (v VerdictReplaceBody) Modify(e wrapper.Entity) (bool, error) {
+	replace := func(data []byte) []byte {
+		return v.Pattern.ReplaceAll(data, v.Replacement)
+	}
+	switch e := e.(type) {
+	case *wrapper.Request:
+		return e.ReplaceBody(replace)
+	case *wrapper.Response:
+		return e.ReplaceBody(replace)
+	default:
+		return false, nil
+	}
+}
+
+func (v VerdictReplaceBody) String() string {
+	return fmt.Sprintf("replace '%s' in body with '%s'", v.Pattern, v.Replacement)
+}
+
+type VerdictSetQuery struct {
+	modification
+	Name  string
+	Value string
+}
+
+func (v VerdictSetQuery) Modify(e wrapper.Entity) (bool, error) {
+	req, ok := e.(*wrapper.Request)
+	if !ok {
+		return false, nil
+	}
+	req.SetQuery(v.Name, &v.Value)
+	return true, nil
+}
+
+func (v VerdictSetQuery) String() string {
+	return fmt.Sprintf("set query '%s' to '%s'", v.Name, v.Value)
+}
+
+type VerdictRemoveQuery struct {
+	modification
+	Name string
+}
+
+func (v VerdictRemoveQuery) Modify(e wrapper.Entity) (bool, error) {
+	req, ok := e.(*wrapper.Request)
+	if !ok {
+		return false, nil
+	}
+	if _, ok := req.Request.URL.Query()[v.Name]; !ok {
+		return false, nil
+	}
+	req.SetQuery(v.Name, nil)
+	return true, nil
+}
+
+func (v VerdictRemoveQuery) String() string {
+	return fmt.Sprintf("remove query '%s'", v.Name)
+}
+
+type VerdictSetStatus struct {
+	modification
+	Code int
+}
+
+func (v VerdictSetStatus) Modify(e wrapper.Entity) (bool, error) {
+	resp, ok := e.(*wrapper.Response)
+	if !ok {
+		return false, nil
+	}
+	resp.SetStatus(v.Code)
+	return true, nil
+}
+
+func (v VerdictSetStatus) String() string {
+	return fmt.Sprintf("set status %d", v.Code)
+}
+
+// VerdictRateLimit is the common rate limit, which can also count the requests by the header or the cookie.
+type VerdictRateLimit struct {
+	common.VerdictRateLimit
+}
+
+func (v VerdictRateLimit) MutateEntity(ctx *common.ProxyContext, e wrapper.Entity) error {
+	return v.Apply(ctx, rateKeyValue(v.Key, e))
+}
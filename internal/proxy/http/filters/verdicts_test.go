@@ -0,0 +1,125 @@
+package filters
+
+import (
+	"errors"
+	"goxy/internal/common"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseVerdict(t *testing.T) {
+	tests := []struct {
+		name    string
+		desc    string
+		want    common.Verdict
+		wantErr bool
+	}{
+		{
+			name: "set header",
+			desc: "set_header::X-Test::a::b",
+			want: VerdictSetHeader{Name: "X-Test", Value: "a::b"},
+		},
+		{
+			name:    "set header without value",
+			desc:    "set_header::X-Test",
+			wantErr: true,
+		},
+		{
+			name: "remove header",
+			desc: "remove_header::X-Test",
+			want: VerdictRemoveHeader{Name: "X-Test"},
+		},
+		{
+			name: "replace header",
+			desc: "replace_header::User-Agent::python.*::curl",
+			want: VerdictReplaceHeader{Name: "User-Agent", Pattern: regexp.MustCompile("python.*"), Replacement: "curl"},
+		},
+		{
+			name:    "replace header with invalid pattern",
+			desc:    "replace_header::User-Agent::(::curl",
+			wantErr: true,
+		},
+		{
+			name: "replace body",
+			desc: `replace_body::flag\{\w+\}::`,
+			want: VerdictReplaceBody{Pattern: regexp.MustCompile(`flag\{\w+\}`), Replacement: []byte{}},
+		},
+		{
+			name: "set query",
+			desc: "set_query::id::1",
+			want: VerdictSetQuery{Name: "id", Value: "1"},
+		},
+		{
+			name: "remove query",
+			desc: "remove_query::id",
+			want: VerdictRemoveQuery{Name: "id"},
+		},
+		{
+			name: "set status",
+			desc: "set_status::418",
+			want: VerdictSetStatus{Code: 418},
+		},
+		{
+			name:    "invalid status",
+			desc:    "set_status::42",
+			wantErr: true,
+		},
+		{
+			name: "common verdict",
+			desc: "drop",
+			want: common.VerdictSetFlag{Key: common.DropFlag},
+		},
+		{
+			name:    "unknown verdict",
+			desc:    "rewrite::a",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVerdict(tt.desc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseVerdict() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVerdict() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFilters_Rewriter(t *testing.T) {
+	rs := &RuleSet{Rules: map[string]Rule{}}
+	_, err := NewFilters([]common.FilterConfig{{Rule: "ingress", Verdict: "replace::a::b"}}, rs)
+	if err == nil {
+		t.Errorf("NewFilters() accepted the stream rewrite verdict")
+	}
+}
+
+func TestNewFilters_MessageModifier(t *testing.T) {
+	rs, err := NewRuleSet([]common.RuleConfig{
+		{Name: "message", Type: "ws::ingress::body::contains", Args: []string{"attack"}},
+		{Name: "request", Type: "http::ingress::body::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	tests := []struct {
+		rule    string
+		verdict string
+		wantErr bool
+	}{
+		{rule: "message", verdict: "replace_body::attack::safe", wantErr: true},
+		{rule: "message", verdict: "set_header::X-Test::1", wantErr: true},
+		{rule: "message", verdict: "drop"},
+		{rule: "request", verdict: "replace_body::attack::safe"},
+	}
+	for _, tt := range tests {
+		_, err := NewFilters([]common.FilterConfig{{Rule: tt.rule, Verdict: tt.verdict}}, rs)
+		if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrUnsupportedVerdict)) {
+			t.Errorf("NewFilters(%s, %s) error = %v, wantErr %v", tt.rule, tt.verdict, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/filters"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+// protoHandler answers with the protocol of the request, or with the flag if the body asks for it.
+func protoHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if strings.Contains(string(body), "secret") {
+		_, _ = fmt.Fprint(w, "flag{secret}")
+		return
+	}
+	_, _ = fmt.Fprint(w, r.Proto)
+}
+
+func h2cTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func TestProxy_HTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxy-h2")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	proxyCert, proxyKey := writeTestCert(t, dir, "proxy")
+
+	tlsTarget := httptest.NewUnstartedServer(http.HandlerFunc(protoHandler))
+	tlsTarget.EnableHTTP2 = true
+	tlsTarget.StartTLS()
+	defer tlsTarget.Close()
+
+	h2cTarget := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(protoHandler), &http2.Server{}))
+	defer h2cTarget.Close()
+
+	tests := []struct {
+		name       string
+		cfg        common.ServiceConfig
+		scheme     string
+		client     http.RoundTripper
+		wantTarget string
+	}{
+		{
+			name: "h2 over tls",
+			cfg: common.ServiceConfig{
+				Target: strings.TrimPrefix(tlsTarget.URL, "https://"),
+				TLS:    &common.TLSConfig{Terminate: true, Cert: proxyCert, Key: proxyKey, Upstream: true, SkipVerify: true},
+			},
+			scheme: "https",
+			client: &http2.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			wantTarget: "HTTP/2.0",
+		},
+		{
+			name: "h2c prior knowledge",
+			cfg: common.ServiceConfig{
+				Target: strings.TrimPrefix(h2cTarget.URL, "http://"),
+				H2C:    true,
+			},
+			scheme:     "http",
+			client:     h2cTransport(),
+			wantTarget: "HTTP/2.0",
+		},
+		{
+			name: "h2c client to http/1.1 target",
+			cfg: common.ServiceConfig{
+				Target: strings.TrimPrefix(h2cTarget.URL, "http://"),
+			},
+			scheme:     "http",
+			client:     h2cTransport(),
+			wantTarget: "HTTP/1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = "h2"
+			tt.cfg.Type = "http"
+			tt.cfg.Listen = "127.0.0.1:0"
+			tt.cfg.Filters = []common.FilterConfig{{Rule: "flag", Verdict: "drop"}}
+			p := startTestProxy(t, tt.cfg, []common.RuleConfig{
+				{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+			})
+			client := &http.Client{Transport: tt.client, Timeout: time.Second * 5}
+			url := fmt.Sprintf("%s://%s/", tt.scheme, p.Addr())
+
+			resp, err := client.Post(url, "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatalf("Post() error = %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Errorf("client protocol = %s, want HTTP/2.0", resp.Proto)
+			}
+			if string(body) != tt.wantTarget {
+				t.Errorf("target protocol = %q, want %q", body, tt.wantTarget)
+			}
+
+			resp, err = client.Post(url, "text/plain", strings.NewReader("secret"))
+			if err != nil {
+				t.Fatalf("Post() error = %v", err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("dropped stream status = %d, want 204", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestProxy_H2CUpgrade(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(protoHandler))
+	defer target.Close()
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "h2c",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+	}, nil)
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatalf("SetDeadline() error = %v", err)
+	}
+
+	// Empty settings payload, the request itself is answered on the stream 1.
+	_, _ = fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %d, want 101", resp.StatusCode)
+	}
+
+	if _, err := fmt.Fprint(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("writing preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("WriteSettings() error = %v", err)
+	}
+
+	status := ""
+	body := new(bytes.Buffer)
+	dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame() error = %v", err)
+		}
+		if f.Header().StreamID != 1 {
+			continue
+		}
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			if _, err := dec.Write(f.HeaderBlockFragment()); err != nil {
+				t.Fatalf("decoding headers: %v", err)
+			}
+		case *http2.DataFrame:
+			body.Write(f.Data())
+		}
+		if f.Header().Flags.Has(http2.FlagDataEndStream) {
+			break
+		}
+	}
+	if status != "200" || body.String() != "HTTP/1.1" {
+		t.Errorf("response = %s %q, want 200 HTTP/1.1", status, body)
+	}
+}
+
+func TestNewProxy_H2CUpstreamTLS(t *testing.T) {
+	rs, err := filters.NewRuleSet(nil)
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	_, err = NewProxy(common.ServiceConfig{
+		Name:   "h2c tls",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: "127.0.0.1:1",
+		H2C:    true,
+		TLS:    &common.TLSConfig{Upstream: true},
+	}, rs, nil)
+	if !errors.Is(err, ErrH2CUpstreamTLS) {
+		t.Errorf("NewProxy() error = %v, want %v", err, ErrH2CUpstreamTLS)
+	}
+}
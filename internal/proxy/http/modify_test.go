@@ -0,0 +1,170 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"goxy/internal/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxy_ModifyRequest(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "host=%s added=%s removed=%s ua=%s query=%s length=%d body=%s",
+			r.Host, r.Header.Get("X-Added"), r.Header.Get("X-Removed"), r.UserAgent(),
+			r.URL.RawQuery, r.ContentLength, body)
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "modify",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "ingress", Verdict: "set_header::X-Added::yes"},
+			{Rule: "ingress", Verdict: "set_header::Host::example.com"},
+			{Rule: "ingress", Verdict: "remove_header::X-Removed"},
+			{Rule: "ingress", Verdict: "replace_header::User-Agent::python.*::curl"},
+			{Rule: "ingress", Verdict: "set_query::id::2"},
+			{Rule: "ingress", Verdict: "remove_query::debug"},
+			{Rule: "ingress", Verdict: `replace_body::flag\{\w+\}::[redacted]`},
+			// The rules after the modification see the changed request.
+			{Rule: "redacted", Verdict: "drop"},
+			{Rule: "modified", Verdict: "drop"},
+		},
+	}, []common.RuleConfig{
+		{Name: "redacted", Type: "http::ingress::body::contains", Args: []string{"flag{"}},
+		{Name: "modified", Type: "http::ingress::query::contains", Field: "debug", Args: []string{"1"}},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+p.Addr().String()+"/?id=1&debug=1",
+		strings.NewReader("a flag{abc} b"))
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	req.Header.Set("X-Removed", "yes")
+	req.Header.Set("User-Agent", "python-requests/2.18.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	want := "host=example.com added=yes removed= ua=curl query=id=2 length=14 body=a [redacted] b"
+	if resp.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, body, want)
+	}
+}
+
+func TestProxy_ModifyResponse(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("X-Powered-By", "php")
+		_, _ = w.Write(compress(t, encoding, "secret: flag{abc}"))
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "modify",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "flag", Verdict: "set_status::404"},
+			{Rule: "flag", Verdict: `replace_body::flag\{\w+\}::nope`},
+			// Body has no flag after the previous filter.
+			{Rule: "flag", Verdict: "set_status::500"},
+			{Rule: "egress", Verdict: "remove_header::X-Powered-By"},
+		},
+	}, []common.RuleConfig{
+		{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+	})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, encoding := range []string{"", "gzip"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			resp, err := client.Get("http://" + p.Addr().String() + "/?encoding=" + encoding)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusNotFound || string(body) != "secret: nope" {
+				t.Errorf("response = %d %q, want 404 %q", resp.StatusCode, body, "secret: nope")
+			}
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len(body))
+			}
+			// Changed compressed body is sent decoded.
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if got := resp.Header.Get("X-Powered-By"); got != "" {
+				t.Errorf("X-Powered-By = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestProxy_ModifyResponse_Undecoded(t *testing.T) {
+	gzipped := compress(t, "gzip", "secret: flag{abc}")
+	bodies := map[string][]byte{
+		// Not supported, the rules see it raw.
+		"zstd": []byte("secret: flag{abc}"),
+		// The checksum is cut off, the body is decoded only partly.
+		"gzip": gzipped[:len(gzipped)-4],
+	}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		w.Header().Set("Content-Encoding", encoding)
+		_, _ = w.Write(bodies[encoding])
+	}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "modify",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "flag", Verdict: `replace_body::flag\{\w+\}::nope`},
+		},
+	}, []common.RuleConfig{
+		{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+	})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for encoding, want := range bodies {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+p.Addr().String()+"/?encoding="+encoding, nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			// Otherwise the transport to the target asks for gzip itself and decodes it.
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			if !bytes.Equal(body, want) {
+				t.Errorf("body = %q, want untouched %q", body, want)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, encoding)
+			}
+		})
+	}
+}
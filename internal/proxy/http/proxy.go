@@ -2,72 +2,118 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"go.uber.org/atomic"
+	"goxy/internal/alerts"
+	"goxy/internal/capture"
 	"goxy/internal/common"
+	"goxy/internal/metrics"
 	"goxy/internal/proxy/http/filters"
 	"goxy/internal/proxy/http/wrapper"
+	"goxy/internal/tlsconfig"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
 	ErrShutdownTimeout = errors.New("proxy shutdown timeout")
 	ErrInvalidFilter   = errors.New("no such filter")
+	ErrH2CUpstreamTLS  = errors.New("h2c can't be used with upstream tls")
 )
 
-func NewProxy(cfg common.ServiceConfig, rs *filters.RuleSet) (*Proxy, error) {
-	fts := make([]filters.Filter, 0, len(cfg.Filters))
-	for _, f := range cfg.Filters {
-		rule, ok := rs.GetRule(f.Rule)
-		if !ok {
-			return nil, fmt.Errorf("invalid rule name: %s", f.Rule)
-		}
-		verdict, err := common.ParseVerdict(f.Verdict)
-		if err != nil {
-			return nil, fmt.Errorf("parse verdict: %w", err)
+func NewProxy(cfg common.ServiceConfig, rs *filters.RuleSet, cs *capture.Store) (*Proxy, error) {
+	fts, err := filters.NewFilters(cfg.Filters, rs)
+	if err != nil {
+		return nil, fmt.Errorf("creating filters: %w", err)
+	}
+
+	var serverTLS, clientTLS *tls.Config
+	if cfg.TLS != nil {
+		if cfg.TLS.Terminate {
+			if serverTLS, err = tlsconfig.Server(cfg.TLS); err != nil {
+				return nil, fmt.Errorf("creating server tls config: %w", err)
+			}
+			// HTTP/2 is negotiated with the clients supporting it.
+			serverTLS.NextProtos = []string{"h2", "http/1.1"}
 		}
-		filter := filters.Filter{
-			Rule:    rule,
-			Verdict: verdict,
+		if cfg.TLS.Upstream {
+			if clientTLS, err = tlsconfig.Client(cfg.TLS, cfg.Target); err != nil {
+				return nil, fmt.Errorf("creating client tls config: %w", err)
+			}
 		}
-		filter.SetAlert(f.Alert)
-		fts = append(fts, filter)
+	}
+	transport, err := newTransport(cfg, clientTLS)
+	if err != nil {
+		return nil, fmt.Errorf("creating transport: %w", err)
 	}
 
 	logger := logrus.WithField("type", "http").WithField("listen", cfg.Listen)
+	// Cancelled on shutdown, so the delayed connections don't hold it.
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &Proxy{
 		ListenAddr: cfg.Listen,
-		TargetAddr: cfg.Target,
 
 		serviceConfig: cfg,
 		logger:        logger,
 		filters:       fts,
+		serverTLS:     serverTLS,
+		clientTLS:     clientTLS,
+		transport:     transport,
+		client:        &http.Client{Transport: transport},
+		sockets:       newSocketSet(),
+		blackholes:    newConnSet(),
+		conns:         newRawConns(),
+		mimic:         new(mimicCache),
+		capture:       cs,
+		stats:         new(common.ProxyStats),
+		ctx:           ctx,
+		cancel:        cancel,
 		wg:            new(sync.WaitGroup),
+		mu:            new(sync.RWMutex),
 	}
 	return p, nil
 }
 
 type Proxy struct {
 	ListenAddr string
-	TargetAddr string
 
 	serviceConfig common.ServiceConfig
 	closing       bool
 	listening     atomic.Bool
 	server        *http.Server
+	listener      net.Listener
+	serverTLS     *tls.Config
+	clientTLS     *tls.Config
+	transport     http.RoundTripper
 	client        *http.Client
+	sockets       *socketSet
+	blackholes    *connSet
+	conns         *rawConns
+	mimic         *mimicCache
+	capture       *capture.Store
+	stats         *common.ProxyStats
+	active        atomic.Int64
+	requestSeq    atomic.Int64
+	ctx           context.Context
+	cancel        context.CancelFunc
 	wg            *sync.WaitGroup
 	logger        *logrus.Entry
 	filters       []filters.Filter
+	mu            *sync.RWMutex
 }
 
-func (p Proxy) GetListening() bool {
+func (p *Proxy) GetListening() bool {
 	return p.listening.Load()
 }
 
@@ -75,29 +121,151 @@ func (p *Proxy) SetListening(state bool) {
 	p.listening.Store(state)
 }
 
-func (p *Proxy) SetFilterState(filter int, enabled, alert bool) error {
+func (p *Proxy) GetStats() *common.ProxyStats {
+	return p.stats
+}
+
+func (p *Proxy) ActiveConnections() int {
+	return int(p.active.Load())
+}
+
+// GetShadow reports whether the whole service is in shadow mode:
+// filters are evaluated and their matches are recorded, but verdicts are never applied.
+func (p *Proxy) GetShadow() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.serviceConfig.Shadow
+}
+
+func (p *Proxy) SetShadow(shadow bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serviceConfig.Shadow = shadow
+}
+
+func (p *Proxy) SetFilterState(filter int, enabled, alert, shadow bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	if filter < 0 || filter >= len(p.filters) {
 		return ErrInvalidFilter
 	}
 	p.filters[filter].SetEnabled(enabled)
 	p.filters[filter].SetAlert(alert)
+	p.filters[filter].SetShadow(shadow)
 	return nil
 }
 
+// Reload replaces the service config and the filter chain of the running proxy.
+// Listen address, TLS and protocol settings cannot be changed without restarting the proxy, so they're ignored.
+// Filters with the same rule and verdict keep their counters.
+// Requests that are already being processed finish with the old filters.
+func (p *Proxy) Reload(cfg common.ServiceConfig, fts []filters.Filter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg.Listen = p.ListenAddr
+	cfg.TLS = p.serviceConfig.TLS
+	cfg.H2C = p.serviceConfig.H2C
+	filters.KeepStats(fts, p.filters)
+	p.serviceConfig = cfg
+	p.filters = fts
+	p.logger.Info("Configuration reloaded")
+}
+
 func (p *Proxy) Start() error {
-	p.wg.Add(1)
 	p.SetListening(true)
 
+	listener, err := net.Listen("tcp", p.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("running listen: %w", err)
+	}
+	p.listener = countingListener{Listener: listener, stats: p.stats, conns: p.conns, once: new(sync.Once)}
+	if p.serverTLS != nil {
+		p.listener = tls.NewListener(p.listener, p.serverTLS)
+	}
+
+	// HTTP/2 is served over TLS if the client negotiates it,
+	// and in cleartext both with prior knowledge and after the h2c upgrade.
+	h2s := &http2.Server{IdleTimeout: time.Second * 30}
+	p.server = &http.Server{
+		Addr:        p.ListenAddr,
+		ReadTimeout: time.Second * 15,
+		// No write timeout, as the streamed responses may last long.
+		IdleTimeout: time.Second * 30,
+		Handler:     h2c.NewHandler(p.getHandler(), h2s),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				p.stats.AddConnection()
+				p.active.Inc()
+			case http.StateClosed, http.StateHijacked:
+				p.active.Dec()
+			}
+		},
+	}
+	if err := http2.ConfigureServer(p.server, h2s); err != nil {
+		return fmt.Errorf("configuring http2: %w", err)
+	}
+
+	p.wg.Add(1)
 	go p.serve()
 	return nil
 }
 
-func (p *Proxy) Shutdown(ctx context.Context) error {
+// CloseListener stops accepting new connections, the active ones are kept.
+func (p *Proxy) CloseListener() error {
 	p.closing = true
+	if p.listener == nil {
+		return nil
+	}
+	if err := p.listener.Close(); err != nil {
+		return fmt.Errorf("closing listener: %w", err)
+	}
+	return nil
+}
+
+// Drain stops accepting new connections and waits for the active requests to finish.
+// Connections still open when ctx is done are closed.
+func (p *Proxy) Drain(ctx context.Context) error {
+	if err := p.CloseListener(); err != nil {
+		return err
+	}
+	if p.server == nil {
+		return nil
+	}
+
 	if err := p.server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("shutting down server: %w", err)
+		if ctx.Err() == nil {
+			return fmt.Errorf("shutting down server: %w", err)
+		}
+		p.logger.Infof("Drain timeout, closing %d connections", p.ActiveConnections())
+		p.cancel()
+		if err := p.server.Close(); err != nil {
+			return fmt.Errorf("closing server: %w", err)
+		}
 	}
-	p.client.CloseIdleConnections()
+	// Blackholed clients get no answer anyway.
+	p.blackholes.closeAll()
+	if err := p.sockets.wait(ctx); err != nil {
+		p.logger.Infof("Drain timeout, closing websockets")
+		p.sockets.closeAll(closeGoingAway)
+	}
+	p.getClient().CloseIdleConnections()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.closing = true
+	p.cancel()
+	p.sockets.closeAll(closeGoingAway)
+	p.blackholes.closeAll()
+	// The server is missing if the proxy has not started.
+	if p.server != nil {
+		if err := p.server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shutting down server: %w", err)
+		}
+	}
+	p.getClient().CloseIdleConnections()
 
 	done := make(chan interface{}, 1)
 	go func() {
@@ -114,39 +282,135 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (p Proxy) GetConfig() *common.ServiceConfig {
-	return &p.serviceConfig
+func (p *Proxy) GetConfig() *common.ServiceConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cfg := p.serviceConfig
+	return &cfg
 }
 
-func (p Proxy) String() string {
+func (p *Proxy) String() string {
+	if p.serverTLS != nil {
+		return fmt.Sprintf("HTTPS proxy %s", p.ListenAddr)
+	}
 	return fmt.Sprintf("HTTP proxy %s", p.ListenAddr)
 }
 
-func (p Proxy) GetFilters() []common.Filter {
-	result := make([]common.Filter, 0, len(p.filters))
-	for _, f := range p.filters {
-		f := f
-		result = append(result, &f)
+// Addr returns the address the proxy is listening on, or nil if it's not started.
+func (p *Proxy) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+func (p *Proxy) GetFilters() []common.Filter {
+	fts := p.getFilters()
+	result := make([]common.Filter, 0, len(fts))
+	for i := range fts {
+		result = append(result, &fts[i])
 	}
 	return result
 }
 
-func (p Proxy) runFilters(pctx *common.ProxyContext, e wrapper.Entity) error {
-	for _, f := range p.filters {
-		if !f.IsEnabled() {
+func (p *Proxy) getFilters() []filters.Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.filters
+}
+
+func (p *Proxy) getClient() *http.Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.client
+}
+
+// requestInfo identifies the proxied request in the captures and alerts.
+type requestInfo struct {
+	id         string
+	clientAddr string
+	capture    *capture.Session
+}
+
+func (p *Proxy) runFilters(pctx *common.ProxyContext, req requestInfo, e wrapper.Entity) error {
+	return applyFilters(pctx, p.getFilters(), e, p.GetShadow(), func(f *filters.Filter, shadow bool) {
+		req.capture.AddMatch(f.Name, f.Verdict.String(), e.GetIngress(), shadow)
+		if shadow {
+			p.logger.Debugf("Rule %v triggered in shadow mode", f.Rule)
+			return
+		}
+		reasons := pctx.TakeAlerts()
+		if f.GetAlert() {
+			p.logger.Warningf("Rule %v triggered", f.Rule)
+			reasons = append(reasons, alerts.ReasonRuleTriggered)
+		}
+		if len(reasons) == 0 {
+			return
+		}
+		payload, err := dumpEntity(e)
+		if err != nil {
+			p.logger.Errorf("Error dumping payload for alert: %v", err)
+		}
+		for _, reason := range reasons {
+			alerts.Publish(alerts.Alert{
+				Service:    p.GetConfig().Name,
+				Rule:       f.Name,
+				Reason:     reason,
+				ConnID:     req.id,
+				RecordID:   req.capture.ID(),
+				ClientAddr: req.clientAddr,
+				Ingress:    e.GetIngress(),
+				Payload:    alerts.Excerpt(payload),
+			})
+		}
+	})
+}
+
+// applyFilters runs the filter chain over the entity, calling matched for each triggered filter.
+// matched is called after the verdict is applied.
+// WebSocket messages are checked only by the ws:: rules, requests and responses by the rest.
+// Verdicts of the shadow filters, or of all filters if shadow is set, are not applied.
+// Modification verdicts change the entity right away, the next filters see the change.
+// Chain stops after the filter dropping or accepting the request.
+func applyFilters(
+	pctx *common.ProxyContext,
+	fts []filters.Filter,
+	e wrapper.Entity,
+	shadow bool,
+	matched func(f *filters.Filter, shadow bool),
+) error {
+	_, message := e.(*wrapper.Message)
+	for i := range fts {
+		f := &fts[i]
+		if !f.IsEnabled() || filters.IsMessageRule(f.Rule) != message {
 			continue
 		}
+		stats := f.GetStats()
+		stats.AddEvaluation()
 		res, err := f.Rule.Apply(pctx, e)
 		if err != nil {
+			stats.AddError()
 			return fmt.Errorf("error in rule %T: %w", f.Rule, err)
 		}
 		if res {
-			if f.GetAlert() {
-				p.logger.Warningf("Rule %v triggered", f.Rule)
+			stats.AddMatch()
+			if shadow || f.GetShadow() {
+				matched(f, true)
+				continue
 			}
-			if err := f.Verdict.Mutate(pctx); err != nil {
+			dropped := pctx.GetFlag(common.DropFlag)
+			err := mutate(pctx, f.Verdict, e)
+			if err == nil {
+				err = modify(pctx, f.Verdict, e)
+			}
+			matched(f, false)
+			if err != nil {
+				stats.AddError()
 				return fmt.Errorf("error mutating verdict %T: %w", f.Verdict, err)
 			}
+			if !dropped && pctx.GetFlag(common.DropFlag) {
+				stats.AddDrop()
+			}
 			if pctx.GetFlag(common.DropFlag) || pctx.GetFlag(common.AcceptFlag) {
 				break
 			}
@@ -155,22 +419,46 @@ func (p Proxy) runFilters(pctx *common.ProxyContext, e wrapper.Entity) error {
 	return nil
 }
 
-func (p Proxy) getHandler() http.HandlerFunc {
+// mutate applies the verdict to the context, the entity verdicts also see the request or the response.
+func mutate(pctx *common.ProxyContext, v common.Verdict, e wrapper.Entity) error {
+	if ev, ok := v.(filters.EntityVerdict); ok {
+		return ev.MutateEntity(pctx, e)
+	}
+	return v.Mutate(pctx)
+}
+
+// modify applies the modification verdict to the entity, setting the modified flag if it has changed.
+func modify(pctx *common.ProxyContext, v common.Verdict, e wrapper.Entity) error {
+	m, ok := v.(filters.Modifier)
+	if !ok {
+		return nil
+	}
+	changed, err := m.Modify(e)
+	if err != nil {
+		return fmt.Errorf("modifying entity: %w", err)
+	}
+	if changed {
+		pctx.SetFlag(common.ModifiedFlag)
+	}
+	return nil
+}
+
+func (p *Proxy) getHandler() http.HandlerFunc {
 	handleError := func(w http.ResponseWriter) {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 	}
-	handleDrop := func(w http.ResponseWriter) {
-		w.WriteHeader(http.StatusNoContent)
-	}
-	wrapBody := func(body io.ReadCloser) (io.ReadCloser, error) {
-		w, err := wrapper.NewBodyReader(body)
+	wrapBody := func(body io.ReadCloser, limit int64, idle time.Duration) (*wrapper.BodyReader, error) {
+		br, err := wrapper.NewStreamingBodyReader(body, limit, idle)
 		if err != nil {
 			return nil, fmt.Errorf("creating reader: %w", err)
 		}
-		if err := body.Close(); err != nil {
-			return nil, fmt.Errorf("closing original body: %w", err)
+		// The rest of the partially read body is passed through later.
+		if !br.Partial() {
+			if err := body.Close(); err != nil {
+				return nil, fmt.Errorf("closing original body: %w", err)
+			}
 		}
-		return w, nil
+		return br, nil
 	}
 
 	reqLogger := p.logger.WithField("side", "request")
@@ -178,60 +466,173 @@ func (p Proxy) getHandler() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqLogger.Debugf("New request: %v", r)
+		p.stats.AddRequest()
+
+		cfg := p.GetConfig()
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer func() {
+			metrics.HTTPRequests.WithLabelValues(cfg.Name, strconv.Itoa(sw.status)).Inc()
+			metrics.HTTPRequestDuration.WithLabelValues(cfg.Name).Observe(time.Since(start).Seconds())
+		}()
 
 		if !p.GetListening() {
 			reqLogger.Debugf("Proxy is not listening, dropping")
-			handleDrop(w)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
-		var err error
-		if r.Body, err = wrapBody(r.Body); err != nil {
+		reqBody, err := wrapBody(r.Body, cfg.MaxInspectBody, 0)
+		if err != nil {
 			reqLogger.Errorf("Error wrapping body: %v", err)
 			handleError(w)
 			return
 		}
+		defer reqBody.Release()
+		r.Body = reqBody
+
+		pctx := common.NewServiceContext(cfg, r.RemoteAddr)
+		if session := sessionID(r, cfg.GetSessionCookies()); session != "" {
+			pctx.SetScopeKey(common.ScopeSession, cfg.Name+"/"+session)
+		}
+		sess := p.capture.NewSession(cfg.Name, "http", r.RemoteAddr, cfg.Target)
+		defer func() {
+			sess.Finish(capture.VerdictFromContext(pctx))
+		}()
+		if sess != nil {
+			sess.SetHTTPInfo(capture.HTTPInfo{Method: r.Method, URL: r.URL.String()})
+			if raw, err := dumpRequest(r); err != nil {
+				reqLogger.Errorf("Error dumping request: %v", err)
+			} else {
+				sess.AddChunk(true, raw)
+			}
+		}
+
+		req := requestInfo{
+			id:         strconv.FormatInt(p.requestSeq.Inc(), 10),
+			clientAddr: r.RemoteAddr,
+			capture:    sess,
+		}
+		if p.checkBody(cfg, reqBody, req, true) {
+			reqLogger.Debugf("Dropping oversized body")
+			pctx.SetFlag(common.DropFlag)
+			p.stats.AddDropped()
+			p.handleDrop(w, r, cfg, pctx)
+			return
+		}
+		p.checkEncoding(cfg, r.Header, r.ContentLength, req, true)
 
-		pctx := common.NewProxyContext()
 		reqEntity := &wrapper.Request{Request: r}
-		if err := p.runFilters(pctx, reqEntity); err != nil {
+		if err := p.runFilters(pctx, req, reqEntity); err != nil {
 			reqLogger.Errorf("Error running filters: %v", err)
 			handleError(w)
 			return
 		}
 
+		if err := p.delay(r, pctx); err != nil {
+			reqLogger.Debugf("Request delay interrupted: %v", err)
+			handleError(w)
+			return
+		}
+
 		if pctx.GetFlag(common.DropFlag) {
 			reqLogger.Debugf("Dropping connection")
-			handleDrop(w)
+			p.stats.AddDropped()
+			p.handleDrop(w, r, cfg, pctx)
 			return
 		}
 
 		r.URL.Scheme = "http"
-		r.URL.Host = p.TargetAddr
+		if cfg.TLS != nil && cfg.TLS.Upstream {
+			r.URL.Scheme = "https"
+		}
+		r.URL.Host = cfg.Target
 		r.RequestURI = ""
-		response, err := p.client.Do(r)
+		r.Body = reqBody.Stream()
+
+		// Timeout covers the request and the inspected part of the response, the rest may be streamed longer.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		timer := time.AfterFunc(requestTimeout(cfg), cancel)
+		defer timer.Stop()
+
+		var (
+			response *http.Response
+			upstream *wsConn
+		)
+		if isWebSocketUpgrade(r) {
+			response, upstream, err = p.dialUpgrade(r, cfg)
+			if upstream != nil {
+				// Closed by the socket if the target switches protocols, it's a no-op then.
+				defer upstream.conn.Close()
+			}
+		} else {
+			response, err = p.getClient().Do(r.WithContext(ctx))
+		}
 		if err != nil {
 			respLogger.Errorf("Error making target request: %v", err)
+			metrics.UpstreamErrors.WithLabelValues(cfg.Name).Inc()
 			handleError(w)
 			return
 		}
 
-		if response.Body, err = wrapBody(response.Body); err != nil {
+		// Bodies of unknown length may be streamed, so they're not waited for.
+		idle := time.Duration(0)
+		if response.ContentLength < 0 {
+			idle = cfg.GetBodyIdleTimeout()
+		}
+		respBody, err := wrapBody(response.Body, cfg.MaxInspectBody, idle)
+		if err != nil {
 			respLogger.Errorf("Error wrapping body: %v", err)
 			handleError(w)
 			return
 		}
+		defer respBody.Release()
+		timer.Stop()
+		response.Body = respBody
+
+		if sess != nil {
+			sess.SetStatus(response.StatusCode)
+			if raw, err := dumpResponse(response); err != nil {
+				respLogger.Errorf("Error dumping response: %v", err)
+			} else {
+				sess.AddChunk(false, raw)
+			}
+		}
+
+		if p.checkBody(cfg, respBody, req, false) {
+			respLogger.Debugf("Dropping oversized body")
+			pctx.SetFlag(common.DropFlag)
+			p.stats.AddDropped()
+			p.handleDrop(w, r, cfg, pctx)
+			return
+		}
+		p.checkEncoding(cfg, response.Header, response.ContentLength, req, false)
 
 		respEntity := &wrapper.Response{Response: response}
-		if err := p.runFilters(pctx, respEntity); err != nil {
+		if err := p.runFilters(pctx, req, respEntity); err != nil {
 			respLogger.Errorf("Error running filters: %v", err)
 			handleError(w)
 			return
 		}
 
+		if err := p.delay(r, pctx); err != nil {
+			respLogger.Debugf("Response delay interrupted: %v", err)
+			handleError(w)
+			return
+		}
+
 		if pctx.GetFlag(common.DropFlag) {
 			respLogger.Debugf("Dropping connection")
-			handleDrop(w)
+			p.stats.AddDropped()
+			p.handleDrop(w, r, cfg, pctx)
+			return
+		}
+
+		if upstream != nil && response.StatusCode == http.StatusSwitchingProtocols {
+			sw.status = response.StatusCode
+			p.serveWebSocket(sw.ResponseWriter, r, response, upstream, pctx, req, respLogger)
 			return
 		}
 
@@ -242,7 +643,12 @@ func (p Proxy) getHandler() http.HandlerFunc {
 		}
 		w.WriteHeader(response.StatusCode)
 
-		if _, err := io.Copy(w, response.Body); err != nil {
+		if rate := pctx.GetTarpit(); rate > 0 {
+			ctx, cancel := p.requestContext(r)
+			defer cancel()
+			w = newTarpitWriter(ctx, w, rate)
+		}
+		if err := copyBody(w, respBody.Stream(), respBody.Partial()); err != nil {
 			respLogger.Errorf("Error copying body: %v", err)
 			handleError(w)
 			return
@@ -250,29 +656,143 @@ func (p Proxy) getHandler() http.HandlerFunc {
 	}
 }
 
+// checkBody applies the oversized body policy to the body the filters don't see whole:
+// larger than the inspected size, or streamed on after the idle timeout.
+// It reports whether the request should be dropped.
+func (p *Proxy) checkBody(cfg *common.ServiceConfig, body *wrapper.BodyReader, req requestInfo, ingress bool) bool {
+	if !body.Partial() {
+		return false
+	}
+	switch cfg.OversizedBody {
+	case common.BodyPolicyDrop:
+		return true
+	case common.BodyPolicyAlert:
+		payload, err := ioutil.ReadAll(body)
+		if err != nil {
+			p.logger.Errorf("Error reading payload for alert: %v", err)
+		}
+		if err := body.Close(); err != nil {
+			p.logger.Errorf("Error resetting body: %v", err)
+		}
+		reason := alerts.ReasonBodyOversized
+		if !body.Oversized() {
+			reason = alerts.ReasonBodyPartial
+		}
+		alerts.Publish(alerts.Alert{
+			Service:    cfg.Name,
+			Reason:     reason,
+			ConnID:     req.id,
+			RecordID:   req.capture.ID(),
+			ClientAddr: req.clientAddr,
+			Ingress:    ingress,
+			Payload:    alerts.Excerpt(payload),
+		})
+	}
+	return false
+}
+
+// checkEncoding counts the body the filters see raw, as its content encoding isn't supported,
+// and raises the alert for it under the alert policy. Such bodies are never dropped.
+func (p *Proxy) checkEncoding(cfg *common.ServiceConfig, header http.Header, length int64, req requestInfo, ingress bool) {
+	if length == 0 {
+		return
+	}
+	coding := wrapper.UnsupportedEncoding(header)
+	if coding == "" {
+		return
+	}
+	p.stats.AddUndecoded()
+	if cfg.OversizedBody == common.BodyPolicyAlert {
+		alerts.Publish(alerts.Alert{
+			Service:    cfg.Name,
+			Reason:     alerts.ReasonBodyUndecoded,
+			ConnID:     req.id,
+			RecordID:   req.capture.ID(),
+			ClientAddr: req.clientAddr,
+			Ingress:    ingress,
+			Payload:    "Content-Encoding: " + coding,
+		})
+	}
+}
+
+// copyBody passes the body to the client. Partially buffered bodies are flushed as they come,
+// so the streaming responses are delivered without delay.
+func copyBody(w http.ResponseWriter, body io.ReadCloser, flush bool) error {
+	defer body.Close()
+	flusher, ok := w.(http.Flusher)
+	if !flush || !ok {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func (p *Proxy) serve() {
 	defer p.wg.Done()
 
 	p.logger.Info("Starting")
 
-	timeout := time.Second * 5
-	if p.serviceConfig.RequestTimeout != nil {
-		timeout = *p.serviceConfig.RequestTimeout
+	if err := p.server.Serve(p.listener); err != nil && err != http.ErrServerClosed && !p.closing {
+		p.logger.Errorf("Error in server: %v", err)
+	}
+	p.logger.Infof("Server shutdown complete")
+}
+
+// newTransport creates the transport to the target. HTTP/2 is used if the target negotiates it over TLS,
+// or with prior knowledge if the service has h2c set.
+func newTransport(cfg common.ServiceConfig, clientTLS *tls.Config) (http.RoundTripper, error) {
+	if cfg.H2C {
+		if clientTLS != nil {
+			return nil, ErrH2CUpstreamTLS
+		}
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}, nil
 	}
-	p.client = &http.Client{
-		Timeout: timeout,
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if clientTLS != nil {
+		transport.TLSClientConfig = clientTLS
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, fmt.Errorf("configuring http2: %w", err)
+		}
 	}
+	return transport, nil
+}
 
-	p.server = &http.Server{
-		Addr:         p.ListenAddr,
-		ReadTimeout:  time.Second * 15,
-		WriteTimeout: time.Second * 15,
-		IdleTimeout:  time.Second * 30,
-		Handler:      p.getHandler(),
+// requestTimeout returns how long the target may take to respond.
+func requestTimeout(cfg *common.ServiceConfig) time.Duration {
+	if cfg.RequestTimeout != nil {
+		return *cfg.RequestTimeout
 	}
+	return time.Second * 5
+}
 
-	if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		p.logger.Errorf("Error in server: %v", err)
+// sessionID returns the value of the first session cookie the request has.
+func sessionID(r *http.Request, cookies []string) string {
+	for _, name := range cookies {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
 	}
-	p.logger.Infof("Server shutdown complete")
+	return ""
 }
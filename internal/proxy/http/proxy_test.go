@@ -0,0 +1,188 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/filters"
+	"goxy/internal/tlsconfig"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert generates the certificate for the local addresses and returns the paths of its files.
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	certPEM, keyPEM, err := tlsconfig.GenerateCert([]string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("GenerateCert() error = %v", err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return certPath, keyPath
+}
+
+func startTestProxy(t *testing.T, cfg common.ServiceConfig, rules []common.RuleConfig) *Proxy {
+	t.Helper()
+
+	rs, err := filters.NewRuleSet(rules)
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p, err := NewProxy(cfg, rs, nil)
+	if err != nil {
+		t.Fatalf("NewProxy() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = p.Shutdown(ctx)
+	})
+	return p
+}
+
+func TestProxy_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxy-tls")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxyCert, proxyKey := writeTestCert(t, dir, "proxy")
+	targetCert, targetKey := writeTestCert(t, dir, "target")
+	otherCA, _ := writeTestCert(t, dir, "other")
+
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Errorf("target request is not encrypted")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "secret") {
+			_, _ = fmt.Fprint(w, "flag{secret}")
+			return
+		}
+		_, _ = fmt.Fprintf(w, "echo %s", body)
+	}))
+	cert, err := tls.LoadX509KeyPair(targetCert, targetKey)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair() error = %v", err)
+	}
+	target.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	target.StartTLS()
+	defer target.Close()
+
+	rules := []common.RuleConfig{
+		{Name: "attack", Type: "http::ingress::body::contains", Args: []string{"attack"}},
+		{Name: "flag", Type: "http::egress::body::contains", Args: []string{"flag{"}},
+	}
+	fts := []common.FilterConfig{
+		{Rule: "attack", Verdict: "drop"},
+		{Rule: "flag", Verdict: "drop"},
+	}
+
+	tests := []struct {
+		name       string
+		tls        common.TLSConfig
+		clientCA   string
+		wantStatus map[string]int
+	}{
+		{
+			name:     "cert files and pinned CA",
+			tls:      common.TLSConfig{Terminate: true, Cert: proxyCert, Key: proxyKey, Upstream: true, CA: targetCert},
+			clientCA: proxyCert,
+			wantStatus: map[string]int{
+				"hello":  http.StatusOK,
+				"attack": http.StatusNoContent,
+				"secret": http.StatusNoContent,
+			},
+		},
+		{
+			name: "self-signed and skip verify",
+			tls:  common.TLSConfig{Terminate: true, Upstream: true, SkipVerify: true},
+			wantStatus: map[string]int{
+				"hello":  http.StatusOK,
+				"attack": http.StatusNoContent,
+			},
+		},
+		{
+			name:     "wrong pinned CA",
+			tls:      common.TLSConfig{Terminate: true, Cert: proxyCert, Key: proxyKey, Upstream: true, CA: otherCA},
+			clientCA: proxyCert,
+			wantStatus: map[string]int{
+				"hello": http.StatusInternalServerError,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg := tt.tls
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:    "https",
+				Type:    "http",
+				Listen:  "127.0.0.1:0",
+				Target:  target.Listener.Addr().String(),
+				TLS:     &tlsCfg,
+				Filters: fts,
+			}, rules)
+
+			clientTLS := &tls.Config{InsecureSkipVerify: true}
+			if tt.clientCA != "" {
+				clientTLS, err = tlsconfig.Client(&common.TLSConfig{CA: tt.clientCA}, p.Addr().String())
+				if err != nil {
+					t.Fatalf("Client() error = %v", err)
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			defer client.CloseIdleConnections()
+
+			for body, want := range tt.wantStatus {
+				resp, err := client.Post("https://"+p.Addr().String()+"/", "text/plain", strings.NewReader(body))
+				if err != nil {
+					t.Fatalf("Post(%s) error = %v", body, err)
+				}
+				got, _ := ioutil.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("Post(%s) status = %d, want %d", body, resp.StatusCode, want)
+				}
+				if want == http.StatusOK && string(got) != "echo "+body {
+					t.Errorf("Post(%s) body = %q", body, got)
+				}
+			}
+		})
+	}
+
+	t.Run("plain client", func(t *testing.T) {
+		p := startTestProxy(t, common.ServiceConfig{
+			Name:   "https",
+			Type:   "http",
+			Listen: "127.0.0.1:0",
+			Target: target.Listener.Addr().String(),
+			TLS:    &common.TLSConfig{Terminate: true, Upstream: true, SkipVerify: true},
+		}, nil)
+		resp, err := http.Get("http://" + p.Addr().String() + "/")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				t.Errorf("Get() plain request proxied over TLS listener")
+			}
+		}
+	})
+}
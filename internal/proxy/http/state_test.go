@@ -0,0 +1,108 @@
+package http
+
+import (
+	"goxy/internal/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxy_SessionScope(t *testing.T) {
+	// The counts of the previous runs are forgotten.
+	common.SharedState = common.NewState()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "session scope",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "login", Verdict: "inc::session::logins"},
+			{Rule: "bruteforce", Verdict: "flag::ip::bruteforcer"},
+			{Rule: "bruteforcer", Verdict: "drop"},
+		},
+	}, []common.RuleConfig{
+		{Name: "login", Type: "http::ingress::path::contains", Args: []string{"/login"}},
+		{Name: "bruteforce", Type: "http::counter_gt", Args: []string{"session", "logins", "1"}},
+		{Name: "bruteforcer", Type: "http::flag", Args: []string{"ip", "bruteforcer"}},
+	})
+
+	get := func(path, session string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+p.Addr().String()+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "PHPSESSID", Value: session})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Requests without the session are not counted.
+	for i := 0; i < 3; i++ {
+		if got := get("/login", ""); got != http.StatusOK {
+			t.Fatalf("request without session got %d, want 200", got)
+		}
+	}
+	if got := get("/login", "a"); got != http.StatusOK {
+		t.Errorf("first login of session got %d, want 200", got)
+	}
+	if got := get("/login", "b"); got != http.StatusOK {
+		t.Errorf("first login of other session got %d, want 200", got)
+	}
+	// The second login of the session flags the client IP, which drops all its requests.
+	if got := get("/login", "a"); got != http.StatusNoContent {
+		t.Errorf("second login of session got %d, want 204", got)
+	}
+	if got := get("/", ""); got != http.StatusNoContent {
+		t.Errorf("request of flagged IP got %d, want 204", got)
+	}
+}
+
+func TestProxy_RateLimit(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "rate limit",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "api_flood", Verdict: "alert::api key flood"},
+			{Rule: "ingress", Verdict: "ratelimit::ip::3::1m"},
+		},
+	}, []common.RuleConfig{
+		{Name: "api_flood", Type: "http::ingress::rate_gt", Args: []string{"header:X-Api-Key", "1", "1m"}},
+	})
+
+	// The rate rule only raises the alert, the verdict drops the requests over the IP limit.
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNoContent} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+p.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatalf("NewRequest() error = %v", err)
+		}
+		req.Header.Set("X-Api-Key", "key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d got %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+
+	stats := p.GetFilters()[0].GetStats().Dump()
+	if stats.Matches != 3 {
+		t.Errorf("rate rule matches = %d, want 3", stats.Matches)
+	}
+}
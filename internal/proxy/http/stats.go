@@ -0,0 +1,75 @@
+package http
+
+import (
+	"goxy/internal/common"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// countingListener counts the bytes passing through the accepted connections.
+// Closing it more than once is a no-op.
+// Accepted connections are kept in conns until they're closed.
+type countingListener struct {
+	net.Listener
+	stats *common.ProxyStats
+	conns *rawConns
+	once  *sync.Once
+}
+
+func (l countingListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.conns.add(c)
+	return countingConn{Conn: c, stats: l.stats, conns: l.conns}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	stats *common.ProxyStats
+	conns *rawConns
+}
+
+func (c countingConn) Close() error {
+	c.conns.remove(c.Conn)
+	return c.Conn.Close()
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.AddBytes(true, n)
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.AddBytes(false, n)
+	return n, err
+}
+
+// statusWriter remembers the response status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,444 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/wrapper"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxMessageSize limits the WebSocket message buffered for the filters.
+const MaxMessageSize = 16 * 1024 * 1024
+
+// CloseWriteTimeout limits sending the close frames, so the stalled peers don't hold the close up.
+const CloseWriteTimeout = time.Second
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+
+	closeGoingAway      = 1001
+	closeProtocolError  = 1002
+	closePolicyViolated = 1008
+	closeTooBig         = 1009
+)
+
+var (
+	ErrWebSocketProtocol = errors.New("websocket protocol error")
+	ErrMessageTooLarge   = errors.New("websocket message too large")
+)
+
+// isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// message is the control frame or the complete data message, raw holds the frames as they were read.
+type message struct {
+	opcode  byte
+	payload []byte
+	raw     []byte
+}
+
+func (m *message) isData() bool {
+	return m.opcode == opText || m.opcode == opBinary
+}
+
+// messageReader reads the frames and assembles the fragmented data messages.
+// Control frames are returned as soon as they're read, even between the fragments.
+type messageReader struct {
+	r       *bufio.Reader
+	maxSize int
+	pending *message
+}
+
+func newMessageReader(r *bufio.Reader, maxSize int) *messageReader {
+	return &messageReader{r: r, maxSize: maxSize}
+}
+
+func (m *messageReader) next() (*message, error) {
+	for {
+		fin, opcode, payload, raw, err := m.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case opcode >= opClose:
+			if !fin || len(payload) > 125 {
+				return nil, fmt.Errorf("%w: invalid control frame", ErrWebSocketProtocol)
+			}
+			return &message{opcode: opcode, payload: payload, raw: raw}, nil
+		case opcode == opContinuation:
+			if m.pending == nil {
+				return nil, fmt.Errorf("%w: unexpected continuation frame", ErrWebSocketProtocol)
+			}
+		case opcode == opText || opcode == opBinary:
+			if m.pending != nil {
+				return nil, fmt.Errorf("%w: expected continuation frame", ErrWebSocketProtocol)
+			}
+			m.pending = &message{opcode: opcode}
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %d", ErrWebSocketProtocol, opcode)
+		}
+
+		if len(m.pending.payload)+len(payload) > m.maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		m.pending.payload = append(m.pending.payload, payload...)
+		m.pending.raw = append(m.pending.raw, raw...)
+		if fin {
+			msg := m.pending
+			m.pending = nil
+			return msg, nil
+		}
+	}
+}
+
+// readFrame returns the unmasked payload of the frame and the frame itself.
+func (m *messageReader) readFrame() (fin bool, opcode byte, payload, raw []byte, err error) {
+	head := make([]byte, 2, 14)
+	if _, err = io.ReadFull(m.r, head); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+
+	extra := 0
+	switch head[1] & 0x7f {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	head = head[:2+extra]
+	if _, err = io.ReadFull(m.r, head[2:]); err != nil {
+		err = noEOF(err)
+		return
+	}
+
+	length := uint64(head[1] & 0x7f)
+	rest := head[2:]
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		length = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	}
+	if length > uint64(m.maxSize) {
+		err = ErrMessageTooLarge
+		return
+	}
+
+	raw = make([]byte, len(head)+int(length))
+	copy(raw, head)
+	if _, err = io.ReadFull(m.r, raw[len(head):]); err != nil {
+		err = noEOF(err)
+		return
+	}
+	payload = append([]byte(nil), raw[len(head):]...)
+	if masked {
+		for i := range payload {
+			payload[i] ^= rest[i%4]
+		}
+	}
+	return
+}
+
+// noEOF reports the stream ending in the middle of the frame.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// closeFrame builds the close frame with the status code.
+// Frames sent to the server must be masked.
+func closeFrame(code uint16, masked bool) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	frame := []byte{0x80 | opClose, byte(len(payload))}
+	if masked {
+		key := make([]byte, 4)
+		_, _ = rand.Read(key)
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return append(frame, payload...)
+}
+
+// wsConn is one side of the proxied socket, writes may come from both directions.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+func (c *wsConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// socket is the WebSocket connection between the client and the target.
+type socket struct {
+	client   *wsConn
+	upstream *wsConn
+	once     sync.Once
+}
+
+// close closes both sides, sending them the close frame with the code if it's not zero.
+// The deadline also breaks the writes in progress, which hold the side locked.
+func (s *socket) close(code uint16) {
+	s.once.Do(func() {
+		if code != 0 {
+			deadline := time.Now().Add(CloseWriteTimeout)
+			_ = s.client.conn.SetWriteDeadline(deadline)
+			_ = s.upstream.conn.SetWriteDeadline(deadline)
+			_ = s.client.write(closeFrame(code, false))
+			_ = s.upstream.write(closeFrame(code, true))
+		}
+		_ = s.client.conn.Close()
+		_ = s.upstream.conn.Close()
+	})
+}
+
+// socketSet tracks the open sockets, as the server doesn't know about the hijacked connections.
+type socketSet struct {
+	mu      sync.Mutex
+	sockets map[*socket]struct{}
+	wg      sync.WaitGroup
+}
+
+func newSocketSet() *socketSet {
+	return &socketSet{sockets: make(map[*socket]struct{})}
+}
+
+func (s *socketSet) add(sock *socket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sockets[sock] = struct{}{}
+	s.wg.Add(1)
+}
+
+func (s *socketSet) remove(sock *socket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sockets[sock]; ok {
+		delete(s.sockets, sock)
+		s.wg.Done()
+	}
+}
+
+func (s *socketSet) closeAll(code uint16) {
+	s.mu.Lock()
+	sockets := make([]*socket, 0, len(s.sockets))
+	for sock := range s.sockets {
+		sockets = append(sockets, sock)
+	}
+	s.mu.Unlock()
+
+	for _, sock := range sockets {
+		sock.close(code)
+	}
+}
+
+// wait waits for all sockets to be closed, or for ctx to be done.
+func (s *socketSet) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialUpgrade sends the upgrade request to the target and reads its response.
+// The returned connection is used for the socket if the target switches protocols.
+func (p *Proxy) dialUpgrade(r *http.Request, cfg *common.ServiceConfig) (*http.Response, *wsConn, error) {
+	timeout := requestTimeout(cfg)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.TLS != nil && cfg.TLS.Upstream {
+		tlsCfg := p.clientTLS.Clone()
+		tlsCfg.NextProtos = []string{"http/1.1"}
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.Target, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.Target)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to target: %w", err)
+	}
+
+	// Compressed messages can't be filtered, so no extensions are negotiated.
+	r.Header.Del("Sec-WebSocket-Extensions")
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("setting deadline: %w", err)
+	}
+	if err := r.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("writing request: %w", err)
+	}
+	upstream := &wsConn{conn: conn, r: bufio.NewReader(conn)}
+	response, err := http.ReadResponse(upstream.r, r)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+	return response, upstream, nil
+}
+
+// serveWebSocket takes over the client connection after the target switched protocols
+// and relays the frames in both directions until either side closes the socket.
+// Every text and binary message is checked by the filters, drop closes the socket.
+func (p *Proxy) serveWebSocket(
+	w http.ResponseWriter,
+	r *http.Request,
+	response *http.Response,
+	upstream *wsConn,
+	pctx *common.ProxyContext,
+	req requestInfo,
+	logger *logrus.Entry,
+) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Errorf("Connection can't be hijacked")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		logger.Errorf("Error hijacking connection: %v", err)
+		return
+	}
+
+	sock := &socket{client: &wsConn{conn: conn, r: brw.Reader}, upstream: upstream}
+	p.sockets.add(sock)
+	p.active.Inc()
+	defer func() {
+		sock.close(0)
+		p.active.Dec()
+		p.sockets.remove(sock)
+	}()
+
+	// Server timeouts apply to the requests, not to the sockets.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logger.Errorf("Error resetting client deadline: %v", err)
+		return
+	}
+	if err := upstream.conn.SetDeadline(time.Time{}); err != nil {
+		logger.Errorf("Error resetting target deadline: %v", err)
+		return
+	}
+	if err := response.Write(conn); err != nil {
+		logger.Errorf("Error writing upgrade response: %v", err)
+		return
+	}
+
+	logger.Debugf("WebSocket established")
+	done := make(chan struct{})
+	go func() {
+		p.relayMessages(sock, r, true, pctx, req, logger)
+		close(done)
+	}()
+	p.relayMessages(sock, r, false, pctx, req, logger)
+	<-done
+	logger.Debugf("WebSocket closed")
+}
+
+// relayMessages forwards the frames in one direction, filtering the data messages.
+func (p *Proxy) relayMessages(
+	sock *socket,
+	r *http.Request,
+	ingress bool,
+	pctx *common.ProxyContext,
+	req requestInfo,
+	logger *logrus.Entry,
+) {
+	src, dst := sock.client, sock.upstream
+	if !ingress {
+		src, dst = sock.upstream, sock.client
+	}
+
+	mr := newMessageReader(src.r, MaxMessageSize)
+	for {
+		msg, err := mr.next()
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrMessageTooLarge):
+				logger.Debugf("Closing websocket: %v", err)
+				sock.close(closeTooBig)
+			case errors.Is(err, ErrWebSocketProtocol):
+				logger.Debugf("Closing websocket: %v", err)
+				sock.close(closeProtocolError)
+			default:
+				sock.close(0)
+			}
+			return
+		}
+
+		req.capture.AddChunk(ingress, msg.raw)
+		if msg.isData() {
+			e := &wrapper.Message{Request: r, Ingress: ingress, Text: msg.opcode == opText, Data: msg.payload}
+			if err := p.runFilters(pctx, req, e); err != nil {
+				logger.Errorf("Error running filters: %v", err)
+			}
+			if pctx.GetFlag(common.DropFlag) {
+				logger.Debugf("Dropping websocket")
+				p.stats.AddDropped()
+				sock.close(closePolicyViolated)
+				return
+			}
+		}
+
+		if err := dst.write(msg.raw); err != nil {
+			sock.close(0)
+			return
+		}
+	}
+}
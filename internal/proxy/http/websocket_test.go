@@ -0,0 +1,311 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/http/filters"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const opPing = 0x9
+
+// buildFrame builds the frame, the key is used to mask it if it's set.
+func buildFrame(fin bool, opcode byte, payload []byte, key []byte) []byte {
+	frame := []byte{opcode, 0}
+	if fin {
+		frame[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = append(frame, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	data := append([]byte(nil), payload...)
+	if key != nil {
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i := range data {
+			data[i] ^= key[i%4]
+		}
+	}
+	return append(frame, data...)
+}
+
+// startWebSocketEcho starts the target echoing the data messages back, prefixed with "echo: ".
+func startWebSocketEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			_, _ = fmt.Fprint(w, "plain")
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Extensions") != "" {
+			t.Errorf("extensions are not stripped")
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+		mr := newMessageReader(brw.Reader, MaxMessageSize)
+		for {
+			msg, err := mr.next()
+			if err != nil {
+				return
+			}
+			if msg.opcode == opClose {
+				_, _ = conn.Write(buildFrame(true, opClose, msg.payload, nil))
+				return
+			}
+			if msg.isData() {
+				_, _ = conn.Write(buildFrame(true, msg.opcode, append([]byte("echo: "), msg.payload...), nil))
+			}
+		}
+	}))
+	t.Cleanup(target.Close)
+	return target
+}
+
+type wsClient struct {
+	conn net.Conn
+	mr   *messageReader
+}
+
+func dialWebSocket(t *testing.T, addr string) *wsClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_, _ = fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status = %d, want 101", resp.StatusCode)
+	}
+	return &wsClient{conn: conn, mr: newMessageReader(br, MaxMessageSize)}
+}
+
+func (c *wsClient) send(t *testing.T, frames ...[]byte) {
+	t.Helper()
+	for _, f := range frames {
+		if _, err := c.conn.Write(f); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+}
+
+func (c *wsClient) receive(t *testing.T) *message {
+	t.Helper()
+	if err := c.conn.SetReadDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	msg, err := c.mr.next()
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	return msg
+}
+
+func TestProxy_WebSocket(t *testing.T) {
+	target := startWebSocketEcho(t)
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "ws",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "drop"},
+			{Rule: "admin", Verdict: "drop"},
+			{Rule: "flag", Verdict: "drop"},
+			{Rule: "http_attack", Verdict: "drop"},
+		},
+	}, []common.RuleConfig{
+		{Name: "attack", Type: "ws::ingress::body::contains", Args: []string{"attack"}},
+		{Name: "admin", Type: "ws::ingress::json::contains", Field: "user", Args: []string{"admin"}},
+		{Name: "flag", Type: "ws::egress::body::contains", Args: []string{"flag{"}},
+		// Request rules must not see the messages.
+		{Name: "http_attack", Type: "http::ingress::body::contains", Args: []string{"hello"}},
+	})
+	key := []byte{1, 2, 3, 4}
+
+	t.Run("fragmented message", func(t *testing.T) {
+		c := dialWebSocket(t, p.Addr().String())
+		c.send(t,
+			buildFrame(false, opText, []byte("hel"), key),
+			buildFrame(true, opPing, []byte("ping"), key),
+			buildFrame(true, opContinuation, []byte("lo"), key),
+		)
+		if msg := c.receive(t); string(msg.payload) != "echo: hello" {
+			t.Errorf("received %q, want echo: hello", msg.payload)
+		}
+		if got := p.ActiveConnections(); got != 1 {
+			t.Errorf("ActiveConnections() = %d, want 1", got)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{name: "ingress drop", payload: "attack"},
+		{name: "json field drop", payload: `{"user": "admin"}`},
+		{name: "egress drop", payload: "flag{test}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialWebSocket(t, p.Addr().String())
+			half := len(tt.payload) / 2
+			c.send(t,
+				buildFrame(false, opText, []byte(tt.payload[:half]), key),
+				buildFrame(true, opContinuation, []byte(tt.payload[half:]), key),
+			)
+			msg := c.receive(t)
+			if msg.opcode != opClose || binary.BigEndian.Uint16(msg.payload) != closePolicyViolated {
+				t.Fatalf("received %d %q, want close 1008", msg.opcode, msg.payload)
+			}
+		})
+	}
+}
+
+func TestProxy_WebSocket_NotUpgraded(t *testing.T) {
+	target := startWebSocketEcho(t)
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "ws",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+	}, nil)
+
+	resp, err := http.Get("http://" + p.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestEvaluate_WebSocket(t *testing.T) {
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "ws::ingress::body::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	fts, err := filters.NewFilters([]common.FilterConfig{{Rule: "attack", Verdict: "drop"}}, rs)
+	if err != nil {
+		t.Fatalf("NewFilters() error = %v", err)
+	}
+
+	ingress := new(bytes.Buffer)
+	ingress.WriteString("GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	ingress.Write(buildFrame(true, opText, []byte("hello"), []byte{1, 2, 3, 4}))
+	ingress.Write(buildFrame(true, opText, []byte("attack"), []byte{1, 2, 3, 4}))
+	egress := new(bytes.Buffer)
+	egress.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	egress.Write(buildFrame(true, opText, []byte("echo: hello"), nil))
+
+	matches := make([]string, 0)
+	ctxs, err := Evaluate(common.ServiceConfig{}, fts, []capture.Chunk{
+		{Ingress: true, Data: ingress.Bytes()},
+		{Ingress: false, Data: egress.Bytes()},
+	}, func(f *filters.Filter, ingress, shadow bool, raw []byte) {
+		matches = append(matches, string(raw))
+	})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if len(ctxs) != 1 || !ctxs[0].GetFlag(common.DropFlag) {
+		t.Errorf("socket is not dropped")
+	}
+	if len(matches) != 1 || matches[0] != "attack" {
+		t.Errorf("matches = %v, want [attack]", matches)
+	}
+}
+
+func TestProxy_WebSocketShutdownStalled(t *testing.T) {
+	// The target floods the client, which doesn't read anything.
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		frame := buildFrame(true, opBinary, bytes.Repeat([]byte("a"), 1024*1024), nil)
+		for {
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}))
+	defer target.Close()
+
+	rs, err := filters.NewRuleSet(nil)
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p, err := NewProxy(common.ServiceConfig{
+		Name:   "ws stalled",
+		Type:   "http",
+		Listen: "127.0.0.1:0",
+		Target: strings.TrimPrefix(target.URL, "http://"),
+	}, rs, nil)
+	if err != nil {
+		t.Fatalf("NewProxy() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	dialWebSocket(t, p.Addr().String())
+	time.Sleep(time.Millisecond * 200)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		done <- p.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	case <-time.After(CloseWriteTimeout * 3):
+		t.Fatalf("Shutdown() is blocked by the stalled client")
+	}
+}
@@ -0,0 +1,141 @@
+package wrapper
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxDecodedSize limits the decompressed body the rules see, so small bombs don't take all memory.
+const MaxDecodedSize = 32 * 1024 * 1024
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrDecodedTooLarge     = errors.New("decoded body too large")
+)
+
+// supportedEncodings are the content encodings decoded for the rules.
+var supportedEncodings = map[string]bool{"gzip": true, "x-gzip": true, "deflate": true, "br": true}
+
+// unsupportedLogged holds the unsupported encodings already warned about.
+var unsupportedLogged sync.Map
+
+// decodedBody caches the body decoded for the rules until the body or its encoding changes.
+type decodedBody struct {
+	data     []byte
+	encoding string
+	valid    bool
+}
+
+// get returns the decoded body, reading and resetting the body only the first time.
+func (d *decodedBody) get(body io.ReadCloser, header http.Header) ([]byte, error) {
+	encoding := strings.Join(header["Content-Encoding"], ",")
+	if d.valid && d.encoding == encoding {
+		return d.data, nil
+	}
+	buf, err := ioutil.ReadAll(body)
+	if cerr := body.Close(); cerr != nil {
+		logrus.Errorf("Error resetting body: %v", cerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	d.data, _ = decodeBody(buf, header)
+	d.encoding, d.valid = encoding, true
+	return d.data, nil
+}
+
+func (d *decodedBody) reset() {
+	*d = decodedBody{}
+}
+
+// UnsupportedEncoding returns the first content encoding of the header the body can't be decoded from,
+// empty if all of them are supported.
+func UnsupportedEncoding(header http.Header) string {
+	for _, coding := range contentCodings(header) {
+		if coding != "" && coding != "identity" && !supportedEncodings[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// contentCodings returns the lowercase content encodings of the header, in the order they were applied.
+func contentCodings(header http.Header) []string {
+	codings := strings.Split(strings.Join(header["Content-Encoding"], ","), ",")
+	for i := range codings {
+		codings[i] = strings.ToLower(strings.TrimSpace(codings[i]))
+	}
+	return codings
+}
+
+// decodeBody removes the content encodings of the body for the rules and reports whether it was decoded completely.
+// Only gzip, deflate and br are supported, bodies in the other encodings (e.g. zstd) are inspected raw.
+// Body truncated by the inspection limit or corrupted is decoded as far as possible,
+// the raw body is returned if it can't be decoded at all.
+func decodeBody(data []byte, header http.Header) ([]byte, bool) {
+	codings := contentCodings(header)
+	complete := true
+	// Encodings are listed in the order they were applied.
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := codings[i]
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		decoded, err := decode(data, coding)
+		if errors.Is(err, ErrUnsupportedEncoding) {
+			if _, logged := unsupportedLogged.LoadOrStore(coding, true); !logged {
+				logrus.Warnf("Body encoding %s is not supported, such bodies are inspected raw", coding)
+			}
+			return data, false
+		}
+		if err != nil {
+			logrus.Debugf("Error decoding body: %v", err)
+			if len(decoded) == 0 {
+				return data, false
+			}
+			complete = false
+		}
+		data = decoded
+	}
+	return data, complete
+}
+
+func decode(data []byte, coding string) ([]byte, error) {
+	var r io.Reader
+	switch coding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("creating gzip reader: %w", err)
+		}
+		r = zr
+	case "deflate":
+		// Deflate is supposed to be zlib-wrapped, but raw streams are common too.
+		if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(data))
+		}
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, coding)
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, MaxDecodedSize+1))
+	if err == nil && len(decoded) > MaxDecodedSize {
+		return decoded[:MaxDecodedSize], ErrDecodedTooLarge
+	}
+	return decoded, err
+}
@@ -0,0 +1,50 @@
+package wrapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Message is a WebSocket text or binary message implementing Entity interface.
+// Cookies, headers and URL are the ones of the upgrade request.
+type Message struct {
+	Request *http.Request
+	Ingress bool
+	Text    bool
+	Data    []byte
+}
+
+func (m Message) GetForm() (map[string][]string, error) {
+	// Message cannot contain a form.
+	return nil, nil
+}
+
+func (m Message) GetJSON() (interface{}, error) {
+	result := new(interface{})
+	if err := json.Unmarshal(m.Data, result); err != nil {
+		return nil, fmt.Errorf("parsing json: %w", err)
+	}
+	return *result, nil
+}
+
+func (m Message) GetBody() ([]byte, error) {
+	return m.Data, nil
+}
+
+func (m Message) GetIngress() bool {
+	return m.Ingress
+}
+
+func (m Message) GetCookies() []*http.Cookie {
+	return m.Request.Cookies()
+}
+
+func (m Message) GetHeaders() map[string][]string {
+	return m.Request.Header
+}
+
+func (m Message) GetURL() *url.URL {
+	return m.Request.URL
+}
@@ -0,0 +1,106 @@
+package wrapper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+var ErrNotBuffered = errors.New("body is not buffered")
+
+// SetHeader sets the header of the request to forward, Host header sets the request host.
+func (r *Request) SetHeader(name, value string) {
+	if http.CanonicalHeaderKey(name) == "Host" {
+		r.Request.Host = value
+		return
+	}
+	r.Request.Header.Set(name, value)
+}
+
+// SetQuery sets the query parameter, or removes it if value is nil.
+func (r *Request) SetQuery(name string, value *string) {
+	q := r.Request.URL.Query()
+	if value == nil {
+		q.Del(name)
+	} else {
+		q.Set(name, *value)
+	}
+	r.Request.URL.RawQuery = q.Encode()
+	r.resetForm()
+}
+
+// ReplaceBody changes the body to forward, reporting whether it has changed.
+// Compressed body is changed decoded and forwarded without the encoding.
+// Partially read compressed body is left intact.
+func (r *Request) ReplaceBody(replace func([]byte) []byte) (bool, error) {
+	changed, err := replaceBody(r.Request.Body, r.Request.Header, &r.Request.ContentLength, replace)
+	if changed {
+		r.resetForm()
+		r.decoded.reset()
+	}
+	return changed, err
+}
+
+func (r *Request) resetForm() {
+	r.Request.Form = nil
+	r.Request.PostForm = nil
+}
+
+// SetStatus replaces the response status.
+func (r *Response) SetStatus(code int) {
+	r.Response.StatusCode = code
+	r.Response.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+// ReplaceBody is the Request.ReplaceBody for the response.
+func (r *Response) ReplaceBody(replace func([]byte) []byte) (bool, error) {
+	changed, err := replaceBody(r.Response.Body, r.Response.Header, &r.Response.ContentLength, replace)
+	if changed {
+		r.decoded.reset()
+	}
+	return changed, err
+}
+
+// replaceBody replaces the buffered part of the body, the content length is updated to match.
+func replaceBody(body io.Reader, header http.Header, length *int64, replace func([]byte) []byte) (bool, error) {
+	br, ok := body.(*BodyReader)
+	if !ok {
+		return false, ErrNotBuffered
+	}
+	buf, err := ioutil.ReadAll(br)
+	if err != nil {
+		return false, fmt.Errorf("reading body: %w", err)
+	}
+	if err := br.Close(); err != nil {
+		return false, fmt.Errorf("resetting body: %w", err)
+	}
+
+	encoded := len(header["Content-Encoding"]) != 0
+	if encoded && br.Partial() {
+		return false, nil
+	}
+	data := buf
+	if encoded {
+		// The body is sent decoded after the change, so it's left as is unless decoded completely.
+		var complete bool
+		if data, complete = decodeBody(buf, header); !complete {
+			return false, nil
+		}
+	}
+	result := replace(data)
+	if bytes.Equal(result, data) {
+		return false, nil
+	}
+
+	br.replace(result)
+	header.Del("Content-Encoding")
+	if *length >= 0 {
+		*length += int64(len(result) - len(buf))
+		header.Set("Content-Length", strconv.FormatInt(*length, 10))
+	}
+	return true, nil
+}
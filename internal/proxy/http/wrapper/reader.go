@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"time"
 )
 
 func NewBodyReader(r io.Reader) (*BodyReader, error) {
@@ -16,8 +18,75 @@ func NewBodyReader(r io.Reader) (*BodyReader, error) {
 	return br, nil
 }
 
+// NewStreamingBodyReader buffers up to limit bytes of the body for the filters, zero limit means no limit.
+// If idle is set, buffering also stops when no data arrives for that long,
+// so the streaming bodies are not held until they end.
+// The rest of the body is left unread, Stream returns the whole body for passing it through.
+func NewStreamingBodyReader(body io.ReadCloser, limit int64, idle time.Duration) (*BodyReader, error) {
+	if idle > 0 {
+		return newIdleBodyReader(body, limit, idle)
+	}
+
+	r := io.Reader(body)
+	if limit > 0 {
+		r = io.LimitReader(body, limit+1)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("draining reader: %w", err)
+	}
+	if limit <= 0 || int64(len(buf)) <= limit {
+		return &BodyReader{b: bytes.NewReader(buf), body: body}, nil
+	}
+	return &BodyReader{
+		b:         bytes.NewReader(buf[:limit]),
+		rest:      io.MultiReader(bytes.NewReader(buf[limit:]), body),
+		body:      body,
+		oversized: true,
+	}, nil
+}
+
+func newIdleBodyReader(body io.ReadCloser, limit int64, idle time.Duration) (*BodyReader, error) {
+	p := newPump(body)
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+
+	buf := make([]byte, 0)
+	for limit <= 0 || int64(len(buf)) <= limit {
+		select {
+		case chunk, ok := <-p.chunks:
+			if !ok {
+				if p.err != io.EOF {
+					return nil, fmt.Errorf("draining reader: %w", p.err)
+				}
+				return &BodyReader{b: bytes.NewReader(buf), body: body}, nil
+			}
+			buf = append(buf, chunk...)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case <-timer.C:
+			return &BodyReader{b: bytes.NewReader(buf), rest: p, body: body, stop: p.stop}, nil
+		}
+	}
+	return &BodyReader{
+		b:         bytes.NewReader(buf[:limit]),
+		rest:      io.MultiReader(bytes.NewReader(buf[limit:]), p),
+		body:      body,
+		stop:      p.stop,
+		oversized: true,
+	}, nil
+}
+
+// BodyReader holds the body, or its inspected prefix, for the filters to read it any number of times.
+// Closing it rewinds the buffer.
 type BodyReader struct {
-	b *bytes.Reader
+	b         *bytes.Reader
+	rest      io.Reader
+	body      io.Closer
+	stop      func()
+	oversized bool
 }
 
 func (r *BodyReader) Read(b []byte) (int, error) {
@@ -34,3 +103,99 @@ func (r *BodyReader) Close() error {
 	}
 	return nil
 }
+
+// Oversized reports whether the body is larger than the limit.
+func (r *BodyReader) Oversized() bool {
+	return r.oversized
+}
+
+// Partial reports whether only the prefix of the body is buffered.
+func (r *BodyReader) Partial() bool {
+	return r.rest != nil
+}
+
+// Stream returns the whole body, the buffered part followed by the unread rest.
+// It must be read only once, after the filters are done. Closing it releases the body.
+func (r *BodyReader) Stream() io.ReadCloser {
+	if err := r.Close(); err != nil {
+		return ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	if r.rest == nil {
+		return streamCloser{Reader: r.b, r: r}
+	}
+	return streamCloser{Reader: io.MultiReader(r.b, r.rest), r: r}
+}
+
+// replace swaps the buffered part of the body, the unread rest is kept after it.
+func (r *BodyReader) replace(data []byte) {
+	r.b = bytes.NewReader(data)
+}
+
+// Release closes the original body, the unread rest of it is discarded.
+func (r *BodyReader) Release() error {
+	if r.stop != nil {
+		r.stop()
+	}
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+type streamCloser struct {
+	io.Reader
+	r *BodyReader
+}
+
+func (s streamCloser) Close() error {
+	return s.r.Release()
+}
+
+// pump reads the body in the background, so the reads waiting for data can be abandoned.
+type pump struct {
+	chunks  chan []byte
+	err     error
+	done    chan struct{}
+	once    sync.Once
+	pending []byte
+}
+
+func newPump(r io.Reader) *pump {
+	p := &pump{chunks: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case p.chunks <- append([]byte(nil), buf[:n]...):
+				case <-p.done:
+					return
+				}
+			}
+			if err != nil {
+				p.err = err
+				close(p.chunks)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *pump) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		chunk, ok := <-p.chunks
+		if !ok {
+			return 0, p.err
+		}
+		p.pending = chunk
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *pump) stop() {
+	p.once.Do(func() { close(p.done) })
+}
@@ -1,21 +1,28 @@
 package wrapper
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // Request is a wrapper around http.Request implementing Entity interface.
 // It's expected that Request.Body is already wrapped with BodyReader.
+// Body is decoded according to its Content-Encoding once for all the rules, the request itself is left intact.
 type Request struct {
 	Request *http.Request
+
+	decoded decodedBody
 }
 
-func (r Request) GetForm() (map[string][]string, error) {
+func (r *Request) GetForm() (map[string][]string, error) {
+	if len(r.Request.Header["Content-Encoding"]) != 0 {
+		return r.getEncodedForm()
+	}
 	defer r.resetBody()
 	if err := r.Request.ParseForm(); err != nil {
 		return nil, fmt.Errorf("parsing form: %w", err)
@@ -23,9 +30,32 @@ func (r Request) GetForm() (map[string][]string, error) {
 	return r.Request.Form, nil
 }
 
-func (r Request) GetJSON() (interface{}, error) {
-	defer r.resetBody()
-	dec := json.NewDecoder(r.Request.Body)
+// getEncodedForm parses the compressed urlencoded form along with the query.
+func (r *Request) getEncodedForm() (map[string][]string, error) {
+	result := r.Request.URL.Query()
+	if ct := r.Request.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+		return result, nil
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("parsing form: %w", err)
+	}
+	for k, v := range form {
+		result[k] = append(v, result[k]...)
+	}
+	return result, nil
+}
+
+func (r *Request) GetJSON() (interface{}, error) {
+	body, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
 	result := new(interface{})
 	if err := dec.Decode(result); err != nil {
 		return nil, fmt.Errorf("parsing json: %w", err)
@@ -33,32 +63,27 @@ func (r Request) GetJSON() (interface{}, error) {
 	return *result, nil
 }
 
-func (r Request) GetBody() ([]byte, error) {
-	defer r.resetBody()
-	buf, err := ioutil.ReadAll(r.Request.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading body: %w", err)
-	}
-	return buf, nil
+func (r *Request) GetBody() ([]byte, error) {
+	return r.decoded.get(r.Request.Body, r.Request.Header)
 }
 
-func (r Request) GetIngress() bool {
+func (r *Request) GetIngress() bool {
 	return true
 }
 
-func (r Request) GetCookies() []*http.Cookie {
+func (r *Request) GetCookies() []*http.Cookie {
 	return r.Request.Cookies()
 }
 
-func (r Request) GetHeaders() map[string][]string {
+func (r *Request) GetHeaders() map[string][]string {
 	return r.Request.Header
 }
 
-func (r Request) GetURL() *url.URL {
+func (r *Request) GetURL() *url.URL {
 	return r.Request.URL
 }
 
-func (r Request) resetBody() {
+func (r *Request) resetBody() {
 	if err := r.Request.Body.Close(); err != nil {
 		logrus.Errorf("Error resetting request body: %v", err)
 	}
@@ -1,28 +1,33 @@
 package wrapper
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 )
 
 // Response is a wrapper around http.Response implementing Entity interface.
 // It's expected that Response.Body is already wrapped with BodyReader.
+// Body is decoded according to its Content-Encoding once for all the rules, the response itself is left intact.
 type Response struct {
 	Response *http.Response
+
+	decoded decodedBody
 }
 
-func (r Response) GetForm() (map[string][]string, error) {
+func (r *Response) GetForm() (map[string][]string, error) {
 	// Response cannot contain a form.
 	return nil, nil
 }
 
-func (r Response) GetJSON() (interface{}, error) {
-	defer r.resetBody()
-	dec := json.NewDecoder(r.Response.Body)
+func (r *Response) GetJSON() (interface{}, error) {
+	body, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
 	result := new(interface{})
 	if err := dec.Decode(result); err != nil {
 		return nil, fmt.Errorf("parsing json: %w", err)
@@ -30,36 +35,25 @@ func (r Response) GetJSON() (interface{}, error) {
 	return *result, nil
 }
 
-func (r Response) GetIngress() bool {
+func (r *Response) GetIngress() bool {
 	return false
 }
 
-func (r Response) GetBody() ([]byte, error) {
-	defer r.resetBody()
-	buf, err := ioutil.ReadAll(r.Response.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading body: %w", err)
-	}
-	return buf, nil
+func (r *Response) GetBody() ([]byte, error) {
+	return r.decoded.get(r.Response.Body, r.Response.Header)
 }
 
-func (r Response) GetCookies() []*http.Cookie {
+func (r *Response) GetCookies() []*http.Cookie {
 	return r.Response.Cookies()
 }
 
-func (r Response) GetHeaders() map[string][]string {
+func (r *Response) GetHeaders() map[string][]string {
 	return r.Response.Header
 }
 
-func (r Response) GetURL() *url.URL {
+func (r *Response) GetURL() *url.URL {
 	if r.Response.Request != nil {
 		return r.Response.Request.URL
 	}
 	return nil
 }
-
-func (r Response) resetBody() {
-	if err := r.Response.Body.Close(); err != nil {
-		logrus.Errorf("Error resetting response body: %v", err)
-	}
-}
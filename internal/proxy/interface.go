@@ -4,16 +4,24 @@ import (
 	"context"
 	"fmt"
 	"goxy/internal/common"
+	"net"
 )
 
 type Proxy interface {
 	Start() error
 	Shutdown(ctx context.Context) error
+	CloseListener() error
+	Drain(ctx context.Context) error
 	GetConfig() *common.ServiceConfig
 	GetListening() bool
 	SetListening(state bool)
-	SetFilterState(filter int, enabled, alert bool) error
+	GetShadow() bool
+	SetShadow(shadow bool)
+	SetFilterState(filter int, enabled, alert, shadow bool) error
 	GetFilters() []common.Filter
+	GetStats() *common.ProxyStats
+	ActiveConnections() int
+	Addr() net.Addr
 
 	fmt.Stringer
 }
@@ -4,10 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"goxy/internal/capture"
 	"goxy/internal/common"
+	"goxy/internal/dryrun"
 	"goxy/internal/models"
+	"goxy/internal/pcap"
 	"goxy/internal/proxy/http"
 	"goxy/internal/proxy/tcp"
+	"goxy/internal/proxy/udp"
+	"io"
+	"os"
+	"reflect"
 	"sync"
 	"time"
 
@@ -17,47 +24,176 @@ import (
 	tcpfilters "goxy/internal/proxy/tcp/filters"
 )
 
+// DefaultDrainTimeout is how long the connections of the removed proxy are served
+// if the service has no drain timeout set.
+const DefaultDrainTimeout = time.Second * 30
+
 var (
-	ErrNoSuchProxy = errors.New("no such proxy")
+	ErrNoSuchProxy     = errors.New("no such proxy")
+	ErrCaptureDisabled = errors.New("traffic capture is disabled")
+	ErrStartFailed     = errors.New("proxy failed to start")
 )
 
 func NewManager(cfg *common.ProxyConfig) (*Manager, error) {
-	tcpRuleSet, err := tcpfilters.NewRuleSet(cfg.Rules)
+	limiters := common.NewRateLimiters()
+	rs, err := newRuleSets(cfg, limiters)
 	if err != nil {
-		logrus.Fatalf("Error creating tcp ruleset: %v", err)
+		return nil, err
 	}
 
-	httpRuleSet, err := httpfilters.NewRuleSet(cfg.Rules)
-	if err != nil {
-		logrus.Fatalf("Error creating http ruleset: %v", err)
+	var cs *capture.Store
+	if cfg.Capture.Enabled {
+		if cs, err = newCaptureStore(cfg.Capture); err != nil {
+			return nil, fmt.Errorf("creating capture store: %w", err)
+		}
 	}
 
 	proxies := make([]Proxy, 0)
-	for _, s := range cfg.Services {
-		var p Proxy
-		if s.Type == "tcp" {
-			if p, err = tcp.NewProxy(s, tcpRuleSet); err != nil {
-				logrus.Fatalf("Error creating tcp proxy: %v", err)
-			}
-		} else if s.Type == "http" {
-			if p, err = http.NewProxy(s, httpRuleSet); err != nil {
-				logrus.Fatalf("Error creating http proxy: %v", err)
-			}
-		} else {
-			return nil, fmt.Errorf("invalid proxy type: %s", s.Type)
+	ids := make([]int, 0)
+	for i, s := range cfg.Services {
+		p, err := newProxy(s, rs, cs)
+		if err != nil {
+			return nil, err
 		}
 		proxies = append(proxies, p)
+		ids = append(ids, i+1)
 	}
 
-	m := &Manager{proxies}
+	drainCtx, cancelDrains := context.WithCancel(context.Background())
+	m := &Manager{
+		proxies:      proxies,
+		ids:          ids,
+		nextID:       len(ids) + 1,
+		config:       cfg,
+		capture:      cs,
+		limiters:     limiters,
+		mu:           new(sync.RWMutex),
+		edit:         new(sync.Mutex),
+		drains:       new(sync.WaitGroup),
+		drainCtx:     drainCtx,
+		cancelDrains: cancelDrains,
+	}
 	return m, nil
 }
 
 type Manager struct {
 	proxies []Proxy
+	// ids are the stable proxy IDs, so proxies[i], ids[i] and config.Services[i] describe the same service.
+	ids     []int
+	nextID  int
+	config  *common.ProxyConfig
+	capture *capture.Store
+	// saved is the config file SaveConfig wrote last, to tell its own writes from the changes.
+	saved os.FileInfo
+	// limiters are the rate limiters of the rules, kept across the reloads.
+	limiters *common.RateLimiters
+	mu       *sync.RWMutex
+	// edit serializes the config changes, which are prepared outside of mu.
+	edit *sync.Mutex
+	// drains tracks the removed proxies still serving their connections,
+	// drainCtx is cancelled on shutdown to close them.
+	drains       *sync.WaitGroup
+	drainCtx     context.Context
+	cancelDrains context.CancelFunc
+}
+
+// serviceIndex returns the position of the proxy with the given ID.
+func serviceIndex(ids []int, proxyID int) (int, error) {
+	for i, id := range ids {
+		if id == proxyID {
+			return i, nil
+		}
+	}
+	return -1, ErrNoSuchProxy
+}
+
+// getProxy returns the proxy by ID, mu must be held.
+func (m *Manager) getProxy(proxyID int) (Proxy, error) {
+	i, err := serviceIndex(m.ids, proxyID)
+	if err != nil {
+		return nil, err
+	}
+	return m.proxies[i], nil
+}
+
+func newCaptureStore(cfg common.CaptureConfig) (*capture.Store, error) {
+	cs, err := capture.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PCAP.Enabled {
+		w, err := pcap.NewRollingWriter(cfg.PCAP.Dir, cfg.PCAP.MaxFileSize, cfg.PCAP.MaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("creating pcap writer: %w", err)
+		}
+		cs.AddSink(w)
+	}
+	return cs, nil
+}
+
+type ruleSets struct {
+	tcp  *tcpfilters.RuleSet
+	http *httpfilters.RuleSet
+	udp  *tcpfilters.RuleSet
+}
+
+func newRuleSets(cfg *common.ProxyConfig, limiters *common.RateLimiters) (*ruleSets, error) {
+	tcpRuleSet, err := tcpfilters.NewRuleSetWith("tcp", cfg.Rules, limiters)
+	if err != nil {
+		return nil, fmt.Errorf("creating tcp ruleset: %w", err)
+	}
+
+	httpRuleSet, err := httpfilters.NewRuleSetWith(cfg.Rules, limiters)
+	if err != nil {
+		return nil, fmt.Errorf("creating http ruleset: %w", err)
+	}
+
+	udpRuleSet, err := tcpfilters.NewRuleSetWith("udp", cfg.Rules, limiters)
+	if err != nil {
+		return nil, fmt.Errorf("creating udp ruleset: %w", err)
+	}
+
+	return &ruleSets{tcp: tcpRuleSet, http: httpRuleSet, udp: udpRuleSet}, nil
+}
+
+// NewProxy creates the standalone proxy for the single service, using the rules from cfg.
+func NewProxy(cfg *common.ProxyConfig, s common.ServiceConfig, cs *capture.Store) (Proxy, error) {
+	rs, err := newRuleSets(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newProxy(s, rs, cs)
+}
+
+func newProxy(s common.ServiceConfig, rs *ruleSets, cs *capture.Store) (Proxy, error) {
+	switch s.Type {
+	case "tcp":
+		p, err := tcp.NewProxy(s, rs.tcp, cs)
+		if err != nil {
+			return nil, fmt.Errorf("creating tcp proxy %s: %w", s.Name, err)
+		}
+		return p, nil
+	case "http":
+		p, err := http.NewProxy(s, rs.http, cs)
+		if err != nil {
+			return nil, fmt.Errorf("creating http proxy %s: %w", s.Name, err)
+		}
+		return p, nil
+	case "udp":
+		p, err := udp.NewProxy(s, rs.udp, cs)
+		if err != nil {
+			return nil, fmt.Errorf("creating udp proxy %s: %w", s.Name, err)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("invalid proxy type: %s", s.Type)
+	}
 }
 
 func (m *Manager) StartAll() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	for i, p := range m.proxies {
 		if err := p.Start(); err != nil {
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
@@ -74,10 +210,37 @@ func (m *Manager) StartAll() error {
 }
 
 func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := shutdownProxies(ctx, m.proxies); err != nil {
+		return err
+	}
+
+	m.cancelDrains()
+	done := make(chan interface{})
+	go func() {
+		m.drains.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for removed proxies: %w", ctx.Err())
+	case <-done:
+	}
+
+	if m.capture != nil {
+		if err := m.capture.Close(); err != nil {
+			return fmt.Errorf("closing capture store: %w", err)
+		}
+	}
+	return nil
+}
+
+func shutdownProxies(ctx context.Context, proxies []Proxy) error {
 	wg := sync.WaitGroup{}
-	wg.Add(len(m.proxies))
+	wg.Add(len(proxies))
 	errCh := make(chan error)
-	for _, p := range m.proxies {
+	for _, p := range proxies {
 		go func(p Proxy) {
 			defer wg.Done()
 			if err := p.Shutdown(ctx); err != nil {
@@ -98,20 +261,239 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 	}
 }
 
-func (m Manager) DumpProxies() []models.ProxyDescription {
+// Reload applies the new config to the running proxies.
+// All rules and filters are validated before anything is changed,
+// so if the new config is invalid the old one stays in effect.
+// Services are matched by name and keep their IDs: services with the same type, listen address
+// and TLS settings are updated in place without dropping their connections, others are restarted.
+// Removed proxies stop listening at once and are drained in background.
+// If any proxy fails to start, the previous config is restored.
+// Capture settings are not reloaded.
+func (m *Manager) Reload(cfg *common.ProxyConfig) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	return m.reloadOrRestore(cfg, nil)
+}
+
+// ReloadWith loads the config with load and applies it as Reload does.
+// The config is loaded under the same lock as the edits are applied,
+// so the concurrent reloads don't read the file at once or apply the older config last.
+func (m *Manager) ReloadWith(load func() (*common.ProxyConfig, error)) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	return m.reloadOrRestore(cfg, nil)
+}
+
+// reloadOrRestore applies the config, restoring the previous one if any proxy fails to start.
+// edit must be held.
+func (m *Manager) reloadOrRestore(cfg *common.ProxyConfig, ids []int) error {
+	prevCfg, prevIDs := m.snapshot()
+	err := m.reload(cfg, ids)
+	if errors.Is(err, ErrStartFailed) {
+		if rerr := m.reload(prevCfg, prevIDs); rerr != nil {
+			logrus.Errorf("Error restoring the config: %v", rerr)
+		}
+	}
+	return err
+}
+
+// reload applies the config. ids are the IDs of the proxies serving the services,
+// services with zero or missing ID are matched by name.
+func (m *Manager) reload(cfg *common.ProxyConfig, ids []int) error {
+	limiters := m.limiters.Next()
+	rs, err := newRuleSets(cfg, limiters)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byName := make(map[string]int, len(m.proxies))
+	for i := len(m.proxies) - 1; i >= 0; i-- {
+		byName[m.proxies[i].GetConfig().Name] = i
+	}
+
+	proxies := make([]Proxy, 0, len(cfg.Services))
+	proxyIDs := make([]int, 0, len(cfg.Services))
+	updates := make([]func(), 0, len(cfg.Services))
+	started := make([]Proxy, 0)
+	claimed := make(map[int]bool)
+	kept := make(map[Proxy]bool)
+	nextID := m.nextID
+	for i, s := range cfg.Services {
+		old := -1
+		if i < len(ids) && ids[i] != 0 {
+			old, _ = serviceIndex(m.ids, ids[i])
+		} else if j, ok := byName[s.Name]; ok {
+			old = j
+		}
+
+		var id int
+		if old == -1 && i < len(ids) && ids[i] != 0 {
+			// The proxy is gone, like the one failed to start, its ID is kept.
+			id = ids[i]
+			if id >= nextID {
+				nextID = id + 1
+			}
+		} else if old != -1 && !claimed[old] {
+			claimed[old] = true
+			id = m.ids[old]
+			p := m.proxies[old]
+			oldCfg := p.GetConfig()
+			if oldCfg.Type == s.Type && oldCfg.Listen == s.Listen && oldCfg.H2C == s.H2C && reflect.DeepEqual(oldCfg.TLS, s.TLS) {
+				apply, err := prepareReload(p, s, rs)
+				if err != nil {
+					return fmt.Errorf("invalid config: %w", err)
+				}
+				kept[p] = true
+				updates = append(updates, apply)
+				proxies = append(proxies, p)
+				proxyIDs = append(proxyIDs, id)
+				continue
+			}
+		} else {
+			id = nextID
+			nextID += 1
+		}
+
+		p, err := newProxy(s, rs, m.capture)
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+		started = append(started, p)
+		proxies = append(proxies, p)
+		proxyIDs = append(proxyIDs, id)
+	}
+
+	stopped := make([]Proxy, 0)
+	for _, p := range m.proxies {
+		if !kept[p] {
+			stopped = append(stopped, p)
+		}
+	}
+
+	// Config is valid, apply it.
+	// Listeners are closed first, so the restarted proxies can take their addresses.
+	for _, p := range stopped {
+		if err := p.CloseListener(); err != nil {
+			logrus.Errorf("Error stopping removed proxy %v: %v", p, err)
+		}
+		m.drain(p)
+	}
+
+	for _, apply := range updates {
+		apply()
+	}
+
+	var startErr error
+	failed := make(map[Proxy]bool)
+	for _, p := range started {
+		if err := p.Start(); err != nil {
+			logrus.Errorf("Error starting proxy %v: %v", p, err)
+			failed[p] = true
+			if startErr == nil {
+				startErr = fmt.Errorf("%w: %v: %v", ErrStartFailed, p, err)
+			}
+		}
+	}
+
+	// Proxies failed to start are left out, so they are neither listed nor shut down.
+	services := make([]common.ServiceConfig, 0, len(proxies))
+	running := make([]Proxy, 0, len(proxies))
+	runningIDs := make([]int, 0, len(proxies))
+	for i, p := range proxies {
+		if failed[p] {
+			continue
+		}
+		services = append(services, cfg.Services[i])
+		running = append(running, p)
+		runningIDs = append(runningIDs, proxyIDs[i])
+	}
+
+	newCfg := *cfg
+	newCfg.Services = services
+	newCfg.Capture = m.config.Capture
+	m.proxies = running
+	m.ids = runningIDs
+	m.nextID = nextID
+	m.config = &newCfg
+	m.limiters = limiters
+	limiters.Commit()
+	logrus.Infof("Config reloaded: %d kept, %d started, %d stopped", len(updates), len(started)-len(failed), len(stopped))
+	return startErr
+}
+
+// drain waits in background for the connections of the removed proxy to finish.
+func (m *Manager) drain(p Proxy) {
+	timeout := DefaultDrainTimeout
+	if t := p.GetConfig().DrainTimeout; t != nil {
+		timeout = *t
+	}
+
+	m.drains.Add(1)
+	go func() {
+		defer m.drains.Done()
+		ctx, cancel := context.WithTimeout(m.drainCtx, timeout)
+		defer cancel()
+		if err := p.Drain(ctx); err != nil {
+			logrus.Errorf("Error draining proxy %v: %v", p, err)
+			return
+		}
+		logrus.Infof("Proxy %v drained", p)
+	}()
+}
+
+// prepareReload validates the new service config and returns the function applying it to the proxy.
+func prepareReload(p Proxy, s common.ServiceConfig, rs *ruleSets) (func(), error) {
+	switch pt := p.(type) {
+	case *tcp.Proxy:
+		fts, err := tcpfilters.NewFilters(s.Filters, rs.tcp)
+		if err != nil {
+			return nil, fmt.Errorf("creating filters for %s: %w", s.Name, err)
+		}
+		return func() { pt.Reload(s, fts) }, nil
+	case *http.Proxy:
+		fts, err := httpfilters.NewFilters(s.Filters, rs.http)
+		if err != nil {
+			return nil, fmt.Errorf("creating filters for %s: %w", s.Name, err)
+		}
+		return func() { pt.Reload(s, fts) }, nil
+	case *udp.Proxy:
+		fts, err := tcpfilters.NewFilters(s.Filters, rs.udp)
+		if err != nil {
+			return nil, fmt.Errorf("creating filters for %s: %w", s.Name, err)
+		}
+		return func() { pt.Reload(s, fts) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy type %T", p)
+	}
+}
+
+func (m *Manager) DumpProxies() []models.ProxyDescription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	result := make([]models.ProxyDescription, 0, len(m.proxies))
 	for i, p := range m.proxies {
-		proxyID := i + 1
+		proxyID := m.ids[i]
 		filters := p.GetFilters()
 		descriptions := make([]models.FilterDescription, 0, len(filters))
 		for j, f := range filters {
 			desc := models.FilterDescription{
 				ID:      j + 1,
 				ProxyID: proxyID,
+				Name:    f.GetName(),
 				Rule:    f.GetRule().String(),
 				Verdict: f.GetVerdict().String(),
 				Enabled: f.IsEnabled(),
 				Alert:   f.GetAlert(),
+				Shadow:  f.GetShadow(),
+				Stats:   f.GetStats().Dump(),
 			}
 			descriptions = append(descriptions, desc)
 		}
@@ -119,6 +501,7 @@ func (m Manager) DumpProxies() []models.ProxyDescription {
 			ID:                 proxyID,
 			Service:            p.GetConfig(),
 			Listening:          p.GetListening(),
+			Stats:              p.GetStats().Dump(),
 			FilterDescriptions: descriptions,
 		}
 		result = append(result, desc)
@@ -126,21 +509,185 @@ func (m Manager) DumpProxies() []models.ProxyDescription {
 	return result
 }
 
+// DumpStats returns the counters of all proxies and their filters.
+// Filters are identified by their rule names.
+func (m *Manager) DumpStats() []models.ProxyStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]models.ProxyStats, 0, len(m.proxies))
+	for i, p := range m.proxies {
+		filters := p.GetFilters()
+		fstats := make([]models.FilterStats, 0, len(filters))
+		for j, f := range filters {
+			fstats = append(fstats, models.FilterStats{
+				ID:    j + 1,
+				Rule:  f.GetName(),
+				Stats: f.GetStats().Dump(),
+			})
+		}
+		result = append(result, models.ProxyStats{
+			ID:      m.ids[i],
+			Name:    p.GetConfig().Name,
+			Stats:   p.GetStats().Dump(),
+			Filters: fstats,
+		})
+	}
+	return result
+}
+
+// ResetStats resets the counters of the proxy and its filters, or of all proxies if proxyID is zero.
+func (m *Manager) ResetStats(proxyID int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	proxies := m.proxies
+	if proxyID != 0 {
+		p, err := m.getProxy(proxyID)
+		if err != nil {
+			return err
+		}
+		proxies = []Proxy{p}
+	}
+	for _, p := range proxies {
+		p.GetStats().Reset()
+		for _, f := range p.GetFilters() {
+			f.GetStats().Reset()
+		}
+	}
+	return nil
+}
+
 func (m *Manager) SetProxyListening(proxyID int, listening bool) error {
-	if proxyID < 1 || proxyID > len(m.proxies) {
-		return ErrNoSuchProxy
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, err := m.getProxy(proxyID)
+	if err != nil {
+		return err
 	}
-	m.proxies[proxyID-1].SetListening(listening)
+	p.SetListening(listening)
 	return nil
 }
 
-func (m *Manager) SetFilterState(proxyID, filterID int, enabled, alert bool) error {
-	if proxyID < 1 || proxyID > len(m.proxies) {
-		return ErrNoSuchProxy
+// SetProxyShadow switches the service shadow mode, the change is kept in the config.
+func (m *Manager) SetProxyShadow(proxyID int, shadow bool) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := serviceIndex(m.ids, proxyID)
+	if err != nil {
+		return err
+	}
+	m.proxies[i].SetShadow(shadow)
+
+	cfg := m.config.Copy()
+	cfg.Services[i].Shadow = shadow
+	m.config = cfg
+	return nil
+}
+
+// SetFilterState updates the filter flags, the change is kept in the config.
+func (m *Manager) SetFilterState(proxyID, filterID int, enabled, alert, shadow bool) error {
+	m.edit.Lock()
+	defer m.edit.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := serviceIndex(m.ids, proxyID)
+	if err != nil {
+		return err
 	}
-	p := m.proxies[proxyID-1]
-	if err := p.SetFilterState(filterID-1, enabled, alert); err != nil {
+	p := m.proxies[i]
+	if err := p.SetFilterState(filterID-1, enabled, alert, shadow); err != nil {
 		return fmt.Errorf("setting filter enabled for proxy %v: %w", p, err)
 	}
+
+	cfg := m.config.Copy()
+	f := &cfg.Services[i].Filters[filterID-1]
+	f.Disabled = !enabled
+	f.Alert = alert
+	f.Shadow = shadow
+	m.config = cfg
 	return nil
 }
+
+func (m *Manager) ListTraffic(proxyID, offset, limit int) ([]capture.Record, error) {
+	service, err := m.captureService(proxyID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := m.capture.List(service, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listing records: %w", err)
+	}
+	return records, nil
+}
+
+func (m *Manager) GetTraffic(proxyID int, recordID string) (*capture.Record, error) {
+	service, err := m.captureService(proxyID)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := m.capture.Get(service, recordID)
+	if err != nil {
+		return nil, fmt.Errorf("getting record: %w", err)
+	}
+	return rec, nil
+}
+
+// ExportPCAP writes the proxy records selected by the query to w as a pcap file, oldest first.
+func (m *Manager) ExportPCAP(proxyID int, q capture.Query, w io.Writer) error {
+	service, err := m.captureService(proxyID)
+	if err != nil {
+		return err
+	}
+
+	records := make([]*capture.Record, 0)
+	err = m.capture.Walk(service, func(rec *capture.Record) bool {
+		if q.Match(rec) {
+			records = append(records, rec)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("reading records: %w", err)
+	}
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if err := pcap.Export(w, records); err != nil {
+		return fmt.Errorf("exporting pcap: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) captureService(proxyID int) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.capture == nil {
+		return "", ErrCaptureDisabled
+	}
+	p, err := m.getProxy(proxyID)
+	if err != nil {
+		return "", err
+	}
+	return p.GetConfig().Name, nil
+}
+
+// DryRun evaluates the filters of the current config over the recorded sessions without any network I/O.
+func (m *Manager) DryRun(records []*capture.Record, opts dryrun.Options) (*dryrun.Report, error) {
+	m.mu.RLock()
+	cfg := m.config
+	m.mu.RUnlock()
+
+	report, err := dryrun.Run(cfg, records, opts)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating filters: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"goxy/internal/common"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	tcpfilters "goxy/internal/proxy/tcp/filters"
+)
+
+func testConfig(rule string) *common.ProxyConfig {
+	return &common.ProxyConfig{
+		Rules: []common.RuleConfig{
+			{Name: "tcp_rule", Type: rule, Args: []string{"kek"}},
+		},
+		Services: []common.ServiceConfig{
+			{
+				Name:   "tcp service",
+				Type:   "tcp",
+				Listen: "127.0.0.1:0",
+				Target: "127.0.0.1:1",
+				Filters: []common.FilterConfig{
+					{Rule: "tcp_rule", Verdict: "drop"},
+				},
+			},
+		},
+	}
+}
+
+func TestManager_Reload(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	before := m.proxies[0]
+
+	if err := m.Reload(testConfig("tcp::regex")); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if m.proxies[0] != before {
+		t.Errorf("Reload() restarted the proxy, but mustn't")
+	}
+	if got := m.proxies[0].GetFilters()[0].GetRule().String(); got != "regex 'kek'" {
+		t.Errorf("Reload() filters not swapped, got rule %s", got)
+	}
+
+	if err := m.Reload(testConfig("tcp::invalid")); err == nil {
+		t.Errorf("Reload() invalid config accepted")
+	}
+	if got := m.proxies[0].GetFilters()[0].GetRule().String(); got != "regex 'kek'" {
+		t.Errorf("Reload() invalid config applied, got rule %s", got)
+	}
+}
+
+func TestManager_Reload_RateLimits(t *testing.T) {
+	cfg := func(contains string) *common.ProxyConfig {
+		return &common.ProxyConfig{
+			Rules: []common.RuleConfig{
+				{Name: "flood", Type: "tcp::rate_gt", Args: []string{"global", "1", "1m"}},
+				{Name: "marker", Type: "tcp::contains", Args: []string{contains}},
+			},
+			Services: []common.ServiceConfig{
+				{
+					Name:   "tcp service",
+					Type:   "tcp",
+					Listen: "127.0.0.1:0",
+					Target: "127.0.0.1:1",
+					Filters: []common.FilterConfig{
+						{Rule: "flood", Verdict: "drop"},
+						{Rule: "marker", Verdict: "ratelimit::global::1::1m"},
+					},
+				},
+			},
+		}
+	}
+	m, err := NewManager(cfg("kek"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	// Each hit is the new connection, the second one is over the limit of both.
+	hit := func() (bool, bool) {
+		fts := m.proxies[0].GetFilters()
+		rule := fts[0].GetRule().(tcpfilters.Rule)
+		over, err := rule.Apply(common.NewProxyContext(), nil, true)
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+		ctx := common.NewProxyContext()
+		if err := fts[1].GetVerdict().(common.VerdictRateLimit).Mutate(ctx); err != nil {
+			t.Fatalf("Mutate() error = %v", err)
+		}
+		return over, ctx.GetFlag(common.DropFlag)
+	}
+	hit()
+
+	if err := m.Reload(cfg("lol")); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if rule, verdict := hit(); !rule || !verdict {
+		t.Errorf("Reload() reset the rate windows, over limit: rule %v, verdict %v", rule, verdict)
+	}
+}
+
+func proxyIDs(m *Manager) []int {
+	var result []int
+	for _, desc := range m.DumpProxies() {
+		result = append(result, desc.ID)
+	}
+	return result
+}
+
+func TestManager_Services(t *testing.T) {
+	m, err := NewManager(testConfig("tcp::contains"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Shutdown(context.Background())
+
+	for _, name := range []string{"second", "third"} {
+		if _, err := m.AddService(common.ServiceConfig{Name: name, Type: "tcp", Listen: "127.0.0.1:0", Target: "127.0.0.1:1"}); err != nil {
+			t.Fatalf("AddService() error = %v", err)
+		}
+	}
+	if got := proxyIDs(m); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("AddService() got IDs %v", got)
+	}
+	if _, err := m.AddService(common.ServiceConfig{Name: "third", Type: "tcp", Listen: "127.0.0.1:0", Target: "127.0.0.1:1"}); !errors.Is(err, ErrServiceExists) {
+		t.Errorf("AddService() duplicate name error = %v, want %v", err, ErrServiceExists)
+	}
+	if _, err := m.AddService(common.ServiceConfig{Name: "bad", Type: "ftp", Listen: "127.0.0.1:0", Target: "127.0.0.1:1"}); err == nil {
+		t.Errorf("AddService() invalid type accepted")
+	}
+
+	if err := m.RemoveService(2); err != nil {
+		t.Fatalf("RemoveService() error = %v", err)
+	}
+	if err := m.RemoveService(2); !errors.Is(err, ErrNoSuchProxy) {
+		t.Errorf("RemoveService() removed twice, error = %v", err)
+	}
+	if got := proxyIDs(m); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("RemoveService() got IDs %v, want [1 3]", got)
+	}
+
+	third := m.proxies[1]
+	if err := m.UpdateService(3, common.ServiceConfig{Name: "renamed", Type: "tcp", Listen: "127.0.0.1:0", Target: "127.0.0.1:2"}); err != nil {
+		t.Fatalf("UpdateService() error = %v", err)
+	}
+	if m.proxies[1] != third {
+		t.Errorf("UpdateService() restarted the proxy, but mustn't")
+	}
+	if s, err := m.GetService(3); err != nil || s.Name != "renamed" || s.Target != "127.0.0.1:2" {
+		t.Errorf("GetService() = %+v, %v", s, err)
+	}
+
+	id, err := m.AddService(common.ServiceConfig{Name: "second", Type: "tcp", Listen: "127.0.0.1:0", Target: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("AddService() error = %v", err)
+	}
+	if id != 4 {
+		t.Errorf("AddService() reused the ID, got %d", id)
+	}
+	if got := proxyIDs(m); !reflect.DeepEqual(got, []int{1, 3, 4}) {
+		t.Errorf("AddService() got IDs %v, want [1 3 4]", got)
+	}
+}
+
+func startEcho(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func echo(conn net.Conn, msg string) error {
+	if err := conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, buf)
+	return err
+}
+
+func TestManager_RemoveService_Drain(t *testing.T) {
+	target := startEcho(t)
+	defer target.Close()
+
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		wantAlive bool
+	}{
+		{"drained", time.Minute, true},
+		{"timed out", time.Millisecond * 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("tcp::contains")
+			cfg.Services[0].Target = target.Addr().String()
+			cfg.Services[0].DrainTimeout = &tt.timeout
+			m, err := NewManager(cfg)
+			if err != nil {
+				t.Fatalf("NewManager() error = %v", err)
+			}
+			if err := m.StartAll(); err != nil {
+				t.Fatalf("StartAll() error = %v", err)
+			}
+			addr := m.proxies[0].Addr().String()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+			if err := echo(conn, "hello"); err != nil {
+				t.Fatalf("echo() error = %v", err)
+			}
+
+			if err := m.RemoveService(1); err != nil {
+				t.Fatalf("RemoveService() error = %v", err)
+			}
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+				t.Errorf("Dial() removed proxy accepted the connection")
+			}
+
+			if !tt.wantAlive {
+				time.Sleep(tt.timeout * 2)
+			}
+			if err := echo(conn, "still there"); (err == nil) != tt.wantAlive {
+				t.Errorf("echo() after removal error = %v, want alive %v", err, tt.wantAlive)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			if err := m.Shutdown(ctx); err != nil {
+				t.Errorf("Shutdown() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestManager_Reload_StartFailed(t *testing.T) {
+	target := startEcho(t)
+	defer target.Close()
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer busy.Close()
+
+	cfg := testConfig("tcp::contains")
+	cfg.Services[0].Target = target.Addr().String()
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	if err := m.StartAll(); err != nil {
+		t.Fatalf("StartAll() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(cfg *common.ProxyConfig)
+	}{
+		{"new service", func(cfg *common.ProxyConfig) {
+			cfg.Services = append(cfg.Services, common.ServiceConfig{
+				Name: "web", Type: "http", Listen: busy.Addr().String(), Target: "127.0.0.1:1",
+			})
+		}},
+		{"moved service", func(cfg *common.ProxyConfig) {
+			cfg.Services[0].Listen = busy.Addr().String()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := m.GetConfig()
+			tt.edit(cfg)
+			if err := m.Reload(cfg); !errors.Is(err, ErrStartFailed) {
+				t.Fatalf("Reload() error = %v, want %v", err, ErrStartFailed)
+			}
+			if got := proxyIDs(m); !reflect.DeepEqual(got, []int{1}) {
+				t.Errorf("Reload() got IDs %v, want [1]", got)
+			}
+			if got := m.GetConfig().Services; len(got) != 1 || got[0].Listen != "127.0.0.1:0" {
+				t.Errorf("Reload() previous config not restored, got services %+v", got)
+			}
+
+			conn, err := net.Dial("tcp", m.proxies[0].Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+			if err := echo(conn, "hello"); err != nil {
+				t.Errorf("echo() restored proxy error = %v", err)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"goxy/internal/common"
+)
+
+var (
+	activeConnectionsDesc = prometheus.NewDesc(
+		"goxy_active_connections",
+		"Client connections currently open.",
+		[]string{"service", "type"}, nil,
+	)
+	connectionsDesc = prometheus.NewDesc(
+		"goxy_connections_total",
+		"Client connections accepted.",
+		[]string{"service"}, nil,
+	)
+	bytesDesc = prometheus.NewDesc(
+		"goxy_bytes_total",
+		"Bytes received from (ingress) and sent to (egress) the clients.",
+		[]string{"service", "direction"}, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"goxy_dropped_total",
+		"Connections and requests dropped by the filters.",
+		[]string{"service"}, nil,
+	)
+	undecodedDesc = prometheus.NewDesc(
+		"goxy_undecoded_bodies_total",
+		"HTTP bodies the filters saw raw, as their content encoding is not supported.",
+		[]string{"service"}, nil,
+	)
+	filterEvaluationsDesc = prometheus.NewDesc(
+		"goxy_filter_evaluations_total",
+		"Rule evaluations by the filters.",
+		[]string{"service", "rule"}, nil,
+	)
+	filterMatchesDesc = prometheus.NewDesc(
+		"goxy_filter_matches_total",
+		"Rule matches by the filters, shadow ones included.",
+		[]string{"service", "rule"}, nil,
+	)
+	filterDropsDesc = prometheus.NewDesc(
+		"goxy_filter_drops_total",
+		"Connections and requests dropped by the filters.",
+		[]string{"service", "rule"}, nil,
+	)
+	filterErrorsDesc = prometheus.NewDesc(
+		"goxy_filter_errors_total",
+		"Errors in the filter rules and verdicts.",
+		[]string{"service", "rule"}, nil,
+	)
+)
+
+func (m *Manager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeConnectionsDesc
+	ch <- connectionsDesc
+	ch <- bytesDesc
+	ch <- droppedDesc
+	ch <- undecodedDesc
+	ch <- filterEvaluationsDesc
+	ch <- filterMatchesDesc
+	ch <- filterDropsDesc
+	ch <- filterErrorsDesc
+}
+
+// Collect exports the proxy and filter counters.
+// Filters using the same rule in the service are summed up.
+func (m *Manager) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counter := func(desc *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+
+	for _, p := range m.proxies {
+		cfg := p.GetConfig()
+		ch <- prometheus.MustNewConstMetric(
+			activeConnectionsDesc,
+			prometheus.GaugeValue,
+			float64(p.ActiveConnections()),
+			cfg.Name, cfg.Type,
+		)
+
+		stats := p.GetStats().Dump()
+		counter(connectionsDesc, stats.Connections, cfg.Name)
+		counter(bytesDesc, stats.BytesIn, cfg.Name, "ingress")
+		counter(bytesDesc, stats.BytesOut, cfg.Name, "egress")
+		counter(droppedDesc, stats.Dropped, cfg.Name)
+		counter(undecodedDesc, stats.Undecoded, cfg.Name)
+
+		rules := make([]string, 0)
+		byRule := make(map[string]*common.FilterCounters)
+		for _, f := range p.GetFilters() {
+			fs := f.GetStats().Dump()
+			r, ok := byRule[f.GetName()]
+			if !ok {
+				r = new(common.FilterCounters)
+				byRule[f.GetName()] = r
+				rules = append(rules, f.GetName())
+			}
+			r.Evaluations += fs.Evaluations
+			r.Matches += fs.Matches
+			r.Drops += fs.Drops
+			r.Errors += fs.Errors
+		}
+		for _, name := range rules {
+			r := byRule[name]
+			counter(filterEvaluationsDesc, r.Evaluations, cfg.Name, name)
+			counter(filterMatchesDesc, r.Matches, cfg.Name, name)
+			counter(filterDropsDesc, r.Drops, cfg.Name, name)
+			counter(filterErrorsDesc, r.Errors, cfg.Name, name)
+		}
+	}
+}
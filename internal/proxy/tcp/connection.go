@@ -2,18 +2,44 @@ package tcp
 
 import (
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+	"goxy/internal/capture"
 	"goxy/internal/common"
 	"net"
+	"sync"
 )
 
 type Connection struct {
+	ID      string
 	Remote  net.Conn
 	Local   net.Conn
 	Context *common.ProxyContext
 	Logger  *logrus.Entry
+	Capture *capture.Session
+
+	ingressWindow *streamWindow
+	egressWindow  *streamWindow
+	// raw is the client TCP connection, under TLS if it's terminated.
+	raw      net.Conn
+	dropOnce sync.Once
+	holding  atomic.Bool
+	// filterMu serializes the filter runs of the directions, see Proxy.filter.
+	filterMu sync.Mutex
 }
 
+func (c *Connection) window(ingress bool) *streamWindow {
+	if ingress {
+		return c.ingressWindow
+	}
+	return c.egressWindow
+}
+
+// CloseCounterpart closes the other side of the connection.
+// Blackholed client connection is kept, it's closed once the proxy is done with it.
 func (c *Connection) CloseCounterpart(ingress bool) error {
+	if !ingress && c.holding.Load() {
+		return nil
+	}
 	if ingress {
 		if err := c.Local.Close(); err != nil && !isConnectionClosedErr(err) {
 			return err
@@ -26,11 +52,14 @@ func (c *Connection) CloseCounterpart(ingress bool) error {
 	return nil
 }
 
-func newConnection(remote net.Conn, local net.Conn) *Connection {
+func newConnection(remote net.Conn, local net.Conn, ctx *common.ProxyContext, windowSize int) *Connection {
 	return &Connection{
 		Remote:  remote,
 		Local:   local,
-		Context: common.NewProxyContext(),
+		Context: ctx,
 		Logger:  logrus.WithField("src", remote.RemoteAddr()),
+
+		ingressWindow: newStreamWindow(windowSize),
+		egressWindow:  newStreamWindow(windowSize),
 	}
 }
@@ -0,0 +1,41 @@
+package tcp
+
+import (
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+)
+
+// Evaluate runs the filter chain over the recorded connection without any network I/O,
+// the same way the proxy does for the live one: chunks go through the stream windows
+// and processing stops when the connection is dropped. Rewrites only set the modified flag.
+// matched is called for every triggered filter with the data the rule was applied to,
+// which is valid only until matched returns.
+// Filter errors don't stop the evaluation, the first one is returned.
+func Evaluate(
+	cfg common.ServiceConfig,
+	fts []filters.Filter,
+	chunks []capture.Chunk,
+	matched func(f *filters.Filter, ingress, shadow bool, buf []byte),
+) (*common.ProxyContext, error) {
+	var firstErr error
+	pctx := common.NewProxyContext()
+	windows := map[bool]*streamWindow{
+		true:  newStreamWindow(cfg.StreamWindow),
+		false: newStreamWindow(cfg.StreamWindow),
+	}
+	for _, c := range chunks {
+		buf, from := windows[c.Ingress].feed(c.Data)
+		err := ApplyFilters(pctx, fts, buf, from, c.Ingress, cfg.Shadow, func(f *filters.Filter, shadow bool) {
+			matched(f, c.Ingress, shadow, buf)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if pctx.GetFlag(common.DropFlag) {
+			break
+		}
+		pctx.Rewrite(c.Data)
+	}
+	return pctx, firstErr
+}
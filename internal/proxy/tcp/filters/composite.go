@@ -52,6 +52,26 @@ func (r CompositeAndRule) Apply(ctx *common.ProxyContext, buf []byte, ingress bo
 	return true, nil
 }
 
+// ApplyFrom requires all rules to match, with at least one payload match in the new data.
+func (r CompositeAndRule) ApplyFrom(ctx *common.ProxyContext, buf []byte, from int, ingress bool) (bool, error) {
+	fresh := false
+	for _, rule := range r.rules {
+		res, err := rule.Apply(ctx, buf, ingress)
+		if err != nil {
+			return false, fmt.Errorf("error in rule %T: %w", rule, err)
+		}
+		if !res {
+			return false, nil
+		}
+		if !fresh && isStream(rule) {
+			if fresh, err = ApplyNew(rule, ctx, buf, from, ingress); err != nil {
+				return false, fmt.Errorf("error in rule %T: %w", rule, err)
+			}
+		}
+	}
+	return fresh, nil
+}
+
 func (r CompositeAndRule) String() string {
 	ruleNames := make([]string, 0, len(r.rules))
 	for _, rule := range r.rules {
@@ -9,6 +9,8 @@ var DefaultRuleWrappers = map[string]RuleWrapperCreator{
 	"ingress": NewIngressWrapper,
 	"egress":  NewEgressWrapper,
 	"not":     NewNotWrapper,
+	"sni":     NewSNIWrapper,
+	"alpn":    NewALPNWrapper,
 }
 
 var DefaultRuleCreators = map[string]RuleCreator{
@@ -17,6 +19,8 @@ var DefaultRuleCreators = map[string]RuleCreator{
 	"contains":   NewContainsRule,
 	"icontains":  NewIContainsRule,
 	"counter_gt": NewCounterGTRule,
+	"rate_gt":    NewRateGTRule,
+	"flag":       NewFlagRule,
 
 	"and": NewCompositeAndRule,
 	"not": NewCompositeNotRule,
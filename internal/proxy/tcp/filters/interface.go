@@ -11,15 +11,56 @@ type Rule interface {
 	fmt.Stringer
 }
 
+// StreamRule is the rule matching the payload, which can tell the matches in the new data
+// from the ones in the data seen before, kept in the stream window.
+type StreamRule interface {
+	Rule
+	// ApplyFrom is Apply ignoring the matches lying entirely before from, the offset of the new data in buf.
+	ApplyFrom(ctx *common.ProxyContext, buf []byte, from int, ingress bool) (bool, error)
+}
+
+// ApplyNew applies the rule to buf, where the data before from was already matched on,
+// so that the payload matched once is not reported again on the following reads.
+// Rules not matching the payload are applied as is.
+func ApplyNew(rule Rule, ctx *common.ProxyContext, buf []byte, from int, ingress bool) (bool, error) {
+	if sr, ok := rule.(StreamRule); ok && from > 0 && isStream(rule) {
+		return sr.ApplyFrom(ctx, buf, from, ingress)
+	}
+	return rule.Apply(ctx, buf, ingress)
+}
+
+// isStream reports whether the rule result depends on the payload matches.
+// Negated rules are not, as the payload seen before affects them as well.
+func isStream(rule Rule) bool {
+	switch r := rule.(type) {
+	case RegexRule, ContainsRule, IContainsRule:
+		return true
+	case *IngressWrapper:
+		return isStream(r.rule)
+	case *EgressWrapper:
+		return isStream(r.rule)
+	case CompositeAndRule:
+		for _, rule := range r.rules {
+			if isStream(rule) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type RuleCreator func(rs RuleSet, cfg common.RuleConfig) (Rule, error)
 type RuleWrapperCreator func(rule Rule, cfg common.RuleConfig) Rule
 
 type Filter struct {
+	Name    string
 	Rule    Rule
 	Verdict common.Verdict
 
 	alert    atomic.Bool
 	disabled atomic.Bool
+	shadow   atomic.Bool
+	stats    *common.FilterStats
 }
 
 func (f Filter) IsEnabled() bool {
@@ -30,6 +71,14 @@ func (f Filter) GetAlert() bool {
 	return f.alert.Load()
 }
 
+func (f Filter) GetShadow() bool {
+	return f.shadow.Load()
+}
+
+func (f Filter) GetStats() *common.FilterStats {
+	return f.stats
+}
+
 func (f *Filter) SetEnabled(enabled bool) {
 	f.disabled.Store(!enabled)
 }
@@ -38,6 +87,14 @@ func (f *Filter) SetAlert(alert bool) {
 	f.alert.Store(alert)
 }
 
+func (f *Filter) SetShadow(shadow bool) {
+	f.shadow.Store(shadow)
+}
+
+func (f Filter) GetName() string {
+	return f.Name
+}
+
 func (f Filter) GetRule() common.Rule {
 	return f.Rule
 }
@@ -49,3 +106,47 @@ func (f Filter) GetVerdict() common.Verdict {
 func (f Filter) String() string {
 	return fmt.Sprintf("if %s: %s", f.Rule, f.Verdict)
 }
+
+func NewFilters(cfg []common.FilterConfig, rs *RuleSet) ([]Filter, error) {
+	fts := make([]Filter, 0, len(cfg))
+	for _, f := range cfg {
+		rule, ok := rs.GetRule(f.Rule)
+		if !ok {
+			return nil, fmt.Errorf("invalid rule name: %s", f.Rule)
+		}
+		verdict, err := common.ParseVerdict(f.Verdict)
+		if err != nil {
+			return nil, fmt.Errorf("parse verdict: %w", err)
+		}
+		filter := Filter{
+			Name:    f.Rule,
+			Rule:    rule,
+			Verdict: verdict,
+			stats:   new(common.FilterStats),
+		}
+		filter.SetAlert(f.Alert)
+		filter.SetShadow(f.Shadow)
+		filter.SetEnabled(!f.Disabled)
+		fts = append(fts, filter)
+	}
+	return fts, nil
+}
+
+// KeepStats makes the new filters continue the counters of the old ones with the same rule and verdict.
+// The rate limit verdicts are kept too, so the reload doesn't reset their windows.
+func KeepStats(fts, old []Filter) {
+	used := make(map[int]bool, len(old))
+	for i := range fts {
+		for j := range old {
+			if used[j] || fts[i].Name != old[j].Name || fts[i].Verdict.String() != old[j].Verdict.String() {
+				continue
+			}
+			fts[i].stats = old[j].stats
+			if _, ok := old[j].Verdict.(common.VerdictRateLimit); ok {
+				fts[i].Verdict = old[j].Verdict
+			}
+			used[j] = true
+			break
+		}
+	}
+}
@@ -45,21 +45,59 @@ func NewIContainsRule(_ RuleSet, cfg common.RuleConfig) (Rule, error) {
 	return r, nil
 }
 
+// NewCounterGTRule takes the counter and the value, the counter may be preceded by the scope.
 func NewCounterGTRule(_ RuleSet, cfg common.RuleConfig) (Rule, error) {
-	if len(cfg.Args) != 2 {
+	if len(cfg.Args) != 2 && len(cfg.Args) != 3 {
 		return nil, ErrInvalidRuleArgs
 	}
-	val, err := strconv.Atoi(cfg.Args[1])
+	scope, key, err := common.ParseScoped(cfg.Args[:len(cfg.Args)-1])
+	if err != nil {
+		return nil, err
+	}
+	val, err := strconv.Atoi(cfg.Args[len(cfg.Args)-1])
 	if err != nil {
 		return nil, fmt.Errorf("parsing value: %w", err)
 	}
 	r := CounterGTRule{
-		key:   cfg.Args[0],
+		scope: scope,
+		key:   key,
 		value: val,
 	}
 	return r, nil
 }
 
+// NewFlagRule takes the flag, optionally preceded by the scope.
+func NewFlagRule(_ RuleSet, cfg common.RuleConfig) (Rule, error) {
+	if len(cfg.Args) != 1 && len(cfg.Args) != 2 {
+		return nil, ErrInvalidRuleArgs
+	}
+	scope, flag, err := common.ParseScoped(cfg.Args)
+	if err != nil {
+		return nil, err
+	}
+	return FlagRule{scope: scope, flag: flag}, nil
+}
+
+// NewRateGTRule takes the key, the limit and the window, like "ip", "10" and "1m".
+func NewRateGTRule(rs RuleSet, cfg common.RuleConfig) (Rule, error) {
+	if len(cfg.Args) != 3 {
+		return nil, ErrInvalidRuleArgs
+	}
+	key, err := common.ParseRateKey(cfg.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if key.Name != "" {
+		return nil, fmt.Errorf("%w: %s is supported only for http", common.ErrInvalidRateKey, key.Source)
+	}
+	limit, window, err := common.ParseRate(cfg.Args[1], cfg.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	limiter := rs.Limiters.Get(cfg.Type+"/"+cfg.Name+"/"+key.String(), limit, window)
+	return RateGTRule{key: key, limiter: limiter}, nil
+}
+
 type IngressRule struct{}
 
 func (r IngressRule) Apply(_ *common.ProxyContext, _ []byte, ingress bool) (bool, error) {
@@ -78,6 +116,15 @@ func (r RegexRule) Apply(_ *common.ProxyContext, buf []byte, _ bool) (bool, erro
 	return r.regex.Match(buf), nil
 }
 
+func (r RegexRule) ApplyFrom(_ *common.ProxyContext, buf []byte, from int, _ bool) (bool, error) {
+	for _, loc := range r.regex.FindAllIndex(buf, -1) {
+		if loc[1] > from {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (r RegexRule) String() string {
 	return fmt.Sprintf("regex '%s'", r.regex)
 }
@@ -90,6 +137,10 @@ func (r ContainsRule) Apply(_ *common.ProxyContext, buf []byte, _ bool) (bool, e
 	return bytes.Contains(buf, r.value), nil
 }
 
+func (r ContainsRule) ApplyFrom(_ *common.ProxyContext, buf []byte, from int, _ bool) (bool, error) {
+	return bytes.Contains(buf[newMatchStart(from, len(r.value)):], r.value), nil
+}
+
 func (r ContainsRule) String() string {
 	return fmt.Sprintf("contains '%s'", string(r.value))
 }
@@ -102,19 +153,64 @@ func (r IContainsRule) Apply(_ *common.ProxyContext, buf []byte, _ bool) (bool,
 	return bytes.Contains(bytes.ToLower(buf), r.value), nil
 }
 
+func (r IContainsRule) ApplyFrom(_ *common.ProxyContext, buf []byte, from int, _ bool) (bool, error) {
+	return bytes.Contains(bytes.ToLower(buf[newMatchStart(from, len(r.value)):]), r.value), nil
+}
+
 func (r IContainsRule) String() string {
 	return fmt.Sprintf("icontains '%s'", string(r.value))
 }
 
+// newMatchStart returns the offset the match of the length has to start at to overlap the data from the offset.
+func newMatchStart(from, length int) int {
+	if start := from - length + 1; start > 0 {
+		return start
+	}
+	return 0
+}
+
 type CounterGTRule struct {
+	scope string
 	key   string
 	value int
 }
 
 func (r CounterGTRule) Apply(ctx *common.ProxyContext, _ []byte, _ bool) (bool, error) {
-	return ctx.GetCounter(r.key) > r.value, nil
+	return ctx.GetScopedCounter(r.scope, r.key) > r.value, nil
 }
 
 func (r CounterGTRule) String() string {
-	return fmt.Sprintf("counter '%s' > %d", r.key, r.value)
+	return fmt.Sprintf("counter '%s' > %d", common.ScopedName(r.scope, r.key), r.value)
+}
+
+// FlagRule matches if the flag is set in the scope, like the modified flag of the rewritten connection.
+type FlagRule struct {
+	scope string
+	flag  string
+}
+
+func (r FlagRule) Apply(ctx *common.ProxyContext, _ []byte, _ bool) (bool, error) {
+	return ctx.GetScopedFlag(r.scope, r.flag), nil
+}
+
+func (r FlagRule) String() string {
+	return fmt.Sprintf("flag '%s'", common.ScopedName(r.scope, r.flag))
+}
+
+// RateGTRule matches the connections over the rate limit, each connection is counted once.
+type RateGTRule struct {
+	key     common.RateKey
+	limiter *common.RateLimiter
+}
+
+func (r RateGTRule) Apply(ctx *common.ProxyContext, _ []byte, _ bool) (bool, error) {
+	key, ok := r.key.Resolve(ctx, "")
+	if !ok {
+		return false, nil
+	}
+	return r.limiter.HitOnce(ctx, key), nil
+}
+
+func (r RateGTRule) String() string {
+	return fmt.Sprintf("rate by %s > %d per %v", r.key, r.limiter.Limit, r.limiter.Window)
 }
@@ -4,6 +4,7 @@ import (
 	"goxy/internal/common"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestContainsRule_Apply(t *testing.T) {
@@ -262,3 +263,52 @@ func TestIContainsRule_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestRateGTRule_Apply(t *testing.T) {
+	rule, err := NewRateGTRule(RuleSet{}, common.RuleConfig{Args: []string{"ip", "2", "1m"}})
+	if err != nil {
+		t.Fatalf("NewRateGTRule() error = %v", err)
+	}
+	r := rule.(RateGTRule)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.limiter.SetClock(func() time.Time { return now })
+
+	state := common.NewState()
+	connect := func(addr string) *common.ProxyContext {
+		ctx := common.NewProxyContext()
+		ctx.BindState(state, time.Minute, common.ScopeKeys("svc", addr))
+		return ctx
+	}
+	tests := []struct {
+		name    string
+		addr    string
+		advance time.Duration
+		want    bool
+	}{
+		{"first connection", "10.0.0.1:1000", 0, false},
+		{"second connection", "10.0.0.1:1001", time.Second, false},
+		{"other client", "10.0.0.2:1000", time.Second, false},
+		{"third connection", "10.0.0.1:1002", time.Second, true},
+		{"after the window", "10.0.0.1:1003", time.Minute * 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			ctx := connect(tt.addr)
+			// Each connection is counted once, however many chunks it has.
+			for i := 0; i < 3; i++ {
+				got, err := r.Apply(ctx, []byte("data"), true)
+				if err != nil {
+					t.Fatalf("Apply() error = %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("Apply() chunk %d got = %v, want %v", i, got, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := NewRateGTRule(RuleSet{}, common.RuleConfig{Args: []string{"header:X-Api-Key", "2", "1m"}}); err == nil {
+		t.Errorf("NewRateGTRule() accepted the header key")
+	}
+}
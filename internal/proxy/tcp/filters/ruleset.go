@@ -8,6 +8,8 @@ import (
 
 type RuleSet struct {
 	Rules map[string]Rule
+	// Limiters keeps the windows of the rate rules across the reloads, nil creates the new limiters.
+	Limiters *common.RateLimiters
 }
 
 func (rs RuleSet) GetRule(name string) (Rule, bool) {
@@ -21,10 +23,21 @@ func (rs RuleSet) GetRule(name string) (Rule, bool) {
 }
 
 func NewRuleSet(cfg []common.RuleConfig) (*RuleSet, error) {
-	rs := RuleSet{Rules: make(map[string]Rule)}
+	return NewRuleSetFor("tcp", cfg)
+}
+
+// NewRuleSetFor parses the rules of the family, like tcp::, skipping the others.
+// Datagram proxies use the same rules on the datagram payloads under their own family.
+func NewRuleSetFor(family string, cfg []common.RuleConfig) (*RuleSet, error) {
+	return NewRuleSetWith(family, cfg, nil)
+}
+
+// NewRuleSetWith is NewRuleSetFor taking the rate limiters of the rules from the registry.
+func NewRuleSetWith(family string, cfg []common.RuleConfig, limiters *common.RateLimiters) (*RuleSet, error) {
+	rs := RuleSet{Rules: make(map[string]Rule), Limiters: limiters}
 
 	for _, rc := range cfg {
-		if strings.HasPrefix(rc.Type, "tcp::") {
+		if strings.HasPrefix(rc.Type, family+"::") {
 			tokens := strings.Split(rc.Type, "::")
 			if len(tokens) < 2 {
 				return nil, fmt.Errorf("invalid rule: %s", rc.Type)
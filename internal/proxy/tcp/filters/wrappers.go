@@ -17,6 +17,14 @@ func NewNotWrapper(rule Rule, _ common.RuleConfig) Rule {
 	return &NotWrapper{rule}
 }
 
+func NewSNIWrapper(rule Rule, _ common.RuleConfig) Rule {
+	return &ValueWrapper{rule: rule, key: common.TLSServerNameKey, name: "sni"}
+}
+
+func NewALPNWrapper(rule Rule, _ common.RuleConfig) Rule {
+	return &ValueWrapper{rule: rule, key: common.TLSProtocolKey, name: "alpn"}
+}
+
 type IngressWrapper struct {
 	rule Rule
 }
@@ -32,6 +40,17 @@ func (w IngressWrapper) Apply(ctx *common.ProxyContext, buf []byte, ingress bool
 	return res, nil
 }
 
+func (w IngressWrapper) ApplyFrom(ctx *common.ProxyContext, buf []byte, from int, ingress bool) (bool, error) {
+	if !ingress {
+		return false, nil
+	}
+	res, err := ApplyNew(w.rule, ctx, buf, from, ingress)
+	if err != nil {
+		return false, fmt.Errorf("error in rule %T: %w", w.rule, err)
+	}
+	return res, nil
+}
+
 func (w IngressWrapper) String() string {
 	return fmt.Sprintf("ingress and %s", w.rule)
 }
@@ -51,6 +70,17 @@ func (w EgressWrapper) Apply(ctx *common.ProxyContext, buf []byte, ingress bool)
 	return res, nil
 }
 
+func (w EgressWrapper) ApplyFrom(ctx *common.ProxyContext, buf []byte, from int, ingress bool) (bool, error) {
+	if ingress {
+		return false, nil
+	}
+	res, err := ApplyNew(w.rule, ctx, buf, from, ingress)
+	if err != nil {
+		return false, fmt.Errorf("error in rule %T: %w", w.rule, err)
+	}
+	return res, nil
+}
+
 func (w EgressWrapper) String() string {
 	return fmt.Sprintf("egress and %s", w.rule)
 }
@@ -70,3 +100,27 @@ func (w NotWrapper) Apply(ctx *common.ProxyContext, buf []byte, ingress bool) (b
 func (w NotWrapper) String() string {
 	return fmt.Sprintf("not (%s)", w.rule)
 }
+
+// ValueWrapper applies the rule to the connection detail from the context instead of the data,
+// it never matches if the detail is not set.
+type ValueWrapper struct {
+	rule Rule
+	key  string
+	name string
+}
+
+func (w ValueWrapper) Apply(ctx *common.ProxyContext, _ []byte, ingress bool) (bool, error) {
+	value, ok := ctx.GetValue(w.key)
+	if !ok {
+		return false, nil
+	}
+	res, err := w.rule.Apply(ctx, []byte(value), ingress)
+	if err != nil {
+		return false, fmt.Errorf("error in rule %T: %w", w.rule, err)
+	}
+	return res, nil
+}
+
+func (w ValueWrapper) String() string {
+	return fmt.Sprintf("%s %s", w.name, w.rule)
+}
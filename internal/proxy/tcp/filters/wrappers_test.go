@@ -131,3 +131,39 @@ func TestNotWrapper_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestValueWrapper_Apply(t *testing.T) {
+	rs, err := NewRuleSet([]common.RuleConfig{
+		{Name: "sni", Type: "tcp::sni::contains", Args: []string{"evil"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	rule := rs.Rules["sni"]
+
+	tests := []struct {
+		name string
+		sni  string
+		buf  string
+		want bool
+	}{
+		{"plain connection", "", "evil", false},
+		{"matching name", "evil.local", "hello", true},
+		{"other name", "good.local", "evil", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := common.NewProxyContext()
+			if tt.sni != "" {
+				ctx.SetValue(common.TLSServerNameKey, tt.sni)
+			}
+			got, err := rule.Apply(ctx, []byte(tt.buf), true)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,75 +2,102 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"go.uber.org/atomic"
+	"goxy/internal/alerts"
+	"goxy/internal/capture"
 	"goxy/internal/common"
+	"goxy/internal/metrics"
 	"goxy/internal/proxy/tcp/filters"
+	"goxy/internal/tlsconfig"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 const BufSize = 64 * 1024
 
+// HoldTimeout is how long the data held back for the rewrites waits for the rest of the payload
+// before it's forwarded as is.
+const HoldTimeout = time.Millisecond * 100
+
 var (
 	ErrShutdownTimeout = errors.New("proxy shutdown timeout")
 	ErrDropped         = errors.New("connection dropped")
 	ErrInvalidFilter   = errors.New("no such filter")
 )
 
-func NewProxy(cfg common.ServiceConfig, rs *filters.RuleSet) (*Proxy, error) {
-	fts := make([]filters.Filter, 0, len(cfg.Filters))
-	for _, f := range cfg.Filters {
-		rule, ok := rs.GetRule(f.Rule)
-		if !ok {
-			return nil, fmt.Errorf("invalid rule name: %s", f.Rule)
-		}
-		verdict, err := common.ParseVerdict(f.Verdict)
-		if err != nil {
-			return nil, fmt.Errorf("parse verdict: %w", err)
+func NewProxy(cfg common.ServiceConfig, rs *filters.RuleSet, cs *capture.Store) (*Proxy, error) {
+	fts, err := filters.NewFilters(cfg.Filters, rs)
+	if err != nil {
+		return nil, fmt.Errorf("creating filters: %w", err)
+	}
+
+	var serverTLS, clientTLS *tls.Config
+	if cfg.TLS != nil {
+		if cfg.TLS.Terminate {
+			if serverTLS, err = tlsconfig.Server(cfg.TLS); err != nil {
+				return nil, fmt.Errorf("creating server tls config: %w", err)
+			}
+			serverTLS = mirrorALPN(serverTLS)
 		}
-		filter := filters.Filter{
-			Rule:    rule,
-			Verdict: verdict,
+		if cfg.TLS.Upstream {
+			if clientTLS, err = tlsconfig.Client(cfg.TLS, cfg.Target); err != nil {
+				return nil, fmt.Errorf("creating client tls config: %w", err)
+			}
 		}
-		filter.SetAlert(f.Alert)
-		fts = append(fts, filter)
 	}
 
 	logger := logrus.WithField("type", "tcp").WithField("listen", cfg.Listen)
+	// Cancelled on shutdown, so the delayed connections don't hold it.
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &Proxy{
 		ListenAddr: cfg.Listen,
-		TargetAddr: cfg.Target,
 
 		serviceConfig: cfg,
 		logger:        logger,
 		filters:       fts,
+		serverTLS:     serverTLS,
+		clientTLS:     clientTLS,
 		conns:         newConnMap(),
+		capture:       cs,
+		stats:         new(common.ProxyStats),
+		ctx:           ctx,
+		cancel:        cancel,
 		wg:            new(sync.WaitGroup),
+		mu:            new(sync.RWMutex),
 	}
 	return p, nil
 }
 
 type Proxy struct {
 	ListenAddr string
-	TargetAddr string
 
 	serviceConfig common.ServiceConfig
 	closing       bool
 	listening     atomic.Bool
 	conns         *connMap
-	connSeq       *atomic.Int32
+	capture       *capture.Store
+	stats         *common.ProxyStats
+	ctx           context.Context
+	cancel        context.CancelFunc
 	wg            *sync.WaitGroup
 	listener      net.Listener
+	serverTLS     *tls.Config
+	clientTLS     *tls.Config
+	closeOnce     sync.Once
+	closeErr      error
 	logger        *logrus.Entry
 	filters       []filters.Filter
+	mu            *sync.RWMutex
 }
 
-func (p Proxy) GetListening() bool {
+func (p *Proxy) GetListening() bool {
 	return p.listening.Load()
 }
 
@@ -78,18 +105,59 @@ func (p *Proxy) SetListening(state bool) {
 	p.listening.Store(state)
 }
 
-func (p *Proxy) SetFilterState(filter int, enabled, alert bool) error {
+func (p *Proxy) GetStats() *common.ProxyStats {
+	return p.stats
+}
+
+func (p *Proxy) ActiveConnections() int {
+	return p.conns.length()
+}
+
+// GetShadow reports whether the whole service is in shadow mode:
+// filters are evaluated and their matches are recorded, but verdicts are never applied.
+func (p *Proxy) GetShadow() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.serviceConfig.Shadow
+}
+
+func (p *Proxy) SetShadow(shadow bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serviceConfig.Shadow = shadow
+}
+
+func (p *Proxy) SetFilterState(filter int, enabled, alert, shadow bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	if filter < 0 || filter >= len(p.filters) {
 		return ErrInvalidFilter
 	}
 	p.filters[filter].SetEnabled(enabled)
 	p.filters[filter].SetAlert(alert)
+	p.filters[filter].SetShadow(shadow)
 	return nil
 }
 
+// Reload replaces the service config and the filter chain of the running proxy.
+// Listen address and TLS settings cannot be changed without restarting the proxy, so they're ignored.
+// Filters with the same rule and verdict keep their counters.
+// Connections that are already established pick up the new filters on the next read.
+func (p *Proxy) Reload(cfg common.ServiceConfig, fts []filters.Filter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg.Listen = p.ListenAddr
+	cfg.TLS = p.serviceConfig.TLS
+	filters.KeepStats(fts, p.filters)
+	p.serviceConfig = cfg
+	p.filters = fts
+	p.logger.Info("Configuration reloaded")
+}
+
 func (p *Proxy) Start() error {
 	p.SetListening(true)
 
+	// TLS is set up on the accepted connections, so the raw ones can be reset.
 	var err error
 	p.listener, err = net.Listen("tcp", p.ListenAddr)
 	if err != nil {
@@ -101,12 +169,52 @@ func (p *Proxy) Start() error {
 	return nil
 }
 
+// CloseListener stops accepting new connections, the active ones are kept.
+func (p *Proxy) CloseListener() error {
+	p.closeOnce.Do(func() {
+		p.closing = true
+		if p.listener != nil {
+			p.closeErr = p.listener.Close()
+		}
+	})
+	if p.closeErr != nil {
+		return fmt.Errorf("closing listener: %w", p.closeErr)
+	}
+	return nil
+}
+
+// Drain stops accepting new connections and waits for the active ones to finish.
+// Connections still open when ctx is done are closed.
+func (p *Proxy) Drain(ctx context.Context) error {
+	if err := p.CloseListener(); err != nil {
+		return err
+	}
+
+	done := make(chan interface{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.logger.Infof("Drain timeout, closing %d connections", p.conns.length())
+	p.cancel()
+	p.conns.closeAll(p.logger)
+	<-done
+	return nil
+}
+
 func (p *Proxy) Shutdown(ctx context.Context) error {
-	p.closing = true
-	if err := p.listener.Close(); err != nil {
-		return fmt.Errorf("closing listener: %w", err)
+	if err := p.CloseListener(); err != nil {
+		return err
 	}
 
+	p.cancel()
 	done := make(chan interface{}, 1)
 	go func() {
 		p.conns.closeAll(p.logger)
@@ -123,26 +231,118 @@ func (p *Proxy) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-func (p Proxy) GetConfig() *common.ServiceConfig {
-	return &p.serviceConfig
+func (p *Proxy) GetConfig() *common.ServiceConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cfg := p.serviceConfig
+	return &cfg
+}
+
+func (p *Proxy) getFilters() []filters.Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.filters
+}
+
+func (p *Proxy) runFilters(conn *Connection, buf []byte, from int, ingress bool) error {
+	return ApplyFilters(conn.Context, p.getFilters(), buf, from, ingress, p.GetShadow(), func(f *filters.Filter, shadow bool) {
+		conn.Capture.AddMatch(f.Name, f.Verdict.String(), ingress, shadow)
+		if shadow {
+			p.logger.Debugf("Rule %v triggered in shadow mode", f.Rule)
+			return
+		}
+		reasons := conn.Context.TakeAlerts()
+		if f.GetAlert() {
+			p.logger.Warningf("Rule %v triggered", f.Rule)
+			reasons = append(reasons, alerts.ReasonRuleTriggered)
+		}
+		for _, reason := range reasons {
+			alerts.Publish(alerts.Alert{
+				Service:    p.GetConfig().Name,
+				Rule:       f.Name,
+				Reason:     reason,
+				ConnID:     conn.ID,
+				RecordID:   conn.Capture.ID(),
+				ClientAddr: conn.Remote.RemoteAddr().String(),
+				Ingress:    ingress,
+				Payload:    alerts.Excerpt(buf),
+			})
+		}
+	})
+}
+
+// actions are queued by the filters of one direction for its data.
+type actions struct {
+	rewrites []common.Rewriter
+	delay    time.Duration
 }
 
-func (p Proxy) runFilters(pctx *common.ProxyContext, buf []byte, ingress bool) error {
-	for _, f := range p.filters {
+// filter runs the filters over the window and takes the actions they queued.
+// Directions are filtered one at a time, so each one takes only the actions of its own filters,
+// the alerts included. The tarpit is kept in the context, it limits both directions.
+func (p *Proxy) filter(conn *Connection, buf []byte, from int, ingress bool) (actions, error) {
+	conn.filterMu.Lock()
+	defer conn.filterMu.Unlock()
+	err := p.runFilters(conn, buf, from, ingress)
+	return actions{
+		rewrites: conn.Context.TakeRewrites(),
+		delay:    conn.Context.TakeDelay(),
+	}, err
+}
+
+// rewriters returns the verdicts of the filters which may rewrite the payload.
+func rewriters(fts []filters.Filter) []common.Rewriter {
+	var result []common.Rewriter
+	for i := range fts {
+		if r, ok := fts[i].Verdict.(common.Rewriter); ok {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// ApplyFilters runs the filter chain over buf, calling matched for each triggered filter.
+// Data before from was already filtered, payload matches lying entirely in it are skipped.
+// matched is called after the verdict is applied.
+// Verdicts of the shadow filters, or of all filters if shadow is set, are not applied.
+// Chain stops after the filter dropping or accepting the connection.
+func ApplyFilters(
+	pctx *common.ProxyContext,
+	fts []filters.Filter,
+	buf []byte,
+	from int,
+	ingress bool,
+	shadow bool,
+	matched func(f *filters.Filter, shadow bool),
+) error {
+	for i := range fts {
+		f := &fts[i]
 		if !f.IsEnabled() {
 			continue
 		}
-		res, err := f.Rule.Apply(pctx, buf, ingress)
+		stats := f.GetStats()
+		stats.AddEvaluation()
+		res, err := filters.ApplyNew(f.Rule, pctx, buf, from, ingress)
 		if err != nil {
+			stats.AddError()
 			return fmt.Errorf("error in rule %T: %w", f.Rule, err)
 		}
 		if res {
-			if f.GetAlert() {
-				p.logger.Warningf("Rule %v triggered", f.Rule)
+			stats.AddMatch()
+			if shadow || f.GetShadow() {
+				matched(f, true)
+				continue
 			}
-			if err := f.Verdict.Mutate(pctx); err != nil {
+			dropped := pctx.GetFlag(common.DropFlag)
+			err := f.Verdict.Mutate(pctx)
+			matched(f, false)
+			if err != nil {
+				stats.AddError()
 				return fmt.Errorf("error mutating verdict %T: %w", f.Verdict, err)
 			}
+			if !dropped && pctx.GetFlag(common.DropFlag) {
+				stats.AddDrop()
+			}
 			if pctx.GetFlag(common.DropFlag) || pctx.GetFlag(common.AcceptFlag) {
 				break
 			}
@@ -151,24 +351,29 @@ func (p Proxy) runFilters(pctx *common.ProxyContext, buf []byte, ingress bool) e
 	return nil
 }
 
-func (p Proxy) String() string {
+func (p *Proxy) String() string {
 	return fmt.Sprintf("TCP proxy %s", p.ListenAddr)
 }
 
-func (p Proxy) GetFilters() []common.Filter {
-	result := make([]common.Filter, 0, len(p.filters))
-	for _, f := range p.filters {
-		f := f
-		result = append(result, &f)
+// Addr returns the address the proxy is listening on, or nil if it's not started.
+func (p *Proxy) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+func (p *Proxy) GetFilters() []common.Filter {
+	fts := p.getFilters()
+	result := make([]common.Filter, 0, len(fts))
+	for i := range fts {
+		result = append(result, &fts[i])
 	}
 	return result
 }
 
-func (p Proxy) oneSideHandler(conn *Connection, logger *logrus.Entry, ingress bool) error {
-	var (
-		src io.Reader
-		dst io.Writer
-	)
+func (p *Proxy) oneSideHandler(conn *Connection, logger *logrus.Entry, ingress bool) error {
+	var src, dst net.Conn
 	if ingress {
 		src = conn.Remote
 		dst = conn.Local
@@ -177,34 +382,88 @@ func (p Proxy) oneSideHandler(conn *Connection, logger *logrus.Entry, ingress bo
 		dst = conn.Remote
 	}
 
+	// Tarpit limits the rest of the connection, whichever direction it's matched in.
+	write := func(data []byte) error {
+		var w io.Writer = dst
+		if tarpit := conn.Context.GetTarpit(); tarpit > 0 {
+			w = common.NewThrottledWriter(p.ctx, dst, tarpit)
+		}
+		nw, ew := w.Write(data)
+		if ew != nil {
+			return fmt.Errorf("proxy connection write: %w", ew)
+		}
+		if len(data) != nw {
+			return fmt.Errorf("proxt connection write: %w", io.ErrShortWrite)
+		}
+		return nil
+	}
+
+	window := conn.window(ingress)
 	buf := make([]byte, BufSize)
+	waiting := false
 	for {
+		// The held back data is forwarded as is if no more data arrives soon.
+		if held := window.holding(); held || waiting {
+			deadline := time.Time{}
+			if held {
+				deadline = time.Now().Add(HoldTimeout)
+			}
+			if err := src.SetReadDeadline(deadline); err != nil {
+				return fmt.Errorf("setting read deadline: %w", err)
+			}
+			waiting = held
+		}
+
 		nr, er := src.Read(buf)
 		if nr > 0 {
 
 			data := buf[:nr]
+			p.stats.AddBytes(ingress, nr)
+			conn.Capture.AddChunk(ingress, data)
 
-			if err := p.runFilters(conn.Context, data, ingress); err != nil {
+			matchBuf, from := window.feed(data)
+			acts, err := p.filter(conn, matchBuf, from, ingress)
+			if err != nil {
 				logger.Errorf("Error running filters: %v", err)
 			}
 
+			if acts.delay > 0 {
+				logger.Debugf("Delaying data for %v", acts.delay)
+				if err := common.Sleep(p.ctx, acts.delay); err != nil {
+					return fmt.Errorf("delaying data: %w", err)
+				}
+			}
+
 			if conn.Context.GetFlag(common.DropFlag) {
 				logger.Debugf("Dropping connection")
+				conn.dropOnce.Do(func() { p.drop(conn, logger) })
 				return ErrDropped
 			}
 
-			nw, ew := dst.Write(data)
-			if ew != nil {
-				return fmt.Errorf("proxy connection write: %w", ew)
+			var holds []common.Rewriter
+			if window.size > 0 {
+				holds = rewriters(p.getFilters())
 			}
-			if nr != nw {
-				return fmt.Errorf("proxt connection write: %w", io.ErrShortWrite)
+			if err := write(window.forward(conn.Context, data, acts.rewrites, holds)); err != nil {
+				return err
 			}
 		}
 		if er != nil {
+			var netErr net.Error
+			if errors.As(er, &netErr) && netErr.Timeout() && window.holding() {
+				if err := write(window.flush()); err != nil {
+					return err
+				}
+				continue
+			}
 			if er != io.EOF {
 				return fmt.Errorf("proxy connection read: %w", er)
 			}
+			if window.holding() {
+				if err := write(window.flush()); err != nil {
+					return err
+				}
+			}
 			break
 		}
 	}
@@ -213,10 +472,29 @@ func (p Proxy) oneSideHandler(conn *Connection, logger *logrus.Entry, ingress bo
 	return nil
 }
 
-func (p Proxy) handleConnection(id string) {
+// drop answers the dropped connection in the drop mode, closing it is left to the handlers.
+func (p *Proxy) drop(c *Connection, logger *logrus.Entry) {
+	cfg := p.GetConfig()
+	switch cfg.DropMode(c.Context) {
+	case common.DropModeRST:
+		if err := reset(c.raw); err != nil {
+			logger.Warningf("Error resetting connection: %v", err)
+		}
+	case common.DropModeBlackhole:
+		c.holding.Store(true)
+		if err := c.Local.Close(); err != nil && !isConnectionClosedErr(err) {
+			logger.Warningf("Error closing target connection: %v", err)
+		}
+		logger.Debugf("Blackholing connection")
+		discard(c.Remote, cfg.BlackholeTimeout())
+	}
+}
+
+func (p *Proxy) handleConnection(id string) {
 	defer p.wg.Done()
 
-	conn := p.conns.get(id)
+	raw := p.conns.get(id)
+	conn := raw
 	connLogger := p.logger.WithField("conn", id)
 	defer func() {
 		if err := conn.Close(); err != nil && !isConnectionClosedErr(err) {
@@ -226,13 +504,31 @@ func (p Proxy) handleConnection(id string) {
 	}()
 
 	connLogger.Debugf("Connection received")
-	localConn, err := net.Dial("tcp", p.TargetAddr)
+	cfg := p.GetConfig()
+	pctx := common.NewServiceContext(cfg, raw.RemoteAddr().String())
+	if p.serverTLS != nil {
+		tlsConn := tls.Server(raw, p.serverTLS)
+		conn = tlsConn
+		if err := handshake(tlsConn, pctx); err != nil {
+			connLogger.Warningf("TLS handshake failed: %v", err)
+			return
+		}
+	}
+
+	localConn, err := dialTarget(cfg.Target, p.clientTLS, pctx)
 	if err != nil {
 		connLogger.Errorf("Failed to connect to target: %v", err)
+		metrics.UpstreamErrors.WithLabelValues(cfg.Name).Inc()
 		return
 	}
 
-	c := newConnection(conn, localConn)
+	c := newConnection(conn, localConn, pctx, cfg.StreamWindow)
+	c.ID = id
+	c.raw = raw
+	c.Capture = p.capture.NewSession(cfg.Name, "tcp", conn.RemoteAddr().String(), localConn.RemoteAddr().String())
+	defer func() {
+		c.Capture.Finish(capture.VerdictFromContext(c.Context))
+	}()
 
 	handler := func(wg *sync.WaitGroup, ingress bool) {
 		defer wg.Done()
@@ -258,6 +554,10 @@ func (p Proxy) handleConnection(id string) {
 	go handler(&wg, true)
 	go handler(&wg, false)
 	wg.Wait()
+
+	if c.Context.GetFlag(common.DropFlag) {
+		p.stats.AddDropped()
+	}
 }
 
 func (p *Proxy) serve() {
@@ -285,6 +585,7 @@ func (p *Proxy) serve() {
 			continue
 		}
 
+		p.stats.AddConnection()
 		connID := p.conns.add(conn)
 		p.wg.Add(1)
 		go p.handleConnection(connID)
@@ -0,0 +1,679 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"goxy/internal/alerts"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestApplyFilters_Shadow(t *testing.T) {
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		filterShadow  bool
+		serviceShadow bool
+		wantDrop      bool
+		wantCounter   int
+		wantShadow    []bool
+	}{
+		{
+			name:       "no shadow",
+			wantDrop:   true,
+			wantShadow: []bool{false},
+		},
+		{
+			name:         "filter shadow",
+			filterShadow: true,
+			wantCounter:  1,
+			wantShadow:   []bool{true, false},
+		},
+		{
+			name:          "service shadow",
+			serviceShadow: true,
+			wantShadow:    []bool{true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fts, err := filters.NewFilters([]common.FilterConfig{
+				{Rule: "attack", Verdict: "drop", Shadow: tt.filterShadow},
+				{Rule: "attack", Verdict: "inc::hits"},
+			}, rs)
+			if err != nil {
+				t.Fatalf("NewFilters() error = %v", err)
+			}
+
+			pctx := common.NewProxyContext()
+			shadow := make([]bool, 0)
+			err = ApplyFilters(pctx, fts, []byte("attack"), 0, true, tt.serviceShadow, func(_ *filters.Filter, s bool) {
+				shadow = append(shadow, s)
+			})
+			if err != nil {
+				t.Fatalf("ApplyFilters() error = %v", err)
+			}
+			if got := pctx.GetFlag(common.DropFlag); got != tt.wantDrop {
+				t.Errorf("ApplyFilters() drop = %v, want %v", got, tt.wantDrop)
+			}
+			if got := pctx.GetCounter("hits"); got != tt.wantCounter {
+				t.Errorf("ApplyFilters() counter = %v, want %v", got, tt.wantCounter)
+			}
+			if len(shadow) != len(tt.wantShadow) {
+				t.Fatalf("ApplyFilters() matched = %v, want %v", shadow, tt.wantShadow)
+			}
+			for i := range shadow {
+				if shadow[i] != tt.wantShadow[i] {
+					t.Errorf("ApplyFilters() matched = %v, want %v", shadow, tt.wantShadow)
+				}
+			}
+		})
+	}
+}
+
+func TestProxy_Stats(t *testing.T) {
+	target, _ := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	cfg := common.ServiceConfig{
+		Name:   "test",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "drop"},
+		},
+	}
+	p := startTestProxy(t, cfg, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	for _, payload := range []string{"hello", "attack"} {
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		waitShort()
+	}
+	waitConnClosed(t, conn)
+
+	deadline := time.Now().Add(time.Second * 2)
+	for p.GetStats().Dump().Dropped == 0 && time.Now().Before(deadline) {
+		waitShort()
+	}
+	want := common.ProxyCounters{Connections: 1, BytesIn: 11, Dropped: 1}
+	if got := p.GetStats().Dump(); got != want {
+		t.Errorf("proxy stats = %+v, want %+v", got, want)
+	}
+
+	fs := p.GetFilters()[0].GetStats()
+	got := fs.Dump()
+	if got.Evaluations != 2 || got.Matches != 1 || got.Drops != 1 || got.Errors != 0 || got.LastMatch == nil {
+		t.Errorf("filter stats = %+v", got)
+	}
+
+	fts, err := filters.NewFilters(cfg.Filters, rs)
+	if err != nil {
+		t.Fatalf("NewFilters() error = %v", err)
+	}
+	p.Reload(cfg, fts)
+	if got := p.GetFilters()[0].GetStats().Dump().Matches; got != 1 {
+		t.Errorf("filter stats after reload: matches = %d, want 1", got)
+	}
+
+	fs.Reset()
+	if got := fs.Dump(); got != (common.FilterCounters{}) {
+		t.Errorf("filter stats after reset = %+v", got)
+	}
+}
+
+func TestProxy_Alerts(t *testing.T) {
+	target, _ := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	cfg := common.ServiceConfig{
+		Name:   "alerting",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "alert::attack found", Alert: true},
+		},
+	}
+	p := startTestProxy(t, cfg, rs)
+
+	ch, cancel := alerts.Subscribe()
+	defer cancel()
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("some attack")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	wantReasons := []string{"attack found", alerts.ReasonRuleTriggered}
+	for _, reason := range wantReasons {
+		select {
+		case a := <-ch:
+			if a.Service != "alerting" || a.Rule != "attack" || a.Reason != reason {
+				t.Errorf("alert = %+v, want reason %q", a, reason)
+			}
+			if a.ConnID == "" || a.ClientAddr != conn.LocalAddr().String() || a.Payload != "some attack" || !a.Ingress {
+				t.Errorf("alert = %+v, connection details missing", a)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("alert %q not published", reason)
+		}
+	}
+}
+
+func TestProxy_Replace(t *testing.T) {
+	target, received := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "flag", Type: "tcp::ingress::regex", Args: []string{`flag\{\w+\}`}},
+		{Name: "magic", Type: "tcp::ingress::contains", Args: []string{"\xde\xad"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	cfg := common.ServiceConfig{
+		Name:   "replace",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Filters: []common.FilterConfig{
+			{Rule: "flag", Verdict: `replace::flag\{\w+\}::[redacted]`},
+			{Rule: "magic", Verdict: "replace_bytes::dead::00"},
+		},
+	}
+	p := startTestProxy(t, cfg, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	for _, payload := range []string{"a flag{abc} b ", "\xde\xad\xbe\xef", " end"} {
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		waitShort()
+	}
+
+	want := "a [redacted] b \x00\xbe\xef end"
+	deadline := time.Now().Add(time.Second * 2)
+	for string(received()) != want && time.Now().Before(deadline) {
+		waitShort()
+	}
+	if got := received(); string(got) != want {
+		t.Errorf("target received %q, want %q", got, want)
+	}
+}
+
+func TestProxy_Replace_SplitPayload(t *testing.T) {
+	target, received := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "flag", Type: "tcp::ingress::regex", Args: []string{`flag\{\w+\}`}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:         "replace",
+		Type:         "tcp",
+		Listen:       "127.0.0.1:0",
+		Target:       target,
+		StreamWindow: 16,
+		Filters: []common.FilterConfig{
+			{Rule: "flag", Verdict: `replace::flag\{\w+\}::[redacted]`},
+		},
+	}, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	for _, payload := range []string{"a fl", "ag{a", "bc} b ", "tail"} {
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		waitShort()
+	}
+
+	// The tail held back for the rewrites is forwarded after the hold timeout.
+	want := "a [redacted] b tail"
+	deadline := time.Now().Add(time.Second * 2)
+	for string(received()) != want && time.Now().Before(deadline) {
+		waitShort()
+	}
+	if got := received(); string(got) != want {
+		t.Errorf("target received %q, want %q", got, want)
+	}
+}
+
+func TestProxy_Replace_NoHold(t *testing.T) {
+	target, received := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "flag", Type: "tcp::ingress::regex", Args: []string{`flag\{\w+\}`}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:         "replace",
+		Type:         "tcp",
+		Listen:       "127.0.0.1:0",
+		Target:       target,
+		StreamWindow: 16,
+		Filters: []common.FilterConfig{
+			{Rule: "flag", Verdict: `replace::flag\{\w+\}::[redacted]`},
+		},
+	}, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	// Nothing in the data could start the flag, so it isn't held back.
+	want := "GET /index.html"
+	start := time.Now()
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	deadline := start.Add(time.Second * 2)
+	for string(received()) != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := received(); string(got) != want {
+		t.Fatalf("target received %q, want %q", got, want)
+	}
+	if elapsed := time.Since(start); elapsed >= HoldTimeout {
+		t.Errorf("data forwarded in %v, want no hold", elapsed)
+	}
+}
+
+func TestProxy_Replace_BothDirections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Answers while the request is still delayed by the proxy.
+		time.Sleep(time.Millisecond * 100)
+		_, _ = c.Write([]byte("hey"))
+		buf := make([]byte, 3)
+		for i := 0; i < 2; i++ {
+			n, _ := io.ReadFull(c, buf)
+			received <- string(buf[:n])
+		}
+	}()
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "kek", Type: "tcp::ingress::contains", Args: []string{"kek"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "replace",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: l.Addr().String(),
+		Filters: []common.FilterConfig{
+			{Rule: "ingress", Verdict: "replace::e::o"},
+			{Rule: "kek", Verdict: "delay::200ms"},
+		},
+	}, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetDeadline() error = %v", err)
+	}
+	if _, err := conn.Write([]byte("kek")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := <-received; got != "kok" {
+		t.Errorf("target received %q, want %q", got, "kok")
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(buf) != "hey" {
+		t.Errorf("client received %q, want %q", buf, "hey")
+	}
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := <-received; got != "byo" {
+		t.Errorf("target received %q, want %q", got, "byo")
+	}
+}
+
+func TestEvaluate_Modified(t *testing.T) {
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "flag", Type: "tcp::contains", Args: []string{"flag{"}},
+		{Name: "modified", Type: "tcp::flag", Args: []string{common.ModifiedFlag}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	fts, err := filters.NewFilters([]common.FilterConfig{
+		{Rule: "flag", Verdict: "replace::flag::galf"},
+		{Rule: "modified", Verdict: "inc::modified"},
+	}, rs)
+	if err != nil {
+		t.Fatalf("NewFilters() error = %v", err)
+	}
+
+	pctx, err := Evaluate(common.ServiceConfig{}, fts, []capture.Chunk{
+		{Ingress: true, Data: []byte("hello")},
+		{Ingress: false, Data: []byte("flag{abc}")},
+		{Ingress: true, Data: []byte("bye")},
+	}, func(*filters.Filter, bool, bool, []byte) {})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	// The chunks after the rewritten one see the flag.
+	if got := pctx.GetCounter("modified"); got != 1 {
+		t.Errorf("modified counter = %d, want 1", got)
+	}
+}
+
+func TestProxy_DropModes(t *testing.T) {
+	target, _ := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	timeout := time.Millisecond * 300
+
+	tests := []struct {
+		name    string
+		drop    *common.DropConfig
+		verdict string
+		wantErr func(err error) bool
+	}{
+		{
+			name:    "close",
+			verdict: "drop",
+			wantErr: func(err error) bool { return err == io.EOF },
+		},
+		{
+			name:    "service rst",
+			drop:    &common.DropConfig{Mode: common.DropModeRST},
+			verdict: "drop",
+			wantErr: func(err error) bool { return errors.Is(err, syscall.ECONNRESET) },
+		},
+		{
+			name:    "verdict rst",
+			verdict: "drop::rst",
+			wantErr: func(err error) bool { return errors.Is(err, syscall.ECONNRESET) },
+		},
+		{
+			name:    "blackhole",
+			drop:    &common.DropConfig{Mode: common.DropModeBlackhole, Timeout: &timeout},
+			verdict: "drop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:    "drop",
+				Type:    "tcp",
+				Listen:  "127.0.0.1:0",
+				Target:  target,
+				Drop:    tt.drop,
+				Filters: []common.FilterConfig{{Rule: "attack", Verdict: tt.verdict}},
+			}, rs)
+
+			conn := dialTestProxy(t, p)
+			defer conn.Close()
+			if _, err := conn.Write([]byte("attack")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			buf := make([]byte, 16)
+			if tt.wantErr == nil {
+				// Blackholed connection stays open until the timeout.
+				_ = conn.SetReadDeadline(time.Now().Add(timeout / 2))
+				if _, err := conn.Read(buf); !isTimeoutErr(err) {
+					t.Fatalf("Read() error = %v, want timeout", err)
+				}
+				if _, err := conn.Write([]byte("more")); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				waitConnClosed(t, conn)
+				return
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+			if _, err := conn.Read(buf); !tt.wantErr(err) {
+				t.Errorf("Read() error = %v", err)
+			}
+		})
+	}
+}
+
+func isTimeoutErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestProxy_DelayAndTarpit(t *testing.T) {
+	target, received := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "slow", Type: "tcp::ingress::contains", Args: []string{"slow"}},
+		{Name: "trickle", Type: "tcp::ingress::contains", Args: []string{"trickle"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		minTime time.Duration
+	}{
+		{"not matched", "fast", 0},
+		{"delay", "slow", time.Millisecond * 200},
+		// 15 bytes at 50 B/s are written in three chunks 100ms apart.
+		{"tarpit", "trickle12345678", time.Millisecond * 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:   "delay",
+				Type:   "tcp",
+				Listen: "127.0.0.1:0",
+				Target: target,
+				Filters: []common.FilterConfig{
+					{Rule: "slow", Verdict: "delay::200ms"},
+					{Rule: "trickle", Verdict: "tarpit::50"},
+				},
+			}, rs)
+
+			conn := dialTestProxy(t, p)
+			defer conn.Close()
+			before := len(received())
+			start := time.Now()
+			if _, err := conn.Write([]byte(tt.payload)); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			deadline := time.Now().Add(time.Second * 2)
+			for len(received())-before < len(tt.payload) && time.Now().Before(deadline) {
+				waitShort()
+			}
+			elapsed := time.Since(start)
+			if got := len(received()) - before; got != len(tt.payload) {
+				t.Fatalf("target received %d bytes, want %d", got, len(tt.payload))
+			}
+			if elapsed < tt.minTime {
+				t.Errorf("payload forwarded in %v, want at least %v", elapsed, tt.minTime)
+			}
+			if tt.minTime == 0 && elapsed > time.Millisecond*100 {
+				t.Errorf("payload forwarded in %v, want no delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxy_Tarpit_BothDirections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	response := strings.Repeat("a", 40)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, len("trickle"))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		_, _ = c.Write([]byte(response))
+	}()
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "trickle", Type: "tcp::ingress::contains", Args: []string{"trickle"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:    "tarpit",
+		Type:    "tcp",
+		Listen:  "127.0.0.1:0",
+		Target:  l.Addr().String(),
+		Filters: []common.FilterConfig{{Rule: "trickle", Verdict: "tarpit::50"}},
+	}, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetDeadline() error = %v", err)
+	}
+	if _, err := conn.Write([]byte("trickle")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	// 40 bytes at 50 B/s take about 800ms, the egress is limited by the ingress match too.
+	start := time.Now()
+	if _, err := io.ReadFull(conn, buf[1:]); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*500 {
+		t.Errorf("response received in %v, want the tarpit", elapsed)
+	}
+}
+
+func TestProxy_Shutdown_Delayed(t *testing.T) {
+	target, _ := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "slow", Type: "tcp::ingress::contains", Args: []string{"slow"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p, err := NewProxy(common.ServiceConfig{
+		Name:    "delay",
+		Type:    "tcp",
+		Listen:  "127.0.0.1:0",
+		Target:  target,
+		Filters: []common.FilterConfig{{Rule: "slow", Verdict: "delay::1m"}},
+	}, rs, nil)
+	if err != nil {
+		t.Fatalf("NewProxy() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("slow")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestProxy_ScopedCounter(t *testing.T) {
+	// The counts of the previous runs are forgotten.
+	common.SharedState = common.NewState()
+	target, _ := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+		{Name: "repeated", Type: "tcp::counter_gt", Args: []string{"ip", "attacks", "2"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "scoped counter",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: target,
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "inc::ip::attacks"},
+			{Rule: "repeated", Verdict: "drop"},
+		},
+	}, rs)
+
+	// Each connection attacks once, the counter of the client IP outlives them.
+	for i := 1; i <= 3; i++ {
+		conn := dialTestProxy(t, p)
+		if _, err := conn.Write([]byte("attack")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		_, err := conn.Read(make([]byte, 16))
+		_ = conn.Close()
+		if dropped := err == io.EOF; dropped != (i == 3) {
+			t.Errorf("connection %d dropped = %v, read error = %v", i, dropped, err)
+		}
+	}
+}
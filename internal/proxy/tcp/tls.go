@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"goxy/internal/common"
+	"net"
+	"time"
+)
+
+// HandshakeTimeout limits the TLS handshakes with the client and the target.
+const HandshakeTimeout = time.Second * 10
+
+// mirrorALPN makes the server accept the application protocol preferred by the client,
+// the same protocol is then requested from the target.
+func mirrorALPN(cfg *tls.Config) *tls.Config {
+	result := cfg.Clone()
+	result.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 0 {
+			return nil, nil
+		}
+		c := cfg.Clone()
+		c.NextProtos = hello.SupportedProtos
+		return c, nil
+	}
+	return result
+}
+
+// handshake completes the client TLS handshake and stores the server name and the protocol in the context.
+func handshake(conn *tls.Conn, ctx *common.ProxyContext) error {
+	if err := conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("resetting deadline: %w", err)
+	}
+
+	state := conn.ConnectionState()
+	if state.ServerName != "" {
+		ctx.SetValue(common.TLSServerNameKey, state.ServerName)
+	}
+	if state.NegotiatedProtocol != "" {
+		ctx.SetValue(common.TLSProtocolKey, state.NegotiatedProtocol)
+	}
+	return nil
+}
+
+// dialTarget connects to the target, over TLS if the client config is set.
+func dialTarget(target string, clientTLS *tls.Config, ctx *common.ProxyContext) (net.Conn, error) {
+	if clientTLS == nil {
+		return net.Dial("tcp", target)
+	}
+	cfg := clientTLS.Clone()
+	if proto, ok := ctx.GetValue(common.TLSProtocolKey); ok {
+		cfg.NextProtos = []string{proto}
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: HandshakeTimeout}, "tcp", target, cfg)
+}
@@ -0,0 +1,147 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+	"goxy/internal/tlsconfig"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTLSEchoServer starts the TLS echo server writing its certificate to dir.
+// Protocols negotiated with the clients are sent to the returned channel.
+func startTLSEchoServer(t *testing.T, dir string, protos []string) (string, <-chan string) {
+	t.Helper()
+
+	certPEM, keyPEM, err := tlsconfig.GenerateCert([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("GenerateCert() error = %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "target.crt"), certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: protos})
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	negotiated := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c *tls.Conn) {
+				defer c.Close()
+				if err := c.Handshake(); err != nil {
+					return
+				}
+				negotiated <- c.ConnectionState().NegotiatedProtocol
+				_, _ = io.Copy(c, c)
+			}(c.(*tls.Conn))
+		}
+	}()
+	return l.Addr().String(), negotiated
+}
+
+func TestProxy_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxy-tls")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target, negotiated := startTLSEchoServer(t, dir, []string{"goxy-test", "other"})
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::ingress::contains", Args: []string{"attack"}},
+		{Name: "evil_sni", Type: "tcp::sni::contains", Args: []string{"evil"}},
+		{Name: "test_alpn", Type: "tcp::alpn::regex", Args: []string{"^goxy-test$"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	cfg := common.ServiceConfig{
+		Name:   "tls",
+		Type:   "tcp",
+		Listen: "127.0.0.1:0",
+		Target: target,
+		TLS: &common.TLSConfig{
+			Terminate: true,
+			Upstream:  true,
+			CA:        filepath.Join(dir, "target.crt"),
+		},
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "drop"},
+			{Rule: "evil_sni", Verdict: "drop"},
+			{Rule: "test_alpn", Verdict: "inc::alpn"},
+		},
+	}
+	p := startTestProxy(t, cfg, rs)
+
+	dial := func(serverName string) *tls.Conn {
+		conn, err := tls.Dial("tcp", p.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         []string{"goxy-test"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		return conn
+	}
+
+	conn := dial("service.local")
+	defer conn.Close()
+	if got := conn.ConnectionState().NegotiatedProtocol; got != "goxy-test" {
+		t.Errorf("client negotiated protocol = %q, want goxy-test", got)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 5)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("ReadFull() = %q, %v, want hello", buf, err)
+	}
+	select {
+	case got := <-negotiated:
+		if got != "goxy-test" {
+			t.Errorf("target negotiated protocol = %q, want goxy-test", got)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("target connection not established")
+	}
+	if got := p.GetFilters()[2].GetStats().Dump().Matches; got == 0 {
+		t.Errorf("alpn rule not matched")
+	}
+
+	if _, err := conn.Write([]byte("attack")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	waitConnClosed(t, conn)
+
+	evil := dial("evil.local")
+	defer evil.Close()
+	if _, err := evil.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	waitConnClosed(t, evil)
+	if got := p.GetFilters()[1].GetStats().Dump().Drops; got != 1 {
+		t.Errorf("sni rule drops = %d, want 1", got)
+	}
+}
@@ -1,17 +1,21 @@
 package tcp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"strings"
+	"time"
 )
 
 func isConnectionClosedErr(err error) bool {
 	if err == nil {
 		return false
 	}
-	if errors.Is(err, ErrDropped) {
+	if errors.Is(err, ErrDropped) || errors.Is(err, context.Canceled) {
 		return true
 	}
 	return strings.Contains(err.Error(), "use of closed network connection")
@@ -20,3 +24,20 @@ func isConnectionClosedErr(err error) bool {
 func genConnID(c net.Conn, num int) string {
 	return fmt.Sprintf("%s:%d", c.RemoteAddr(), num)
 }
+
+// reset makes closing the connection send RST instead of FIN.
+func reset(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("unsupported connection %T", c)
+	}
+	return tc.SetLinger(0)
+}
+
+// discard reads and drops the data until the timeout or the connection is closed.
+func discard(c net.Conn, timeout time.Duration) {
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, c)
+}
@@ -0,0 +1,115 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSinkServer starts a tcp server storing everything it receives.
+func startSinkServer(t *testing.T) (string, func() []byte) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	mu := sync.Mutex{}
+	var data []byte
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					mu.Lock()
+					data = append(data, buf[:n]...)
+					mu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+
+	received := func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]byte(nil), data...)
+	}
+	return l.Addr().String(), received
+}
+
+func startTestProxy(t *testing.T, cfg common.ServiceConfig, rs *filters.RuleSet) *Proxy {
+	t.Helper()
+
+	p, err := NewProxy(cfg, rs, nil)
+	if err != nil {
+		t.Fatalf("NewProxy() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := p.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	})
+	return p
+}
+
+func dialTestProxy(t *testing.T, p *Proxy) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	return conn
+}
+
+func waitShort() {
+	time.Sleep(time.Millisecond * 5)
+}
+
+func waitConnClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second * 2)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err == io.EOF || isConnectionResetErr(err) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("connection not closed: %v", err)
+		}
+	}
+}
+
+func isConnectionResetErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
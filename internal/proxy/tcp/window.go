@@ -0,0 +1,87 @@
+package tcp
+
+import "goxy/internal/common"
+
+// streamWindow keeps the tail of one direction of the stream,
+// so that rules can match payloads split across several reads.
+type streamWindow struct {
+	buf  []byte
+	size int
+	// held is the tail of the data not forwarded yet, see forward.
+	held []byte
+}
+
+func newStreamWindow(size int) *streamWindow {
+	w := &streamWindow{size: size}
+	if size > 0 {
+		w.buf = make([]byte, 0, size+BufSize)
+	}
+	return w
+}
+
+// feed appends data to the window and returns the data to run the rules on:
+// at most size bytes previously seen in this direction followed by the whole data,
+// and the offset of data in it, so the rules can skip the matches seen before.
+// Returned slice is valid until the next call to feed.
+// Window with non-positive size is disabled and returns data as is.
+func (w *streamWindow) feed(data []byte) ([]byte, int) {
+	if w.size <= 0 {
+		return data, 0
+	}
+	if len(w.buf) > w.size {
+		n := copy(w.buf, w.buf[len(w.buf)-w.size:])
+		w.buf = w.buf[:n]
+	}
+	from := len(w.buf)
+	w.buf = append(w.buf, data...)
+	return w.buf, from
+}
+
+// forward returns the held data followed by data, rewritten by the rewrites, to forward.
+// If nothing is rewritten, the tail of the last size bytes that could start the payload
+// of any of the holds is held back instead, so that the payload split across reads
+// is rewritten whole once the rest of it arrives.
+// Held data is never rewritten twice, as all of it is forwarded once rewritten.
+func (w *streamWindow) forward(ctx *common.ProxyContext, data []byte, rewrites, holds []common.Rewriter) []byte {
+	out := data
+	if len(w.held) > 0 {
+		out = append(w.held, data...)
+		w.held = nil
+	}
+	if len(rewrites) > 0 {
+		return ctx.ApplyRewrites(rewrites, out)
+	}
+	if len(holds) == 0 || w.size <= 0 {
+		return out
+	}
+	tail := out
+	if len(tail) > w.size {
+		tail = tail[len(tail)-w.size:]
+	}
+	keep := 0
+	for _, r := range holds {
+		if n := r.Pending(tail); n > keep {
+			keep = n
+		}
+	}
+	if keep > len(tail) {
+		keep = len(tail)
+	}
+	if keep == 0 {
+		return out
+	}
+	w.held = append([]byte(nil), out[len(out)-keep:]...)
+	return out[:len(out)-keep]
+}
+
+// holding reports whether any data is held back.
+func (w *streamWindow) holding() bool {
+	return len(w.held) > 0
+}
+
+// flush returns the held data to forward as is.
+func (w *streamWindow) flush() []byte {
+	result := w.held
+	w.held = nil
+	return result
+}
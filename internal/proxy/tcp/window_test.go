@@ -0,0 +1,174 @@
+package tcp
+
+import (
+	"bytes"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+	"strings"
+	"testing"
+)
+
+func TestStreamWindow_Feed(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		chunks []string
+		want   string
+	}{
+		{
+			"disabled",
+			0,
+			[]string{"ke", "k"},
+			"k",
+		},
+		{
+			"fits",
+			16,
+			[]string{"ke", "k"},
+			"kek",
+		},
+		{
+			"tail only",
+			3,
+			[]string{"some ", "data ", "here"},
+			"ta here",
+		},
+		{
+			"large chunk kept whole",
+			2,
+			[]string{"abc", "defgh"},
+			"bcdefgh",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newStreamWindow(tt.size)
+			var got []byte
+			for _, c := range tt.chunks {
+				got, _ = w.feed([]byte(c))
+			}
+			if string(got) != tt.want {
+				t.Errorf("feed() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamWindow_SplitPayload(t *testing.T) {
+	payloads := []string{"kek", "attack", "some/../../etc/passwd"}
+	for _, payload := range payloads {
+		t.Run(payload, func(t *testing.T) {
+			rule, err := filters.NewContainsRule(filters.RuleSet{}, common.RuleConfig{Args: []string{payload}})
+			if err != nil {
+				t.Fatalf("NewContainsRule() error = %v", err)
+			}
+
+			w := newStreamWindow(len(payload))
+			data := []byte("prefix " + payload + " suffix")
+			matched := false
+			for i := range data {
+				buf, from := w.feed(data[i : i+1])
+				res, err := filters.ApplyNew(rule, common.NewProxyContext(), buf, from, true)
+				if err != nil {
+					t.Fatalf("Apply() error = %v", err)
+				}
+				matched = matched || res
+			}
+			if !matched {
+				t.Errorf("payload %q split into single bytes not matched", payload)
+			}
+		})
+	}
+}
+
+func TestApplyFilters_MatchOnce(t *testing.T) {
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "contains", Type: "tcp::contains", Args: []string{"kek"}},
+		{Name: "icontains", Type: "tcp::ingress::icontains", Args: []string{"KEK"}},
+		{Name: "regex", Type: "tcp::regex", Args: []string{"ke+k"}},
+		{Name: "lol", Type: "tcp::contains", Args: []string{"lol"}},
+		{Name: "and", Type: "tcp::and", Args: []string{"contains", "lol"}},
+		{Name: "not", Type: "tcp::not", Args: []string{"lol"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+
+	tests := []struct {
+		rule   string
+		chunks []string
+		want   int
+	}{
+		{"contains", []string{"a kek", " b", " c", " d"}, 1},
+		{"contains", []string{"a k", "ek", " b", " c"}, 1},
+		{"contains", []string{"kek", " kek", " b"}, 2},
+		{"icontains", []string{"a KeK", " b", " c"}, 1},
+		{"regex", []string{"a keeek", " b", " c"}, 1},
+		{"regex", []string{"a kee", "ek", " b"}, 1},
+		// Matched once the last part arrives, in any order.
+		{"and", []string{"kek", " b", " lol", " c"}, 1},
+		{"and", []string{"lol", " kek", " c"}, 1},
+		// Negated rules are matched on every read, as without the window.
+		{"not", []string{"a", "b", "c"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+" "+strings.Join(tt.chunks, "|"), func(t *testing.T) {
+			fts, err := filters.NewFilters([]common.FilterConfig{{Rule: tt.rule, Verdict: "inc::matches"}}, rs)
+			if err != nil {
+				t.Fatalf("NewFilters() error = %v", err)
+			}
+			pctx := common.NewProxyContext()
+			w := newStreamWindow(16)
+			for _, c := range tt.chunks {
+				buf, from := w.feed([]byte(c))
+				if err := ApplyFilters(pctx, fts, buf, from, true, false, func(*filters.Filter, bool) {}); err != nil {
+					t.Fatalf("ApplyFilters() error = %v", err)
+				}
+			}
+			if got := pctx.GetCounter("matches"); got != tt.want {
+				t.Errorf("rule matched %d times, want %d", got, tt.want)
+			}
+			if got := fts[0].GetStats().Dump().Matches; got != int64(tt.want) {
+				t.Errorf("rule match stats = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_SplitPayloadDropped(t *testing.T) {
+	target, received := startSinkServer(t)
+
+	rs, err := filters.NewRuleSet([]common.RuleConfig{
+		{Name: "attack", Type: "tcp::contains", Args: []string{"attack"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSet() error = %v", err)
+	}
+	cfg := common.ServiceConfig{
+		Name:         "test",
+		Type:         "tcp",
+		Listen:       "127.0.0.1:0",
+		Target:       target,
+		StreamWindow: 64,
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "drop"},
+		},
+	}
+	p := startTestProxy(t, cfg, rs)
+
+	conn := dialTestProxy(t, p)
+	defer conn.Close()
+	payload := []byte("some attack payload")
+	for i := range payload {
+		if _, err := conn.Write(payload[i : i+1]); err != nil {
+			// Connection is already dropped.
+			break
+		}
+		waitShort()
+	}
+	waitConnClosed(t, conn)
+
+	if got := received(); bytes.Contains(got, []byte("attack")) {
+		t.Errorf("split payload reached the target: %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package udp
+
+import (
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp"
+	"goxy/internal/proxy/tcp/filters"
+)
+
+// Evaluate runs the filter chain over the recorded session without any network I/O,
+// the same way the proxy does for the live one: each chunk is a single datagram.
+// Dropping the datagram doesn't stop the evaluation unless the service drops whole sessions,
+// the returned context has the drop flag set if any datagram was dropped.
+// Filter errors don't stop the evaluation, the first one is returned.
+func Evaluate(
+	cfg common.ServiceConfig,
+	fts []filters.Filter,
+	chunks []capture.Chunk,
+	matched func(f *filters.Filter, ingress, shadow bool, buf []byte),
+) (*common.ProxyContext, error) {
+	var firstErr error
+	dropped := false
+	pctx := common.NewProxyContext()
+	for _, c := range chunks {
+		err := tcp.ApplyFilters(pctx, fts, c.Data, 0, c.Ingress, cfg.Shadow, func(f *filters.Filter, shadow bool) {
+			matched(f, c.Ingress, shadow, c.Data)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if pctx.GetFlag(common.DropFlag) {
+			dropped = true
+			if cfg.DropSession {
+				break
+			}
+			pctx.ClearFlag(common.DropFlag)
+			pctx.TakeRewrites()
+			continue
+		}
+		pctx.Rewrite(c.Data)
+	}
+	if dropped {
+		pctx.SetFlag(common.DropFlag)
+	}
+	return pctx, firstErr
+}
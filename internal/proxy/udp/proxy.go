@@ -0,0 +1,434 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/atomic"
+	"goxy/internal/alerts"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/metrics"
+	"goxy/internal/proxy/tcp"
+	"goxy/internal/proxy/tcp/filters"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MaxDatagramSize is the largest UDP payload.
+const MaxDatagramSize = 64 * 1024
+
+// DefaultSessionTimeout is used if the service has no session timeout set.
+const DefaultSessionTimeout = time.Minute
+
+var (
+	ErrShutdownTimeout = errors.New("proxy shutdown timeout")
+	ErrInvalidFilter   = errors.New("no such filter")
+)
+
+// NewProxy creates the UDP proxy, the rules are the udp:: family parsed with filters.NewRuleSetFor.
+func NewProxy(cfg common.ServiceConfig, rs *filters.RuleSet, cs *capture.Store) (*Proxy, error) {
+	fts, err := filters.NewFilters(cfg.Filters, rs)
+	if err != nil {
+		return nil, fmt.Errorf("creating filters: %w", err)
+	}
+
+	logger := logrus.WithField("type", "udp").WithField("listen", cfg.Listen)
+	p := &Proxy{
+		ListenAddr: cfg.Listen,
+
+		serviceConfig: cfg,
+		logger:        logger,
+		filters:       fts,
+		sessions:      newSessionMap(),
+		capture:       cs,
+		stats:         new(common.ProxyStats),
+		wg:            new(sync.WaitGroup),
+		mu:            new(sync.RWMutex),
+	}
+	return p, nil
+}
+
+type Proxy struct {
+	ListenAddr string
+
+	serviceConfig common.ServiceConfig
+	closing       atomic.Bool
+	listening     atomic.Bool
+	sessions      *sessionMap
+	sessionSeq    atomic.Int64
+	capture       *capture.Store
+	stats         *common.ProxyStats
+	wg            *sync.WaitGroup
+	conn          *net.UDPConn
+	closeOnce     sync.Once
+	closeErr      error
+	logger        *logrus.Entry
+	filters       []filters.Filter
+	mu            *sync.RWMutex
+}
+
+func (p *Proxy) GetListening() bool {
+	return p.listening.Load()
+}
+
+func (p *Proxy) SetListening(state bool) {
+	p.listening.Store(state)
+}
+
+func (p *Proxy) GetStats() *common.ProxyStats {
+	return p.stats
+}
+
+// ActiveConnections returns the number of the active sessions.
+func (p *Proxy) ActiveConnections() int {
+	return p.sessions.length()
+}
+
+func (p *Proxy) GetShadow() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.serviceConfig.Shadow
+}
+
+func (p *Proxy) SetShadow(shadow bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serviceConfig.Shadow = shadow
+}
+
+func (p *Proxy) SetFilterState(filter int, enabled, alert, shadow bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if filter < 0 || filter >= len(p.filters) {
+		return ErrInvalidFilter
+	}
+	p.filters[filter].SetEnabled(enabled)
+	p.filters[filter].SetAlert(alert)
+	p.filters[filter].SetShadow(shadow)
+	return nil
+}
+
+// Reload replaces the service config and the filter chain of the running proxy.
+// Listen address cannot be changed without restarting the proxy, so it's ignored.
+// Active sessions keep their target and pick up the new filters with the next datagram.
+func (p *Proxy) Reload(cfg common.ServiceConfig, fts []filters.Filter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg.Listen = p.ListenAddr
+	filters.KeepStats(fts, p.filters)
+	p.serviceConfig = cfg
+	p.filters = fts
+	p.logger.Info("Configuration reloaded")
+}
+
+func (p *Proxy) Start() error {
+	p.SetListening(true)
+
+	addr, err := net.ResolveUDPAddr("udp", p.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("resolving listen address: %w", err)
+	}
+	if p.conn, err = net.ListenUDP("udp", addr); err != nil {
+		return fmt.Errorf("running listen: %w", err)
+	}
+
+	p.wg.Add(1)
+	go p.serve()
+	return nil
+}
+
+// CloseListener stops receiving datagrams, the sessions can't send responses to the clients after that.
+func (p *Proxy) CloseListener() error {
+	p.closeOnce.Do(func() {
+		p.closing.Store(true)
+		if p.conn != nil {
+			p.closeErr = p.conn.Close()
+		}
+	})
+	if p.closeErr != nil {
+		return fmt.Errorf("closing listener: %w", p.closeErr)
+	}
+	return nil
+}
+
+// Drain stops receiving datagrams and waits for the sessions to expire.
+// Sessions still active when ctx is done are closed.
+func (p *Proxy) Drain(ctx context.Context) error {
+	if err := p.CloseListener(); err != nil {
+		return err
+	}
+
+	done := make(chan interface{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	p.logger.Infof("Drain timeout, closing %d sessions", p.sessions.length())
+	p.sessions.closeAll()
+	<-done
+	return nil
+}
+
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if err := p.CloseListener(); err != nil {
+		return err
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		p.sessions.closeAll()
+		p.wg.Wait()
+		done <- nil
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ErrShutdownTimeout
+	case <-done:
+		break
+	}
+	return nil
+}
+
+func (p *Proxy) GetConfig() *common.ServiceConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	cfg := p.serviceConfig
+	return &cfg
+}
+
+func (p *Proxy) String() string {
+	return fmt.Sprintf("UDP proxy %s", p.ListenAddr)
+}
+
+// Addr returns the address the proxy is listening on, or nil if it's not started.
+func (p *Proxy) Addr() net.Addr {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.LocalAddr()
+}
+
+func (p *Proxy) GetFilters() []common.Filter {
+	fts := p.getFilters()
+	result := make([]common.Filter, 0, len(fts))
+	for i := range fts {
+		result = append(result, &fts[i])
+	}
+	return result
+}
+
+func (p *Proxy) getFilters() []filters.Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.filters
+}
+
+func (p *Proxy) runFilters(s *session, data []byte, ingress bool) error {
+	return tcp.ApplyFilters(s.ctx, p.getFilters(), data, 0, ingress, p.GetShadow(), func(f *filters.Filter, shadow bool) {
+		s.capture.AddMatch(f.Name, f.Verdict.String(), ingress, shadow)
+		if shadow {
+			p.logger.Debugf("Rule %v triggered in shadow mode", f.Rule)
+			return
+		}
+		reasons := s.ctx.TakeAlerts()
+		if f.GetAlert() {
+			p.logger.Warningf("Rule %v triggered", f.Rule)
+			reasons = append(reasons, alerts.ReasonRuleTriggered)
+		}
+		for _, reason := range reasons {
+			alerts.Publish(alerts.Alert{
+				Service:    p.GetConfig().Name,
+				Rule:       f.Name,
+				Reason:     reason,
+				ConnID:     s.id,
+				RecordID:   s.capture.ID(),
+				ClientAddr: s.client.String(),
+				Ingress:    ingress,
+				Payload:    alerts.Excerpt(data),
+			})
+		}
+	})
+}
+
+// handleDatagram runs the filters over the datagram and returns the datagram to forward,
+// rewritten by the verdicts, or false if it's dropped.
+func (p *Proxy) handleDatagram(s *session, data []byte, ingress bool, logger *logrus.Entry) ([]byte, bool) {
+	s.touch()
+	if s.dropped.Load() {
+		return nil, false
+	}
+
+	p.stats.AddBytes(ingress, len(data))
+	s.capture.AddChunk(ingress, data)
+
+	// The datagrams of both directions are filtered one at a time, so the drop flag,
+	// the rewrites and the alerts taken are the ones of this datagram.
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+	if err := p.runFilters(s, data, ingress); err != nil {
+		logger.Errorf("Error running filters: %v", err)
+	}
+	// Datagrams are not delayed nor throttled.
+	s.ctx.TakeDelay()
+	s.ctx.TakeTarpit()
+
+	if !s.ctx.GetFlag(common.DropFlag) {
+		return s.ctx.Rewrite(data), true
+	}
+	p.stats.AddDropped()
+	s.dropCount.Inc()
+	if p.GetConfig().DropSession {
+		logger.Debugf("Dropping session")
+		s.dropped.Store(true)
+	} else {
+		logger.Debugf("Dropping datagram")
+		s.ctx.ClearFlag(common.DropFlag)
+	}
+	s.ctx.TakeRewrites()
+	return nil, false
+}
+
+// newSession connects to the target for the new client and starts relaying the responses.
+func (p *Proxy) newSession(client *net.UDPAddr) (*session, error) {
+	cfg := p.GetConfig()
+	target, err := net.ResolveUDPAddr("udp", cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("resolving target: %w", err)
+	}
+	upstream, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to target: %w", err)
+	}
+
+	s := &session{
+		id:       client.String() + ":" + strconv.FormatInt(p.sessionSeq.Inc(), 10),
+		client:   client,
+		upstream: upstream,
+		ctx:      common.NewServiceContext(cfg, client.String()),
+		capture:  p.capture.NewSession(cfg.Name, "udp", client.String(), target.String()),
+	}
+	s.touch()
+	p.sessions.add(s)
+	p.stats.AddConnection()
+
+	p.wg.Add(1)
+	go p.handleSession(s)
+	return s, nil
+}
+
+// handleSession relays the target datagrams to the client until the session expires.
+func (p *Proxy) handleSession(s *session) {
+	defer p.wg.Done()
+
+	logger := p.logger.WithField("session", s.id)
+	logger.Debugf("Session started")
+	defer func() {
+		p.sessions.remove(s)
+		if err := s.upstream.Close(); err != nil && !isClosedErr(err) {
+			logger.Warningf("Error closing target socket: %v", err)
+		}
+		verdict := capture.VerdictFromContext(s.ctx)
+		if s.dropCount.Load() > 0 {
+			verdict = capture.VerdictDrop
+		}
+		s.capture.Finish(verdict)
+		logger.Debugf("Session finished")
+	}()
+
+	timeout := DefaultSessionTimeout
+	if t := p.GetConfig().SessionTimeout; t != nil {
+		timeout = *t
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		deadline := s.deadline(timeout)
+		if !time.Now().Before(deadline) {
+			logger.Debugf("Session expired")
+			return
+		}
+		if err := s.upstream.SetReadDeadline(deadline); err != nil {
+			logger.Errorf("Error setting deadline: %v", err)
+			return
+		}
+
+		n, err := s.upstream.Read(buf)
+		if n > 0 {
+			if data, ok := p.handleDatagram(s, buf[:n], false, logger); ok {
+				if _, err := p.conn.WriteToUDP(data, s.client); err != nil && !isClosedErr(err) {
+					logger.Errorf("Error writing to client: %v", err)
+				}
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if !isClosedErr(err) {
+				logger.Debugf("Error reading from target: %v", err)
+				metrics.UpstreamErrors.WithLabelValues(p.GetConfig().Name).Inc()
+			}
+			return
+		}
+	}
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+
+	p.logger.Infof("Starting")
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			if p.closing.Load() {
+				p.logger.Info("Listener exiting")
+			} else {
+				p.logger.Errorf("Proxy stopped: %T: %v", err, err)
+			}
+			return
+		}
+
+		if !p.GetListening() {
+			p.logger.Debugf("Proxy closed, dropping the datagram")
+			continue
+		}
+
+		s := p.sessions.get(client.String())
+		if s == nil {
+			if s, err = p.newSession(client); err != nil {
+				p.logger.Errorf("Failed to start session: %v", err)
+				metrics.UpstreamErrors.WithLabelValues(p.GetConfig().Name).Inc()
+				continue
+			}
+		}
+
+		data, ok := p.handleDatagram(s, buf[:n], true, p.logger.WithField("session", s.id))
+		if !ok {
+			continue
+		}
+		if _, err := s.upstream.Write(data); err != nil && !isClosedErr(err) {
+			p.logger.Errorf("Error writing to target: %v", err)
+		}
+	}
+}
+
+func isClosedErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
@@ -0,0 +1,248 @@
+package udp
+
+import (
+	"context"
+	"goxy/internal/common"
+	"goxy/internal/proxy/tcp/filters"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startTestProxy(t *testing.T, cfg common.ServiceConfig) *Proxy {
+	t.Helper()
+
+	rs, err := filters.NewRuleSetFor("udp", []common.RuleConfig{
+		{Name: "attack", Type: "udp::ingress::contains", Args: []string{"attack"}},
+		{Name: "kek", Type: "udp::ingress::contains", Args: []string{"kek"}},
+		{Name: "words", Type: "udp::ingress::regex", Args: []string{`(\w+\s?)+$`}},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleSetFor() error = %v", err)
+	}
+	p, err := NewProxy(cfg, rs, nil)
+	if err != nil {
+		t.Fatalf("NewProxy() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { _ = p.Shutdown(context.Background()) })
+	return p
+}
+
+// exchange sends the datagram and reports whether the echo came back.
+func exchange(t *testing.T, conn net.Conn, data string) bool {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	buf := make([]byte, MaxDatagramSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return false
+	}
+	if got := string(buf[:n]); got != data {
+		t.Fatalf("Read() = %q, want %q", got, data)
+	}
+	return true
+}
+
+func TestProxy_Datagrams(t *testing.T) {
+	tests := []struct {
+		name        string
+		dropSession bool
+		wantAfter   bool
+	}{
+		{name: "drop datagram", dropSession: false, wantAfter: true},
+		{name: "drop session", dropSession: true, wantAfter: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTestProxy(t, common.ServiceConfig{
+				Name:        "udp",
+				Type:        "udp",
+				Listen:      "127.0.0.1:0",
+				Target:      startUDPEcho(t),
+				DropSession: tt.dropSession,
+				Filters:     []common.FilterConfig{{Rule: "attack", Verdict: "drop"}},
+			})
+
+			conn, err := net.Dial("udp", p.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			if !exchange(t, conn, "hello") {
+				t.Fatalf("datagram not forwarded")
+			}
+			if got := p.ActiveConnections(); got != 1 {
+				t.Errorf("ActiveConnections() = %d, want 1", got)
+			}
+			if exchange(t, conn, "attack") {
+				t.Errorf("attack datagram forwarded")
+			}
+			if got := exchange(t, conn, "hello"); got != tt.wantAfter {
+				t.Errorf("datagram after drop forwarded = %v, want %v", got, tt.wantAfter)
+			}
+			if got := p.GetFilters()[0].GetStats().Dump().Drops; got != 1 {
+				t.Errorf("filter drops = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestProxy_SessionTimeout(t *testing.T) {
+	timeout := time.Millisecond * 200
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:           "udp",
+		Type:           "udp",
+		Listen:         "127.0.0.1:0",
+		Target:         startUDPEcho(t),
+		SessionTimeout: &timeout,
+	})
+
+	conn, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	if !exchange(t, conn, "hello") {
+		t.Fatalf("datagram not forwarded")
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for p.ActiveConnections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("session not expired")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	// The client gets the new session after the old one expires.
+	if !exchange(t, conn, "hello") {
+		t.Fatalf("datagram not forwarded after expiry")
+	}
+	if got := p.GetStats().Dump().Connections; got != 2 {
+		t.Errorf("sessions = %d, want 2", got)
+	}
+}
+
+func TestProxy_Directions(t *testing.T) {
+	// The directions have to run in parallel to interleave, even on a single CPU.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	// Target answers every datagram with the one the ingress filters would rewrite.
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer target.Close()
+	received := make(chan string, 10000)
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(buf[:n])
+			_, _ = target.WriteTo([]byte("kek"), addr)
+		}
+	}()
+
+	p := startTestProxy(t, common.ServiceConfig{
+		Name:   "udp",
+		Type:   "udp",
+		Listen: "127.0.0.1:0",
+		Target: target.LocalAddr().String(),
+		Filters: []common.FilterConfig{
+			{Rule: "attack", Verdict: "drop"},
+			{Rule: "kek", Verdict: "replace::k::x"},
+			// Widen the gap between the verdicts and their use.
+			{Rule: "words", Verdict: "inc::words"},
+			{Rule: "words", Verdict: "inc::words"},
+			{Rule: "words", Verdict: "inc::words"},
+		},
+	})
+
+	conn, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	answers := make(chan string, 10000)
+	go func() {
+		defer close(answers)
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 300)); err != nil {
+				return
+			}
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			answers <- string(buf[:n])
+		}
+	}()
+	// Both directions are filtered at once, the verdicts of one must not affect the other.
+	for i := 0; i < 2000; i++ {
+		payload := "kek"
+		if i%2 == 1 {
+			payload = "attack"
+		}
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	count := 0
+	for a := range answers {
+		count++
+		if a != "kek" {
+			t.Fatalf("client received %q, want %q", a, "kek")
+		}
+	}
+	if count == 0 {
+		t.Fatalf("client received nothing")
+	}
+	_ = target.Close()
+	for r := range received {
+		if r != "xex" {
+			t.Fatalf("target received %q, want %q", r, "xex")
+		}
+	}
+}
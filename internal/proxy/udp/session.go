@@ -0,0 +1,83 @@
+package udp
+
+import (
+	"go.uber.org/atomic"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"net"
+	"sync"
+	"time"
+)
+
+// session is the exchange with the single client address, proxied through its own target socket.
+type session struct {
+	id       string
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	ctx      *common.ProxyContext
+	capture  *capture.Session
+
+	lastActive atomic.Int64
+	// dropped session discards all datagrams until it expires.
+	dropped   atomic.Bool
+	dropCount atomic.Int32
+	// filterMu serializes the filter runs of the directions, see Proxy.handleDatagram.
+	filterMu sync.Mutex
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// deadline returns the time the session expires at if no datagrams arrive.
+func (s *session) deadline(timeout time.Duration) time.Time {
+	return time.Unix(0, s.lastActive.Load()).Add(timeout)
+}
+
+func newSessionMap() *sessionMap {
+	return &sessionMap{
+		sessions: make(map[string]*session),
+		mu:       new(sync.RWMutex),
+	}
+}
+
+type sessionMap struct {
+	sessions map[string]*session
+	mu       *sync.RWMutex
+}
+
+func (m *sessionMap) get(client string) *session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sessions[client]
+}
+
+func (m *sessionMap) add(s *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.client.String()] = s
+}
+
+// remove deletes the session, unless it's already replaced by the new one for the same client.
+func (m *sessionMap) remove(s *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[s.client.String()] == s {
+		delete(m.sessions, s.client.String())
+	}
+}
+
+func (m *sessionMap) length() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// closeAll closes the target sockets, which ends the sessions.
+func (m *sessionMap) closeAll() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sessions {
+		_ = s.upstream.Close()
+	}
+}
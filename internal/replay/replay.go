@@ -0,0 +1,379 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoSuchService   = errors.New("no such service")
+	ErrUnsupportedType = errors.New("replay is not supported for the service type")
+)
+
+type Result struct {
+	Session    string          `json:"session"`
+	ClientAddr string          `json:"client_addr"`
+	Matches    []capture.Match `json:"matches"`
+	Dropped    bool            `json:"dropped"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Replayer sends the client side of the recorded sessions through the proxy
+// built from the service config. Proxy is connected to the local stand-in target,
+// which answers with the server side of the same sessions.
+type Replayer struct {
+	service common.ServiceConfig
+	proxy   proxy.Proxy
+	timeout time.Duration
+	records chan capture.Record
+
+	target       net.Listener
+	targetConns  chan net.Conn
+	targetServer *http.Server
+	responses    chan *http.Response
+}
+
+// Write implements capture.Sink, it receives the records of the replayed sessions from the proxy.
+func (r *Replayer) Write(rec *capture.Record) error {
+	r.records <- *rec
+	return nil
+}
+
+// FindService returns the service config by name. Empty name is allowed if there's only one service.
+func FindService(cfg *common.ProxyConfig, name string) (common.ServiceConfig, error) {
+	if name == "" && len(cfg.Services) == 1 {
+		return cfg.Services[0], nil
+	}
+	for _, s := range cfg.Services {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return common.ServiceConfig{}, fmt.Errorf("%w: %s", ErrNoSuchService, name)
+}
+
+func NewReplayer(cfg *common.ProxyConfig, service string, timeout time.Duration) (*Replayer, error) {
+	s, err := FindService(cfg, service)
+	if err != nil {
+		return nil, err
+	}
+	if s.Type == "udp" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, s.Type)
+	}
+
+	r := &Replayer{
+		service:     s,
+		timeout:     timeout,
+		records:     make(chan capture.Record, 16),
+		targetConns: make(chan net.Conn, 16),
+		responses:   make(chan *http.Response, 1),
+	}
+
+	if r.target, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, fmt.Errorf("starting stand-in target: %w", err)
+	}
+	if s.Type == "http" {
+		r.targetServer = &http.Server{Handler: http.HandlerFunc(r.serveRecordedResponse)}
+		go func() {
+			if err := r.targetServer.Serve(r.target); err != nil && err != http.ErrServerClosed {
+				logrus.Errorf("Error in stand-in target: %v", err)
+			}
+		}()
+	} else {
+		go r.acceptTargetConns()
+	}
+
+	cs, err := capture.NewStore(common.CaptureConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("creating capture store: %w", err)
+	}
+	cs.AddSink(r)
+
+	s.Listen = "127.0.0.1:0"
+	s.Target = r.target.Addr().String()
+	if r.proxy, err = proxy.NewProxy(cfg, s, cs); err != nil {
+		_ = r.target.Close()
+		return nil, fmt.Errorf("creating proxy: %w", err)
+	}
+	if err := r.proxy.Start(); err != nil {
+		_ = r.target.Close()
+		return nil, fmt.Errorf("starting proxy: %w", err)
+	}
+	return r, nil
+}
+
+func (r *Replayer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := r.proxy.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutting down proxy: %w", err)
+	}
+	if r.targetServer != nil {
+		if err := r.targetServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shutting down stand-in target: %w", err)
+		}
+		return nil
+	}
+	if err := r.target.Close(); err != nil {
+		return fmt.Errorf("closing stand-in target: %w", err)
+	}
+	return nil
+}
+
+// Replay sends the session through the proxy and reports the filters fired.
+// Proxy records are told apart by the client address, so the records of the earlier sessions
+// arriving late are not counted.
+func (r *Replayer) Replay(rec *capture.Record) Result {
+	res := Result{
+		Session:    rec.ID,
+		ClientAddr: rec.ClientAddr,
+		Matches:    make([]capture.Match, 0),
+	}
+	r.dropStale()
+
+	client, err := net.DialTimeout("tcp", r.proxy.Addr().String(), r.timeout)
+	if err != nil {
+		res.Error = fmt.Sprintf("connecting to proxy: %v", err)
+		return res
+	}
+	addr := client.LocalAddr().String()
+
+	var expected int
+	if r.service.Type == "http" {
+		expected, err = r.replayHTTP(client, rec)
+	} else {
+		expected, err = r.replayTCP(client, rec)
+	}
+	// The proxy saves the records when the connection is closed.
+	_ = client.Close()
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	for i := 0; i < expected; {
+		select {
+		case got := <-r.records:
+			if got.ClientAddr != addr {
+				continue
+			}
+			i += 1
+			res.Matches = append(res.Matches, got.Matches...)
+			if got.Verdict == capture.VerdictDrop {
+				res.Dropped = true
+			}
+		case <-time.After(r.timeout * 2):
+			if res.Error == "" {
+				res.Error = "timeout waiting for the proxy"
+			}
+			return res
+		}
+	}
+	return res
+}
+
+// dropStale discards the records left from the earlier sessions.
+func (r *Replayer) dropStale() {
+	for {
+		select {
+		case <-r.records:
+		default:
+			return
+		}
+	}
+}
+
+func (r *Replayer) acceptTargetConns() {
+	for {
+		c, err := r.target.Accept()
+		if err != nil {
+			close(r.targetConns)
+			return
+		}
+		r.targetConns <- c
+	}
+}
+
+func (r *Replayer) targetConn() (net.Conn, error) {
+	select {
+	case c, ok := <-r.targetConns:
+		if !ok {
+			return nil, errors.New("stand-in target closed")
+		}
+		return c, nil
+	case <-time.After(r.timeout):
+		return nil, errors.New("proxy didn't connect to the target")
+	}
+}
+
+// replayTCP plays the chunks in the recorded order: the client writes ingress chunks,
+// the stand-in target writes egress ones. After each write the other side reads the data.
+func (r *Replayer) replayTCP(client net.Conn, rec *capture.Record) (int, error) {
+	server, err := r.targetConn()
+	if err != nil {
+		return 1, err
+	}
+	defer server.Close()
+
+	for _, c := range rec.Chunks {
+		src, dst := server, client
+		if c.Ingress {
+			src, dst = client, server
+		}
+		if _, err := src.Write(c.Data); err != nil {
+			// Connection dropped by the proxy.
+			return 1, nil
+		}
+		if closed := r.drain(dst, len(c.Data)); closed {
+			return 1, nil
+		}
+	}
+	return 1, nil
+}
+
+// drain reads up to n bytes from the connection, waiting for the timeout at most.
+// Returns true if the connection is closed.
+func (r *Replayer) drain(c net.Conn, n int) bool {
+	if err := c.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return true
+	}
+	_, err := io.ReadFull(c, make([]byte, n))
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// replayHTTP sends the requests from the ingress side one by one over the single connection.
+// Stand-in target answers them with the responses from the egress side.
+func (r *Replayer) replayHTTP(client net.Conn, rec *capture.Record) (int, error) {
+	ingress, egress := splitStreams(rec)
+	requests, err := readRequests(ingress)
+	if err != nil && len(requests) == 0 {
+		return 0, fmt.Errorf("parsing requests: %w", err)
+	}
+	responses := readResponses(egress, len(requests))
+
+	br := bufio.NewReader(client)
+
+	for i, raw := range requests {
+		var resp *http.Response
+		if i < len(responses) {
+			resp = responses[i]
+		}
+		r.setResponse(resp)
+
+		if err := client.SetDeadline(time.Now().Add(r.timeout * 2)); err != nil {
+			return i, fmt.Errorf("setting deadline: %w", err)
+		}
+		if _, err := client.Write(raw); err != nil {
+			return i, nil
+		}
+		got, err := http.ReadResponse(br, nil)
+		if err != nil {
+			// Connection dropped by the proxy, the request is recorded anyway.
+			return i + 1, nil
+		}
+		_, _ = io.Copy(ioutil.Discard, got.Body)
+		_ = got.Body.Close()
+	}
+	return len(requests), nil
+}
+
+func (r *Replayer) setResponse(resp *http.Response) {
+	select {
+	case <-r.responses:
+	default:
+	}
+	r.responses <- resp
+}
+
+func (r *Replayer) serveRecordedResponse(w http.ResponseWriter, _ *http.Request) {
+	var resp *http.Response
+	select {
+	case resp = <-r.responses:
+	default:
+	}
+	if resp == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	for k, vals := range resp.Header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func splitStreams(rec *capture.Record) ([]byte, []byte) {
+	ingress := new(bytes.Buffer)
+	egress := new(bytes.Buffer)
+	for _, c := range rec.Chunks {
+		if c.Ingress {
+			ingress.Write(c.Data)
+		} else {
+			egress.Write(c.Data)
+		}
+	}
+	return ingress.Bytes(), egress.Bytes()
+}
+
+// readRequests splits the stream into raw requests.
+func readRequests(data []byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+	rd := bytes.NewReader(data)
+	br := bufio.NewReader(rd)
+	consumed := 0
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return result, err
+		}
+		if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+			return result, err
+		}
+		pos := len(data) - rd.Len() - br.Buffered()
+		result = append(result, data[consumed:pos])
+		consumed = pos
+	}
+}
+
+// readResponses parses at most n responses from the stream, with bodies buffered.
+func readResponses(data []byte, n int) []*http.Response {
+	result := make([]*http.Response, 0, n)
+	br := bufio.NewReader(bytes.NewReader(data))
+	for len(result) < n {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return result
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return result
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		// Body is written as is, transfer details are up to the stand-in target.
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+		result = append(result, resp)
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package replay
+
+import (
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"testing"
+	"time"
+)
+
+func testConfig(typ, rule string) *common.ProxyConfig {
+	return &common.ProxyConfig{
+		Rules: []common.RuleConfig{
+			{Name: "attack", Type: rule, Args: []string{"attack"}},
+		},
+		Services: []common.ServiceConfig{
+			{
+				Name:   "service",
+				Type:   typ,
+				Listen: "127.0.0.1:0",
+				Target: "127.0.0.1:1",
+				Filters: []common.FilterConfig{
+					{Rule: "attack", Verdict: "drop"},
+				},
+			},
+		},
+	}
+}
+
+func session(id string, chunks ...capture.Chunk) *capture.Record {
+	return &capture.Record{ID: id, ClientAddr: "10.0.0.1:1234", TargetAddr: "10.0.0.2:80", Chunks: chunks}
+}
+
+func chunk(ingress bool, data string) capture.Chunk {
+	return capture.Chunk{Ingress: ingress, Data: []byte(data)}
+}
+
+func TestReplayer_TCP(t *testing.T) {
+	r, err := NewReplayer(testConfig("tcp", "tcp::ingress::contains"), "service", time.Millisecond*200)
+	if err != nil {
+		t.Fatalf("NewReplayer() error = %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	tests := []struct {
+		name    string
+		rec     *capture.Record
+		dropped bool
+	}{
+		{
+			name:    "benign",
+			rec:     session("1", chunk(true, "hello"), chunk(false, "hi there, attack"), chunk(true, "bye")),
+			dropped: false,
+		},
+		{
+			name:    "exploit",
+			rec:     session("2", chunk(true, "hello"), chunk(false, "hi"), chunk(true, "attack"), chunk(false, "flag")),
+			dropped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := r.Replay(tt.rec)
+			if res.Error != "" {
+				t.Fatalf("Replay() error = %v", res.Error)
+			}
+			if res.Dropped != tt.dropped {
+				t.Errorf("Replay() dropped = %v, want %v", res.Dropped, tt.dropped)
+			}
+			if fired := len(res.Matches) > 0; fired != tt.dropped {
+				t.Errorf("Replay() matches = %v", res.Matches)
+			}
+		})
+	}
+}
+
+func TestReplayer_LateRecord(t *testing.T) {
+	r, err := NewReplayer(testConfig("tcp", "tcp::ingress::contains"), "service", time.Millisecond*200)
+	if err != nil {
+		t.Fatalf("NewReplayer() error = %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	// The record of the earlier session the replay stopped waiting for.
+	late := capture.Record{
+		ClientAddr: "127.0.0.1:1",
+		Matches:    []capture.Match{{Rule: "contains 'attack'", Verdict: "drop"}},
+		Verdict:    capture.VerdictDrop,
+	}
+	if err := r.Write(&late); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	res := r.Replay(session("1", chunk(true, "hello"), chunk(false, "hi")))
+	if res.Error != "" {
+		t.Fatalf("Replay() error = %v", res.Error)
+	}
+	if res.Dropped || len(res.Matches) != 0 {
+		t.Errorf("Replay() counted the late record: dropped %v, matches %v", res.Dropped, res.Matches)
+	}
+}
+
+func TestReplayer_HTTP(t *testing.T) {
+	r, err := NewReplayer(testConfig("http", "http::ingress::body::contains"), "", time.Millisecond*200)
+	if err != nil {
+		t.Fatalf("NewReplayer() error = %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	rec := session(
+		"1",
+		chunk(true, "GET / HTTP/1.1\r\nHost: a\r\n\r\n"),
+		chunk(false, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"),
+		chunk(true, "POST /x HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\n\r\nattack"),
+		chunk(false, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nflag"),
+	)
+	res := r.Replay(rec)
+	if res.Error != "" {
+		t.Fatalf("Replay() error = %v", res.Error)
+	}
+	if !res.Dropped {
+		t.Errorf("Replay() session not dropped")
+	}
+	if len(res.Matches) != 1 || res.Matches[0].Rule != "attack" {
+		t.Errorf("Replay() matches = %v, want single attack match", res.Matches)
+	}
+}
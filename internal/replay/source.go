@@ -0,0 +1,42 @@
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"goxy/internal/capture"
+	"goxy/internal/pcap"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ReadRecords reads the sessions from the pcap, pcapng or goxy capture file.
+func ReadRecords(r io.Reader) ([]*capture.Record, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if pcap.IsPcap(header) {
+		return pcap.ReadRecords(br)
+	}
+	return capture.ReadRecords(br)
+}
+
+// FilterByPort keeps the sessions to the target port. Zero port keeps everything.
+func FilterByPort(records []*capture.Record, port int) []*capture.Record {
+	if port == 0 {
+		return records
+	}
+	result := make([]*capture.Record, 0, len(records))
+	for _, rec := range records {
+		_, p, err := net.SplitHostPort(rec.TargetAddr)
+		if err != nil {
+			continue
+		}
+		if p == strconv.Itoa(port) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
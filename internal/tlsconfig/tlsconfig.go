@@ -0,0 +1,135 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"goxy/internal/common"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// SelfSignedValidity is the lifetime of the generated certificates.
+const SelfSignedValidity = time.Hour * 24 * 365
+
+var (
+	ErrKeyPairIncomplete = errors.New("both cert and key must be set")
+	ErrInvalidCA         = errors.New("no certificates found in CA file")
+)
+
+// DefaultHosts are the names of the self-signed certificate if none are configured.
+var DefaultHosts = []string{"localhost", "127.0.0.1"}
+
+// Server returns the config terminating the client TLS with the certificate from the files,
+// or with the generated self-signed certificate if none are set.
+func Server(cfg *common.TLSConfig) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case cfg.Cert != "" && cfg.Key != "":
+		if cert, err = tls.LoadX509KeyPair(cfg.Cert, cfg.Key); err != nil {
+			return nil, fmt.Errorf("loading key pair: %w", err)
+		}
+	case cfg.Cert != "" || cfg.Key != "":
+		return nil, ErrKeyPairIncomplete
+	default:
+		hosts := cfg.Hosts
+		if len(hosts) == 0 {
+			hosts = DefaultHosts
+		}
+		certPEM, keyPEM, err := GenerateCert(hosts)
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, fmt.Errorf("parsing self-signed certificate: %w", err)
+		}
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// Client returns the config for connecting to the target over TLS.
+// Target certificate is verified against the pinned CA if it's set, or against the system roots.
+func Client(cfg *common.TLSConfig, target string) (*tls.Config, error) {
+	serverName := cfg.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, fmt.Errorf("parsing target: %w", err)
+		}
+		serverName = host
+	}
+
+	result := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.SkipVerify,
+	}
+	if cfg.CA != "" {
+		data, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCA
+		}
+		result.RootCAs = pool
+	}
+	return result, nil
+}
+
+// GenerateCert creates the PEM encoded self-signed certificate and its key for the host names and IPs.
+func GenerateCert(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating serial: %w", err)
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"goxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
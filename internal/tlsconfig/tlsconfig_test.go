@@ -0,0 +1,92 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"goxy/internal/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateCert(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCert([]string{"example.com", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("GenerateCert() error = %v", err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	for _, name := range []string{"example.com", "127.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: pool}); err != nil {
+			t.Errorf("Verify(%s) error = %v", name, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "other.com", Roots: pool}); err == nil {
+		t.Errorf("Verify(other.com) succeeded, but mustn't")
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goxy-tls")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPEM, keyPEM, err := GenerateCert([]string{"localhost"})
+	if err != nil {
+		t.Fatalf("GenerateCert() error = %v", err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     common.TLSConfig
+		wantErr error
+	}{
+		{"files", common.TLSConfig{Cert: certPath, Key: keyPath}, nil},
+		{"self-signed", common.TLSConfig{Hosts: []string{"goxy.local"}}, nil},
+		{"missing key", common.TLSConfig{Cert: certPath}, ErrKeyPairIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Server(&tt.cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Server() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(got.Certificates) != 1 {
+				t.Errorf("Server() got %d certificates, want 1", len(got.Certificates))
+			}
+		})
+	}
+
+	if _, err := Client(&common.TLSConfig{CA: keyPath}, "127.0.0.1:443"); !errors.Is(err, ErrInvalidCA) {
+		t.Errorf("Client() invalid CA error = %v, want %v", err, ErrInvalidCA)
+	}
+	got, err := Client(&common.TLSConfig{CA: certPath}, "127.0.0.1:443")
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	if got.ServerName != "127.0.0.1" || got.RootCAs == nil {
+		t.Errorf("Client() server name = %s, pinned CA = %v", got.ServerName, got.RootCAs != nil)
+	}
+}
@@ -1,5 +1,11 @@
 package web
 
+import (
+	"goxy/internal/common"
+	"mime/multipart"
+	"time"
+)
+
 type ModelDetailRequest struct {
 	ID int `uri:"id" binding:"required"`
 }
@@ -13,7 +19,62 @@ type SetProxyListeningRequest struct {
 	Listening bool `json:"listening"`
 }
 
+type SetProxyShadowRequest struct {
+	Shadow bool `json:"shadow"`
+}
+
 type UpdateFilterStateRequest struct {
 	Enabled bool `json:"enabled"`
 	Alert   bool `json:"alert"`
+	Shadow  bool `json:"shadow"`
+}
+
+type TrafficListRequest struct {
+	Offset int `form:"offset" binding:"min=0"`
+	Limit  int `form:"limit" binding:"min=0,max=1000"`
+}
+
+type TrafficDetailRequest struct {
+	ID       int    `uri:"id" binding:"required"`
+	RecordID string `uri:"record_id" binding:"required"`
+}
+
+type PCAPExportRequest struct {
+	From time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To   time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Rule string    `form:"rule"`
+}
+
+type DryRunRequest struct {
+	File    *multipart.FileHeader `form:"file" binding:"required"`
+	Service string                `form:"service"`
+	Samples int                   `form:"samples" binding:"min=0,max=100"`
+}
+
+type AlertListRequest struct {
+	After int64 `form:"after" binding:"min=0"`
+	Limit int   `form:"limit" binding:"min=0,max=1000"`
+}
+
+// SaveConfigRequest is accepted by the config changing endpoints to write the config file after the change.
+type SaveConfigRequest struct {
+	Save bool `form:"save"`
+}
+
+type RuleDetailRequest struct {
+	Name string `uri:"name" binding:"required"`
+}
+
+type ReorderRulesRequest struct {
+	Names []string `json:"names" binding:"required"`
+}
+
+type CreateFilterRequest struct {
+	common.FilterConfig
+	// Before is the ID of the filter to insert the new one before, zero to append.
+	Before int `json:"before" binding:"min=0"`
+}
+
+type ReorderFiltersRequest struct {
+	Order []int `json:"order" binding:"required"`
 }
@@ -1,10 +1,25 @@
 package web
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"goxy/internal/alerts"
+	"goxy/internal/capture"
+	"goxy/internal/common"
+	"goxy/internal/dryrun"
+	"goxy/internal/replay"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+const alertStreamPingInterval = time.Second * 10
+
 func (s Server) statusHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
@@ -41,6 +56,29 @@ func (s Server) setProxyListening() gin.HandlerFunc {
 	}
 }
 
+func (s Server) setProxyShadow() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		dataReq := new(SetProxyShadowRequest)
+		if err := c.ShouldBindJSON(dataReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := s.ProxyManager.SetProxyShadow(idReq.ID, dataReq.Shadow); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
 func (s Server) updateFilterState() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		detReq := new(ProxyFilterDetailRequest)
@@ -55,7 +93,164 @@ func (s Server) updateFilterState() gin.HandlerFunc {
 			return
 		}
 
-		if err := s.ProxyManager.SetFilterState(detReq.ID, detReq.FilterID, dataReq.Enabled, dataReq.Alert); err != nil {
+		if err := s.ProxyManager.SetFilterState(detReq.ID, detReq.FilterID, dataReq.Enabled, dataReq.Alert, dataReq.Shadow); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func (s Server) reloadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := s.ProxyManager.ReloadWith(common.LoadProxyConfig); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func (s Server) trafficListingHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		listReq := &TrafficListRequest{Limit: 100}
+		if err := c.ShouldBindQuery(listReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		records, err := s.ProxyManager.ListTraffic(idReq.ID, listReq.Offset, listReq.Limit)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"records": records})
+	}
+}
+
+func (s Server) trafficDetailHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		detReq := new(TrafficDetailRequest)
+		if err := c.ShouldBindUri(detReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		record, err := s.ProxyManager.GetTraffic(detReq.ID, detReq.RecordID)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, capture.ErrNoSuchRecord) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"record": record})
+	}
+}
+
+func (s Server) pcapExportHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		exportReq := new(PCAPExportRequest)
+		if err := c.ShouldBindQuery(exportReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		q := capture.Query{
+			From: exportReq.From,
+			To:   exportReq.To,
+			Rule: exportReq.Rule,
+		}
+		buf := new(bytes.Buffer)
+		if err := s.ProxyManager.ExportPCAP(idReq.ID, q, buf); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filename := fmt.Sprintf("proxy_%d.pcap", idReq.ID)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Data(http.StatusOK, "application/vnd.tcpdump.pcap", buf.Bytes())
+	}
+}
+
+func (s Server) dryRunHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := new(DryRunRequest)
+		if err := c.ShouldBind(req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		f, err := req.File.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		records, err := replay.ReadRecords(f)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		opts := dryrun.Options{Service: req.Service, MaxSamples: req.Samples}
+		report, err := s.ProxyManager.DryRun(records, opts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"report": report})
+	}
+}
+
+func (s Server) statsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats := s.ProxyManager.DumpStats()
+		c.JSON(http.StatusOK, gin.H{"stats": stats})
+	}
+}
+
+func (s Server) resetStatsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := s.ProxyManager.ResetStats(0); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func (s Server) resetProxyStatsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := s.ProxyManager.ResetStats(idReq.ID); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
@@ -63,3 +258,286 @@ func (s Server) updateFilterState() gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	}
 }
+
+func (s Server) alertListingHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		listReq := &AlertListRequest{Limit: 100}
+		if err := c.ShouldBindQuery(listReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"alerts": alerts.History(listReq.After, listReq.Limit)})
+	}
+}
+
+// alertStreamHandler sends the alerts as server-sent events.
+// Reconnecting clients get the alerts they missed from the history by the Last-Event-ID header.
+func (s Server) alertStreamHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ch, cancel := alerts.Subscribe()
+		defer cancel()
+
+		var lastSent int64
+		send := func(a alerts.Alert) {
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatInt(a.ID, 10),
+				Event: "alert",
+				Data:  a,
+			})
+			lastSent = a.ID
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		if last, err := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64); err == nil {
+			missed := alerts.History(last, 0)
+			for i := len(missed) - 1; i >= 0; i-- {
+				send(missed[i])
+			}
+		}
+
+		ping := time.NewTicker(alertStreamPingInterval)
+		defer ping.Stop()
+
+		c.Stream(func(_ io.Writer) bool {
+			select {
+			case a, ok := <-ch:
+				if !ok {
+					return false
+				}
+				// Alerts published while reading the history are sent only once.
+				if a.ID > lastSent {
+					send(a)
+				}
+				return true
+			case <-ping.C:
+				c.Render(-1, sse.Event{Event: "ping", Data: ""})
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
+
+// saveConfig writes the running config to the file if requested by the save query parameter.
+func (s Server) saveConfig(c *gin.Context) error {
+	req := new(SaveConfigRequest)
+	if err := c.ShouldBindQuery(req); err != nil {
+		return err
+	}
+	if !req.Save {
+		return nil
+	}
+	return s.ProxyManager.SaveConfig(viper.ConfigFileUsed())
+}
+
+// respondConfigChanged finishes the request changing the config.
+func (s Server) respondConfigChanged(c *gin.Context, err error) {
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.saveConfig(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (s Server) saveConfigHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := s.ProxyManager.SaveConfig(viper.ConfigFileUsed()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func (s Server) ruleListingHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := s.ProxyManager.GetConfig()
+		c.JSON(http.StatusOK, gin.H{"rules": cfg.Rules})
+	}
+}
+
+func (s Server) createRuleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule := new(common.RuleConfig)
+		if err := c.ShouldBindJSON(rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.AddRule(*rule))
+	}
+}
+
+func (s Server) updateRuleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		detReq := new(RuleDetailRequest)
+		if err := c.ShouldBindUri(detReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		rule := new(common.RuleConfig)
+		if err := c.ShouldBindJSON(rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.UpdateRule(detReq.Name, *rule))
+	}
+}
+
+func (s Server) deleteRuleHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		detReq := new(RuleDetailRequest)
+		if err := c.ShouldBindUri(detReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.DeleteRule(detReq.Name))
+	}
+}
+
+func (s Server) reorderRulesHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderReq := new(ReorderRulesRequest)
+		if err := c.ShouldBindJSON(orderReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.ReorderRules(orderReq.Names))
+	}
+}
+
+func (s Server) createFilterHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		createReq := new(CreateFilterRequest)
+		if err := c.ShouldBindJSON(createReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := s.ProxyManager.AddFilter(idReq.ID, createReq.Before, createReq.FilterConfig)
+		s.respondConfigChanged(c, err)
+	}
+}
+
+func (s Server) updateFilterHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		detReq := new(ProxyFilterDetailRequest)
+		if err := c.ShouldBindUri(detReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filter := new(common.FilterConfig)
+		if err := c.ShouldBindJSON(filter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.UpdateFilter(detReq.ID, detReq.FilterID, *filter))
+	}
+}
+
+func (s Server) deleteFilterHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		detReq := new(ProxyFilterDetailRequest)
+		if err := c.ShouldBindUri(detReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.DeleteFilter(detReq.ID, detReq.FilterID))
+	}
+}
+
+func (s Server) reorderFiltersHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		orderReq := new(ReorderFiltersRequest)
+		if err := c.ShouldBindJSON(orderReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.ReorderFilters(idReq.ID, orderReq.Order))
+	}
+}
+
+func (s Server) createProxyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		service := new(common.ServiceConfig)
+		if err := c.ShouldBindJSON(service); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		id, err := s.ProxyManager.AddService(*service)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := s.saveConfig(c); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"id": id})
+	}
+}
+
+// updateProxyHandler changes the fields of the service present in the request.
+func (s Server) updateProxyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		service, err := s.ProxyManager.GetService(idReq.ID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err := c.ShouldBindJSON(&service); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.UpdateService(idReq.ID, service))
+	}
+}
+
+func (s Server) deleteProxyHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idReq := new(ModelDetailRequest)
+		if err := c.ShouldBindUri(idReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.respondConfigChanged(c, s.ProxyManager.RemoveService(idReq.ID))
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"goxy/internal/metrics"
 	"goxy/internal/proxy"
 	"net/http"
 	"os"
@@ -17,8 +20,17 @@ func NewServer(pm *proxy.Manager) *Server {
 		Username: viper.GetString("web.username"),
 		Password: viper.GetString("web.password"),
 	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		pm,
+	)
+	registry.MustRegister(metrics.Collectors()...)
+
 	ms := &Server{
 		ProxyManager: pm,
+		Registry:     registry,
 		Router:       gin.New(),
 		StaticDir:    viper.GetString("web.static_dir"),
 		AuthData:     ad,
@@ -35,6 +47,7 @@ type BasicAuthData struct {
 
 type Server struct {
 	ProxyManager *proxy.Manager
+	Registry     *prometheus.Registry
 	Router       *gin.Engine
 	StaticDir    string
 	AuthData     BasicAuthData
@@ -45,10 +58,38 @@ func (s *Server) registerRoutes() {
 	{
 		api.GET("/status/", s.statusHandler())
 		api.GET("/proxies/", s.proxyListingHandler())
+		api.POST("/proxies/", s.createProxyHandler())
+		api.PATCH("/proxies/:id/", s.updateProxyHandler())
+		api.DELETE("/proxies/:id/", s.deleteProxyHandler())
 		api.PUT("/proxies/:id/listening/", s.setProxyListening())
+		api.PUT("/proxies/:id/shadow/", s.setProxyShadow())
+		api.POST("/proxies/:id/filters/", s.createFilterHandler())
+		api.POST("/proxies/:id/filters/order/", s.reorderFiltersHandler())
 		api.PUT("/proxies/:id/filters/:filter_id/", s.updateFilterState())
+		api.PATCH("/proxies/:id/filters/:filter_id/", s.updateFilterHandler())
+		api.DELETE("/proxies/:id/filters/:filter_id/", s.deleteFilterHandler())
+		api.GET("/proxies/:id/traffic/", s.trafficListingHandler())
+		api.GET("/proxies/:id/traffic/:record_id/", s.trafficDetailHandler())
+		api.GET("/proxies/:id/pcap/", s.pcapExportHandler())
+		api.POST("/proxies/:id/stats/reset/", s.resetProxyStatsHandler())
+		api.GET("/stats/", s.statsHandler())
+		api.POST("/stats/reset/", s.resetStatsHandler())
+		api.GET("/rules/", s.ruleListingHandler())
+		api.POST("/rules/", s.createRuleHandler())
+		api.POST("/rules/order/", s.reorderRulesHandler())
+		api.PUT("/rules/:name/", s.updateRuleHandler())
+		api.DELETE("/rules/:name/", s.deleteRuleHandler())
+		api.POST("/config/save/", s.saveConfigHandler())
+		api.POST("/reload/", s.reloadHandler())
+		api.POST("/dry-run/", s.dryRunHandler())
+		api.GET("/alerts/", s.alertListingHandler())
+		api.GET("/alerts/stream", s.alertStreamHandler())
 	}
 
+	// Compression is up to the gzip middleware.
+	metricsHandler := promhttp.HandlerFor(s.Registry, promhttp.HandlerOpts{DisableCompression: true})
+	s.Router.GET("/metrics", gin.WrapH(metricsHandler))
+
 	logrus.Infof("Serving static dir: %s", s.StaticDir)
 
 	s.Router.NoRoute(func(c *gin.Context) {
@@ -66,7 +107,8 @@ func (s *Server) registerMiddleware() {
 	s.Router.Use(gin.Recovery())
 	s.Router.Use(loggerMiddleware())
 
-	s.Router.Use(gzip.Gzip(gzip.DefaultCompression))
+	// Server-sent events must be flushed as is.
+	s.Router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/api/alerts/stream"})))
 	s.Router.Use(cors.Default())
 
 	if !gin.IsDebugging() {
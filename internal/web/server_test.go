@@ -0,0 +1,106 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"goxy/internal/common"
+	"goxy/internal/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServer_Metrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set("web.username", "admin")
+	viper.Set("web.password", "admin")
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+
+	listen := freeAddr(t)
+	cfg := &common.ProxyConfig{
+		Rules: []common.RuleConfig{
+			{Name: "attack", Type: "http::ingress::body::contains", Args: []string{"attack"}},
+		},
+		Services: []common.ServiceConfig{
+			{
+				Name:   "web",
+				Type:   "http",
+				Listen: listen,
+				Target: target.Listener.Addr().String(),
+				Filters: []common.FilterConfig{
+					{Rule: "attack", Verdict: "drop"},
+				},
+			},
+		},
+	}
+	m, err := proxy.NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	if err := m.StartAll(); err != nil {
+		t.Fatalf("StartAll() error = %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = m.Shutdown(ctx)
+	}()
+
+	for _, body := range []string{"hello", "attack", "bye"} {
+		resp, err := http.Post("http://"+listen+"/", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post() error = %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	s := NewServer(m)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("admin", "admin")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d", rec.Code)
+	}
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+
+	want := []string{
+		`goxy_http_requests_total{code="200",service="web"} 2`,
+		`goxy_http_requests_total{code="204",service="web"} 1`,
+		`goxy_http_request_duration_seconds_count{service="web"} 3`,
+		`goxy_filter_matches_total{rule="attack",service="web"} 1`,
+		`goxy_filter_drops_total{rule="attack",service="web"} 1`,
+		`goxy_dropped_total{service="web"} 1`,
+		`goxy_connections_total{service="web"} `,
+		`goxy_active_connections{service="web",type="http"} `,
+	}
+	for _, line := range want {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("/metrics doesn't contain %q", line)
+		}
+	}
+}